@@ -1597,6 +1597,21 @@ func (lc *Client) DriveShareRename(ctx context.Context, oldName, newName string)
 	return err
 }
 
+// DriveShareSetEnabled enables or disables the share with the given name
+// without removing it from the list of shares, for pausing it temporarily.
+// Shares are enabled again when tailscaled restarts.
+//
+// API maturity: this method is not considered a stable API and is
+// subject to change between releases.
+func (lc *Client) DriveShareSetEnabled(ctx context.Context, name string, enabled bool) error {
+	v := url.Values{
+		"name":    {name},
+		"enabled": {strconv.FormatBool(enabled)},
+	}
+	_, err := lc.send(ctx, "PUT", "/localapi/v0/drive/share-enabled?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
 // DriveShareList returns the list of shares that drive is currently serving
 // to remote nodes.
 //
@@ -1612,6 +1627,21 @@ func (lc *Client) DriveShareList(ctx context.Context) ([]*drive.Share, error) {
 	return shares, err
 }
 
+// DriveTransfers returns the transfers of files from or to the shares that
+// drive is serving to remote nodes that are currently in progress.
+//
+// API maturity: this method is not considered a stable API and is
+// subject to change between releases.
+func (lc *Client) DriveTransfers(ctx context.Context) ([]drive.TransferInfo, error) {
+	result, err := lc.get200(ctx, "/localapi/v0/drive/transfers")
+	if err != nil {
+		return nil, err
+	}
+	var transfers []drive.TransferInfo
+	err = json.Unmarshal(result, &transfers)
+	return transfers, err
+}
+
 // IPNBusWatcher is an active subscription (watch) of the local tailscaled IPN bus.
 // It's returned by [Client.WatchIPNBus].
 //
@@ -10,6 +10,8 @@
 	"fmt"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/drive"
@@ -20,6 +22,7 @@
 	driveRenameUsage  = "tailscale drive rename <oldname> <newname>"
 	driveUnshareUsage = "tailscale drive unshare <name>"
 	driveListUsage    = "tailscale drive list"
+	driveStatusUsage  = "tailscale drive status"
 )
 
 func init() {
@@ -35,6 +38,7 @@ func driveCmd() *ffcli.Command {
 			driveRenameUsage,
 			driveUnshareUsage,
 			driveListUsage,
+			driveStatusUsage,
 		}, "\n"),
 		LongHelp:  buildShareLongHelp(),
 		UsageFunc: usageFuncNoDefaultValues,
@@ -63,6 +67,12 @@ func driveCmd() *ffcli.Command {
 				ShortHelp:  "[ALPHA] List current shares",
 				Exec:       runDriveList,
 			},
+			{
+				Name:       "status",
+				ShortUsage: driveStatusUsage,
+				ShortHelp:  "[ALPHA] List file transfers in progress",
+				Exec:       runDriveStatus,
+			},
 		},
 	}
 }
@@ -154,6 +164,33 @@ func runDriveList(ctx context.Context, args []string) error {
 	return nil
 }
 
+// runDriveStatus is the entry point for the "tailscale drive status" command.
+func runDriveStatus(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %s", driveStatusUsage)
+	}
+
+	transfers, err := localClient.DriveTransfers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(transfers) == 0 {
+		fmt.Println("No file transfers in progress.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(Stdout, 0, 0, 4, ' ', 0)
+	fmt.Fprintln(tw, "share\tpath\tdirection\tprogress\tpeer\tstarted")
+	for _, t := range transfers {
+		progress := fmt.Sprintf("%d bytes", t.Transferred)
+		if t.Total >= 0 {
+			progress = fmt.Sprintf("%d/%d bytes", t.Transferred, t.Total)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", t.Share, t.Path, t.Direction, progress, t.Principal, t.Started.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
 func buildShareLongHelp() string {
 	longHelpAs := ""
 	if drive.AllowShareAs() {
@@ -491,7 +491,7 @@ func getTargetStableID(ctx context.Context, ipStr string) (id tailcfg.StableNode
 		return "", isOffline, errors.New("cannot send files: local Tailscale is not connected to the tailnet")
 
 	case ipnstate.TaildropTargetMissingCap:
-		return "", isOffline, errors.New("cannot send files: missing required Taildrop capability")
+		return "", isOffline, errors.New("cannot send files: Taildrop is not enabled for this node")
 
 	case ipnstate.TaildropTargetOffline:
 		// Don't gate on the server-reported Online bit (which lags reality
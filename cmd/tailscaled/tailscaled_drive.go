@@ -8,10 +8,18 @@
 import (
 	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"tailscale.com/drive/driveimpl"
+	"tailscale.com/envknob"
 	"tailscale.com/tsd"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
 	"tailscale.com/wgengine"
 )
 
@@ -19,7 +27,9 @@ func init() {
 	subCommands["serve-taildrive"] = &serveDriveFunc
 
 	hookSetSysDrive.Set(func(sys *tsd.System, logf logger.Logf) {
-		sys.Set(driveimpl.NewFileSystemForRemote(logf))
+		fs := driveimpl.NewFileSystemForRemote(logf)
+		configureDriveForRemote(fs, logf)
+		sys.Set(fs)
 	})
 	hookSetWgEnginConfigDrive.Set(func(conf *wgengine.Config, logf logger.Logf) {
 		conf.DriveForLocal = driveimpl.NewFileSystemForLocal(logf)
@@ -28,6 +38,49 @@ func init() {
 
 var serveDriveFunc = serveDrive
 
+// configureDriveForRemote applies the TS_DRIVE_* environment variables to fs.
+func configureDriveForRemote(fs *driveimpl.FileSystemForRemote, logf logger.Logf) {
+	maxShares, _ := envknob.LookupInt("TS_DRIVE_MAX_SHARES")
+	maxUserServers, _ := envknob.LookupInt("TS_DRIVE_MAX_USER_SERVERS")
+	maxBufferedBody, _ := envknob.LookupIntSized("TS_DRIVE_MAX_BUFFERED_BODY", 10, 64)
+	fs.SetLimits(maxShares, maxUserServers, int64(maxBufferedBody))
+	maxIdleConnsPerShare, _ := envknob.LookupInt("TS_DRIVE_MAX_IDLE_CONNS_PER_SHARE")
+	maxConnsPerShare, _ := envknob.LookupInt("TS_DRIVE_MAX_CONNS_PER_SHARE")
+	fs.SetConnectionLimits(maxIdleConnsPerShare, maxConnsPerShare)
+	if size, ok := envknob.LookupInt("TS_DRIVE_READ_AHEAD_SIZE"); ok {
+		fs.SetReadAheadSize(size)
+	}
+	if d, ok := lookupDriveDuration("TS_DRIVE_USER_SERVER_STARTUP_TIMEOUT", logf); ok {
+		fs.SetUserServerStartupTimeout(d)
+	}
+	tempFiles := driveimpl.TempFileConfig{
+		Dir:    envknob.String("TS_DRIVE_TEMP_DIR"),
+		Prefix: envknob.String("TS_DRIVE_TEMP_PREFIX"),
+	}
+	tempFiles.MaxAge, _ = lookupDriveDuration("TS_DRIVE_TEMP_MAX_AGE", logf)
+	fs.SetTempFileConfig(tempFiles)
+	if hide, ok := envknob.LookupBool("TS_DRIVE_HIDE_DOTFILES"); ok {
+		if err := fs.SetHideDotfilesByDefault(hide); err != nil {
+			logf("taildrive: ignoring TS_DRIVE_HIDE_DOTFILES: %v", err)
+		}
+	}
+}
+
+// lookupDriveDuration returns the duration in the named environment variable,
+// if it's set. Invalid durations are logged and ignored.
+func lookupDriveDuration(envVar string, logf logger.Logf) (time.Duration, bool) {
+	v := envknob.String(envVar)
+	if v == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logf("taildrive: ignoring %s: %v", envVar, err)
+		return 0, false
+	}
+	return d, true
+}
+
 // serveDrive serves one or more Taildrives on localhost using the WebDAV
 // protocol. On UNIX and MacOS tailscaled environment, Taildrive spawns child
 // tailscaled processes in serve-taildrive mode in order to access the fliesystem
@@ -35,22 +88,123 @@ func init() {
 //
 // serveDrive prints the address on which it's listening to stdout so that the
 // parent process knows where to connect to.
+//
+// The arguments are <sharename> <path> pairs, optionally preceded by
+// --read-only=<sharename> arguments marking shares as read-only,
+// --hide-dotfiles=<sharename> arguments hiding shares' dotfiles,
+// --fsync=<sharename> arguments making writes to shares durable,
+// --normalize-unicode=<sharename> arguments making shares' file names match
+// in any Unicode normalization form,
+// --quota=<sharename>=<bytes> arguments setting shares' quotas,
+// --extra-path=<sharename>=<path> arguments adding directories to merge into
+// shares, in order of precedence after the shares' own paths, and
+// --temp-dir=<path>, --temp-prefix=<prefix> and --temp-max-age=<duration>
+// arguments configuring temporary files (see driveimpl.TempFileConfig).
+// Temporary files are kept in the user's cache directory by default.
+// Share names can't start with a dash or contain an equals sign, so these are
+// unambiguous.
 func serveDrive(args []string) error {
+	readOnly := make(set.Set[string])
+	hideDotfiles := make(set.Set[string])
+	fsync := make(set.Set[string])
+	normalize := make(set.Set[string])
+	quotas := make(map[string]int64)
+	extraPaths := make(map[string][]string)
+	var tempFiles driveimpl.TempFileConfig
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if name, ok := strings.CutPrefix(args[0], "--read-only="); ok {
+			readOnly.Add(name)
+		} else if name, ok := strings.CutPrefix(args[0], "--hide-dotfiles="); ok {
+			hideDotfiles.Add(name)
+		} else if name, ok := strings.CutPrefix(args[0], "--fsync="); ok {
+			fsync.Add(name)
+		} else if name, ok := strings.CutPrefix(args[0], "--normalize-unicode="); ok {
+			normalize.Add(name)
+		} else if v, ok := strings.CutPrefix(args[0], "--quota="); ok {
+			name, bytes, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("invalid argument %q", args[0])
+			}
+			quota, err := strconv.ParseInt(bytes, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid argument %q: %w", args[0], err)
+			}
+			quotas[name] = quota
+		} else if v, ok := strings.CutPrefix(args[0], "--extra-path="); ok {
+			name, path, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("invalid argument %q", args[0])
+			}
+			extraPaths[name] = append(extraPaths[name], path)
+		} else if dir, ok := strings.CutPrefix(args[0], "--temp-dir="); ok {
+			tempFiles.Dir = dir
+		} else if prefix, ok := strings.CutPrefix(args[0], "--temp-prefix="); ok {
+			tempFiles.Prefix = prefix
+		} else if v, ok := strings.CutPrefix(args[0], "--temp-max-age="); ok {
+			maxAge, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid argument %q: %w", args[0], err)
+			}
+			tempFiles.MaxAge = maxAge
+		} else {
+			return fmt.Errorf("unknown flag %q", args[0])
+		}
+		args = args[1:]
+	}
 	if len(args) == 0 {
 		return errors.New("missing shares")
 	}
 	if len(args)%2 != 0 {
 		return errors.New("need <sharename> <path> pairs")
 	}
+	if tempFiles.Dir == "" {
+		dir, err := defaultDriveTempDir()
+		if err != nil {
+			// Only ranged PUTs need a temp dir, so carry on without.
+			log.Printf("no directory for Taildrive temp files: %v", err)
+		}
+		tempFiles.Dir = dir
+	}
 	s, err := driveimpl.NewFileServer()
 	if err != nil {
 		return fmt.Errorf("unable to start Taildrive file server: %v", err)
 	}
-	shares := make(map[string]string)
+	s.SetTempFileConfig(tempFiles)
+	s.LockShares()
+	s.ClearSharesLocked()
 	for i := 0; i < len(args); i += 2 {
-		shares[args[i]] = args[i+1]
+		if extra := extraPaths[args[i]]; len(extra) > 0 {
+			s.AddUnionShareLocked(args[i], append([]string{args[i+1]}, extra...))
+		} else if readOnly.Contains(args[i]) {
+			s.AddReadOnlyShareLocked(args[i], args[i+1])
+		} else {
+			s.AddShareLocked(args[i], args[i+1])
+		}
+		s.SetHideDotfilesLocked(args[i], hideDotfiles.Contains(args[i]))
+		s.SetFsyncLocked(args[i], fsync.Contains(args[i]))
+		s.SetNormalizeUnicodeLocked(args[i], normalize.Contains(args[i]))
+		s.SetQuotaLocked(args[i], quotas[args[i]])
 	}
-	s.SetShares(shares)
+	s.UnlockShares()
+	go func() {
+		if err := s.CleanupTempFiles(); err != nil {
+			log.Printf("cleaning up Taildrive temp files: %v", err)
+		}
+	}()
 	fmt.Printf("%v\n", s.Addr())
 	return s.Serve()
 }
+
+// defaultDriveTempDir returns the directory in which serveDrive keeps
+// temporary files by default, creating it if needed.
+func defaultDriveTempDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "Tailscale", "taildrive-tmp")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
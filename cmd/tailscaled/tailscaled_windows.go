@@ -42,7 +42,6 @@
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.zx2c4.com/wintun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
-	"tailscale.com/drive/driveimpl"
 	"tailscale.com/envknob"
 	_ "tailscale.com/ipn/auditlog"
 	"tailscale.com/logpolicy"
@@ -341,7 +340,9 @@ func beWindowsSubprocess() bool {
 	}
 	sys.Set(netMon)
 
-	sys.Set(driveimpl.NewFileSystemForRemote(log.Printf))
+	if f, ok := hookSetSysDrive.GetOk(); ok {
+		f(sys, log.Printf)
+	}
 
 	publicLogID, _ := logid.ParsePublicID(logID)
 	err = startIPNServer(ctx, log.Printf, publicLogID, sys)
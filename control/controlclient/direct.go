@@ -1819,6 +1819,13 @@ func doPingerPing(logf logger.Logf, c *http.Client, pr *tailcfg.PingRequest, pin
 	if err != nil {
 		d := time.Since(start).Round(time.Millisecond)
 		logf("doPingerPing: ping error of type %q to %v after %v: %v", pingType, pr.IP, d, err)
+		// Still tell control that the ping failed (such as by timing
+		// out), rather than leaving it waiting for a result.
+		postPingResult(start, logf, c, pr, &tailcfg.PingResponse{
+			Type: pingType,
+			IP:   pr.IP.String(),
+			Err:  err.Error(),
+		})
 		return
 	}
 	postPingResult(start, logf, c, pr, res.ToPingResponse(pingType))
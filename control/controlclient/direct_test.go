@@ -4,11 +4,13 @@
 package controlclient
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -286,3 +288,43 @@ func TestTsmpPing(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// errPinger is a Pinger whose pings all fail with err.
+type errPinger struct {
+	err error
+}
+
+func (p errPinger) Ping(ctx context.Context, ip netip.Addr, pingType tailcfg.PingType, size int) (*ipnstate.PingResult, error) {
+	return nil, p.err
+}
+
+// TestPingerPingFailure tests that failed pings are reported to control,
+// so that it doesn't have to wait for a result that never comes.
+func TestPingerPingFailure(t *testing.T) {
+	got := make(chan *tailcfg.PingResponse, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		res := new(tailcfg.PingResponse)
+		if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+			t.Errorf("decoding ping result: %v", err)
+		}
+		got <- res
+	}))
+	defer ts.Close()
+
+	pr := &tailcfg.PingRequest{
+		URL: ts.URL,
+		IP:  netip.MustParseAddr("100.64.0.1"),
+	}
+	doPingerPing(t.Logf, ts.Client(), pr, errPinger{errors.New("timed out")}, tailcfg.PingDisco)
+
+	select {
+	case res := <-got:
+		want := &tailcfg.PingResponse{Type: tailcfg.PingDisco, IP: "100.64.0.1", Err: "timed out"}
+		if !reflect.DeepEqual(res, want) {
+			t.Errorf("got ping result %+v, want %+v", res, want)
+		}
+	default:
+		t.Fatal("no ping result was posted")
+	}
+}
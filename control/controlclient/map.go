@@ -314,6 +314,8 @@ func (ms *mapSession) handleNonKeepAliveMapResponse(ctx context.Context, resp *t
 		upgradeNode(p)
 	}
 
+	ms.checkSelfNotPeer(resp)
+
 	// Call Node.InitDisplayNames on any changed nodes.
 	initDisplayNames(cmp.Or(resp.Node.View(), ms.lastNode), resp)
 
@@ -477,6 +479,30 @@ type updateStats struct {
 	changed int
 }
 
+// checkSelfNotPeer logs a warning if resp lists the self node as a peer or
+// removes it, which a well-behaved control server never does. The self node
+// can't be removed as a peer, so such removals are dropped from resp.
+func (ms *mapSession) checkSelfNotPeer(resp *tailcfg.MapResponse) {
+	self := cmp.Or(resp.Node.View(), ms.lastNode)
+	if !self.Valid() || self.ID() == 0 {
+		return
+	}
+	for _, peers := range [][]*tailcfg.Node{resp.Peers, resp.PeersChanged} {
+		for _, n := range peers {
+			if n != nil && n.ID == self.ID() {
+				ms.logf("[unexpected] netmap: control sent self node %v as a peer", n.ID)
+			}
+		}
+	}
+	resp.PeersRemoved = slices.DeleteFunc(resp.PeersRemoved, func(id tailcfg.NodeID) bool {
+		if id != self.ID() {
+			return false
+		}
+		ms.logf("[unexpected] netmap: control removed self node %v as a peer; ignoring", id)
+		return true
+	})
+}
+
 // removeUnwantedDiscoUpdates goes over the patchified updates and reject items
 // where the node is offline and has last been seen before the recorded last seen.
 func (ms *mapSession) removeUnwantedDiscoUpdates(resp *tailcfg.MapResponse, viaTSMP bool) {
@@ -1070,6 +1096,12 @@ func peerChangeDiff(was tailcfg.NodeView, n *tailcfg.Node, onFalse func(string))
 			}
 		case "Endpoints":
 			if !views.SliceEqual(was.Endpoints(), views.SliceOf(n.Endpoints)) {
+				if len(n.Endpoints) == 0 {
+					// An empty PeerChange.Endpoints means no change,
+					// so removing them all can't be a patch.
+					onFalse(field)
+					return nil, false
+				}
 				pc().Endpoints = slices.Clone(n.Endpoints)
 			}
 		case "LegacyDERPString":
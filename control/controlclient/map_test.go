@@ -1182,6 +1182,11 @@ func TestPeerChangeDiff(t *testing.T) {
 			b:    &tailcfg.Node{ID: 1, Endpoints: eps("10.0.0.2:2")},
 			want: &tailcfg.PeerChange{NodeID: 1, Endpoints: eps("10.0.0.2:2")},
 		},
+		{
+			name: "miss-change-endpoints-to-none",
+			a:    &tailcfg.Node{ID: 1, Endpoints: eps("10.0.0.1:1")},
+			b:    &tailcfg.Node{ID: 1},
+		},
 		{
 			name: "patch-cap",
 			a:    &tailcfg.Node{ID: 1, Cap: 1},
@@ -5,6 +5,10 @@
 
 package drive
 
+import (
+	"tailscale.com/types/opt"
+)
+
 // Clone makes a deep copy of Share.
 // The result aliases no memory with the original.
 func (src *Share) Clone() *Share {
@@ -14,15 +18,24 @@ func (src *Share) Clone() *Share {
 	dst := new(Share)
 	*dst = *src
 	dst.BookmarkData = append(src.BookmarkData[:0:0], src.BookmarkData...)
+	dst.ExtraPaths = append(src.ExtraPaths[:0:0], src.ExtraPaths...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ShareCloneNeedsRegeneration = Share(struct {
-	Name         string
-	Path         string
-	As           string
-	BookmarkData []byte
+	Name              string
+	Path              string
+	As                string
+	BookmarkData      []byte
+	ReadOnly          bool
+	RequireSecret     string
+	MaxRequestsPerSec float64
+	HideDotfiles      opt.Bool
+	Fsync             bool
+	Quota             int64
+	NormalizeUnicode  bool
+	ExtraPaths        []string
 }{})
 
 // Clone duplicates src into dst and reports whether it succeeded.
@@ -11,6 +11,7 @@
 
 	jsonv2 "github.com/go-json-experiment/json"
 	"github.com/go-json-experiment/json/jsontext"
+	"tailscale.com/types/opt"
 	"tailscale.com/types/views"
 )
 
@@ -105,10 +106,83 @@ func (v ShareView) BookmarkData() views.ByteSlice[[]byte] {
 	return views.ByteSliceOf(v.ж.BookmarkData)
 }
 
+// ReadOnly, if true, makes the share's contents unmodifiable by remote
+// nodes, regardless of the permissions granted to them. It's meant for
+// sharing things like backups or snapshots.
+func (v ShareView) ReadOnly() bool { return v.ж.ReadOnly }
+
+// RequireSecret, if non-empty, is a secret that remote nodes must present
+// in the X-Taildrive-Secret header of every request for the share, in
+// addition to having been granted access to it. Requests without the
+// matching secret are rejected with 401 Unauthorized.
+func (v ShareView) RequireSecret() string { return v.ж.RequireSecret }
+
+// MaxRequestsPerSec, if positive, limits the rate at which each remote
+// principal may make requests for the share. Requests in excess of the
+// limit are rejected with 429 Too Many Requests.
+func (v ShareView) MaxRequestsPerSec() float64 { return v.ж.MaxRequestsPerSec }
+
+// HideDotfiles, if true, hides files and directories whose names begin
+// with a period from remote principals: they're left out of directory
+// listings and can't be accessed, so that sharing a home directory
+// doesn't expose files like .ssh or .bashrc. If false, they're visible
+// like any other file. If unset, the default of the node sharing the
+// files applies, which is to show them unless configured otherwise.
+//
+// Dotfiles can only be hidden where shares are served by user servers,
+// that is, if AllowShareAs reports true.
+func (v ShareView) HideDotfiles() opt.Bool { return v.ж.HideDotfiles }
+
+// Fsync, if true, makes the server flush written files and their
+// containing directories to stable storage after a successful PUT, COPY
+// or MOVE, before responding. This protects against data loss if the
+// sharing machine crashes or loses power, at the cost of noticeably
+// higher latency for writes, especially on spinning disks and network
+// filesystems.
+func (v ShareView) Fsync() bool { return v.ж.Fsync }
+
+// Quota, if positive, is the number of bytes that the share's files are
+// meant to take up at most. It's reported to WebDAV clients that support
+// quotas (RFC 4331), so that they can show how much space is left. It
+// isn't enforced, except that ranged PUTs of files that wouldn't fit are
+// refused up front. Without a quota, the free space of the filesystem
+// holding the share is reported instead.
+func (v ShareView) Quota() int64 { return v.ж.Quota }
+
+// NormalizeUnicode, if true, makes the server find files and directories
+// whose names are in a different Unicode normalization form than the
+// requested ones. macOS stores names decomposed (NFD) while other
+// platforms usually keep them composed (NFC), so without it, a client
+// requesting "café" in one form doesn't find a file stored in the other.
+//
+// The policy is: a path that exists exactly as requested is always used
+// as is. Otherwise, each of its components is matched with the directory
+// entry with the same NFC form, if any. Names aren't normalized when
+// creating files or directories, or when listing them.
+func (v ShareView) NormalizeUnicode() bool { return v.ж.NormalizeUnicode }
+
+// ExtraPaths, if non-empty, are the paths to more directories on this
+// machine whose contents are merged with those of Path into a single
+// tree, as in a union mount. Such shares are always read-only. When
+// several directories contain a file or directory with the same path
+// within them, the one in the directory listed first wins, with Path
+// coming before all ExtraPaths. Directories found at the same path in
+// several directories are merged too, recursively, unless one listed
+// earlier has a file there instead.
+func (v ShareView) ExtraPaths() views.Slice[string] { return views.SliceOf(v.ж.ExtraPaths) }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ShareViewNeedsRegeneration = Share(struct {
-	Name         string
-	Path         string
-	As           string
-	BookmarkData []byte
+	Name              string
+	Path              string
+	As                string
+	BookmarkData      []byte
+	ReadOnly          bool
+	RequireSecret     string
+	MaxRequestsPerSec float64
+	HideDotfiles      opt.Bool
+	Fsync             bool
+	Quota             int64
+	NormalizeUnicode  bool
+	ExtraPaths        []string
 }{})
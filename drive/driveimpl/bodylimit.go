@@ -0,0 +1,41 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBufferedBody is the default size of the largest request body, other
+// than that of a PUT, that a FileSystemForRemote accepts. See SetLimits.
+const DefaultMaxBufferedBody = 1 << 20
+
+// limitBufferedBody limits the body of r, unless r is a PUT request, to limit
+// bytes. Requests with larger bodies fail with status 413 Request Entity Too
+// Large. Bodies of unknown length are read into memory to find out, as they'd
+// be by the file server anyway. It reports whether r may be served, having
+// responded to r if not.
+func limitBufferedBody(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if r.Method == "PUT" || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if r.ContentLength < 0 {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		return true
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
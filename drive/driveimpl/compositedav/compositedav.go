@@ -36,6 +36,11 @@ type Child struct {
 	// with this Child's WebDAV service.
 	Transport http.RoundTripper
 
+	// ModifyResponse (if specified) modifies the responses of this Child's
+	// WebDAV service before they're proxied, like that of an
+	// httputil.ReverseProxy.
+	ModifyResponse func(*http.Response) error
+
 	rp       *httputil.ReverseProxy
 	initOnce sync.Once
 }
@@ -52,8 +57,9 @@ func (c *Child) CloseIdleConnections() {
 func (c *Child) init() {
 	c.initOnce.Do(func() {
 		c.rp = &httputil.ReverseProxy{
-			Transport: c.Transport,
-			Rewrite:   func(r *httputil.ProxyRequest) {},
+			Transport:      c.Transport,
+			Rewrite:        func(r *httputil.ProxyRequest) {},
+			ModifyResponse: c.ModifyResponse,
 		}
 	})
 }
@@ -115,6 +121,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(pathComponents) >= mpl {
+		if r.Method == "DELETE" {
+			// Failed deletions of collections' members are reported in
+			// MultiStatus responses, whose hrefs need rewriting.
+			status, result := h.delegateRewriting(w, r, pathComponents, mpl)
+			respondRewritten(w, status, result)
+			return
+		}
 		h.delegate(mpl, pathComponents[mpl-1:], w, r)
 		return
 	}
@@ -0,0 +1,306 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/atomicfile"
+)
+
+// propsFileName is the name of the file in the root of each share in which
+// the dead properties of the share's files are kept. It's hidden from WebDAV
+// clients, whatever the case they use to refer to it, as shares may be on
+// case-insensitive file systems.
+const propsFileName = ".taildrive-props.json"
+
+// deadPropsFS extends a webdav.FileSystem to keep the dead properties of its
+// files, that is, the arbitrary properties that clients set with PROPPATCH,
+// in a propStore. Without it, the webdav package refuses to set any such
+// properties, which breaks clients like macOS Finder that store metadata in
+// them.
+type deadPropsFS struct {
+	webdav.FileSystem
+	props    *propStore
+	readOnly bool // if true, properties can't be modified
+}
+
+// isPropsFile reports whether name refers to the propStore's own file.
+func isPropsFile(name string) bool {
+	return strings.EqualFold(cleanPropsPath(name), "/"+propsFileName)
+}
+
+func (fs *deadPropsFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isPropsFile(name) {
+		return os.ErrPermission
+	}
+	return fs.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (fs *deadPropsFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if isPropsFile(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &deadPropsFile{File: f, fs: fs, name: cleanPropsPath(name)}, nil
+}
+
+func (fs *deadPropsFS) RemoveAll(ctx context.Context, name string) error {
+	if isPropsFile(name) {
+		return os.ErrNotExist
+	}
+	if err := fs.FileSystem.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	return fs.props.removeAll(name)
+}
+
+func (fs *deadPropsFS) Rename(ctx context.Context, oldName, newName string) error {
+	if isPropsFile(oldName) {
+		return os.ErrNotExist
+	}
+	if isPropsFile(newName) {
+		return os.ErrPermission
+	}
+	if err := fs.FileSystem.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	return fs.props.rename(oldName, newName)
+}
+
+func (fs *deadPropsFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isPropsFile(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Stat(ctx, name)
+}
+
+// deadPropsFile extends a webdav.File to implement the webdav.DeadPropsHolder
+// interface using its deadPropsFS's propStore.
+type deadPropsFile struct {
+	webdav.File
+	fs   *deadPropsFS
+	name string // cleaned path within the share
+}
+
+func (f *deadPropsFile) Readdir(count int) ([]fs.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	if f.name != "/" {
+		return fis, err
+	}
+	// Hide the propStore's file from listings of the share root.
+	return slices.DeleteFunc(fis, func(fi fs.FileInfo) bool {
+		return strings.EqualFold(fi.Name(), propsFileName)
+	}), err
+}
+
+func (f *deadPropsFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.fs.props.get(f.name)
+}
+
+func (f *deadPropsFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	status := http.StatusOK
+	if f.fs.readOnly {
+		status = http.StatusForbidden
+	}
+	pstat := webdav.Propstat{Status: status}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	if f.fs.readOnly {
+		return []webdav.Propstat{pstat}, nil
+	}
+	if err := f.fs.props.patch(f.name, patches); err != nil {
+		return nil, err
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// propStore keeps the dead properties of the files in a share, persisting
+// them in a JSON file so that they survive restarts of the file server.
+type propStore struct {
+	file string // path of the JSON file, or empty to keep them in memory only
+
+	mu     sync.Mutex
+	loaded bool
+	props  map[string]map[xml.Name]webdav.Property // cleaned path => properties
+}
+
+// newPropStore returns a propStore for the share in the local directory
+// sharePath, or an in-memory one if sharePath is empty.
+func newPropStore(sharePath string) *propStore {
+	if sharePath == "" {
+		return &propStore{}
+	}
+	return &propStore{file: filepath.Join(sharePath, propsFileName)}
+}
+
+// cleanPropsPath returns the key under which the properties of the file with
+// the given name are kept.
+func cleanPropsPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// loadLocked reads the store's file, if it hasn't been read yet. A file that
+// can't be read or parsed is treated as empty, so that a damaged file doesn't
+// break PROPFIND and PROPPATCH for the whole share. The properties it held are
+// lost once new ones are saved.
+//
+// ps.mu must be held.
+func (ps *propStore) loadLocked() {
+	if ps.loaded {
+		return
+	}
+	ps.loaded = true
+	ps.props = make(map[string]map[xml.Name]webdav.Property)
+	if ps.file == "" {
+		return
+	}
+	b, err := os.ReadFile(ps.file)
+	if err != nil {
+		return
+	}
+	var stored map[string][]webdav.Property
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return
+	}
+	for name, props := range stored {
+		m := make(map[xml.Name]webdav.Property, len(props))
+		for _, p := range props {
+			m[p.XMLName] = p
+		}
+		ps.props[name] = m
+	}
+}
+
+// saveLocked writes the store's properties to its file.
+//
+// ps.mu must be held.
+func (ps *propStore) saveLocked() error {
+	if ps.file == "" {
+		return nil
+	}
+	stored := make(map[string][]webdav.Property, len(ps.props))
+	for name, m := range ps.props {
+		for _, p := range m {
+			stored[name] = append(stored[name], p)
+		}
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(ps.file, b, 0600)
+}
+
+// get returns a copy of the properties of the named file.
+func (ps *propStore) get(name string) (map[xml.Name]webdav.Property, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.loadLocked()
+	m := ps.props[cleanPropsPath(name)]
+	if len(m) == 0 {
+		return nil, nil
+	}
+	out := make(map[xml.Name]webdav.Property, len(m))
+	for k, p := range m {
+		out[k] = p
+	}
+	return out, nil
+}
+
+// patch applies patches to the properties of the named file.
+func (ps *propStore) patch(name string, patches []webdav.Proppatch) error {
+	name = cleanPropsPath(name)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.loadLocked()
+	m := ps.props[name]
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if patch.Remove {
+				delete(m, p.XMLName)
+				continue
+			}
+			if m == nil {
+				m = make(map[xml.Name]webdav.Property)
+			}
+			m[p.XMLName] = p
+		}
+	}
+	if len(m) == 0 {
+		delete(ps.props, name)
+	} else {
+		ps.props[name] = m
+	}
+	return ps.saveLocked()
+}
+
+// removeAll forgets the properties of the named file and, if it's a
+// directory, of everything in it.
+func (ps *propStore) removeAll(name string) error {
+	return ps.update(name, func(string) (string, bool) {
+		return "", false
+	})
+}
+
+// rename moves the properties of oldName and, if it's a directory, of
+// everything in it, to newName.
+func (ps *propStore) rename(oldName, newName string) error {
+	newName = cleanPropsPath(newName)
+	return ps.update(oldName, func(rel string) (string, bool) {
+		return newName + rel, true
+	})
+}
+
+// update calls fn for the properties of name and every file below it, with
+// the path of each relative to name. If fn returns false, the properties are
+// dropped; otherwise they're moved to the path it returns.
+func (ps *propStore) update(name string, fn func(rel string) (string, bool)) error {
+	name = cleanPropsPath(name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.loadLocked()
+	changed := false
+	moved := make(map[string]map[xml.Name]webdav.Property)
+	for p, m := range ps.props {
+		var rel string
+		switch {
+		case p == name:
+		case strings.HasPrefix(p, prefix):
+			rel = p[len(prefix)-1:]
+		default:
+			continue
+		}
+		changed = true
+		delete(ps.props, p)
+		if newName, keep := fn(rel); keep {
+			moved[newName] = m
+		}
+	}
+	if !changed {
+		return nil
+	}
+	for p, m := range moved {
+		ps.props[p] = m
+	}
+	return ps.saveLocked()
+}
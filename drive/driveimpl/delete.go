@@ -0,0 +1,193 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+// errMembersNotDeleted is returned by memberDeletingFS.RemoveAll when some of
+// a collection's members couldn't be removed, and so neither could the
+// collection.
+var errMembersNotDeleted = errors.New("some members of the collection could not be deleted")
+
+// deleteFailure is a member of a collection that couldn't be deleted.
+type deleteFailure struct {
+	name   string
+	status int // HTTP status code describing why
+}
+
+// deleteFailuresKey is the context key under which serveDelete passes a
+// *[]deleteFailure to memberDeletingFS.RemoveAll, to be filled in with the
+// members of the collection being deleted that couldn't be removed.
+type deleteFailuresKey struct{}
+
+// memberDeletingFS wraps a webdav.FileSystem to remove collections member by
+// member. When members can't be removed, it leaves their ancestors in place
+// and records the members so that DELETE can report them, as RFC 4918
+// section 9.6.1 requires, rather than failing as a whole after removing an
+// unknown subset of the collection.
+type memberDeletingFS struct {
+	webdav.FileSystem
+}
+
+func (fs *memberDeletingFS) RemoveAll(ctx context.Context, name string) error {
+	var failures []deleteFailure
+	err := fs.removeTree(ctx, name, &failures)
+	if p, ok := ctx.Value(deleteFailuresKey{}).(*[]deleteFailure); ok {
+		*p = failures
+	}
+	return err
+}
+
+// removeTree removes the named file, or the named directory after removing its
+// members. Members that can't be removed are appended to failures, and their
+// ancestors are left in place.
+func (fs *memberDeletingFS) removeTree(ctx context.Context, name string, failures *[]deleteFailure) error {
+	fi, err := fs.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		// Like os.RemoveAll, succeed if there's nothing to remove.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		fis, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		membersFailed := false
+		for _, fi := range fis {
+			member := path.Join(name, fi.Name())
+			err := fs.removeTree(ctx, member, failures)
+			if err == nil {
+				continue
+			}
+			membersFailed = true
+			if err != errMembersNotDeleted {
+				*failures = append(*failures, deleteFailure{name: member, status: deleteStatus(err)})
+			}
+		}
+		if membersFailed {
+			return errMembersNotDeleted
+		}
+	}
+	err = fs.FileSystem.RemoveAll(ctx, name)
+	if hme, ok := errors.AsType[*hiddenMembersError](err); ok {
+		// The hidden members weren't listed above, so report them here.
+		for _, member := range hme.names {
+			*failures = append(*failures, deleteFailure{name: member, status: http.StatusForbidden})
+		}
+		return errMembersNotDeleted
+	}
+	return err
+}
+
+// deleteStatus returns the status with which to report a member of a
+// collection that couldn't be deleted because of err.
+func deleteStatus(err error) int {
+	if os.IsPermission(err) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// serveDelete serves a DELETE request with h. Collections are always deleted
+// along with their members, so a Depth header other than "infinity" is
+// rejected for non-empty collections (RFC 4918 section 9.6.1). If some members
+// of a collection can't be deleted, the response is a 207 Multi-Status listing
+// them.
+func serveDelete(w http.ResponseWriter, r *http.Request, h http.Handler) {
+	if depth := r.Header.Get("Depth"); depth != "" && depth != "infinity" {
+		if depth != "0" && depth != "1" {
+			http.Error(w, "invalid Depth", http.StatusBadRequest)
+			return
+		}
+		if wh, ok := h.(*webdav.Handler); ok && nonEmptyCollection(r.Context(), wh.FileSystem, r.URL.Path) {
+			http.Error(w, "DELETE of a non-empty collection requires Depth: infinity", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var failures []deleteFailure
+	r = r.WithContext(context.WithValue(r.Context(), deleteFailuresKey{}, &failures))
+	h.ServeHTTP(&deleteResponseWriter{ResponseWriter: w, failures: &failures}, r)
+}
+
+// nonEmptyCollection reports whether the named file is a directory with at
+// least one member.
+func nonEmptyCollection(ctx context.Context, fs webdav.FileSystem, name string) bool {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	fis, err := f.Readdir(1)
+	return err == nil && len(fis) > 0
+}
+
+// deleteResponseWriter is an http.ResponseWriter that replaces the response
+// to a DELETE request whose collection's members couldn't all be deleted with
+// a 207 Multi-Status listing those members.
+type deleteResponseWriter struct {
+	http.ResponseWriter
+	failures *[]deleteFailure // filled in by memberDeletingFS.RemoveAll
+	replaced bool
+}
+
+func (dw *deleteResponseWriter) WriteHeader(statusCode int) {
+	if len(*dw.failures) == 0 {
+		dw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	dw.replaced = true
+	dw.Header().Del("Content-Length")
+	dw.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	dw.ResponseWriter.WriteHeader(http.StatusMultiStatus)
+	writeDeleteMultiStatus(dw.ResponseWriter, *dw.failures)
+}
+
+func (dw *deleteResponseWriter) Write(p []byte) (int, error) {
+	if dw.replaced {
+		// Discard webdav.Handler's own body.
+		return len(p), nil
+	}
+	return dw.ResponseWriter.Write(p)
+}
+
+// writeDeleteMultiStatus writes a multistatus body reporting the given
+// failures. Responses are written as <D:response><D:href> so that
+// compositedav can rewrite their hrefs like those of PROPFIND responses.
+func writeDeleteMultiStatus(w io.Writer, failures []deleteFailure) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><D:multistatus xmlns:D="DAV:">`)
+	for _, f := range failures {
+		b.WriteString("<D:response><D:href>")
+		xml.EscapeText(&b, []byte((&url.URL{Path: f.name}).EscapedPath()))
+		fmt.Fprintf(&b, "</D:href><D:status>HTTP/1.1 %d %s</D:status></D:response>", f.status, http.StatusText(f.status))
+	}
+	b.WriteString("</D:multistatus>")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !windows
+
+package driveimpl
+
+import "errors"
+
+// diskFree returns the number of bytes available on the filesystem holding
+// the named directory, which isn't known on this platform.
+func diskFree(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,199 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/drive"
+)
+
+// dotfilesFS wraps a webdav.FileSystem to hide dotfiles, that is, files and
+// directories whose names begin with a period, and everything within them,
+// if the share is configured to hide them (see drive.Share.HideDotfiles).
+// Hidden files are left out of directory listings and can't be accessed,
+// created or renamed to. Directories that contain hidden files can't be
+// removed or renamed, as that would remove or move the hidden files with them.
+type dotfilesFS struct {
+	webdav.FileSystem
+
+	// hide reports whether dotfiles are currently hidden. It's a func so
+	// that the setting can change without rebuilding the share's handler.
+	hide func() bool
+}
+
+// dotfilesHidden reports whether share's dotfiles are hidden, per its
+// HideDotfiles or, if that's unset, byDefault.
+func dotfilesHidden(share *drive.Share, byDefault bool) bool {
+	if hide, ok := share.HideDotfiles.Get(); ok {
+		return hide
+	}
+	return byDefault
+}
+
+// hiddenMembersError is returned by dotfilesFS when a directory can't be
+// removed or renamed because it contains hidden files.
+type hiddenMembersError struct {
+	names []string // paths of the hidden files
+}
+
+func (e *hiddenMembersError) Error() string {
+	return "directory contains hidden files"
+}
+
+// isDotfile reports whether name is a dotfile.
+func isDotfile(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// hasDotfile reports whether any component of the given path is a dotfile.
+func hasDotfile(name string) bool {
+	return slices.ContainsFunc(strings.Split(path.Clean("/"+name), "/"), isDotfile)
+}
+
+// hidden reports whether the file with the given path is hidden.
+func (fs *dotfilesFS) hidden(name string) bool {
+	return hasDotfile(name) && fs.hide()
+}
+
+// checkNoHiddenMembers returns a *hiddenMembersError if dotfiles are hidden
+// and name is a directory that contains any.
+func (fs *dotfilesFS) checkNoHiddenMembers(ctx context.Context, name string) error {
+	if !fs.hide() {
+		return nil
+	}
+	fi, err := fs.FileSystem.Stat(ctx, name)
+	if err != nil || !fi.IsDir() {
+		// Let the caller's operation report the error, if any.
+		return nil
+	}
+	names, err := fs.hiddenMembers(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return &hiddenMembersError{names: names}
+	}
+	return nil
+}
+
+// hiddenMembers returns the paths of the dotfiles in the named directory and
+// its subdirectories, without descending into dot-directories.
+func (fs *dotfilesFS) hiddenMembers(ctx context.Context, name string) ([]string, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		member := path.Join(name, fi.Name())
+		switch {
+		case isDotfile(fi.Name()):
+			names = append(names, member)
+		case fi.IsDir():
+			more, err := fs.hiddenMembers(ctx, member)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, more...)
+		}
+	}
+	return names, nil
+}
+
+func (fs *dotfilesFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if fs.hidden(name) {
+		return os.ErrNotExist
+	}
+	return fs.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (fs *dotfilesFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if fs.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &dotfilesFile{File: f, fs: fs}, nil
+}
+
+func (fs *dotfilesFS) RemoveAll(ctx context.Context, name string) error {
+	if fs.hidden(name) {
+		return os.ErrNotExist
+	}
+	if err := fs.checkNoHiddenMembers(ctx, name); err != nil {
+		return err
+	}
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs *dotfilesFS) Rename(ctx context.Context, oldName, newName string) error {
+	if fs.hidden(oldName) || fs.hidden(newName) {
+		return os.ErrNotExist
+	}
+	if err := fs.checkNoHiddenMembers(ctx, oldName); err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (fs *dotfilesFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if fs.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Stat(ctx, name)
+}
+
+// dotfilesFile wraps a webdav.File to leave hidden dotfiles out of directory
+// listings.
+type dotfilesFile struct {
+	webdav.File
+	fs *dotfilesFS
+}
+
+// Readdir returns the entries of the directory that aren't hidden. Like
+// os.File.Readdir, it returns count of them if count is positive, unless it
+// runs out of entries first.
+func (f *dotfilesFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.fs.hide() {
+		return f.File.Readdir(count)
+	}
+	visible := func(fis []fs.FileInfo) []fs.FileInfo {
+		return slices.DeleteFunc(fis, func(fi fs.FileInfo) bool {
+			return isDotfile(fi.Name())
+		})
+	}
+	if count <= 0 {
+		fis, err := f.File.Readdir(count)
+		return visible(fis), err
+	}
+	// Hidden entries would leave gaps, so keep reading until there are
+	// count visible ones.
+	var ret []fs.FileInfo
+	for len(ret) < count {
+		fis, err := f.File.Readdir(count - len(ret))
+		ret = append(ret, visible(fis)...)
+		if err == io.EOF && len(ret) > 0 {
+			return ret, nil
+		}
+		if err != nil || len(fis) == 0 {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+func TestDotfilesReaddirCount(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var want []string
+	for _, name := range []string{".a", ".b", ".c", "d", ".e", "f", "g", ".h"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !isDotfile(name) {
+			want = append(want, name)
+		}
+	}
+	fs := &dotfilesFS{FileSystem: webdav.Dir(dir), hide: func() bool { return true }}
+
+	f, err := fs.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	for {
+		fis, err := f.Readdir(2)
+		for _, fi := range fis {
+			got = append(got, fi.Name())
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fis) != 2 && len(got) < len(want) {
+			t.Errorf("Readdir(2) returned %d entries with more remaining", len(fis))
+		}
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+}
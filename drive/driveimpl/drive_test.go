@@ -4,20 +4,26 @@
 package driveimpl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"iter"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -25,9 +31,11 @@
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/studio-b12/gowebdav"
+	"github.com/tailscale/xnet/webdav"
 	"tailscale.com/drive"
 	"tailscale.com/drive/driveimpl/shared"
 	"tailscale.com/tstest"
+	"tailscale.com/types/opt"
 )
 
 const (
@@ -134,6 +142,1961 @@ func TestPermissions(t *testing.T) {
 	}
 }
 
+// TestReadOnlyShare verifies that read-only shares can't be modified, even
+// by principals with read-write permission, both through the
+// FileSystemForRemote and directly at the FileServer.
+func TestReadOnlyShare(t *testing.T) {
+	s := newSystem(t)
+
+	fileserverAddr := s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite, func(sh *drive.Share) { sh.ReadOnly = true })
+	s.write(remote1, share11, file111, "hello world")
+
+	if got := s.readViaWebDAV(remote1, share11, file111); got != "hello world" {
+		t.Errorf("reading from read-only share got %q, want %q", got, "hello world")
+	}
+	s.writeFile("writing file to read-only share should fail", remote1, share11, file112, "hello world", false)
+	if err := s.client.Mkdir(pathTo(remote1, share11, "dir"), 0755); err == nil {
+		t.Error("making directory in read-only share should fail")
+	}
+	if err := s.client.Remove(pathTo(remote1, share11, file111)); err == nil {
+		t.Error("deleting file from read-only share should fail")
+	}
+	if err := s.client.Rename(pathTo(remote1, share11, file111), pathTo(remote1, share11, file112), true); err == nil {
+		t.Error("moving file in read-only share should fail")
+	}
+	if got := s.read(remote1, share11, file111); got != "hello world" {
+		t.Errorf("file in read-only share changed to %q", got)
+	}
+
+	// Go straight to the FileServer, bypassing the FileSystemForRemote.
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	secretToken, addr, _ := strings.Cut(fileserverAddr, "|")
+	for _, method := range []string{"PUT", "DELETE", "MKCOL", "PROPPATCH"} {
+		u := fmt.Sprintf("http://%s/%s/%s/%s", addr, secretToken, url.PathEscape(share11), url.PathEscape(file111))
+		req, err := http.NewRequest(method, u, strings.NewReader("overwritten"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s directly to file server: got status %d, want %d", method, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	if got := s.read(remote1, share11, file111); got != "hello world" {
+		t.Errorf("file in read-only share changed to %q", got)
+	}
+}
+
+// TestRequireSecret verifies that requests for shares with a RequireSecret
+// are only served if they present the matching secret.
+func TestRequireSecret(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite, func(sh *drive.Share) { sh.RequireSecret = "sesame" })
+	s.addShare(remote1, share12, drive.PermissionReadWrite)
+	s.write(remote1, share11, file111, "secret contents")
+	s.write(remote1, share12, file111, "public contents")
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	tests := []struct {
+		name       string
+		share      string
+		secret     string // empty means no header
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "missing", share: share11, wantStatus: http.StatusUnauthorized},
+		{name: "wrong", share: share11, secret: "sesamo", wantStatus: http.StatusUnauthorized},
+		{name: "prefix", share: share11, secret: "sesam", wantStatus: http.StatusUnauthorized},
+		{name: "correct", share: share11, secret: "sesame", wantStatus: http.StatusOK, wantBody: "secret contents"},
+		{name: "not required", share: share12, wantStatus: http.StatusOK, wantBody: "public contents"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := fmt.Sprintf("http://%s/%s/%s/%s/%s",
+				s.local.ln.Addr(),
+				url.PathEscape(domain),
+				url.PathEscape(remote1),
+				url.PathEscape(tt.share),
+				url.PathEscape(file111))
+			req, err := http.NewRequest("GET", u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.secret != "" {
+				req.Header.Set(SecretHeader, tt.secret)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody == "" {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("got body %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestRateLimit verifies that requests for shares with a MaxRequestsPerSec
+// are rate limited per principal, and that principals exceeding the limit
+// don't affect others.
+func TestRateLimit(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite, func(sh *drive.Share) { sh.MaxRequestsPerSec = 2 })
+	s.addShare(remote1, share12, drive.PermissionReadWrite)
+	s.write(remote1, share11, file111, "limited")
+	s.write(remote1, share12, file111, "unlimited")
+
+	r := s.remotes[remote1]
+	get := func(share, principal, remoteAddr string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/"+url.PathEscape(share)+"/"+url.PathEscape(file111), nil)
+		req.RemoteAddr = remoteAddr
+		if principal != "" {
+			req = req.WithContext(drive.WithPrincipalName(req.Context(), principal))
+		}
+		w := httptest.NewRecorder()
+		r.fs.ServeHTTPWithPerms(r.permissions, w, req)
+		return w.Result()
+	}
+
+	// The first principal may burst up to the limit, then gets throttled.
+	const alice = "alice@example.com (laptop)"
+	for i := range 2 {
+		if resp := get(share11, alice, "100.64.0.1:41641"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, resp.StatusCode, http.StatusOK)
+		}
+	}
+	resp := get(share11, alice, "100.64.0.1:41641")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want %q", got, "1")
+	}
+
+	// The same principal connecting from another address is still throttled.
+	if resp := get(share11, alice, "[fd7a:115c:a1e0::1]:41641"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("other address: got status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	// Other shares aren't limited.
+	for i := range 5 {
+		if resp := get(share12, alice, "100.64.0.1:41641"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unlimited share request %d: got status %d, want %d", i, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// Another principal isn't affected by the first one's requests, even
+	// from the same address.
+	const bob = "bob@example.com (desktop)"
+	for i := range 2 {
+		if resp := get(share11, bob, "100.64.0.1:41641"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("second principal request %d: got status %d, want %d", i, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// Without a principal name, principals are told apart by IP address,
+	// whatever the port.
+	for i := range 2 {
+		if resp := get(share11, "", "100.64.0.3:41641"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unnamed principal request %d: got status %d, want %d", i, resp.StatusCode, http.StatusOK)
+		}
+	}
+	if resp := get(share11, "", "100.64.0.3:1234"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("unnamed principal from other port: got status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+}
+
+// TestRequestLimitersPrune verifies that requestLimiters forgets principals
+// that have been idle for a while.
+func TestRequestLimitersPrune(t *testing.T) {
+	var rl requestLimiters
+	now := time.Now()
+	if !rl.allow(now, share11, "100.64.0.1", 10) {
+		t.Fatal("first request not allowed")
+	}
+	if !rl.allow(now.Add(limiterIdleTimeout/2), share11, "100.64.0.2", 10) {
+		t.Fatal("second principal's first request not allowed")
+	}
+	if got := len(rl.limiters); got != 2 {
+		t.Fatalf("got %d limiters, want 2", got)
+	}
+	if !rl.allow(now.Add(limiterIdleTimeout+time.Second), share11, "100.64.0.2", 10) {
+		t.Fatal("second principal's second request not allowed")
+	}
+	if _, ok := rl.limiters[limiterKey{share11, "100.64.0.1"}]; ok {
+		t.Error("idle principal wasn't pruned")
+	}
+	if got := len(rl.limiters); got != 1 {
+		t.Errorf("got %d limiters, want 1", got)
+	}
+}
+
+// TestShareLimits verifies that SetShares rejects configurations with more
+// shares or user servers than allowed by SetLimits, and that Healthy reports
+// the rejection.
+func TestShareLimits(t *testing.T) {
+	shares := func(users ...string) []*drive.Share {
+		var shares []*drive.Share
+		for i, u := range users {
+			shares = append(shares, &drive.Share{Name: fmt.Sprintf("share%d", i), Path: t.TempDir(), As: u})
+		}
+		return shares
+	}
+
+	t.Run("shares", func(t *testing.T) {
+		fs := NewFileSystemForRemote(log.Printf)
+		defer fs.Close()
+		fs.SetFileServerAddr("token|127.0.0.1:1234")
+		fs.SetLimits(2, 0, 0)
+
+		fs.SetShares(shares("", ""))
+		if healthy, errs := fs.Healthy(); !healthy {
+			t.Fatalf("Healthy() = false, %v; want true", errs)
+		}
+		fs.SetShares(shares("", "", ""))
+		healthy, errs := fs.Healthy()
+		if healthy || len(errs) != 1 || !errors.Is(errs[0], ErrTooManyShares) {
+			t.Fatalf("Healthy() = %v, %v; want false with ErrTooManyShares", healthy, errs)
+		}
+		if got, want := errs[0].Error(), "share configuration was rejected: too many Taildrive shares: 3 shares exceed the limit of 2"; got != want {
+			t.Errorf("got error %q, want %q", got, want)
+		}
+		if got := len(fs.shares); got != 2 {
+			t.Errorf("got %d shares after rejected config, want previous 2", got)
+		}
+
+		fs.SetShares(shares(""))
+		if healthy, errs := fs.Healthy(); !healthy {
+			t.Fatalf("Healthy() after valid config = false, %v; want true", errs)
+		}
+	})
+
+	t.Run("user servers", func(t *testing.T) {
+		drive.DisallowShareAs = false
+		defer func() { drive.DisallowShareAs = true }()
+		if !drive.AllowShareAs() {
+			t.Skip("sharing as a specific user is not supported on this platform")
+		}
+
+		fs := NewFileSystemForRemote(log.Printf)
+		defer fs.Close()
+		fs.SetLimits(0, 2, 0)
+		fs.SetShares(shares("alice", "bob", "carol", "alice"))
+		healthy, errs := fs.Healthy()
+		if healthy || len(errs) != 1 || !errors.Is(errs[0], ErrTooManyShares) {
+			t.Fatalf("Healthy() = %v, %v; want false with ErrTooManyShares", healthy, errs)
+		}
+		if got, want := errs[0].Error(), "share configuration was rejected: too many Taildrive shares: shares as 3 users exceed the limit of 2 user servers"; got != want {
+			t.Errorf("got error %q, want %q", got, want)
+		}
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		if len(fs.userServers) != 0 || len(fs.shares) != 0 {
+			t.Errorf("got %d user servers and %d shares after rejected config, want none", len(fs.userServers), len(fs.shares))
+		}
+	})
+}
+
+// TestConnectionLimits verifies that the connections to a share's server are
+// limited as configured with SetConnectionLimits, and that requests beyond
+// the limit wait for a connection rather than failing.
+func TestConnectionLimits(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		active  int
+		maxSeen int
+	)
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		maxSeen = max(maxSeen, active)
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		active--
+		mu.Unlock()
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	fs := NewFileSystemForRemote(log.Printf)
+	defer fs.Close()
+	fs.SetFileServerAddr("token|" + srv.Listener.Addr().String())
+	fs.SetConnectionLimits(3, 2)
+	fs.SetShares([]*drive.Share{{Name: share11, Path: t.TempDir()}})
+
+	fs.mu.RLock()
+	tr, ok := fs.children[share11].Transport.(*http.Transport)
+	fs.mu.RUnlock()
+	if !ok {
+		t.Fatalf("share's transport is not an *http.Transport")
+	}
+	if tr.MaxIdleConnsPerHost != 3 || tr.MaxConnsPerHost != 2 {
+		t.Errorf("transport has MaxIdleConnsPerHost %d and MaxConnsPerHost %d, want 3 and 2", tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost)
+	}
+
+	const requests = 4
+	perms := drive.Permissions{share11: drive.PermissionReadOnly}
+	codes := make(chan int, requests)
+	for range requests {
+		go func() {
+			w := httptest.NewRecorder()
+			fs.ServeHTTPWithPerms(perms, w, httptest.NewRequest("GET", shared.JoinEscaped(share11, file111), nil))
+			codes <- w.Code
+		}()
+	}
+
+	// Two requests reach the server; the others wait for their
+	// connections.
+	for range 2 {
+		<-started
+	}
+	select {
+	case <-started:
+		t.Fatal("more requests reached the server than MaxConnsPerHost allows")
+	case code := <-codes:
+		t.Fatalf("request finished with status %d while waiting for a connection", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	for range requests {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("got status %d, want %d", code, http.StatusOK)
+		}
+	}
+	if maxSeen != 2 {
+		t.Errorf("server saw at most %d concurrent requests, want 2", maxSeen)
+	}
+}
+
+// TestDotfiles verifies that dotfiles, and everything within dot-directories,
+// are hidden from listings and can't be accessed, including by moving or
+// deleting the directories that contain them, if the share is configured to
+// hide them, and are visible like other files otherwise.
+func TestDotfiles(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite, func(sh *drive.Share) { sh.HideDotfiles = opt.NewBool(true) })
+	s.addShare(remote1, share12, drive.PermissionReadWrite)
+	for _, share := range []string{share11, share12} {
+		for _, dir := range []string{".ssh", "sub"} {
+			if err := os.Mkdir(filepath.Join(s.remotes[remote1].shares[share].Path, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.write(remote1, share, ".profile", "profile")
+		s.write(remote1, share, ".ssh/id_ed25519", "key")
+		s.write(remote1, share, "sub/.bashrc", "bashrc")
+		s.write(remote1, share, "sub/"+file111, "visible")
+	}
+
+	s.checkDirList("share root should hide dotfiles", shared.Join(domain, remote1, share11), "sub")
+	s.checkDirList("subdirectory should hide dotfiles", shared.Join(domain, remote1, share11, "sub"), file111)
+	if got := s.readViaWebDAV(remote1, share11, "sub/"+file111); got != "visible" {
+		t.Errorf("reading visible file got %q, want %q", got, "visible")
+	}
+	for _, name := range []string{".profile", ".ssh", ".ssh/id_ed25519", "sub/.bashrc"} {
+		if _, err := s.client.Read(pathTo(remote1, share11, name)); !gowebdav.IsErrNotFound(err) {
+			t.Errorf("reading hidden %q: got error %v, want not found", name, err)
+		}
+		if _, err := s.client.Stat(pathTo(remote1, share11, name)); !gowebdav.IsErrNotFound(err) {
+			t.Errorf("stat of hidden %q: got error %v, want not found", name, err)
+		}
+	}
+	s.writeFile("writing hidden file should fail", remote1, share11, "sub/.new", "new", false)
+	s.renameFile("renaming file to hidden name should fail", remote1, share11, "sub/"+file111, share11, "sub/.renamed", false)
+
+	// Directories that contain hidden files can't be moved or deleted, as
+	// that would move or delete the hidden files with them.
+	s.renameFile("renaming directory containing hidden file should fail", remote1, share11, "sub", share11, "moved", false)
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s%s", s.local.ln.Addr(), shared.JoinEscaped(domain, remote1, share11, "sub")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("DELETE of directory containing hidden file got status %d, want %d", resp.StatusCode, http.StatusMultiStatus)
+	}
+	wantHref := shared.EscapeForXML(shared.Join(domain, remote1, share11)) + shared.JoinEscaped("sub", ".bashrc")
+	want := "<D:response><D:href>" + wantHref + "</D:href><D:status>HTTP/1.1 403 Forbidden</D:status></D:response>"
+	if !strings.Contains(string(body), want) || strings.Count(string(body), "<D:response>") != 1 {
+		t.Errorf("DELETE response doesn't report just the hidden file\ngot:  %s\nwant: %s", body, want)
+	}
+	root := s.remotes[remote1].shares[share11].Path
+	if got := s.read(remote1, share11, "sub/.bashrc"); got != "bashrc" {
+		t.Errorf("hidden file after DELETE of its directory: got %q, want %q", got, "bashrc")
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub", file111)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("visible file should have been deleted; Stat error = %v", err)
+	}
+
+	s.checkDirList("share not hiding dotfiles should list them", shared.Join(domain, remote1, share12, ".ssh"), "id_ed25519")
+	for name, want := range map[string]string{
+		".profile":        "profile",
+		".ssh/id_ed25519": "key",
+		"sub/.bashrc":     "bashrc",
+	} {
+		if got := s.readViaWebDAV(remote1, share12, name); got != want {
+			t.Errorf("reading %q got %q, want %q", name, got, want)
+		}
+	}
+	s.writeFile("writing dotfile to share not hiding dotfiles should succeed", remote1, share12, "sub/.new", "new", true)
+}
+
+// TestDotfilesByDefault verifies that the dotfiles of shares that don't set
+// HideDotfiles are hidden if dotfiles are hidden by default, and that shares
+// can still show them explicitly.
+func TestDotfilesByDefault(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	fs := s.remotes[remote1].fs
+	if err := fs.SetHideDotfilesByDefault(true); err == nil {
+		t.Error("hiding dotfiles by default without user servers: got no error")
+	}
+	drive.DisallowShareAs = false
+	if !drive.AllowShareAs() {
+		drive.DisallowShareAs = true
+		t.Skip("user servers not supported on this platform")
+	}
+	err := fs.SetHideDotfilesByDefault(true)
+	drive.DisallowShareAs = true
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.addShare(remote1, share12, drive.PermissionReadWrite, func(sh *drive.Share) { sh.HideDotfiles = opt.NewBool(false) })
+	for _, share := range []string{share11, share12} {
+		s.write(remote1, share, ".profile", "profile")
+		s.write(remote1, share, file111, "visible")
+	}
+	s.checkDirList("share using the default should hide dotfiles", shared.Join(domain, remote1, share11), file111)
+	s.checkDirList("share showing dotfiles should list them", shared.Join(domain, remote1, share12), ".profile", file111)
+}
+
+// TestUnicodeNormalization verifies that files whose names are stored in one
+// Unicode normalization form can be reached with names in the other on shares
+// normalizing Unicode, and only on those.
+func TestUnicodeNormalization(t *testing.T) {
+	const (
+		nfc = "caf\u00e9"  // "café" with a precomposed é, as on Linux
+		nfd = "cafe\u0301" // "café" with a combining acute accent, as on macOS
+	)
+
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.addShare(remote1, share12, drive.PermissionReadWrite, func(sh *drive.Share) { sh.NormalizeUnicode = true })
+
+	for _, share := range []string{share11, share12} {
+		if err := os.Mkdir(filepath.Join(s.remotes[remote1].shares[share].Path, "dir-"+nfd), 0755); err != nil {
+			t.Fatal(err)
+		}
+		s.write(remote1, share, "both-"+nfc, "both NFC")
+		s.write(remote1, share, "both-"+nfd, "both NFD")
+		s.write(remote1, share, "composed-"+nfc, "composed")
+		s.write(remote1, share, "decomposed-"+nfd, "decomposed")
+		s.write(remote1, share, "dir-"+nfd+"/inner-"+nfc, "inner")
+	}
+
+	// Both shares serve names that exist as requested, even if a file with
+	// the other form of the name exists too.
+	for _, share := range []string{share11, share12} {
+		for name, want := range map[string]string{
+			"both-" + nfc:                  "both NFC",
+			"both-" + nfd:                  "both NFD",
+			"composed-" + nfc:              "composed",
+			"decomposed-" + nfd:            "decomposed",
+			"dir-" + nfd + "/inner-" + nfc: "inner",
+		} {
+			if got := s.readViaWebDAV(remote1, share, name); got != want {
+				t.Errorf("%s: reading %+q got %q, want %q", share, name, got, want)
+			}
+		}
+	}
+
+	// Only the share normalizing Unicode serves them under the other form.
+	for name, want := range map[string]string{
+		"composed-" + nfd:              "composed",
+		"decomposed-" + nfc:            "decomposed",
+		"dir-" + nfc + "/inner-" + nfd: "inner",
+	} {
+		if got := s.readViaWebDAV(remote1, share12, name); got != want {
+			t.Errorf("reading %+q got %q, want %q", name, got, want)
+		}
+		if _, err := s.client.Read(pathTo(remote1, share11, name)); !gowebdav.IsErrNotFound(err) {
+			t.Errorf("reading %+q from share not normalizing Unicode: got error %v, want not found", name, err)
+		}
+	}
+
+	// Writing a file under the other form of its name replaces it, rather
+	// than adding a look-alike, and new files keep the names they're
+	// created with.
+	s.writeFile("overwriting NFD file through NFC name", remote1, share12, "decomposed-"+nfc, "replaced", true)
+	if got := s.read(remote1, share12, "decomposed-"+nfd); got != "replaced" {
+		t.Errorf("NFD file contains %q after writing to its NFC name, want %q", got, "replaced")
+	}
+	s.writeFile("creating file in NFD directory through its NFC name", remote1, share12, "dir-"+nfc+"/new-"+nfc, "new", true)
+	if got := s.read(remote1, share12, "dir-"+nfd+"/new-"+nfc); got != "new" {
+		t.Errorf("new file contains %q, want %q", got, "new")
+	}
+	fis, err := s.client.ReadDir(shared.Join(domain, remote1, share12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+	}
+	want := []string{"both-" + nfc, "both-" + nfd, "composed-" + nfc, "decomposed-" + nfd, "dir-" + nfd}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("listing got %+q, want the stored names %+q", got, want)
+	}
+}
+
+// TestUnionShare verifies that shares with extra paths serve the merged
+// contents of all their directories, that names found in several of them
+// resolve to the first directory's, and that such shares can't be modified.
+func TestUnionShare(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	extra := []string{t.TempDir(), t.TempDir()}
+	s.addShare(remote1, share11, drive.PermissionReadWrite, func(sh *drive.Share) { sh.ExtraPaths = extra })
+	roots := append([]string{s.remotes[remote1].shares[share11].Path}, extra...)
+
+	for i, files := range []map[string]string{
+		{"a": "a0", "both": "both0", "dir/x": "x0", "shadow": "shadow0"},
+		{"b": "b1", "both": "both1", "dir/y": "y1", "shadow/z": "z1"},
+		{"c": "c2", "both": "both2", "dir/x": "x2", "dir/sub/w": "w2"},
+	} {
+		for name, contents := range files {
+			p := filepath.Join(roots[i], filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s.checkDirList("union share should contain files from all roots", shared.Join(domain, remote1, share11), "a", "b", "both", "c", "dir", "shadow")
+	s.checkDirList("directories in several roots should be merged", shared.Join(domain, remote1, share11, "dir"), "sub", "x", "y")
+	for name, want := range map[string]string{
+		"a":         "a0",
+		"b":         "b1",
+		"c":         "c2",
+		"both":      "both0",
+		"dir/x":     "x0",
+		"dir/y":     "y1",
+		"dir/sub/w": "w2",
+		"shadow":    "shadow0",
+	} {
+		if got := s.readViaWebDAV(remote1, share11, name); got != want {
+			t.Errorf("reading %q got %q, want %q", name, got, want)
+		}
+	}
+	if fi := s.statViaWebDAV(remote1, share11, "shadow"); fi.IsDir() {
+		t.Error("file in first root should shadow directory in later root")
+	}
+	if _, err := s.client.Read(pathTo(remote1, share11, "shadow/z")); !gowebdav.IsErrNotFound(err) {
+		t.Errorf("reading file in shadowed directory: got error %v, want not found", err)
+	}
+
+	s.writeFile("writing new file to union share should fail", remote1, share11, "new", "new", false)
+	s.writeFile("overwriting file in union share should fail", remote1, share11, "b", "new", false)
+	if err := s.client.Mkdir(pathTo(remote1, share11, "newdir"), 0755); err == nil {
+		t.Error("making directory in union share should fail")
+	}
+	if err := s.client.Remove(pathTo(remote1, share11, "c")); err == nil {
+		t.Error("deleting file from union share should fail")
+	}
+	if b, err := os.ReadFile(filepath.Join(roots[1], "b")); err != nil || string(b) != "b1" {
+		t.Errorf("file in union share changed to %q, %v", b, err)
+	}
+}
+
+// TestFsync verifies that files written or moved into shares with fsync
+// enabled, and the directories containing them, are synced before the
+// request completes, and that nothing is synced for other shares.
+func TestFsync(t *testing.T) {
+	var mu sync.Mutex
+	var synced []string
+	oldSyncFile := syncFile
+	syncFile = func(f syncer) error {
+		mu.Lock()
+		synced = append(synced, f.(*os.File).Name())
+		mu.Unlock()
+		return f.Sync()
+	}
+	t.Cleanup(func() { syncFile = oldSyncFile })
+	takeSynced := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		s := synced
+		synced = nil
+		return s
+	}
+
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.addShare(remote1, share12, drive.PermissionReadWrite, func(sh *drive.Share) { sh.Fsync = true })
+	dir12 := s.remotes[remote1].shares[share12].Path
+	if err := os.Mkdir(filepath.Join(dir12, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s.writeFile("writing to share without fsync should succeed", remote1, share11, file111, "hello", true)
+	s.renameFile("moving in share without fsync should succeed", remote1, share11, file111, share11, file112, true)
+	if got := takeSynced(); len(got) > 0 {
+		t.Errorf("share without fsync synced %q", got)
+	}
+
+	s.writeFile("writing to share with fsync should succeed", remote1, share12, file111, "hello", true)
+	if got := takeSynced(); !slices.Contains(got, filepath.Join(dir12, file111)) {
+		t.Errorf("PUT didn't sync file; synced %q", got)
+	} else if runtime.GOOS != "windows" && !slices.Contains(got, dir12) {
+		t.Errorf("PUT didn't sync parent directory; synced %q", got)
+	}
+
+	s.renameFile("moving in share with fsync should succeed", remote1, share12, file111, share12, "sub/"+file112, true)
+	if runtime.GOOS != "windows" {
+		got := takeSynced()
+		for _, want := range []string{filepath.Join(dir12, "sub"), dir12} {
+			if !slices.Contains(got, want) {
+				t.Errorf("MOVE didn't sync %q; synced %q", want, got)
+			}
+		}
+	}
+	if got := s.readViaWebDAV(remote1, share12, "sub/"+file112); got != "hello" {
+		t.Errorf("reading moved file got %q, want %q", got, "hello")
+	}
+}
+
+// TestRangedPut verifies that a file can be uploaded in several ranges with
+// Content-Range, and is only written once the last range has been received.
+func TestRangedPut(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+
+	if status, offset := s.putRange(remote1, share11, file111, "up1", "bytes 0-6/13", "hello, "); status != http.StatusAccepted || offset != "7" {
+		t.Fatalf("first range: got status %d and offset %q, want %d and %q", status, offset, http.StatusAccepted, "7")
+	}
+	if _, err := os.Stat(filepath.Join(s.remotes[remote1].shares[share11].Path, file111)); !os.IsNotExist(err) {
+		t.Fatalf("file exists before last range was received: %v", err)
+	}
+	if status, _ := s.putRange(remote1, share11, file111, "up1", "bytes 7-12/13", "world!"); status != http.StatusCreated {
+		t.Fatalf("last range: got status %d, want %d", status, http.StatusCreated)
+	}
+	if got, want := s.read(remote1, share11, file111), "hello, world!"; got != want {
+		t.Errorf("got contents %q, want %q", got, want)
+	}
+	entries, err := os.ReadDir(s.remotes[remote1].tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("staging file %q left behind", e.Name())
+	}
+}
+
+// TestRangedPutRejectsGapsAndOverlaps verifies that ranges that don't start
+// exactly where the upload left off are rejected, reporting the offset to
+// resume from, without disturbing the upload.
+func TestRangedPutRejectsGapsAndOverlaps(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+
+	tests := []struct {
+		name       string
+		id         string
+		rng        string
+		body       string
+		wantStatus int
+		wantOffset string
+	}{
+		{name: "first", id: "up1", rng: "bytes 0-4/10", body: "01234", wantStatus: http.StatusAccepted, wantOffset: "5"},
+		{name: "gap", id: "up1", rng: "bytes 6-9/10", body: "6789", wantStatus: http.StatusConflict, wantOffset: "5"},
+		{name: "overlap", id: "up1", rng: "bytes 3-9/10", body: "3456789", wantStatus: http.StatusConflict, wantOffset: "5"},
+		{name: "short body", id: "up1", rng: "bytes 5-9/10", body: "567", wantStatus: http.StatusBadRequest, wantOffset: "5"},
+		{name: "no upload ID", rng: "bytes 5-9/10", body: "56789", wantStatus: http.StatusBadRequest},
+		{name: "other upload ID", id: "up2", rng: "bytes 5-9/10", body: "56789", wantStatus: http.StatusConflict, wantOffset: "0"},
+		{name: "unknown length", id: "up1", rng: "bytes 5-9/*", body: "56789", wantStatus: http.StatusBadRequest},
+		{name: "rest", id: "up1", rng: "bytes 5-9/10", body: "56789", wantStatus: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		status, offset := s.putRange(remote1, share11, file111, tt.id, tt.rng, tt.body)
+		if status != tt.wantStatus || offset != tt.wantOffset {
+			t.Fatalf("%s: got status %d and offset %q, want %d and %q", tt.name, status, offset, tt.wantStatus, tt.wantOffset)
+		}
+	}
+	if got, want := s.read(remote1, share11, file111), "0123456789"; got != want {
+		t.Errorf("got contents %q, want %q", got, want)
+	}
+}
+
+// TestRangedPutChecksUploadUpFront verifies that the first range of an upload
+// is refused if the file couldn't be written once all of it has been
+// received, and that the number of staged uploads is limited.
+func TestRangedPutChecksUploadUpFront(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite, func(sh *drive.Share) { sh.HideDotfiles = opt.NewBool(true) })
+	s.addShare(remote1, share12, drive.PermissionReadWrite, func(sh *drive.Share) { sh.Quota = 10 })
+	if err := s.client.Mkdir(pathTo(remote1, share11, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		share      string
+		file       string
+		rng        string
+		body       string
+		wantStatus int
+	}{
+		{name: "missing parent", share: share11, file: "nodir/" + file111, rng: "bytes 0-4/10", body: "01234", wantStatus: http.StatusConflict},
+		{name: "hidden dotfile", share: share11, file: ".hidden", rng: "bytes 0-4/10", body: "01234", wantStatus: http.StatusNotFound},
+		{name: "collection", share: share11, file: "dir", rng: "bytes 0-4/10", body: "01234", wantStatus: http.StatusMethodNotAllowed},
+		{name: "over quota", share: share12, file: file111, rng: "bytes 0-4/11", body: "01234", wantStatus: http.StatusInsufficientStorage},
+		{name: "within quota", share: share12, file: file111, rng: "bytes 0-4/10", body: "01234", wantStatus: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		if status, _ := s.putRange(remote1, tt.share, tt.file, "up1", tt.rng, tt.body); status != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+
+	tempDir := s.remotes[remote1].tempDir
+	for i := range maxStagedUploads {
+		if err := os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%supload-%d", DefaultTempFilePrefix, i)), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status, _ := s.putRange(remote1, share11, file111, "up2", "bytes 0-4/10", "01234"); status != http.StatusServiceUnavailable {
+		t.Errorf("too many uploads: got status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	// Uploads already under way can still be finished.
+	if status, _ := s.putRange(remote1, share12, file111, "up1", "bytes 5-9/10", "56789"); status != http.StatusCreated {
+		t.Errorf("last range: got status %d, want %d", status, http.StatusCreated)
+	}
+}
+
+// countingReader produces size bytes of generated content without ever
+// holding more than one read's worth of it, counting the bytes read.
+type countingReader struct {
+	size int64
+	n    int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.n >= r.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), r.size-r.n)]
+	for i := range p {
+		p[i] = byte(r.n + int64(i))
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+// TestLargePutStreams verifies that uploading a file streams it to disk
+// rather than buffering it in memory, by checking that a PUT allocates far
+// less than the size of the file on its way through the local and remote
+// file systems and the file server.
+func TestLargePutStreams(t *testing.T) {
+	const size = 64 << 20
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+
+	body := &countingReader{size: size}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s%s", s.local.ln.Addr(), shared.JoinEscaped(domain, remote1, share11, file111)), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = size
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	runtime.ReadMemStats(&after)
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if body.n != size {
+		t.Errorf("read %d bytes of body, want %d", body.n, size)
+	}
+	if fi := s.stat(remote1, share11, file111); fi.Size() != size {
+		t.Errorf("got file of %d bytes, want %d", fi.Size(), size)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/8 {
+		t.Errorf("PUT of %d bytes allocated %d bytes, want at most %d", size, alloc, size/8)
+	}
+}
+
+// TestMaxBufferedBody verifies that request bodies, other than those of PUTs,
+// are rejected if they're larger than the configured limit.
+func TestMaxBufferedBody(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.write(remote1, share11, file111, "hello")
+	s.remotes[remote1].fs.SetLimits(0, 0, 1024)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	do := func(method string, body io.Reader, contentLength int64) int {
+		t.Helper()
+		u := fmt.Sprintf("http://%s%s", s.local.ln.Addr(), shared.JoinEscaped(domain, remote1, share11, file111))
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = contentLength
+		req.Header.Set("Depth", "0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	propfind := func(padding int) string {
+		return `<?xml version="1.0" encoding="utf-8" ?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/>` + strings.Repeat(" ", padding) + `</D:prop></D:propfind>`
+	}
+
+	small := propfind(0)
+	if got := do("PROPFIND", strings.NewReader(small), int64(len(small))); got != http.StatusMultiStatus {
+		t.Errorf("small PROPFIND: got status %d, want %d", got, http.StatusMultiStatus)
+	}
+	large := propfind(2048)
+	if got := do("PROPFIND", strings.NewReader(large), int64(len(large))); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("large PROPFIND: got status %d, want %d", got, http.StatusRequestEntityTooLarge)
+	}
+	if got := do("PROPFIND", io.MultiReader(strings.NewReader(small)), -1); got != http.StatusMultiStatus {
+		t.Errorf("small PROPFIND of unknown length: got status %d, want %d", got, http.StatusMultiStatus)
+	}
+	if got := do("PROPFIND", io.MultiReader(strings.NewReader(large)), -1); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("large PROPFIND of unknown length: got status %d, want %d", got, http.StatusRequestEntityTooLarge)
+	}
+	if got := do("PUT", &countingReader{size: 4096}, 4096); got != http.StatusCreated {
+		t.Errorf("PUT larger than limit: got status %d, want %d", got, http.StatusCreated)
+	}
+}
+
+// TestProgressHook verifies that the progress of uploading and downloading a
+// large file is reported to the progress hook.
+func TestProgressHook(t *testing.T) {
+	type progress struct {
+		share, path        string
+		transferred, total int64
+	}
+	var mu sync.Mutex
+	var got []progress
+	takeProgress := func() []progress {
+		mu.Lock()
+		defer mu.Unlock()
+		p := got
+		got = nil
+		return p
+	}
+
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.remotes[remote1].fs.SetProgressHook(func(share, path string, transferred, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, progress{share, path, transferred, total})
+	})
+
+	const size = 3*progressBytes + 1234
+	contents := strings.Repeat("x", size)
+	check := func(op string) {
+		t.Helper()
+		ps := takeProgress()
+		if len(ps) < 3 {
+			t.Fatalf("%s: got %d progress reports, want at least 3: %v", op, len(ps), ps)
+		}
+		var last int64
+		for _, p := range ps {
+			if p.share != share11 || p.path != "/"+file111 {
+				t.Errorf("%s: progress reported for %q in %q, want %q in %q", op, p.path, p.share, "/"+file111, share11)
+			}
+			if p.total != size {
+				t.Errorf("%s: got total %d, want %d", op, p.total, size)
+			}
+			if p.transferred <= last {
+				t.Errorf("%s: transferred went from %d to %d, want it to increase", op, last, p.transferred)
+			}
+			last = p.transferred
+		}
+		if last != size {
+			t.Errorf("%s: last report has %d bytes transferred, want %d", op, last, size)
+		}
+	}
+
+	// Use plain requests rather than the WebDAV client, which may repeat
+	// its first request.
+	u := fmt.Sprintf("http://%s%s", s.local.ln.Addr(), shared.JoinEscaped(domain, remote1, share11, file111))
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	do := func(method string, body io.Reader, wantStatus int) []byte {
+		t.Helper()
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s got status %d, want %d", method, resp.StatusCode, wantStatus)
+		}
+		return b
+	}
+
+	do("PUT", strings.NewReader(contents), http.StatusCreated)
+	check("PUT")
+	if string(do("GET", nil, http.StatusOK)) != contents {
+		t.Fatal("downloaded file doesn't match")
+	}
+	check("GET")
+
+	s.checkDirList("listing a directory should not report progress", pathTo(remote1, share11, ""), file111)
+	if ps := takeProgress(); len(ps) > 0 {
+		t.Errorf("PROPFIND reported progress %v", ps)
+	}
+}
+
+// TestActiveTransfers verifies that GETs and PUTs of files are listed by
+// ActiveTransfers while they're in progress, and only then.
+func TestActiveTransfers(t *testing.T) {
+	const principal = "amelie@example.com (laptop)"
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	r := s.remotes[remote1]
+	r.principal = principal
+
+	u := fmt.Sprintf("http://%s%s", s.local.ln.Addr(), shared.JoinEscaped(domain, remote1, share11, file111))
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	awaitTransfer := func(direction drive.TransferDirection, minTransferred int64) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			ts := r.fs.ActiveTransfers()
+			if len(ts) != 1 {
+				return fmt.Errorf("got %d active transfers, want 1: %+v", len(ts), ts)
+			}
+			ti := ts[0]
+			if ti.Share != share11 || ti.Path != "/"+file111 || ti.Direction != direction || ti.Principal != principal {
+				return fmt.Errorf("got transfer %+v, want %s of %q in %q by %q", ti, direction, "/"+file111, share11, principal)
+			}
+			if ti.Transferred < minTransferred {
+				return fmt.Errorf("got %d bytes transferred, want at least %d", ti.Transferred, minTransferred)
+			}
+			if ti.Started.IsZero() {
+				return errors.New("transfer has no start time")
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	awaitNoTransfers := func() {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			if ts := r.fs.ActiveTransfers(); len(ts) > 0 {
+				return fmt.Errorf("got active transfers %+v, want none", ts)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Upload a file whose body only arrives when we write it.
+	const part = "hello, "
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", u, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putDone := make(chan error, 1)
+	go func() {
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				err = fmt.Errorf("PUT got status %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+		}
+		putDone <- err
+	}()
+	if _, err := io.WriteString(pw, part); err != nil {
+		t.Fatal(err)
+	}
+	awaitTransfer(drive.TransferUpload, int64(len(part)))
+	io.WriteString(pw, "world")
+	pw.Close()
+	if err := <-putDone; err != nil {
+		t.Fatal(err)
+	}
+	awaitNoTransfers()
+
+	// Download a file too large to fit in the connection's buffers, and
+	// stop reading it partway.
+	const size = 32 << 20
+	s.write(remote1, share11, file111, strings.Repeat("x", size))
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1<<10)); err != nil {
+		t.Fatal(err)
+	}
+	awaitTransfer(drive.TransferDownload, 1<<10)
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n+1<<10 != size {
+		t.Fatalf("downloaded %d bytes, want %d", n+1<<10, size)
+	}
+	awaitNoTransfers()
+}
+
+// TestCloseContext verifies that CloseContext waits for requests in flight to
+// complete, while rejecting new ones, unless its context is done first.
+func TestCloseContext(t *testing.T) {
+	s := newSystem(t)
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.addRemote(remote2)
+	s.addShare(remote2, share12, drive.PermissionReadWrite)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	// startPut starts uploading a file of the given length to the given
+	// remote, directly rather than through the local file system, and
+	// returns once the remote has started writing it. The rest of the
+	// upload has to be written to the returned pipe.
+	startPut := func(remoteName, shareName, first string, length int64) (*io.PipeWriter, chan *http.Response) {
+		t.Helper()
+		r := s.remotes[remoteName]
+		pr, pw := io.Pipe()
+		u := fmt.Sprintf("http://%s%s", r.ln.Addr(), shared.JoinEscaped(shareName, file111))
+		req, err := http.NewRequest("PUT", u, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = length
+		resc := make(chan *http.Response, 1)
+		go func() {
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Logf("PUT: %v", err)
+				resc <- nil
+				return
+			}
+			resp.Body.Close()
+			resc <- resp
+		}()
+		if _, err := pw.Write([]byte(first)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			_, err := os.Stat(filepath.Join(r.shares[shareName].Path, file111))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return pw, resc
+	}
+	statusOf := func(remoteName, shareName string) int {
+		t.Helper()
+		u := fmt.Sprintf("http://%s%s", s.remotes[remoteName].ln.Addr(), shared.JoinEscaped(shareName))
+		req, err := http.NewRequest("PROPFIND", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("waits", func(t *testing.T) {
+		pw, resc := startPut(remote1, share11, "hello ", 11)
+		closed := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			closed <- s.remotes[remote1].fs.CloseContext(ctx)
+		}()
+
+		// Once new requests are rejected, CloseContext is waiting.
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			if got := statusOf(remote1, share11); got != http.StatusServiceUnavailable {
+				return fmt.Errorf("got status %d, want %d", got, http.StatusServiceUnavailable)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-closed:
+			t.Fatalf("CloseContext returned %v while a request was in flight", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		pw.Write([]byte("world"))
+		pw.Close()
+		if resp := <-resc; resp == nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT got response %v, want status %d", resp, http.StatusCreated)
+		}
+		if err := <-closed; err != nil {
+			t.Fatalf("CloseContext: %v", err)
+		}
+		if got := s.read(remote1, share11, file111); got != "hello world" {
+			t.Errorf("uploaded file has %q, want %q", got, "hello world")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		pw, resc := startPut(remote2, share12, "hello ", 11)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := s.remotes[remote2].fs.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CloseContext returned %v, want %v", err, context.DeadlineExceeded)
+		}
+		pw.CloseWithError(errors.New("abandoned"))
+		<-resc
+	})
+}
+
+// TestHealthy verifies that Healthy reports shares that can't be served,
+// such as before the file server's address is known, or when the user server
+// for a share stopped or was never started.
+func TestHealthy(t *testing.T) {
+	t.Run("file server", func(t *testing.T) {
+		fs := NewFileSystemForRemote(log.Printf)
+		defer fs.Close()
+		fs.SetShares([]*drive.Share{{Name: "a", Path: t.TempDir()}})
+
+		healthy, errs := fs.Healthy()
+		if healthy || len(errs) != 1 {
+			t.Fatalf("Healthy() = %v, %v; want false with 1 error", healthy, errs)
+		}
+		fs.SetFileServerAddr("token|127.0.0.1:1234")
+		if healthy, errs := fs.Healthy(); !healthy || len(errs) != 0 {
+			t.Fatalf("Healthy() = %v, %v; want true with no errors", healthy, errs)
+		}
+	})
+
+	t.Run("user servers", func(t *testing.T) {
+		drive.DisallowShareAs = false
+		defer func() { drive.DisallowShareAs = true }()
+		if !drive.AllowShareAs() {
+			t.Skip("sharing as a specific user is not supported on this platform")
+		}
+
+		running := &userServer{username: "alice", tokenAndAddr: "token|127.0.0.1:1234"}
+		failed := &userServer{username: "bob"}
+		failed.setStopped(errors.New("start: exec: no such file"))
+		fs := NewFileSystemForRemote(log.Printf)
+		defer fs.Close()
+		fs.shares = []*drive.Share{
+			{Name: "a", As: "alice"},
+			{Name: "b", As: "bob"},
+			{Name: "c", As: "carol"},
+		}
+		fs.userServers = map[string]*userServer{
+			"alice": running,
+			"bob":   failed,
+		}
+
+		healthy, errs := fs.Healthy()
+		if healthy {
+			t.Fatal("Healthy() = true; want false")
+		}
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		want := []string{
+			`share "b" is unavailable: file server for user "bob" stopped: start: exec: no such file`,
+			`share "c" is unavailable: no file server for user "carol"`,
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Healthy() errors mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// TestShareEnabled verifies that shares disabled with SetShareEnabled can't be
+// accessed and have no user servers running for them, and that they work as
+// before, with the same permissions, once reenabled.
+func TestShareEnabled(t *testing.T) {
+	t.Run("file server", func(t *testing.T) {
+		s := newSystem(t)
+
+		s.addRemote(remote1)
+		s.addShare(remote1, share11, drive.PermissionReadOnly)
+		s.addShare(remote1, share12, drive.PermissionReadWrite)
+		s.write(remote1, share11, file111, "hello world")
+		fs := s.remotes[remote1].fs
+
+		client := &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		getStatus := func() int {
+			t.Helper()
+			resp, err := client.Get(fmt.Sprintf("http://%s/%s/%s/%s/%s",
+				s.local.ln.Addr(),
+				url.PathEscape(domain),
+				url.PathEscape(remote1),
+				url.PathEscape(share11),
+				url.PathEscape(file111)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		fs.SetShareEnabled(share11, false)
+		if got, want := getStatus(), http.StatusServiceUnavailable; got != want {
+			t.Errorf("GET from disabled share: got status %d, want %d", got, want)
+		}
+		s.checkDirList("disabled share should not be listed", shared.Join(domain, remote1), share12)
+		if healthy, errs := fs.Healthy(); !healthy {
+			t.Errorf("Healthy() with disabled share = false, %v; want true", errs)
+		}
+
+		// Disabled shares stay disabled when shares are set again.
+		fs.SetShares(s.remotes[remote1].shareList)
+		if got, want := getStatus(), http.StatusServiceUnavailable; got != want {
+			t.Errorf("GET from disabled share after SetShares: got status %d, want %d", got, want)
+		}
+
+		fs.SetShareEnabled(share11, true)
+		if got := s.readViaWebDAV(remote1, share11, file111); got != "hello world" {
+			t.Errorf("reading from reenabled share got %q, want %q", got, "hello world")
+		}
+		s.writeFile("writing to reenabled read-only share should fail", remote1, share11, file112, "hello world", false)
+	})
+
+	t.Run("user servers", func(t *testing.T) {
+		drive.DisallowShareAs = false
+		defer func() { drive.DisallowShareAs = true }()
+		if !drive.AllowShareAs() {
+			t.Skip("sharing as a specific user is not supported on this platform")
+		}
+
+		fs := NewFileSystemForRemote(log.Printf)
+		defer fs.Close()
+		fs.SetShares([]*drive.Share{
+			{Name: "a", Path: t.TempDir(), As: "alice"},
+			{Name: "b", Path: t.TempDir(), As: "bob"},
+		})
+		userServer := func(username string) *userServer {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			return fs.userServers[username]
+		}
+		bob := userServer("bob")
+		if bob == nil {
+			t.Fatal("no user server for bob")
+		}
+
+		fs.SetShareEnabled("b", false)
+		if userServer("bob") != nil {
+			t.Error("user server for bob running with his only share disabled")
+		}
+		bob.mu.RLock()
+		closed := bob.closed
+		bob.mu.RUnlock()
+		if !closed {
+			t.Error("user server for bob not stopped when his only share was disabled")
+		}
+		if userServer("alice") == nil {
+			t.Error("no user server for alice, whose share is enabled")
+		}
+
+		fs.SetShareEnabled("b", true)
+		if userServer("bob") == nil {
+			t.Error("no user server for bob after reenabling their share")
+		}
+	})
+}
+
+// TestUserServerStartupTimeout verifies that a user server whose file server
+// doesn't report its address within the configured startup timeout is given
+// up on, and that this is reported as unhealthy.
+func TestUserServerStartupTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("user servers are not supported on Windows")
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake file server that hangs without ever printing its address.
+	executable := filepath.Join(t.TempDir(), "hung-tailscaled")
+	if err := os.WriteFile(executable, []byte("#!/bin/sh\nexec sleep 5\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := make(chan string, 100)
+	s := &userServer{
+		logf: func(format string, args ...any) {
+			select {
+			case logged <- fmt.Sprintf(format, args...):
+			default:
+			}
+		},
+		shares:         []*drive.Share{{Name: "a", Path: t.TempDir()}},
+		username:       u.Username,
+		executable:     executable,
+		startupTimeout: 100 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runLoop()
+	}()
+	defer func() {
+		s.Close()
+		<-done
+	}()
+
+	const want = "no address from file server after 100ms"
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line := <-logged:
+			if !strings.Contains(line, want) {
+				continue
+			}
+			if err := s.health(); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("health() = %v; want error containing %q", err, want)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for log line containing %q", want)
+		}
+	}
+}
+
+// TestOPTIONS verifies that OPTIONS responses advertise only the methods and
+// DAV compliance classes that are actually available in each share.
+func TestOPTIONS(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.addShare(remote1, share12, drive.PermissionReadOnly)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	tests := []struct {
+		name      string
+		share     string
+		wantDAV   string
+		wantAllow []string
+	}{
+		{
+			name:      "read-write",
+			share:     share11,
+			wantDAV:   "1, 2",
+			wantAllow: readWriteMethods,
+		},
+		{
+			name:      "read-only",
+			share:     share12,
+			wantDAV:   "1",
+			wantAllow: readMethods,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := fmt.Sprintf("http://%s/%s/%s/%s",
+				s.local.ln.Addr(),
+				url.PathEscape(domain),
+				url.PathEscape(remote1),
+				url.PathEscape(tt.share))
+			req, err := http.NewRequest("OPTIONS", u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if got := resp.Header.Get("DAV"); got != tt.wantDAV {
+				t.Errorf("DAV = %q, want %q", got, tt.wantDAV)
+			}
+			allow := strings.Split(resp.Header.Get("Allow"), ", ")
+			if !slices.Equal(allow, tt.wantAllow) {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+		})
+	}
+}
+
+// TestOverwrite verifies that COPY and MOVE honor the Overwrite header when
+// the destination already exists.
+func TestOverwrite(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	urlTo := func(name string) string {
+		return fmt.Sprintf("http://%s/%s/%s/%s/%s",
+			s.local.ln.Addr(),
+			url.PathEscape(domain),
+			url.PathEscape(remote1),
+			url.PathEscape(share11),
+			url.PathEscape(name))
+	}
+
+	tests := []struct {
+		method     string
+		overwrite  string // empty means no Overwrite header
+		destExists bool
+		wantStatus int
+	}{
+		{"COPY", "F", true, http.StatusPreconditionFailed},
+		{"COPY", "T", true, http.StatusNoContent},
+		{"COPY", "", true, http.StatusNoContent},
+		{"COPY", "F", false, http.StatusCreated},
+		{"COPY", "X", true, http.StatusBadRequest},
+		{"MOVE", "F", true, http.StatusPreconditionFailed},
+		{"MOVE", "T", true, http.StatusNoContent},
+		{"MOVE", "", true, http.StatusNoContent},
+		{"MOVE", "F", false, http.StatusCreated},
+		{"MOVE", "T", false, http.StatusCreated},
+		{"MOVE", "X", true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s-overwrite=%q-exists=%v", tt.method, tt.overwrite, tt.destExists)
+		t.Run(name, func(t *testing.T) {
+			os.Remove(filepath.Join(s.remotes[remote1].shares[share11].Path, file112))
+			s.write(remote1, share11, file111, "src")
+			if tt.destExists {
+				s.write(remote1, share11, file112, "dst")
+			}
+
+			req, err := http.NewRequest(tt.method, urlTo(file111), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Destination", urlTo(file112))
+			if tt.overwrite != "" {
+				req.Header.Set("Overwrite", tt.overwrite)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			var wantDest string
+			switch {
+			case resp.StatusCode < 400:
+				wantDest = "src"
+			case tt.destExists:
+				wantDest = "dst" // untouched
+			default:
+				return
+			}
+			if got := s.read(remote1, share11, file112); got != wantDest {
+				t.Errorf("destination contents = %q, want %q", got, wantDest)
+			}
+		})
+	}
+}
+
+// TestConditionalPUT verifies that PUT honors If-Match and If-None-Match, so
+// that clients can avoid overwriting each other's changes.
+func TestConditionalPUT(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	urlTo := func(name string) string {
+		return fmt.Sprintf("http://%s/%s/%s/%s/%s",
+			s.local.ln.Addr(),
+			url.PathEscape(domain),
+			url.PathEscape(remote1),
+			url.PathEscape(share11),
+			url.PathEscape(name))
+	}
+	do := func(method, name string, header http.Header, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, urlTo(name), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		maps.Copy(req.Header, header)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	etagOf := func(name string) string {
+		t.Helper()
+		resp := do("GET", name, nil, "")
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Fatalf("no ETag for %s", name)
+		}
+		return etag
+	}
+
+	s.write(remote1, share11, file111, "v1")
+	stale := etagOf(file111)
+	// Change the file's size so that its ETag differs even if its
+	// modification time doesn't.
+	s.write(remote1, share11, file111, "v2 by someone else")
+	current := etagOf(file111)
+	if stale == current {
+		t.Fatalf("ETag didn't change: %s", current)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		header     http.Header
+		wantStatus int
+		want       string // contents of file after the PUT
+	}{
+		{
+			name:       "stale If-Match",
+			file:       file111,
+			header:     http.Header{"If-Match": {stale}},
+			wantStatus: http.StatusPreconditionFailed,
+			want:       "v2 by someone else",
+		},
+		{
+			name:       "If-Match of missing file",
+			file:       file112,
+			header:     http.Header{"If-Match": {"*"}},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "create-only onto existing file",
+			file:       file111,
+			header:     http.Header{"If-None-Match": {"*"}},
+			wantStatus: http.StatusPreconditionFailed,
+			want:       "v2 by someone else",
+		},
+		{
+			name:       "matching If-Match",
+			file:       file111,
+			header:     http.Header{"If-Match": {`"other", ` + current}},
+			wantStatus: http.StatusCreated,
+			want:       "v3",
+		},
+		{
+			name:       "create-only",
+			file:       file112,
+			header:     http.Header{"If-None-Match": {"*"}},
+			wantStatus: http.StatusCreated,
+			want:       "v3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := do("PUT", tt.file, tt.header, "v3")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.want == "" {
+				if _, err := os.Stat(filepath.Join(s.remotes[remote1].shares[share11].Path, tt.file)); !os.IsNotExist(err) {
+					t.Errorf("file exists after failed PUT: %v", err)
+				}
+				return
+			}
+			if got := s.read(remote1, share11, tt.file); got != tt.want {
+				t.Errorf("contents = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMKCOL verifies that MKCOL creates collections and fails with the status
+// codes and explanations from RFC 4918 when it can't.
+func TestMKCOL(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	urlTo := func(name string) string {
+		return fmt.Sprintf("http://%s/%s/%s/%s/%s",
+			s.local.ln.Addr(),
+			url.PathEscape(domain),
+			url.PathEscape(remote1),
+			url.PathEscape(share11),
+			name)
+	}
+
+	// These run in order, as later cases depend on earlier ones.
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"create", "newdir", http.StatusCreated},
+		{"create-nested", "newdir/child", http.StatusCreated},
+		{"existing-dir", "newdir", http.StatusMethodNotAllowed},
+		{"missing-parent", "nodir/child", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("MKCOL", urlTo(tt.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d; body: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if want, ok := mkcolErrors[tt.wantStatus]; ok && !strings.Contains(string(body), want) {
+				t.Errorf("got body %q, want it to contain %q", body, want)
+			}
+
+			fi, err := os.Stat(filepath.Join(s.remotes[remote1].shares[share11].Path, tt.path))
+			switch {
+			case tt.wantStatus == http.StatusConflict:
+				if !os.IsNotExist(err) {
+					t.Errorf("stat after failed MKCOL: %v, want not exist", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case !fi.IsDir():
+				t.Errorf("%s is not a directory", tt.path)
+			}
+		})
+	}
+}
+
+// TestDeadProperties verifies that properties set with PROPPATCH are returned
+// by PROPFIND, follow their files when moved, and survive restarts of the
+// file server, and that the file they're kept in can't be reached by clients
+// and is ignored when it's corrupt.
+func TestDeadProperties(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.write(remote1, share11, file111, "hello")
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	urlTo := func(name string) string {
+		return fmt.Sprintf("http://%s/%s/%s/%s/%s",
+			s.local.ln.Addr(),
+			url.PathEscape(domain),
+			url.PathEscape(remote1),
+			url.PathEscape(share11),
+			url.PathEscape(name))
+	}
+	do := func(method, name, body string, header ...string) string {
+		t.Helper()
+		req, err := http.NewRequest(method, urlTo(name), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode >= 300 {
+			t.Fatalf("%s %s: got status %d; body: %s", method, name, resp.StatusCode, b)
+		}
+		return string(b)
+	}
+	setColor := func(name, color string) {
+		t.Helper()
+		op := `<D:set><D:prop><Z:color>` + color + `</Z:color></D:prop></D:set>`
+		if color == "" {
+			op = `<D:remove><D:prop><Z:color/></D:prop></D:remove>`
+		}
+		got := do("PROPPATCH", name, `<?xml version="1.0" encoding="utf-8" ?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="http://example.com/ns">`+op+`</D:propertyupdate>`)
+		if !strings.Contains(got, "200 OK") {
+			t.Fatalf("PROPPATCH %s didn't succeed: %s", name, got)
+		}
+	}
+	// checkColor checks the color property of the named file, where the
+	// empty string means that it's not set.
+	checkColor := func(label, name, want string) {
+		t.Helper()
+		got := do("PROPFIND", name, `<?xml version="1.0" encoding="utf-8" ?>
+<D:propfind xmlns:D="DAV:" xmlns:Z="http://example.com/ns"><D:prop><Z:color/></D:prop></D:propfind>`, "Depth", "0")
+		if want == "" {
+			if !strings.Contains(got, "404 Not Found") {
+				t.Errorf("%s: color of %s is set, want unset: %s", label, name, got)
+			}
+			return
+		}
+		if !strings.Contains(got, ">"+want+"</") || !strings.Contains(got, "200 OK") {
+			t.Errorf("%s: color of %s isn't %q: %s", label, name, want, got)
+		}
+	}
+
+	checkColor("initially", file111, "")
+	setColor(file111, "blue")
+	checkColor("after PROPPATCH", file111, "blue")
+
+	do("MOVE", file111, "", "Destination", urlTo(file112))
+	checkColor("after MOVE", file112, "blue")
+	s.write(remote1, share11, file111, "hello again")
+	checkColor("new file at old name", file111, "")
+
+	s.restartFileServer(remote1)
+	checkColor("after restart", file112, "blue")
+
+	s.checkDirList("properties file should be hidden", shared.Join(domain, remote1, share11), file112, file111)
+
+	// The properties file can't be reached with a different case either, as
+	// it would be on case-insensitive file systems.
+	for _, method := range []string{"PUT", "DELETE"} {
+		req, err := http.NewRequest(method, urlTo(strings.ToUpper(propsFileName)), strings.NewReader("garbage"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			t.Errorf("%s of properties file with a different case succeeded: %s", method, resp.Status)
+		}
+	}
+
+	setColor(file112, "")
+	checkColor("after removal", file112, "")
+
+	// A corrupt properties file is treated as empty.
+	setColor(file111, "red")
+	propsFile := filepath.Join(s.remotes[remote1].shares[share11].Path, propsFileName)
+	if err := os.WriteFile(propsFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.restartFileServer(remote1)
+	checkColor("after corruption", file111, "")
+	setColor(file111, "green")
+	checkColor("after corruption", file111, "green")
+}
+
+// TestQuotaProperties verifies that PROPFIND reports the quota properties of
+// RFC 4331 when asked for them, based on the share's quota if it has one and
+// on the free disk space otherwise, and that they can't be changed.
+func TestQuotaProperties(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.addShare(remote1, share12, drive.PermissionReadWrite, func(sh *drive.Share) { sh.Quota = 1000 })
+	for _, share := range []string{share11, share12} {
+		if err := os.Mkdir(filepath.Join(s.remotes[remote1].shares[share].Path, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.write(remote1, share11, file111, "hello")
+	s.write(remote1, share12, file111, "hello")
+	s.write(remote1, share12, "sub/"+file112, "0123456789")
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	do := func(method, share, name, body string) string {
+		t.Helper()
+		u := fmt.Sprintf("http://%s%s", s.local.ln.Addr(), shared.JoinEscaped(domain, remote1, share, name))
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Depth", "0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusMultiStatus {
+			t.Fatalf("%s %s: got status %d, want %d; body: %s", method, share, resp.StatusCode, http.StatusMultiStatus, b)
+		}
+		return string(b)
+	}
+	quotaRx := regexp.MustCompile(`<(?:\w+:)?(quota-(?:available|used)-bytes)[^>]*>(\d+)<`)
+	// quota returns the quota properties that PROPFIND reports for the
+	// directory "sub" of share, keyed by their local names. (The roots of
+	// shares are served by compositedav rather than by the file server.)
+	quota := func(share string) map[string]int64 {
+		t.Helper()
+		got := do("PROPFIND", share, "sub", `<?xml version="1.0" encoding="utf-8" ?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`)
+		props := make(map[string]int64)
+		for _, m := range quotaRx.FindAllStringSubmatch(got, -1) {
+			n, err := strconv.ParseInt(m[2], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			props[m[1]] = n
+		}
+		return props
+	}
+
+	if got, want := quota(share12), map[string]int64{"quota-used-bytes": 15, "quota-available-bytes": 985}; !maps.Equal(got, want) {
+		t.Errorf("share with quota: got %v, want %v", got, want)
+	}
+	s.write(remote1, share12, file112, strings.Repeat("x", 1000))
+	if got, want := quota(share12), map[string]int64{"quota-used-bytes": 1015, "quota-available-bytes": 0}; !maps.Equal(got, want) {
+		t.Errorf("share over quota: got %v, want %v", got, want)
+	}
+
+	got := quota(share11)
+	if got["quota-used-bytes"] != 5 {
+		t.Errorf("share without quota: got %d bytes used, want 5", got["quota-used-bytes"])
+	}
+	if _, err := diskFree(s.remotes[remote1].shares[share11].Path); err == nil {
+		if avail, ok := got["quota-available-bytes"]; !ok || avail <= 0 {
+			t.Errorf("share without quota: got %v, want the free disk space available", got)
+		}
+	}
+
+	if allprop := do("PROPFIND", share12, "sub", ""); strings.Contains(allprop, "quota-") {
+		t.Errorf("allprop PROPFIND included quota properties: %s", allprop)
+	}
+
+	patched := do("PROPPATCH", share12, file111, `<?xml version="1.0" encoding="utf-8" ?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:quota-available-bytes>1</D:quota-available-bytes></D:prop></D:set></D:propertyupdate>`)
+	if !strings.Contains(patched, "403 Forbidden") || !strings.Contains(patched, "cannot-modify-protected-property") {
+		t.Errorf("PROPPATCH of quota property wasn't forbidden: %s", patched)
+	}
+}
+
 // TestMissingPaths verifies that the fileserver running at localhost
 // correctly handles paths with missing required components.
 //
@@ -354,6 +2317,259 @@ func TestLOCK(t *testing.T) {
 	}
 }
 
+// TestConditionalDELETE verifies that deleting a locked file, or a directory
+// containing a locked file, requires submitting the lock token in the If
+// header.
+func TestConditionalDELETE(t *testing.T) {
+	const dir = `di r$%11`
+	tests := []struct {
+		name   string
+		locked []string // path components of the locked file within the share
+		target []string // path components of what to delete within the share
+	}{
+		{name: "locked file", locked: []string{file111}, target: []string{file111}},
+		{name: "locked member", locked: []string{dir, file111}, target: []string{dir}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSystem(t)
+
+			s.addRemote(remote1)
+			s.addShare(remote1, share11, drive.PermissionReadWrite)
+			lockedPath := filepath.Join(s.remotes[remote1].shares[share11].Path, filepath.Join(tt.locked...))
+			if err := os.MkdirAll(filepath.Dir(lockedPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			s.write(remote1, share11, filepath.Join(tt.locked...), "hello world")
+
+			client := &http.Client{
+				Transport: &http.Transport{DisableKeepAlives: true},
+			}
+			urlOf := func(name []string) string {
+				return fmt.Sprintf("http://%s%s",
+					s.local.ln.Addr(),
+					shared.JoinEscaped(append([]string{domain, remote1, share11}, name...)...))
+			}
+			do := func(method string, name []string, ifHeader string, body io.Reader) (int, string) {
+				req, err := http.NewRequest(method, urlOf(name), body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ifHeader != "" {
+					req.Header.Set("If", ifHeader)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp.StatusCode, string(b)
+			}
+
+			status, body := do("LOCK", tt.locked, "", strings.NewReader(lockBody))
+			if status != http.StatusOK {
+				t.Fatalf("expected LOCK to succeed, but got status %d", status)
+			}
+			submatches := lockTokenRegex.FindStringSubmatch(body)
+			if len(submatches) != 2 {
+				t.Fatal("failed to find locktoken")
+			}
+			ifHeader := fmt.Sprintf("<%s> (<%s>)", urlOf(tt.locked), submatches[1])
+
+			if status, _ := do("DELETE", tt.target, "", nil); status != http.StatusLocked {
+				t.Fatalf("deleting without lock token should fail with 423, but got %d", status)
+			}
+			if _, err := os.Stat(lockedPath); err != nil {
+				t.Fatalf("locked file should still exist: %v", err)
+			}
+			if status, _ := do("DELETE", tt.target, ifHeader, nil); status != http.StatusNoContent {
+				t.Fatalf("deleting with lock token should have succeeded with 204, but got %d", status)
+			}
+		})
+	}
+}
+
+// undeletableFS is a webdav.FileSystem that refuses to remove one file.
+type undeletableFS struct {
+	webdav.FileSystem
+	name string
+}
+
+func (u *undeletableFS) RemoveAll(ctx context.Context, name string) error {
+	if name == u.name {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return u.FileSystem.RemoveAll(ctx, name)
+}
+
+// TestDELETECollection verifies that deleting a directory deletes its
+// contents, that Depth headers other than infinity are rejected for non-empty
+// directories, and that members that can't be deleted are reported in a 207
+// Multi-Status response.
+func TestDELETECollection(t *testing.T) {
+	const dir = `di r$%11`
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.remotes[remote1].wrapFS[share12] = func(fsys webdav.FileSystem) webdav.FileSystem {
+		return &undeletableFS{FileSystem: fsys, name: "/" + dir + "/sub/" + file112}
+	}
+	s.addShare(remote1, share12, drive.PermissionReadWrite)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	urlOf := func(share string, name ...string) string {
+		return fmt.Sprintf("http://%s%s", s.local.ln.Addr(),
+			shared.JoinEscaped(append([]string{domain, remote1, share}, name...)...))
+	}
+	do := func(method, depth, destination string, share string, name ...string) (int, string) {
+		req, err := http.NewRequest(method, urlOf(share, name...), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth != "" {
+			req.Header.Set("Depth", depth)
+		}
+		if destination != "" {
+			req.Header.Set("Destination", destination)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	root := s.remotes[remote1].shares[share11].Path
+	if err := os.MkdirAll(filepath.Join(root, dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.write(remote1, share11, filepath.Join(dir, file111), "hello")
+	s.write(remote1, share11, filepath.Join(dir, "sub", file112), "world")
+
+	for _, depth := range []string{"0", "1"} {
+		if status, _ := do("DELETE", depth, "", share11, dir); status != http.StatusBadRequest {
+			t.Errorf("DELETE of non-empty directory with Depth: %s got status %d, want %d", depth, status, http.StatusBadRequest)
+		}
+		if status, _ := do("MOVE", depth, urlOf(share11, "moved"), share11, dir); status != http.StatusBadRequest {
+			t.Errorf("MOVE of directory with Depth: %s got status %d, want %d", depth, status, http.StatusBadRequest)
+		}
+	}
+	if status, _ := do("DELETE", "0", "", share11, "empty"); status != http.StatusNoContent {
+		t.Errorf("DELETE of empty directory with Depth: 0 got status %d, want %d", status, http.StatusNoContent)
+	}
+	if status, _ := do("DELETE", "infinity", "", share11, dir); status != http.StatusNoContent {
+		t.Fatalf("DELETE of populated directory got status %d, want %d", status, http.StatusNoContent)
+	}
+	if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+		t.Errorf("deleted directory still exists; Stat error = %v", err)
+	}
+
+	root12 := s.remotes[remote1].shares[share12].Path
+	if err := os.MkdirAll(filepath.Join(root12, dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{file111, filepath.Join("sub", file111), filepath.Join("sub", file112)} {
+		s.write(remote1, share12, filepath.Join(dir, name), "")
+	}
+	status, body := do("DELETE", "", "", share12, dir)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("DELETE of directory with undeletable member got status %d, want %d", status, http.StatusMultiStatus)
+	}
+	// Like the hrefs in PROPFIND responses, the path within the share is
+	// escaped, and the prefix added by compositedav isn't.
+	wantHref := shared.EscapeForXML(shared.Join(domain, remote1, share12)) + shared.JoinEscaped(dir, "sub", file112)
+	want := "<D:response><D:href>" + wantHref + "</D:href><D:status>HTTP/1.1 403 Forbidden</D:status></D:response>"
+	if !strings.Contains(body, want) || strings.Count(body, "<D:response>") != 1 {
+		t.Errorf("DELETE response doesn't report just the undeletable member\ngot:  %s\nwant: %s", body, want)
+	}
+	for _, name := range []string{dir, filepath.Join(dir, "sub"), filepath.Join(dir, "sub", file112)} {
+		if _, err := os.Stat(filepath.Join(root12, name)); err != nil {
+			t.Errorf("%q should remain: %v", name, err)
+		}
+	}
+	for _, name := range []string{filepath.Join(dir, file111), filepath.Join(dir, "sub", file111)} {
+		if _, err := os.Stat(filepath.Join(root12, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%q should have been deleted; Stat error = %v", name, err)
+		}
+	}
+}
+
+func TestLOCKOwner(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.writeFile("writing file to read/write remote should succeed", remote1, share11, file111, "hello world", true)
+	const principal = "alice@example.com (laptop)"
+	s.remotes[remote1].principal = principal
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	u := fmt.Sprintf("http://%s/%s/%s/%s/%s",
+		s.local.ln.Addr(),
+		url.PathEscape(domain),
+		url.PathEscape(remote1),
+		url.PathEscape(share11),
+		url.PathEscape(file111))
+	lock := func(body io.Reader, ifHeader string) string {
+		t.Helper()
+		req, err := http.NewRequest("LOCK", u, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Timeout", "Second-600")
+		if ifHeader != "" {
+			req.Header.Set("If", ifHeader)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected LOCK to succeed, but got status %d: %s", resp.StatusCode, b)
+		}
+		return string(b)
+	}
+	wantOwner := "<D:owner>" + shared.EscapeForXML(principal) + "</D:owner>"
+
+	// The owner claimed by the client is replaced with the principal's name.
+	body := lock(strings.NewReader(strings.Replace(lockBody, "</D:lockinfo>", "<D:owner>mallory</D:owner></D:lockinfo>", 1)), "")
+	if !strings.Contains(body, wantOwner) {
+		t.Fatalf("LOCK response doesn't contain %q: %s", wantOwner, body)
+	}
+
+	// Refreshing the lock keeps its owner.
+	submatches := lockTokenRegex.FindStringSubmatch(body)
+	if len(submatches) != 2 {
+		t.Fatal("failed to find locktoken")
+	}
+	body = lock(nil, fmt.Sprintf("<%s> (<%s>)", u, submatches[1]))
+	if !strings.Contains(body, wantOwner) {
+		t.Fatalf("LOCK refresh response doesn't contain %q: %s", wantOwner, body)
+	}
+}
+
 func TestUNLOCK(t *testing.T) {
 	s := newSystem(t)
 
@@ -434,11 +2650,17 @@ type local struct {
 }
 
 type remote struct {
-	ln          net.Listener
-	fs          *FileSystemForRemote
-	fileServer  *FileServer
-	shares      map[string]string
+	ln         net.Listener
+	fs         *FileSystemForRemote
+	fileServer *FileServer
+	tempDir    string // of fileServer
+	shares     map[string]*drive.Share
+	shareList  []*drive.Share // shares as last set by addShare
+	// wrapFS wraps the file systems of the named shares, for injecting
+	// failures.
+	wrapFS      map[string]func(webdav.FileSystem) webdav.FileSystem
 	permissions map[string]drive.Permission
+	principal   string // if non-empty, passed to drive.WithPrincipalName
 	mu          sync.RWMutex
 }
 
@@ -453,6 +2675,9 @@ func (r *remote) unfreeze() {
 func (r *remote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	if r.principal != "" {
+		req = req.WithContext(drive.WithPrincipalName(req.Context(), r.principal))
+	}
 	r.fs.ServeHTTPWithPerms(r.permissions, w, req)
 }
 
@@ -550,14 +2775,18 @@ func (s *system) addRemote(name string) string {
 	if err != nil {
 		s.t.Fatalf("failed to call NewFileServer: %s", err)
 	}
+	tempDir := s.t.TempDir()
+	fileServer.SetTempFileConfig(TempFileConfig{Dir: tempDir})
 	go fileServer.Serve()
 	s.t.Logf("FileServer for %v listening at %s", name, fileServer.Addr())
 
 	r := &remote{
 		ln:          ln,
 		fileServer:  fileServer,
+		tempDir:     tempDir,
 		fs:          NewFileSystemForRemote(log.Printf),
-		shares:      make(map[string]string),
+		shares:      make(map[string]*drive.Share),
+		wrapFS:      make(map[string]func(webdav.FileSystem) webdav.FileSystem),
 		permissions: make(map[string]drive.Permission),
 	}
 	r.fs.SetFileServerAddr(fileServer.Addr())
@@ -571,26 +2800,74 @@ func (s *system) addRemote(name string) string {
 	return fileServer.Addr()
 }
 
-func (s *system) addShare(remoteName, shareName string, permission drive.Permission) {
+// addShare adds a share in a new temporary directory to the named remote,
+// after applying opts to it, and grants permission to it.
+func (s *system) addShare(remoteName, shareName string, permission drive.Permission, opts ...func(*drive.Share)) {
 	r, ok := s.remotes[remoteName]
 	if !ok {
 		s.t.Fatalf("unknown remote %q", remoteName)
 	}
 
-	f := s.t.TempDir()
-	r.shares[shareName] = f
+	share := &drive.Share{Name: shareName, Path: s.t.TempDir()}
+	for _, opt := range opts {
+		opt(share)
+	}
+	r.shares[shareName] = share
 	r.permissions[shareName] = permission
 
 	shares := make([]*drive.Share, 0, len(r.shares))
-	for shareName, folder := range r.shares {
-		shares = append(shares, &drive.Share{
-			Name: shareName,
-			Path: folder,
-		})
+	for _, share := range r.shares {
+		shares = append(shares, share.Clone())
 	}
 	slices.SortFunc(shares, drive.CompareShares)
 	r.fs.SetShares(shares)
-	r.fileServer.SetShares(r.shares)
+	r.shareList = shares
+	r.setFileServerShares()
+}
+
+// setFileServerShares tells r's FileServer about r's shares.
+func (r *remote) setFileServerShares() {
+	r.fileServer.LockShares()
+	r.fileServer.ClearSharesLocked()
+	for _, share := range r.shareList {
+		if wrap, ok := r.wrapFS[share.Name]; ok {
+			r.fileServer.addShareFSLocked(share.Name, share.Path, wrap(webdav.Dir(share.Path)), share.ReadOnly)
+		} else if len(share.ExtraPaths) > 0 {
+			r.fileServer.AddUnionShareLocked(share.Name, append([]string{share.Path}, share.ExtraPaths...))
+		} else if share.ReadOnly {
+			r.fileServer.AddReadOnlyShareLocked(share.Name, share.Path)
+		} else {
+			r.fileServer.AddShareLocked(share.Name, share.Path)
+		}
+		r.fileServer.SetHideDotfilesLocked(share.Name, dotfilesHidden(share, r.fs.hideDotfilesByDefault))
+		r.fileServer.SetFsyncLocked(share.Name, share.Fsync)
+		r.fileServer.SetNormalizeUnicodeLocked(share.Name, share.NormalizeUnicode)
+		r.fileServer.SetQuotaLocked(share.Name, share.Quota)
+	}
+	r.fileServer.UnlockShares()
+}
+
+// restartFileServer replaces the named remote's FileServer with a new one
+// serving the same shares, as if the file server process had restarted.
+func (s *system) restartFileServer(remoteName string) {
+	r, ok := s.remotes[remoteName]
+	if !ok {
+		s.t.Fatalf("unknown remote %q", remoteName)
+	}
+	fileServer, err := NewFileServer()
+	if err != nil {
+		s.t.Fatalf("failed to call NewFileServer: %s", err)
+	}
+	fileServer.SetTempFileConfig(TempFileConfig{Dir: r.tempDir})
+	go fileServer.Serve()
+	s.t.Logf("FileServer for %v restarted at %s", remoteName, fileServer.Addr())
+
+	if err := r.fileServer.Close(); err != nil {
+		s.t.Fatalf("failed to Close remote fileserver: %s", err)
+	}
+	r.fileServer = fileServer
+	r.setFileServerShares()
+	r.fs.SetFileServerAddr(fileServer.Addr())
 }
 
 func (s *system) freezeRemote(remoteName string) {
@@ -664,7 +2941,7 @@ func (s *system) checkDirList(label string, path string, want ...string) {
 }
 
 func (s *system) stat(remoteName, shareName, name string) os.FileInfo {
-	filename := filepath.Join(s.remotes[remoteName].shares[shareName], name)
+	filename := filepath.Join(s.remotes[remoteName].shares[shareName].Path, name)
 	fi, err := os.Stat(filename)
 	if err != nil {
 		s.t.Fatalf("failed to Stat: %s", err)
@@ -684,7 +2961,7 @@ func (s *system) statViaWebDAV(remoteName, shareName, name string) os.FileInfo {
 }
 
 func (s *system) read(remoteName, shareName, name string) string {
-	filename := filepath.Join(s.remotes[remoteName].shares[shareName], name)
+	filename := filepath.Join(s.remotes[remoteName].shares[shareName].Path, name)
 	b, err := os.ReadFile(filename)
 	if err != nil {
 		s.t.Fatalf("failed to ReadFile: %s", err)
@@ -694,7 +2971,7 @@ func (s *system) read(remoteName, shareName, name string) string {
 }
 
 func (s *system) write(remoteName, shareName, name, contents string) {
-	filename := filepath.Join(s.remotes[remoteName].shares[shareName], name)
+	filename := filepath.Join(s.remotes[remoteName].shares[shareName].Path, name)
 	err := os.WriteFile(filename, []byte(contents), 0644)
 	if err != nil {
 		s.t.Fatalf("failed to WriteFile: %s", err)
@@ -768,6 +3045,35 @@ func fileInfoToStatic(fi fs.FileInfo, fixupMode bool) fs.FileInfo {
 	}
 }
 
+// putRange PUTs body as the given Content-Range of the named file using the
+// given upload ID, if any, and returns the response's status code and upload
+// offset.
+func (s *system) putRange(remoteName, shareName, name, id, contentRange, body string) (status int, offset string) {
+	u := fmt.Sprintf("http://%s/%s/%s/%s/%s",
+		s.local.ln.Addr(),
+		url.PathEscape(domain),
+		url.PathEscape(remoteName),
+		url.PathEscape(shareName),
+		url.PathEscape(name))
+	req, err := http.NewRequest("PUT", u, strings.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set("Content-Range", contentRange)
+	if id != "" {
+		req.Header.Set(UploadIDHeader, id)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get(UploadOffsetHeader)
+}
+
 func pathTo(remote, share, name string) string {
 	return path.Join(domain, remote, share, name)
 }
@@ -11,19 +11,44 @@
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/tailscale/xnet/webdav"
 	"tailscale.com/drive/driveimpl/shared"
+	"tailscale.com/util/set"
 )
 
 // FileServer is a standalone WebDAV server that dynamically serves up shares.
 // It's typically used in a separate process from the actual Taildrive server to
 // serve up files as an unprivileged user.
+//
+// A FileServer holds no more than a bounded amount of any request body in
+// memory. The bodies of PUT requests, which carry file contents, are streamed
+// to the file being written (or, for ranged PUTs, to its staging file) a
+// buffer at a time, so uploading a file takes the same memory whatever its
+// size. The bodies of other requests are either ignored or, like those of
+// PROPFIND, PROPPATCH and LOCK, parsed in memory. Their size is limited by
+// the FileSystemForRemote through which requests reach the FileServer; see
+// FileSystemForRemote.SetLimits.
 type FileServer struct {
 	ln            net.Listener
 	secretToken   string
-	shareHandlers map[string]http.Handler
+	shareHandlers map[string]*webdav.Handler
+	shareLocks    map[string]*memberLockingLS
+	shareQuotas   map[string]*quotaFS
+	readOnly      set.Set[string]  // names of read-only shares
+	hideDotfiles  set.Set[string]  // names of shares whose dotfiles are hidden
+	fsync         set.Set[string]  // names of shares whose writes are fsynced
+	normalize     set.Set[string]  // names of shares whose names are normalized
+	quotas        map[string]int64 // share name => quota in bytes, if any
+	tempFiles     TempFileConfig
 	sharesMu      sync.RWMutex
+
+	uploadsMu sync.Mutex
+	uploading set.Set[string] // staging files of ranged PUTs in progress
+	// conditionalPuts are the files, keyed by share and path, that
+	// conditional PUTs are in progress for.
+	conditionalPuts set.Set[string]
 }
 
 // NewFileServer constructs a FileServer.
@@ -57,7 +82,17 @@ func NewFileServer() (*FileServer, error) {
 	return &FileServer{
 		ln:            ln,
 		secretToken:   secretToken,
-		shareHandlers: make(map[string]http.Handler),
+		shareHandlers: make(map[string]*webdav.Handler),
+		shareLocks:    make(map[string]*memberLockingLS),
+		shareQuotas:   make(map[string]*quotaFS),
+		readOnly:      make(set.Set[string]),
+		hideDotfiles:  make(set.Set[string]),
+		fsync:         make(set.Set[string]),
+		normalize:     make(set.Set[string]),
+		quotas:        make(map[string]int64),
+		uploading:     make(set.Set[string]),
+
+		conditionalPuts: make(set.Set[string]),
 	}, nil
 }
 
@@ -95,18 +130,156 @@ func (s *FileServer) UnlockShares() {
 // ClearSharesLocked clears the map of shares, assuming that LockShares() has
 // been called first.
 func (s *FileServer) ClearSharesLocked() {
-	s.shareHandlers = make(map[string]http.Handler)
+	s.shareHandlers = make(map[string]*webdav.Handler)
+	s.shareLocks = make(map[string]*memberLockingLS)
+	s.shareQuotas = make(map[string]*quotaFS)
+	s.readOnly = make(set.Set[string])
+	s.hideDotfiles = make(set.Set[string])
+	s.fsync = make(set.Set[string])
+	s.normalize = make(set.Set[string])
+	s.quotas = make(map[string]int64)
 }
 
 // AddShareLocked adds a share to the map of shares, assuming that LockShares()
 // has been called first.
 func (s *FileServer) AddShareLocked(share, path string) {
+	s.addShareLocked(share, path, false)
+}
+
+// AddReadOnlyShareLocked is like AddShareLocked, but adds a share whose
+// contents can't be modified through the FileServer.
+func (s *FileServer) AddReadOnlyShareLocked(share, path string) {
+	s.addShareLocked(share, path, true)
+}
+
+// AddUnionShareLocked is like AddReadOnlyShareLocked, but adds a share whose
+// contents are those of the directories at the given paths merged into a
+// single tree (see drive.Share.ExtraPaths). When several directories have a
+// file with the same path, the one listed first wins.
+func (s *FileServer) AddUnionShareLocked(share string, paths []string) {
+	s.addShareFSLocked(share, "", newUnionFS(paths), true)
+}
+
+func (s *FileServer) addShareLocked(share, path string, readOnly bool) {
+	fs := &fsyncFS{FileSystem: webdav.Dir(path), root: path, enabled: func() bool {
+		return s.fsyncEnabled(share)
+	}}
+	s.addShareFSLocked(share, path, fs, readOnly)
+}
+
+// addShareFSLocked adds a share whose contents are in fs. The path of the
+// share's local directory is empty if it's not backed by one.
+func (s *FileServer) addShareFSLocked(share, path string, fs webdav.FileSystem, readOnly bool) {
+	usageFS := fs
+	if readOnly {
+		fs = &readOnlyFS{fs}
+		s.readOnly.Add(share)
+	} else {
+		s.readOnly.Delete(share)
+	}
+	fs = &dotfilesFS{FileSystem: fs, hide: func() bool {
+		return s.dotfilesHidden(share)
+	}}
+	ls := newMemberLockingLS()
+	qfs := &quotaFS{
+		FileSystem: &deadPropsFS{
+			FileSystem: &birthTimingFS{fs},
+			props:      newPropStore(path),
+			readOnly:   readOnly,
+		},
+		usageFS: usageFS,
+		root:    path,
+		quota: func() int64 {
+			return s.quota(share)
+		},
+	}
 	s.shareHandlers[share] = &webdav.Handler{
-		FileSystem: &birthTimingFS{webdav.Dir(path)},
-		LockSystem: webdav.NewMemLS(),
+		FileSystem: &normalizingFS{
+			FileSystem: &memberDeletingFS{qfs},
+			enabled: func() bool {
+				return s.normalizeEnabled(share)
+			},
+		},
+		LockSystem: ls,
+	}
+	s.shareLocks[share] = ls
+	s.shareQuotas[share] = qfs
+}
+
+// SetHideDotfilesLocked sets whether the given share's dotfiles are hidden
+// (see drive.Share.HideDotfiles), assuming that LockShares() has been called
+// first. Dotfiles are shown by default.
+func (s *FileServer) SetHideDotfilesLocked(share string, hide bool) {
+	if hide {
+		s.hideDotfiles.Add(share)
+	} else {
+		s.hideDotfiles.Delete(share)
+	}
+}
+
+// dotfilesHidden reports whether the given share's dotfiles are hidden.
+func (s *FileServer) dotfilesHidden(share string) bool {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	return s.hideDotfiles.Contains(share)
+}
+
+// SetFsyncLocked sets whether writes to the given share are flushed to stable
+// storage before they're acknowledged (see drive.Share.Fsync), assuming that
+// LockShares() has been called first.
+func (s *FileServer) SetFsyncLocked(share string, on bool) {
+	if on {
+		s.fsync.Add(share)
+	} else {
+		s.fsync.Delete(share)
+	}
+}
+
+// fsyncEnabled reports whether writes to the given share are fsynced.
+func (s *FileServer) fsyncEnabled(share string) bool {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	return s.fsync.Contains(share)
+}
+
+// SetNormalizeUnicodeLocked sets whether the given share's files are found
+// regardless of the Unicode normalization form of their names (see
+// drive.Share.NormalizeUnicode), assuming that LockShares() has been called
+// first.
+func (s *FileServer) SetNormalizeUnicodeLocked(share string, on bool) {
+	if on {
+		s.normalize.Add(share)
+	} else {
+		s.normalize.Delete(share)
+	}
+}
+
+// normalizeEnabled reports whether the names of the given share's files are
+// normalized.
+func (s *FileServer) normalizeEnabled(share string) bool {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	return s.normalize.Contains(share)
+}
+
+// SetQuotaLocked sets the quota in bytes of the given share (see
+// drive.Share.Quota), assuming that LockShares() has been called first. A
+// quota of 0 or less means that the share has none.
+func (s *FileServer) SetQuotaLocked(share string, quota int64) {
+	if quota > 0 {
+		s.quotas[share] = quota
+	} else {
+		delete(s.quotas, share)
 	}
 }
 
+// quota returns the quota of the given share, or 0 if it has none.
+func (s *FileServer) quota(share string) int64 {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	return s.quotas[share]
+}
+
 // SetShares sets the full map of shares to the new value, mapping name->path.
 func (s *FileServer) SetShares(shares map[string]string) {
 	s.LockShares()
@@ -150,15 +323,88 @@ func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	share := parts[1]
 	s.sharesMu.RLock()
 	h, found := s.shareHandlers[share]
+	ls := s.shareLocks[share]
+	qfs := s.shareQuotas[share]
+	readOnly := s.readOnly.Contains(share)
+	tempFiles := s.tempFiles
 	s.sharesMu.RUnlock()
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if readOnly && writeMethods[r.Method] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method == "DELETE" && !ls.membersUnlocked(time.Now(), r.URL.Path, r.Header.Get("If")) {
+		// Deleting a collection deletes its members, so it requires the lock
+		// tokens of any locked members too.
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	if r.Method == "MKCOL" {
+		w = &mkcolResponseWriter{ResponseWriter: w}
+	}
 	// WebDAV's locking code compares the lock resources with the request's
 	// host header, set this to empty to avoid mismatches.
 	r.Host = ""
-	h.ServeHTTP(w, r)
+	if r.Method == "PUT" && r.Header.Get("Content-Range") != "" {
+		if tempFiles.Dir == "" {
+			http.Error(w, "ranged PUT requires a temp file directory", http.StatusNotImplemented)
+			return
+		}
+		// The webdav package ignores Content-Range, which would replace
+		// the whole file with the range.
+		serve := func() { s.serveRangePut(w, r, h, qfs, share, tempFiles) }
+		if hasPutPreconditions(r) {
+			s.servePreconditionedPut(w, r, h, share, serve)
+		} else {
+			serve()
+		}
+		return
+	}
+	if r.Method == "PUT" && hasPutPreconditions(r) {
+		s.servePreconditionedPut(w, r, h, share, func() { h.ServeHTTP(w, r) })
+		return
+	}
+	if r.Method == "DELETE" {
+		serveDelete(w, r, h)
+		return
+	}
+	h.ServeHTTP(w, withQuotaProps(r))
+}
+
+// mkcolErrors are the bodies sent for failed MKCOL requests in place of the
+// bare status text that webdav.Handler writes, worded after RFC 4918 section
+// 9.3.1.
+var mkcolErrors = map[int]string{
+	http.StatusMethodNotAllowed: "MKCOL can only be executed on an unmapped URL",
+	http.StatusConflict:         "a collection cannot be made until its parent collection has been created",
+}
+
+// mkcolResponseWriter is an http.ResponseWriter that replaces the bodies of
+// MKCOL error responses with the more helpful ones in mkcolErrors.
+type mkcolResponseWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (mw *mkcolResponseWriter) WriteHeader(statusCode int) {
+	msg, ok := mkcolErrors[statusCode]
+	if !ok {
+		mw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	mw.replaced = true
+	http.Error(mw.ResponseWriter, msg, statusCode)
+}
+
+func (mw *mkcolResponseWriter) Write(p []byte) (int, error) {
+	if mw.replaced {
+		// Discard webdav.Handler's own body.
+		return len(p), nil
+	}
+	return mw.ResponseWriter.Write(p)
 }
 
 func (s *FileServer) Close() error {
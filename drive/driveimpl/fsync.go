@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+// syncer is implemented by files that can be flushed to stable storage, like
+// *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// syncFile flushes f to stable storage. It's a variable so that tests can
+// observe calls to it.
+var syncFile = func(f syncer) error {
+	return f.Sync()
+}
+
+// fsyncFS wraps a webdav.FileSystem rooted at the host directory root to
+// flush written files and their containing directories to stable storage
+// once they're closed or renamed, if the share is configured to do so (see
+// drive.Share.Fsync). The webdav handler closes files before responding to a
+// PUT or COPY and renames them before responding to a MOVE, so clients only
+// see a success once their data is durable.
+type fsyncFS struct {
+	webdav.FileSystem
+	root string
+
+	// enabled reports whether fsync is currently enabled. It's a func so
+	// that the setting can change without rebuilding the share's handler.
+	enabled func() bool
+}
+
+// hostPath returns the path on the host of the file with the given name.
+func (fs *fsyncFS) hostPath(name string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// syncParent flushes the directory containing the file with the given name
+// to stable storage, so that the file's directory entry is durable.
+func (fs *fsyncFS) syncParent(name string) error {
+	if runtime.GOOS == "windows" {
+		// Windows can't open directories for syncing. NTFS journals
+		// metadata, so there's nothing more to do.
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(fs.hostPath(name)))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	err = syncFile(dir)
+	if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EINVAL) {
+		// Some filesystems don't support syncing directories.
+		return nil
+	}
+	return err
+}
+
+func (fs *fsyncFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &fsyncFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *fsyncFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := fs.FileSystem.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if !fs.enabled() {
+		return nil
+	}
+	if err := fs.syncParent(newName); err != nil {
+		return err
+	}
+	if path.Dir(path.Clean("/"+oldName)) == path.Dir(path.Clean("/"+newName)) {
+		return nil
+	}
+	return fs.syncParent(oldName)
+}
+
+// fsyncFile wraps a webdav.File that was opened for writing in order to flush
+// it to stable storage when it's closed.
+type fsyncFile struct {
+	webdav.File
+	fs   *fsyncFS
+	name string
+}
+
+func (f *fsyncFile) Close() error {
+	if !f.fs.enabled() {
+		return f.File.Close()
+	}
+	s, ok := f.File.(syncer)
+	if !ok {
+		return f.File.Close()
+	}
+	if err := syncFile(s); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		f.File.Close()
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return f.fs.syncParent(f.name)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+// memberLockingLS wraps a webdav.LockSystem to keep track of the roots of
+// active locks, so that DELETE requests on collections can be checked against
+// locks on the collections' members. The webdav package only checks locks on
+// the target resource and its ancestors, which would allow anyone to delete a
+// locked file by deleting its parent directory.
+type memberLockingLS struct {
+	webdav.LockSystem
+
+	mu    sync.Mutex
+	locks map[string]trackedLock // lock token => lock
+}
+
+// trackedLock is a lock known to a memberLockingLS.
+type trackedLock struct {
+	root   string
+	expiry time.Time // zero means the lock never expires
+}
+
+func newMemberLockingLS() *memberLockingLS {
+	return &memberLockingLS{
+		LockSystem: webdav.NewMemLS(),
+		locks:      make(map[string]trackedLock),
+	}
+}
+
+func (ls *memberLockingLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	token, err := ls.LockSystem.Create(now, details)
+	if err != nil {
+		return token, err
+	}
+	ls.mu.Lock()
+	ls.locks[token] = trackedLock{
+		root:   path.Clean("/" + details.Root),
+		expiry: lockExpiry(now, details.Duration),
+	}
+	ls.mu.Unlock()
+	return token, nil
+}
+
+func (ls *memberLockingLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := ls.LockSystem.Refresh(now, token, duration)
+	if err != nil {
+		return details, err
+	}
+	ls.mu.Lock()
+	if l, ok := ls.locks[token]; ok {
+		l.expiry = lockExpiry(now, duration)
+		ls.locks[token] = l
+	}
+	ls.mu.Unlock()
+	return details, nil
+}
+
+func (ls *memberLockingLS) Unlock(now time.Time, token string) error {
+	err := ls.LockSystem.Unlock(now, token)
+	if err == nil || err == webdav.ErrNoSuchLock {
+		ls.mu.Lock()
+		delete(ls.locks, token)
+		ls.mu.Unlock()
+	}
+	return err
+}
+
+// lockExpiry returns when a lock created or refreshed at now with the given
+// duration expires. Negative durations mean infinite timeouts, as in
+// webdav.LockDetails.
+func lockExpiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
+
+// membersUnlocked reports whether every unexpired lock on a strict descendant
+// of name has its token submitted in the given If header.
+func (ls *memberLockingLS) membersUnlocked(now time.Time, name, ifHeader string) bool {
+	prefix := strings.TrimSuffix(path.Clean("/"+name), "/") + "/"
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for token, l := range ls.locks {
+		if !l.expiry.IsZero() && !l.expiry.After(now) {
+			delete(ls.locks, token)
+			continue
+		}
+		if strings.HasPrefix(l.root, prefix) && !strings.Contains(ifHeader, "<"+token+">") {
+			return false
+		}
+	}
+	return true
+}
+
+// maxLockInfoSize is the largest LOCK request body that setLockOwner rewrites.
+const maxLockInfoSize = 64 << 10
+
+// lockInfo is the body of a LOCK request that creates a lock, see
+// http://www.webdav.org/specs/rfc4918.html#ELEMENT_lockinfo.
+type lockInfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	LockScope struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	LockType struct {
+		Write *struct{} `xml:"DAV: write"`
+	} `xml:"DAV: locktype"`
+}
+
+// setLockOwner replaces the owner in the body of LOCK request r with name, so
+// that a lock it creates is attributed to the connecting principal rather than
+// to whatever the client claims. Requests that refresh locks have no body and
+// are left alone, as are bodies that can't be parsed, for the webdav handler
+// to reject.
+func setLockOwner(r *http.Request, name string) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLockInfoSize+1))
+	var li lockInfo
+	if err != nil || len(body) > maxLockInfoSize || xml.Unmarshal(body, &li) != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return
+	}
+	r.Body.Close()
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<D:lockinfo xmlns:D="DAV:"><D:lockscope>`)
+	if li.LockScope.Exclusive != nil {
+		b.WriteString("<D:exclusive/>")
+	}
+	if li.LockScope.Shared != nil {
+		b.WriteString("<D:shared/>")
+	}
+	b.WriteString("</D:lockscope><D:locktype>")
+	if li.LockType.Write != nil {
+		b.WriteString("<D:write/>")
+	}
+	b.WriteString("</D:locktype><D:owner>")
+	xml.EscapeText(&b, []byte(name))
+	b.WriteString("</D:owner></D:lockinfo>")
+
+	r.Body = io.NopCloser(&b)
+	r.ContentLength = int64(b.Len())
+	r.Header.Del("Content-Length")
+}
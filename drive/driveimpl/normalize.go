@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tailscale/xnet/webdav"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizingFS wraps a webdav.FileSystem to find files and directories whose
+// names are in a different Unicode normalization form than the requested ones,
+// if the share is configured to (see drive.Share.NormalizeUnicode).
+//
+// A path that exists as requested is used as is. Otherwise, each of its
+// components that doesn't exist is replaced with the first directory entry
+// with the same NFC form, so that requests for NFC names reach files stored
+// with NFD names, as on macOS, and vice versa. Components without such an entry
+// are left as requested, so new files get the names they're created with.
+type normalizingFS struct {
+	webdav.FileSystem
+
+	// enabled reports whether names are currently normalized. It's a func
+	// so that the setting can change without rebuilding the share's
+	// handler.
+	enabled func() bool
+}
+
+// resolve returns the path of the file that the given path names, as described
+// on normalizingFS.
+func (fs *normalizingFS) resolve(ctx context.Context, name string) string {
+	// Names in both forms, which include all ASCII names, can only match
+	// names in either form exactly.
+	if (norm.NFC.IsNormalString(name) && norm.NFD.IsNormalString(name)) || !fs.enabled() {
+		return name
+	}
+	if _, err := fs.FileSystem.Stat(ctx, name); !os.IsNotExist(err) {
+		return name
+	}
+	resolved := "/"
+	components := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	for i, c := range components {
+		exact := path.Join(resolved, c)
+		if _, err := fs.FileSystem.Stat(ctx, exact); !os.IsNotExist(err) {
+			resolved = exact
+			continue
+		}
+		match, ok := fs.findEntry(ctx, resolved, c)
+		if !ok {
+			// Nothing further down can exist.
+			return path.Join(append([]string{resolved}, components[i:]...)...)
+		}
+		resolved = path.Join(resolved, match)
+	}
+	return resolved
+}
+
+// findEntry returns the name of the first entry of the named directory with
+// the same NFC form as name, if any.
+func (fs *normalizingFS) findEntry(ctx context.Context, dir, name string) (string, bool) {
+	f, err := fs.FileSystem.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return "", false
+	}
+	want := norm.NFC.String(name)
+	for _, fi := range fis {
+		if norm.NFC.String(fi.Name()) == want {
+			return fi.Name(), true
+		}
+	}
+	return "", false
+}
+
+func (fs *normalizingFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.FileSystem.Mkdir(ctx, fs.resolve(ctx, name), perm)
+}
+
+func (fs *normalizingFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return fs.FileSystem.OpenFile(ctx, fs.resolve(ctx, name), flag, perm)
+}
+
+func (fs *normalizingFS) RemoveAll(ctx context.Context, name string) error {
+	return fs.FileSystem.RemoveAll(ctx, fs.resolve(ctx, name))
+}
+
+func (fs *normalizingFS) Rename(ctx context.Context, oldName, newName string) error {
+	return fs.FileSystem.Rename(ctx, fs.resolve(ctx, oldName), fs.resolve(ctx, newName))
+}
+
+func (fs *normalizingFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.FileSystem.Stat(ctx, fs.resolve(ctx, name))
+}
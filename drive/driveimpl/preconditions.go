@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+// hasPutPreconditions reports whether r has either of the If-Match and
+// If-None-Match headers, which the webdav package ignores for PUT.
+func hasPutPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// checkPutPreconditions reports whether the If-Match and If-None-Match headers
+// of the PUT request r allow it to write the named file of fs, as described in
+// RFC 9110 section 13.1. Clients use If-Match with the ETag of the version
+// they edited to avoid overwriting someone else's changes, and
+// "If-None-Match: *" to create a file only if it doesn't already exist.
+func checkPutPreconditions(ctx context.Context, fs webdav.FileSystem, name string, r *http.Request) (bool, error) {
+	fi, err := fs.Stat(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	// Directories can't be written with PUT and have no ETag, so they
+	// count as files without a current representation.
+	exists := err == nil && !fi.IsDir()
+	var etag string
+	if exists {
+		if etag, err = fileETag(ctx, fi); err != nil {
+			return false, err
+		}
+	}
+
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !exists || !etagListMatches(im, etag, false) {
+			return false, nil
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if exists && etagListMatches(inm, etag, true) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fileETag returns the ETag that the webdav package reports for the file
+// described by fi.
+func fileETag(ctx context.Context, fi os.FileInfo) (string, error) {
+	if et, ok := fi.(webdav.ETager); ok {
+		etag, err := et.ETag(ctx)
+		if err != webdav.ErrNotImplemented {
+			return etag, err
+		}
+	}
+	// This matches webdav.findETag.
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+// etagListMatches reports whether the value of an If-Match or If-None-Match
+// header, which is either "*" or a comma-separated list of entity tags,
+// matches the existing file's ETag etag. Weak tags only match with the weak
+// comparison that If-None-Match uses.
+func etagListMatches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for tag := range strings.SplitSeq(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(tag, "W/") || strings.HasPrefix(etag, "W/") {
+			continue
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// servePreconditionedPut serves the PUT request r with serve if its If-Match
+// and If-None-Match headers allow it, and otherwise responds with 412
+// Precondition Failed. Conditional PUTs of the same file are serialized, so
+// that of two clients updating the same version, only one succeeds.
+func (s *FileServer) servePreconditionedPut(w http.ResponseWriter, r *http.Request, h http.Handler, share string, serve func()) {
+	wh, ok := h.(*webdav.Handler)
+	if !ok {
+		serve()
+		return
+	}
+	key := share + "\x00" + r.URL.Path
+	s.uploadsMu.Lock()
+	busy := s.conditionalPuts.Contains(key)
+	if !busy {
+		s.conditionalPuts.Add(key)
+	}
+	s.uploadsMu.Unlock()
+	if busy {
+		// The file is about to change, so whatever version the client
+		// expects, it isn't going to be the current one.
+		http.Error(w, "another conditional PUT of this file is in progress", http.StatusPreconditionFailed)
+		return
+	}
+	defer func() {
+		s.uploadsMu.Lock()
+		s.conditionalPuts.Delete(key)
+		s.uploadsMu.Unlock()
+	}()
+
+	ok, err := checkPutPreconditions(r.Context(), wh.FileSystem, r.URL.Path, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	serve()
+}
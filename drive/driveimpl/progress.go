@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/drive"
+)
+
+const (
+	// progressInterval is how often transfer progress is reported at most,
+	// unless progressBytes have been transferred since the last report.
+	progressInterval = 250 * time.Millisecond
+
+	// progressBytes is how many bytes can be transferred before progress is
+	// reported regardless of progressInterval.
+	progressBytes = 4 << 20
+)
+
+// progressTracker tracks the progress of transferring the contents of a file,
+// for drive.FileSystemForRemote.ActiveTransfers, and reports it to a hook, if
+// any (see drive.FileSystemForRemote.SetProgressHook). Reports are spaced by
+// progressInterval or progressBytes, so that the hook doesn't slow down the
+// transfer.
+type progressTracker struct {
+	hook      func(share, path string, transferred, total int64) // or nil
+	share     string
+	path      string
+	direction drive.TransferDirection
+	principal string
+	started   time.Time
+
+	mu           sync.Mutex
+	total        int64 // or -1 if unknown
+	transferred  int64
+	reported     bool // whether progress was reported at all
+	lastReported int64
+	lastReport   time.Time
+}
+
+func newProgressTracker(hook func(share, path string, transferred, total int64), share, path string, direction drive.TransferDirection, principal string, total int64) *progressTracker {
+	now := time.Now()
+	return &progressTracker{
+		hook:       hook,
+		share:      share,
+		path:       path,
+		direction:  direction,
+		principal:  principal,
+		started:    now,
+		total:      total,
+		lastReport: now,
+	}
+}
+
+// info returns a description of the transfer so far.
+func (p *progressTracker) info() drive.TransferInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return drive.TransferInfo{
+		Share:       p.share,
+		Path:        p.path,
+		Direction:   p.direction,
+		Transferred: p.transferred,
+		Total:       p.total,
+		Started:     p.started,
+		Principal:   p.principal,
+	}
+}
+
+// setTotal sets the total number of bytes to be transferred, if it only
+// becomes known once the transfer has started.
+func (p *progressTracker) setTotal(total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+}
+
+// add records that n more bytes have been transferred, and reports progress
+// if it's due.
+func (p *progressTracker) add(n int) {
+	if n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transferred += int64(n)
+	if p.transferred-p.lastReported >= progressBytes || time.Since(p.lastReport) >= progressInterval {
+		p.reportLocked()
+	}
+}
+
+// done reports the final progress of the transfer, unless it has already been
+// reported.
+func (p *progressTracker) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.reported || p.transferred != p.lastReported {
+		p.reportLocked()
+	}
+}
+
+func (p *progressTracker) reportLocked() {
+	if p.hook == nil {
+		return
+	}
+	p.reported = true
+	p.lastReported = p.transferred
+	p.lastReport = time.Now()
+	p.hook(p.share, p.path, p.transferred, p.total)
+}
+
+// progressReader is an io.ReadCloser that tracks the progress of reading a
+// request body.
+type progressReader struct {
+	io.ReadCloser
+	p *progressTracker
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+// progressResponseWriter is an http.ResponseWriter that tracks the progress of
+// writing a response body.
+type progressResponseWriter struct {
+	http.ResponseWriter
+	p           *progressTracker
+	wroteHeader bool
+}
+
+func (w *progressResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		total := int64(-1)
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			total = n
+		}
+		w.p.setTotal(total)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *progressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.p.add(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// http.ResponseWriter, for instance to flush it.
+func (w *progressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
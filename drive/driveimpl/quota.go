@@ -0,0 +1,265 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+// The quota properties of RFC 4331.
+var (
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// isQuotaProp reports whether name is one of the quota properties.
+func isQuotaProp(name xml.Name) bool {
+	return name == quotaAvailableBytes || name == quotaUsedBytes
+}
+
+// maxPropfindBody is the size of the largest PROPFIND body that
+// wantsQuotaProps looks into.
+const maxPropfindBody = 1 << 20
+
+// quotaPropsKey is the context key under which FileServer.ServeHTTP passes a
+// *quotaProps to the files of a quotaFS, for PROPFIND requests that ask for
+// the quota properties.
+type quotaPropsKey struct{}
+
+// quotaProps are the quota properties of a share, computed at most once per
+// request, as they're the same for all of the share's files.
+type quotaProps struct {
+	once  sync.Once
+	props map[xml.Name]webdav.Property
+	err   error
+}
+
+// quotaFS extends a webdav.FileSystem to report the quota properties of
+// RFC 4331 for its files, as live properties that can't be changed with
+// PROPPATCH.
+//
+// Computing how much space a share uses means walking all of it, so the
+// properties are only reported to PROPFIND requests that name them, which
+// is also what the RFC asks for.
+type quotaFS struct {
+	webdav.FileSystem
+
+	// usageFS is the share's file system to count usage in, without the
+	// layers that hide files.
+	usageFS webdav.FileSystem
+	// root is the share's local directory, whose filesystem's free space
+	// is reported if there's no quota, or empty if it's not backed by one.
+	root string
+	// quota returns the share's quota, or 0 if it has none.
+	quota func() int64
+}
+
+func (fs *quotaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaFile{File: f, fs: fs, ctx: ctx}, nil
+}
+
+// props returns the quota properties of the share.
+func (fs *quotaFS) props(ctx context.Context) (map[xml.Name]webdav.Property, error) {
+	used, err := diskUsage(ctx, fs.usageFS, "/")
+	if err != nil {
+		return nil, err
+	}
+	props := map[xml.Name]webdav.Property{
+		quotaUsedBytes: bytesProp(quotaUsedBytes, used),
+	}
+	if quota := fs.quota(); quota > 0 {
+		props[quotaAvailableBytes] = bytesProp(quotaAvailableBytes, max(quota-used, 0))
+	} else if fs.root != "" {
+		// The free space is unknown on some platforms, in which case
+		// the property is reported as not found.
+		if free, err := diskFree(fs.root); err == nil {
+			props[quotaAvailableBytes] = bytesProp(quotaAvailableBytes, free)
+		}
+	}
+	return props, nil
+}
+
+// fits reports whether n more bytes fit in the share, as far as is known: in its
+// quota if it has one, and otherwise in the free space of the filesystem
+// holding it.
+func (fs *quotaFS) fits(ctx context.Context, n int64) (bool, error) {
+	if quota := fs.quota(); quota > 0 {
+		used, err := diskUsage(ctx, fs.usageFS, "/")
+		if err != nil {
+			return false, err
+		}
+		return used+n <= quota, nil
+	}
+	if fs.root != "" {
+		if free, err := diskFree(fs.root); err == nil {
+			return n <= free, nil
+		}
+	}
+	return true, nil
+}
+
+// bytesProp returns the property with the given name and a value of n bytes.
+func bytesProp(name xml.Name, n int64) webdav.Property {
+	return webdav.Property{XMLName: name, InnerXML: strconv.AppendInt(nil, n, 10)}
+}
+
+// diskUsage returns the total size of the files in the named directory of fs,
+// including those in its subdirectories.
+func diskUsage(ctx context.Context, fs webdav.FileSystem, name string) (int64, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			total += fi.Size()
+			continue
+		}
+		n, err := diskUsage(ctx, fs, path.Join(name, fi.Name()))
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// quotaFile extends a webdav.File to add the quota properties to its dead
+// properties, if the request asked for them, and to refuse to patch them.
+type quotaFile struct {
+	webdav.File
+	fs  *quotaFS
+	ctx context.Context // of the request that opened the file
+}
+
+func (f *quotaFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	var props map[xml.Name]webdav.Property
+	if dph, ok := f.File.(webdav.DeadPropsHolder); ok {
+		var err error
+		if props, err = dph.DeadProps(); err != nil {
+			return nil, err
+		}
+	}
+	qp, ok := f.ctx.Value(quotaPropsKey{}).(*quotaProps)
+	if !ok {
+		return props, nil
+	}
+	qp.once.Do(func() {
+		qp.props, qp.err = f.fs.props(f.ctx)
+	})
+	if qp.err != nil {
+		return nil, qp.err
+	}
+	if props == nil {
+		props = make(map[xml.Name]webdav.Property, len(qp.props))
+	}
+	for name, p := range qp.props {
+		props[name] = p
+	}
+	return props, nil
+}
+
+// Patch refuses patches that include the quota properties like the webdav
+// package refuses those of its own live properties, and otherwise passes them
+// on.
+func (f *quotaFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	protected := false
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			protected = protected || isQuotaProp(p.XMLName)
+		}
+	}
+	if protected {
+		forbidden := webdav.Propstat{
+			Status:   http.StatusForbidden,
+			XMLError: `<D:cannot-modify-protected-property xmlns:D="DAV:"/>`,
+		}
+		failedDep := webdav.Propstat{Status: webdav.StatusFailedDependency}
+		for _, patch := range patches {
+			for _, p := range patch.Props {
+				if isQuotaProp(p.XMLName) {
+					forbidden.Props = append(forbidden.Props, webdav.Property{XMLName: p.XMLName})
+				} else {
+					failedDep.Props = append(failedDep.Props, webdav.Property{XMLName: p.XMLName})
+				}
+			}
+		}
+		if len(failedDep.Props) == 0 {
+			return []webdav.Propstat{forbidden}, nil
+		}
+		return []webdav.Propstat{forbidden, failedDep}, nil
+	}
+	if dph, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return dph.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// withQuotaProps returns r with the context that makes a quotaFS report the
+// quota properties, if r is a PROPFIND request that asks for them. It leaves
+// r's body to be read again.
+func withQuotaProps(r *http.Request) *http.Request {
+	if r.Method != "PROPFIND" || r.Body == nil {
+		return r
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxPropfindBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	if err != nil || len(b) > maxPropfindBody || !wantsQuotaProps(b) {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), quotaPropsKey{}, &quotaProps{}))
+}
+
+// wantsQuotaProps reports whether the given PROPFIND request body names
+// either of the quota properties, which aren't included in "allprop".
+func wantsQuotaProps(body []byte) bool {
+	type propNames struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	}
+	var pf struct {
+		XMLName xml.Name  `xml:"DAV: propfind"`
+		Prop    propNames `xml:"DAV: prop"`
+		Include propNames `xml:"DAV: include"`
+	}
+	if err := xml.Unmarshal(body, &pf); err != nil {
+		return false
+	}
+	for _, pn := range append(pf.Prop.Names, pf.Include.Names...) {
+		if isQuotaProp(pn.XMLName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime/rate"
+)
+
+// limiterIdleTimeout is how long a principal's rate limiter for a share is
+// kept after its last request.
+const limiterIdleTimeout = 5 * time.Minute
+
+// requestLimiters rate limits requests for shares with a
+// drive.Share.MaxRequestsPerSec, using a token bucket for each combination of
+// share and connecting principal. The zero value is ready to use.
+type requestLimiters struct {
+	mu        sync.Mutex
+	limiters  map[limiterKey]*shareLimiter
+	lastPrune time.Time
+}
+
+type limiterKey struct {
+	share     string
+	principal string
+}
+
+type shareLimiter struct {
+	lim      *rate.Limiter
+	perSec   float64 // the rate lim was created with
+	lastUsed time.Time
+}
+
+// allow reports whether principal may make a request for share, which is
+// limited to perSec requests per second, at time now. Each principal may
+// burst up to one second's worth of requests.
+func (rl *requestLimiters) allow(now time.Time, share, principal string, perSec float64) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastPrune) >= limiterIdleTimeout {
+		rl.pruneLocked(now)
+	}
+	k := limiterKey{share, principal}
+	sl := rl.limiters[k]
+	if sl == nil || sl.perSec != perSec {
+		// New principal, or the share's limit changed since it was last seen.
+		burst := max(1, int(math.Ceil(perSec)))
+		sl = &shareLimiter{
+			lim:    rate.NewLimiter(rate.Limit(perSec), burst),
+			perSec: perSec,
+		}
+		if rl.limiters == nil {
+			rl.limiters = make(map[limiterKey]*shareLimiter)
+		}
+		rl.limiters[k] = sl
+	}
+	sl.lastUsed = now
+	return sl.lim.Allow()
+}
+
+// pruneLocked forgets the limiters of principals that have been idle for
+// longer than limiterIdleTimeout. Such principals have long since earned back
+// their full burst, so forgetting them doesn't change what they're allowed.
+//
+// rl.mu must be held.
+func (rl *requestLimiters) pruneLocked(now time.Time) {
+	for k, sl := range rl.limiters {
+		if now.Sub(sl.lastUsed) > limiterIdleTimeout {
+			delete(rl.limiters, k)
+		}
+	}
+	rl.lastPrune = now
+}
+
+// retryAfterSecs returns the value of the Retry-After header to send with
+// requests rejected for exceeding a limit of perSec requests per second.
+func retryAfterSecs(perSec float64) int {
+	return max(1, int(math.Ceil(1/perSec)))
+}
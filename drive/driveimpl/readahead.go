@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// DefaultReadAheadSize is the default number of bytes of a file that a
+// FileSystemForRemote reads ahead from a share's server while serving a GET.
+// See SetReadAheadSize.
+const DefaultReadAheadSize = 1 << 20
+
+// readAheadChunkSize is the size of the largest read from a share's server
+// while reading ahead.
+const readAheadChunkSize = 64 << 10
+
+// minReadAheadSize is the smallest read-ahead size, below which reads are too
+// small to be efficient.
+const minReadAheadSize = 4 << 10
+
+// readAheadResponse makes GET responses whose bodies are read ahead by up to
+// size bytes, for use as an httputil.ReverseProxy's ModifyResponse.
+func readAheadResponse(size int) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.Request.Method == "GET" && resp.Body != nil && resp.Body != http.NoBody {
+			resp.Body = newReadAheadReader(resp.Body, size)
+		}
+		return nil
+	}
+}
+
+// readAheadChunk is a chunk of the body read by a readAheadReader.
+type readAheadChunk struct {
+	buf []byte // of which the first n bytes were read
+	n   int
+	err error // returned by the read
+}
+
+// readAheadReader reads the body of a response ahead of its reader, in a
+// goroutine, so that a file's server keeps reading it from disk while the
+// part already read is sent over the network. This matters for large files
+// served over high-latency links, where neither the disk nor the network are
+// kept busy if they wait for each other.
+type readAheadReader struct {
+	body   io.ReadCloser
+	chunks chan readAheadChunk // read by the goroutine, in order
+	free   chan []byte         // buffers returned to the goroutine
+	stop   chan struct{}       // closed by Close
+	once   sync.Once
+
+	cur readAheadChunk // the chunk being read
+	off int            // how much of cur has been read
+	err error          // the error with which the body ended, if it did
+}
+
+// newReadAheadReader returns a reader of body that reads up to size bytes of it
+// ahead, or minReadAheadSize bytes if size is smaller. It must be closed.
+func newReadAheadReader(body io.ReadCloser, size int) *readAheadReader {
+	size = max(size, minReadAheadSize)
+	chunkSize := min(size, readAheadChunkSize)
+	numChunks := size / chunkSize
+	r := &readAheadReader{
+		body:   body,
+		chunks: make(chan readAheadChunk, numChunks),
+		free:   make(chan []byte, numChunks),
+		stop:   make(chan struct{}),
+	}
+	go r.readAhead(chunkSize, numChunks)
+	return r
+}
+
+// readAhead reads the body into at most numChunks buffers of chunkSize bytes,
+// which are allocated as needed, until the body ends or r is closed.
+func (r *readAheadReader) readAhead(chunkSize, numChunks int) {
+	allocated := 0
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		default:
+			if allocated < numChunks {
+				buf = make([]byte, chunkSize)
+				allocated++
+				break
+			}
+			select {
+			case buf = <-r.free:
+			case <-r.stop:
+				return
+			}
+		}
+		n, err := r.body.Read(buf)
+		select {
+		case r.chunks <- readAheadChunk{buf: buf, n: n, err: err}:
+		case <-r.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for r.off >= r.cur.n {
+		if r.cur.buf != nil {
+			// There's always room for the buffer, as there are no more
+			// buffers than free has capacity for.
+			r.free <- r.cur.buf
+			r.cur.buf = nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		select {
+		case r.cur = <-r.chunks:
+			r.off = 0
+			r.err = r.cur.err
+		case <-r.stop:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n := copy(p, r.cur.buf[r.off:r.cur.n])
+	r.off += n
+	return n, nil
+}
+
+// Close closes the body, stopping the read ahead.
+func (r *readAheadReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.stop)
+		err = r.body.Close()
+	})
+	return err
+}
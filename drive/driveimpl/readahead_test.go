@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/drive"
+	"tailscale.com/drive/driveimpl/shared"
+)
+
+// testFile returns the contents of a multi-MB file.
+func testFile() []byte {
+	contents := make([]byte, 4<<20)
+	for i := range contents {
+		contents[i] = byte(i * 7 / 3)
+	}
+	return contents
+}
+
+// TestReadAhead verifies that files are served intact whatever the read-ahead
+// size.
+func TestReadAhead(t *testing.T) {
+	contents := testFile()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		// Write in odd sizes, so that reads don't line up with chunks.
+		for b := contents; len(b) > 0; {
+			n := min(len(b), 12345)
+			w.Write(b[:n])
+			b = b[n:]
+		}
+	}))
+	defer srv.Close()
+
+	for _, size := range []int{-1, 0, 1, 1000, 5000, readAheadChunkSize, readAheadChunkSize + 1, 16 << 20} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			fs := NewFileSystemForRemote(log.Printf)
+			defer fs.Close()
+			fs.SetFileServerAddr("token|" + srv.Listener.Addr().String())
+			fs.SetReadAheadSize(size)
+			fs.SetShares([]*drive.Share{{Name: share11, Path: t.TempDir()}})
+
+			w := httptest.NewRecorder()
+			fs.ServeHTTPWithPerms(drive.Permissions{share11: drive.PermissionReadOnly}, w, httptest.NewRequest("GET", shared.JoinEscaped(share11, file111), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Body.Bytes(); !slices.Equal(got, contents) {
+				t.Errorf("got %d bytes differing from the %d bytes of the file", len(got), len(contents))
+			}
+		})
+	}
+}
+
+// burstyReader is a reader of a file on a disk with long seeks: it takes
+// delay to start reading each 1 MiB of the file, which it then reads quickly.
+type burstyReader struct {
+	b     []byte
+	off   int
+	delay time.Duration
+}
+
+func (r *burstyReader) Read(p []byte) (int, error) {
+	if r.off == len(r.b) {
+		return 0, io.EOF
+	}
+	if r.off%(1<<20) == 0 {
+		time.Sleep(r.delay)
+	}
+	end := min(len(r.b), r.off+len(p), (r.off/(1<<20)+1)<<20)
+	n := copy(p, r.b[r.off:end])
+	r.off += n
+	return n, nil
+}
+
+// readWithReadAhead reads contents from a burstyReader with the given
+// read-ahead size, and sends them to a slow link that takes delay/32 for each
+// 32 KiB, as long overall as reading them. It returns the contents sent and
+// how long that took.
+func readWithReadAhead(tb testing.TB, size int, contents []byte, delay time.Duration) ([]byte, time.Duration) {
+	tb.Helper()
+	start := time.Now()
+	r := newReadAheadReader(io.NopCloser(&burstyReader{b: contents, delay: delay}), size)
+	defer r.Close()
+	got := make([]byte, 0, len(contents))
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := io.ReadFull(r, buf)
+		time.Sleep(delay / 32)
+		got = append(got, buf[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return got, time.Since(start)
+}
+
+// countingBackend is a reader of b that counts the reads of it and records the
+// largest.
+type countingBackend struct {
+	b        []byte
+	reads    int
+	largestN int
+}
+
+func (r *countingBackend) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	r.reads++
+	r.largestN = max(r.largestN, n)
+	return n, nil
+}
+
+// TestReadAheadBackendReads verifies that a larger read-ahead reads a file
+// from the share's server in fewer, larger reads.
+func TestReadAheadBackendReads(t *testing.T) {
+	contents := testFile()
+
+	var backends [2]*countingBackend
+	for i, size := range []int{minReadAheadSize, 2 << 20} {
+		backend := &countingBackend{b: contents}
+		r := newReadAheadReader(io.NopCloser(backend), size)
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, contents) {
+			t.Errorf("read-ahead size %d: got %d bytes differing from the %d bytes of the file", size, len(got), len(contents))
+		}
+		t.Logf("read-ahead size %d: %d reads, largest %d bytes", size, backend.reads, backend.largestN)
+		backends[i] = backend
+	}
+	small, large := backends[0], backends[1]
+	if large.reads >= small.reads {
+		t.Errorf("large read-ahead made %d reads, not fewer than the %d of the small one", large.reads, small.reads)
+	}
+	if large.largestN <= small.largestN {
+		t.Errorf("large read-ahead's largest read was %d bytes, not more than the %d of the small one", large.largestN, small.largestN)
+	}
+}
+
+// BenchmarkReadAhead compares the throughput of read-ahead sizes when neither
+// the disk nor the network is faster than the other but the disk is bursty.
+// Without reading ahead enough, the network waits while the disk seeks.
+func BenchmarkReadAhead(b *testing.B) {
+	contents := testFile()
+	for _, size := range []int{minReadAheadSize, readAheadChunkSize, DefaultReadAheadSize, 4 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(contents)))
+			for range b.N {
+				readWithReadAhead(b, size, contents, 16*time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"os"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+// readOnlyFS wraps a webdav.FileSystem to refuse all modifications. It's used
+// for read-only shares as a safeguard in addition to rejecting write methods
+// in the HTTP handlers.
+type readOnlyFS struct {
+	webdav.FileSystem
+}
+
+// writeFlags are the os.OpenFile flags that allow modifying a file.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+func (fs *readOnlyFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *readOnlyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&writeFlags != 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func (fs *readOnlyFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *readOnlyFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+func TestReadOnlyFS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &readOnlyFS{webdav.Dir(dir)}
+
+	f, err := fs.OpenFile(ctx, "/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("opening file for reading: %v", err)
+	}
+	f.Close()
+
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDONLY | os.O_CREATE, os.O_RDONLY | os.O_TRUNC, os.O_WRONLY | os.O_APPEND} {
+		if _, err := fs.OpenFile(ctx, "/file", flag, 0644); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("OpenFile with flag %#x: got %v, want %v", flag, err, os.ErrPermission)
+		}
+	}
+	if err := fs.Mkdir(ctx, "/dir", 0755); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Mkdir: got %v, want %v", err, os.ErrPermission)
+	}
+	if err := fs.RemoveAll(ctx, "/file"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("RemoveAll: got %v, want %v", err, os.ErrPermission)
+	}
+	if err := fs.Rename(ctx, "/file", "/other"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Rename: got %v, want %v", err, os.ErrPermission)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file")); err != nil {
+		t.Errorf("file should still exist: %v", err)
+	}
+}
@@ -5,19 +5,22 @@
 
 import (
 	"bufio"
+	"cmp"
 	"context"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"net/http"
 	"net/netip"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,8 +32,24 @@
 	"tailscale.com/drive/driveimpl/shared"
 	"tailscale.com/safesocket"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
 )
 
+const (
+	// DefaultMaxShares is the default maximum number of shares that a
+	// FileSystemForRemote serves. See SetLimits.
+	DefaultMaxShares = 256
+
+	// DefaultMaxUserServers is the default maximum number of user servers,
+	// that is, of distinct users whom shares are shared as, each of which
+	// requires a subprocess. See SetLimits.
+	DefaultMaxUserServers = 16
+)
+
+// ErrTooManyShares is the error with which share configurations exceeding a
+// FileSystemForRemote's limits are rejected.
+var ErrTooManyShares = errors.New("too many Taildrive shares")
+
 func NewFileSystemForRemote(logf logger.Logf) *FileSystemForRemote {
 	if logf == nil {
 		logf = log.Printf
@@ -48,6 +67,7 @@ func NewFileSystemForRemote(logf logger.Logf) *FileSystemForRemote {
 type FileSystemForRemote struct {
 	logf       logger.Logf
 	lockSystem webdav.LockSystem
+	limiters   requestLimiters
 
 	// mu guards the below values. Acquire a write lock before updating any of
 	// them, acquire a read lock before reading any of them.
@@ -57,6 +77,26 @@ type FileSystemForRemote struct {
 	shares                 []*drive.Share
 	children               map[string]*compositedav.Child
 	userServers            map[string]*userServer
+	maxShares              int             // or 0 for DefaultMaxShares
+	maxUserServers         int             // or 0 for DefaultMaxUserServers
+	maxBufferedBody        int64           // or 0 for DefaultMaxBufferedBody
+	maxIdleConnsPerShare   int             // or 0 for http.DefaultMaxIdleConnsPerHost
+	maxConnsPerShare       int             // or 0 for no limit
+	readAheadSize          int             // or 0 for DefaultReadAheadSize, or negative for none
+	startupTimeout         time.Duration   // of user servers, or 0 for DefaultUserServerStartupTimeout
+	tempFiles              TempFileConfig  // of user servers
+	hideDotfilesByDefault  bool            // for shares not setting HideDotfiles
+	rejectedErr            error           // why the last call to SetShares was rejected, if it was
+	disabledShares         set.Set[string] // names of shares disabled with SetShareEnabled
+	progressHook           func(share, path string, transferred, total int64)
+	closing                bool // whether CloseContext was called
+
+	transfersMu sync.Mutex
+	transfers   set.Set[*progressTracker] // GETs and PUTs being served
+
+	// inFlight tracks requests being served. Requests are only added to it
+	// while mu is held (for reading suffices) and closing is false.
+	inFlight sync.WaitGroup
 }
 
 // SetFileServerAddr implements drive.FileSystemForRemote.
@@ -66,9 +106,208 @@ func (s *FileSystemForRemote) SetFileServerAddr(addr string) {
 	s.mu.Unlock()
 }
 
+// SetProgressHook implements drive.FileSystemForRemote.
+func (s *FileSystemForRemote) SetProgressHook(hook func(share, path string, transferred, total int64)) {
+	s.mu.Lock()
+	s.progressHook = hook
+	s.mu.Unlock()
+}
+
+// ActiveTransfers implements drive.FileSystemForRemote.
+func (s *FileSystemForRemote) ActiveTransfers() []drive.TransferInfo {
+	s.transfersMu.Lock()
+	infos := make([]drive.TransferInfo, 0, len(s.transfers))
+	for p := range s.transfers {
+		infos = append(infos, p.info())
+	}
+	s.transfersMu.Unlock()
+	slices.SortFunc(infos, func(a, b drive.TransferInfo) int {
+		return a.Started.Compare(b.Started)
+	})
+	return infos
+}
+
+// trackTransfer starts tracking a transfer for ActiveTransfers, until the
+// returned func is called.
+func (s *FileSystemForRemote) trackTransfer(p *progressTracker) (done func()) {
+	s.transfersMu.Lock()
+	s.transfers.Make()
+	s.transfers.Add(p)
+	s.transfersMu.Unlock()
+	return func() {
+		s.transfersMu.Lock()
+		s.transfers.Delete(p)
+		s.transfersMu.Unlock()
+		p.done()
+	}
+}
+
+// SetLimits sets the maximum number of shares and of user servers that s will
+// run, in order to avoid spawning an unbounded number of subprocesses, and the
+// size of the largest request body, other than that of a PUT, that s accepts.
+// Such bodies are read into memory by the file servers, while those of PUTs
+// are streamed to disk. Requests with larger bodies fail with status 413
+// Request Entity Too Large if they declare their length, or else fail once the
+// limit is reached.
+//
+// Zero values mean DefaultMaxShares, DefaultMaxUserServers and
+// DefaultMaxBufferedBody. The share limits apply from the next call to
+// SetShares, the body limit to the next request.
+func (s *FileSystemForRemote) SetLimits(maxShares, maxUserServers int, maxBufferedBody int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxShares = maxShares
+	s.maxUserServers = maxUserServers
+	s.maxBufferedBody = maxBufferedBody
+}
+
+// SetConnectionLimits sets the maximum number of idle connections that s keeps
+// open to the server of each share, and the maximum number of connections in
+// total, for tuning how many requests to a share are served concurrently.
+// Requests that would exceed maxConnsPerShare wait for a connection to become
+// available rather than failing. Zero values mean the defaults of
+// http.Transport's MaxIdleConnsPerHost and MaxConnsPerHost. The limits apply
+// from the next call to SetShares.
+func (s *FileSystemForRemote) SetConnectionLimits(maxIdleConnsPerShare, maxConnsPerShare int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxIdleConnsPerShare = maxIdleConnsPerShare
+	s.maxConnsPerShare = maxConnsPerShare
+}
+
+// SetReadAheadSize sets how many bytes of a file s reads ahead from the
+// share's server while serving a GET of it, so that the server keeps reading
+// the file from disk while the part already read is sent to the client. Larger
+// sizes improve the throughput of large downloads over high-latency links, at
+// the cost of memory. Zero means DefaultReadAheadSize, and a negative size
+// disables reading ahead. The size applies from the next call to SetShares.
+func (s *FileSystemForRemote) SetReadAheadSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readAheadSize = size
+}
+
+// SetUserServerStartupTimeout sets how long to wait for the file server of
+// each user to start and report its address before giving up on it and
+// starting it again. Slow machines may need longer than the default. Zero means
+// DefaultUserServerStartupTimeout. The timeout applies to file servers started
+// by the next call to SetShares.
+func (s *FileSystemForRemote) SetUserServerStartupTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startupTimeout = d
+}
+
+// SetTempFileConfig sets the configuration for the temporary files of the file
+// servers of each user (see FileServer.SetTempFileConfig). If cfg.Dir is empty,
+// they use a directory in the user's cache directory. The configuration applies
+// to file servers started by the next call to SetShares.
+func (s *FileSystemForRemote) SetTempFileConfig(cfg TempFileConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tempFiles = cfg
+}
+
+// SetHideDotfilesByDefault sets whether the dotfiles of shares that don't set
+// drive.Share.HideDotfiles are hidden. They're shown by default. Dotfiles can
+// only be hidden where shares are served by user servers (see
+// drive.AllowShareAs), so it returns an error if hide is true elsewhere. The
+// setting applies from the next call to SetShares.
+func (s *FileSystemForRemote) SetHideDotfilesByDefault(hide bool) error {
+	if hide && !drive.AllowShareAs() {
+		return errors.New("hiding dotfiles is not supported on this platform")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hideDotfilesByDefault = hide
+	return nil
+}
+
+// checkLimits returns an error wrapping ErrTooManyShares if the given shares
+// exceed s's limits.
+func (s *FileSystemForRemote) checkLimits(shares []*drive.Share) error {
+	s.mu.RLock()
+	maxShares := cmp.Or(s.maxShares, DefaultMaxShares)
+	maxUserServers := cmp.Or(s.maxUserServers, DefaultMaxUserServers)
+	s.mu.RUnlock()
+	if len(shares) > maxShares {
+		return fmt.Errorf("%w: %d shares exceed the limit of %d", ErrTooManyShares, len(shares), maxShares)
+	}
+	if drive.AllowShareAs() {
+		users := make(set.Set[string])
+		for _, share := range shares {
+			users.Add(share.As)
+		}
+		if len(users) > maxUserServers {
+			return fmt.Errorf("%w: shares as %d users exceed the limit of %d user servers", ErrTooManyShares, len(users), maxUserServers)
+		}
+	}
+	return nil
+}
+
 // SetShares implements drive.FileSystemForRemote. Shares must be sorted
 // according to drive.CompareShares.
+//
+// If the shares exceed s's limits (see SetLimits), they're rejected and s
+// keeps serving its previous shares. The rejection is logged and reported by
+// Healthy until SetShares is called with shares within the limits.
+//
+// Shares disabled with SetShareEnabled stay disabled.
 func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
+	if err := s.checkLimits(shares); err != nil {
+		s.logf("rejecting Taildrive shares: %v", err)
+		s.mu.Lock()
+		s.rejectedErr = err
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	s.rejectedErr = nil
+	s.mu.Unlock()
+	s.applyShares(shares)
+}
+
+// SetShareEnabled implements drive.FileSystemForRemote.
+func (s *FileSystemForRemote) SetShareEnabled(name string, enabled bool) {
+	s.mu.Lock()
+	if s.disabledShares.Contains(name) == !enabled {
+		s.mu.Unlock()
+		return
+	}
+	if enabled {
+		s.disabledShares.Delete(name)
+	} else {
+		s.disabledShares.Make()
+		s.disabledShares.Add(name)
+	}
+	shares := s.shares
+	s.mu.Unlock()
+	s.applyShares(shares)
+}
+
+// shareIsDisabled reports whether the named share was disabled with
+// SetShareEnabled.
+func (s *FileSystemForRemote) shareIsDisabled(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabledShares.Contains(name)
+}
+
+// applyShares serves the given shares in place of the current ones, with a
+// user server and child for each user and share that isn't disabled.
+func (s *FileSystemForRemote) applyShares(shares []*drive.Share) {
+	s.mu.RLock()
+	var enabled []*drive.Share
+	for _, share := range shares {
+		if !s.disabledShares.Contains(share.Name) {
+			enabled = append(enabled, share)
+		}
+	}
+	startupTimeout := s.startupTimeout
+	tempFiles := s.tempFiles
+	hideDotfilesByDefault := s.hideDotfilesByDefault
+	s.mu.RUnlock()
+
 	userServers := make(map[string]*userServer)
 	if drive.AllowShareAs() {
 		// Set up per-user server by running the current executable as an
@@ -79,13 +318,17 @@ func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
 			return
 		}
 
-		for _, share := range shares {
+		for _, share := range enabled {
 			p, found := userServers[share.As]
 			if !found {
 				p = &userServer{
-					logf:       s.logf,
-					username:   share.As,
-					executable: executable,
+					logf:           s.logf,
+					username:       share.As,
+					executable:     executable,
+					startupTimeout: startupTimeout,
+					tempFiles:      tempFiles,
+
+					hideDotfilesByDefault: hideDotfilesByDefault,
 				}
 				userServers[share.As] = p
 			}
@@ -96,8 +339,8 @@ func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
 		}
 	}
 
-	children := make(map[string]*compositedav.Child, len(shares))
-	for _, share := range shares {
+	children := make(map[string]*compositedav.Child, len(enabled))
+	for _, share := range enabled {
 		children[share.Name] = s.buildChild(share)
 	}
 
@@ -114,6 +357,11 @@ func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
 }
 
 func (s *FileSystemForRemote) buildChild(share *drive.Share) *compositedav.Child {
+	s.mu.RLock()
+	maxIdleConns, maxConns := s.maxIdleConnsPerShare, s.maxConnsPerShare
+	readAheadSize := cmp.Or(s.readAheadSize, DefaultReadAheadSize)
+	s.mu.RUnlock()
+
 	getTokenAndAddr := func(shareName string) (string, string, error) {
 		s.mu.RLock()
 		var share *drive.Share
@@ -155,18 +403,28 @@ func (s *FileSystemForRemote) buildChild(share *drive.Share) *compositedav.Child
 		return parts[0], parts[1], nil
 	}
 
+	var modifyResponse func(*http.Response) error
+	if readAheadSize > 0 {
+		modifyResponse = readAheadResponse(readAheadSize)
+	}
+
 	return &compositedav.Child{
 		Child: &dirfs.Child{
 			Name: share.Name,
 		},
+		ModifyResponse: modifyResponse,
 		BaseURL: func() (string, error) {
 			secretToken, _, err := getTokenAndAddr(share.Name)
 			if err != nil {
 				return "", err
 			}
-			return fmt.Sprintf("http://%s/%s/%s", hex.EncodeToString([]byte(share.Name)), secretToken, url.PathEscape(share.Name)), nil
+			return fmt.Sprintf("http://%s%s", hex.EncodeToString([]byte(share.Name)), shared.JoinEscaped(secretToken, share.Name)), nil
 		},
+		// Each share has its own transport, whose only host is the
+		// share's server, so the per-host limits are per share.
 		Transport: &http.Transport{
+			MaxIdleConnsPerHost: maxIdleConns,
+			MaxConnsPerHost:     maxConns,
 			DialContext: func(ctx context.Context, _, shareAddr string) (net.Conn, error) {
 				shareNameHex, _, err := net.SplitHostPort(shareAddr)
 				if err != nil {
@@ -200,6 +458,47 @@ func (s *FileSystemForRemote) buildChild(share *drive.Share) *compositedav.Child
 
 // ServeHTTPWithPerms implements drive.FileSystemForRemote.
 func (s *FileSystemForRemote) ServeHTTPWithPerms(permissions drive.Permissions, w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	closing := s.closing
+	if !closing {
+		s.inFlight.Add(1)
+	}
+	maxBufferedBody := cmp.Or(s.maxBufferedBody, DefaultMaxBufferedBody)
+	s.mu.RUnlock()
+	if closing {
+		http.Error(w, "taildrive is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.inFlight.Done()
+
+	if !limitBufferedBody(w, r, maxBufferedBody) {
+		return
+	}
+
+	if share := shared.CleanAndSplit(r.URL.Path)[0]; permissions.For(share) != drive.PermissionNone {
+		// Shares to which the principal has no access are reported as not
+		// found below, so only check limits and secrets of shares it can
+		// access.
+		if retryAfter, ok := s.allowRequest(share, r); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if !s.hasShareSecret(share, r.Header.Get(SecretHeader)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if s.shareIsDisabled(share) {
+			http.Error(w, "share is disabled", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if r.Method == "OPTIONS" {
+		s.handleOPTIONS(permissions, w, r)
+		return
+	}
+
 	isWrite := writeMethods[r.Method]
 	if isWrite {
 		share := shared.CleanAndSplit(r.URL.Path)[0]
@@ -213,10 +512,35 @@ func (s *FileSystemForRemote) ServeHTTPWithPerms(permissions drive.Permissions,
 			http.Error(w, "permission denied", http.StatusForbidden)
 			return
 		}
+		if s.shareIsReadOnly(share) {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Method == "LOCK" {
+		if name := drive.PrincipalName(r.Context()); name != "" {
+			setLockOwner(r, name)
+		}
+	}
+
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		switch r.Header.Get("Overwrite") {
+		case "":
+			// Per RFC 4918 section 10.6, a missing Overwrite header must be
+			// treated as "T". The webdav package only overwrites on MOVE if
+			// it's explicitly set, so make it explicit.
+			r.Header.Set("Overwrite", "T")
+		case "T", "F":
+		default:
+			http.Error(w, "invalid Overwrite header", http.StatusBadRequest)
+			return
+		}
 	}
 
 	s.mu.RLock()
 	childrenMap := s.children
+	progressHook := s.progressHook
 	s.mu.RUnlock()
 
 	children := make([]*compositedav.Child, 0, len(childrenMap))
@@ -233,9 +557,158 @@ func (s *FileSystemForRemote) ServeHTTPWithPerms(permissions drive.Permissions,
 		Logf: s.logf,
 	}
 	h.SetChildren("", children...)
+
+	if parts := shared.CleanAndSplit(r.URL.Path); len(parts) > 1 {
+		share, path := parts[0], shared.Join(parts[1:]...)
+		principal := drive.PrincipalName(r.Context())
+		switch r.Method {
+		case "GET":
+			p := newProgressTracker(progressHook, share, path, drive.TransferDownload, principal, -1)
+			defer s.trackTransfer(p)()
+			w = &progressResponseWriter{ResponseWriter: w, p: p}
+		case "PUT":
+			p := newProgressTracker(progressHook, share, path, drive.TransferUpload, principal, r.ContentLength)
+			defer s.trackTransfer(p)()
+			r.Body = &progressReader{ReadCloser: r.Body, p: p}
+		}
+	}
 	h.ServeHTTP(w, r)
 }
 
+// SecretHeader is the HTTP header in which requests must present the secret
+// of shares with a drive.Share.RequireSecret.
+const SecretHeader = "X-Taildrive-Secret"
+
+// share returns the named share, or nil if there's no such share.
+func (s *FileSystemForRemote) share(name string) *drive.Share {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, found := slices.BinarySearchFunc(s.shares, name, func(s *drive.Share, name string) int {
+		return strings.Compare(s.Name, name)
+	})
+	if !found {
+		return nil
+	}
+	return s.shares[i]
+}
+
+// shareIsReadOnly reports whether the named share is configured to be
+// read-only, regardless of permissions. Shares merging several directories
+// always are.
+func (s *FileSystemForRemote) shareIsReadOnly(name string) bool {
+	share := s.share(name)
+	return share != nil && (share.ReadOnly || len(share.ExtraPaths) > 0)
+}
+
+// hasShareSecret reports whether secret satisfies the named share's
+// RequireSecret, if any. It's true for unknown shares, which are reported as
+// not found elsewhere.
+func (s *FileSystemForRemote) hasShareSecret(name, secret string) bool {
+	share := s.share(name)
+	if share == nil || share.RequireSecret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(share.RequireSecret)) == 1
+}
+
+// allowRequest reports whether the connecting principal may make request r
+// for the named share under the share's MaxRequestsPerSec, if any. If not, it
+// also returns the number of seconds after which the principal may retry.
+//
+// The principal is identified by the drive.PrincipalName of the request, so
+// that a peer is limited the same whichever of its addresses it connects
+// from. Requests without one are identified by their remote IP address.
+func (s *FileSystemForRemote) allowRequest(name string, r *http.Request) (retryAfter int, ok bool) {
+	share := s.share(name)
+	if share == nil || share.MaxRequestsPerSec <= 0 {
+		return 0, true
+	}
+	principal := drive.PrincipalName(r.Context())
+	if principal == "" {
+		principal = r.RemoteAddr
+		if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			principal = ap.Addr().String()
+		}
+	}
+	if s.limiters.allow(time.Now(), name, principal, share.MaxRequestsPerSec) {
+		return 0, true
+	}
+	return retryAfterSecs(share.MaxRequestsPerSec), false
+}
+
+// handleOPTIONS responds to an OPTIONS request with DAV and Allow headers
+// reflecting what the connecting principal is actually allowed to do in the
+// requested share, so that clients which probe OPTIONS before deciding how to
+// interact with the server don't attempt operations that will be refused.
+func (s *FileSystemForRemote) handleOPTIONS(permissions drive.Permissions, w http.ResponseWriter, r *http.Request) {
+	perm := drive.PermissionReadOnly
+	share := shared.CleanAndSplit(r.URL.Path)[0]
+	if share != "" {
+		s.mu.RLock()
+		_, shareFound := s.children[share]
+		s.mu.RUnlock()
+		perm = permissions.For(share)
+		if !shareFound || perm == drive.PermissionNone {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if s.shareIsReadOnly(share) {
+			perm = drive.PermissionReadOnly
+		}
+	}
+	// The root directory is a read-only listing of shares, regardless of
+	// the permissions to the shares themselves.
+
+	methods := readMethods
+	davClasses := "1"
+	if perm == drive.PermissionReadWrite {
+		methods = readWriteMethods
+		// Locking is supported on writable shares, making them class 2.
+		davClasses = "1, 2"
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.Header().Set("DAV", davClasses)
+	w.Header().Set("MS-Author-Via", "DAV")
+}
+
+// Healthy implements drive.FileSystemForRemote. Besides unavailable shares,
+// it reports if the last share configuration was rejected by SetShares.
+// Disabled shares aren't expected to be available, so they're ignored.
+func (s *FileSystemForRemote) Healthy() (bool, []error) {
+	s.mu.RLock()
+	var shares []*drive.Share
+	for _, share := range s.shares {
+		if !s.disabledShares.Contains(share.Name) {
+			shares = append(shares, share)
+		}
+	}
+	userServers := s.userServers
+	fileServerTokenAndAddr := s.fileServerTokenAndAddr
+	rejectedErr := s.rejectedErr
+	s.mu.RUnlock()
+
+	var errs []error
+	if rejectedErr != nil {
+		errs = append(errs, fmt.Errorf("share configuration was rejected: %w", rejectedErr))
+	}
+	for _, share := range shares {
+		var err error
+		if !drive.AllowShareAs() {
+			if fileServerTokenAndAddr == "" {
+				err = errors.New("file server address not set")
+			}
+		} else if userServer, found := userServers[share.As]; !found {
+			err = fmt.Errorf("no file server for user %q", share.As)
+		} else {
+			err = userServer.health()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("share %q is unavailable: %w", share.Name, err))
+		}
+	}
+	return len(errs) == 0, errs
+}
+
 func (s *FileSystemForRemote) stopUserServers(userServers map[string]*userServer) {
 	for _, server := range userServers {
 		if err := server.Close(); err != nil {
@@ -264,6 +737,33 @@ func (s *FileSystemForRemote) Close() error {
 	return nil
 }
 
+// CloseContext implements drive.FileSystemForRemote. Requests that arrive
+// after it's called are rejected with 503 Service Unavailable.
+func (s *FileSystemForRemote) CloseContext(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.logf("taildrive: closing with requests still in flight: %v", err)
+	}
+	s.Close()
+	return err
+}
+
+// DefaultUserServerStartupTimeout is how long a userServer waits for its file
+// server to print its address by default. See SetUserServerStartupTimeout.
+const DefaultUserServerStartupTimeout = 10 * time.Second
+
 // userServer runs tailscaled serve-taildrive to serve webdav content for the
 // given Shares. All Shares are assumed to have the same Share.As, and the
 // content is served as that Share.As user.
@@ -272,6 +772,14 @@ type userServer struct {
 	shares     []*drive.Share
 	username   string
 	executable string
+	// startupTimeout is how long to wait for the file server to print its
+	// address before giving up on it. If zero,
+	// DefaultUserServerStartupTimeout is used.
+	startupTimeout time.Duration
+	tempFiles      TempFileConfig
+	// hideDotfilesByDefault is whether to hide the dotfiles of shares that
+	// don't set drive.Share.HideDotfiles.
+	hideDotfilesByDefault bool
 
 	// mu guards the below values. Acquire a write lock before updating any of
 	// them, acquire a read lock before reading any of them.
@@ -279,6 +787,9 @@ type userServer struct {
 	cmd          *exec.Cmd
 	tokenAndAddr string
 	closed       bool
+	// lastErr is the error with which the server last stopped, if it isn't
+	// currently running.
+	lastErr error
 }
 
 func (s *userServer) Close() error {
@@ -306,6 +817,7 @@ func (s *userServer) runLoop() {
 		}
 
 		err := s.run()
+		s.setStopped(err)
 		now := time.Now()
 		timeSinceLastFailure := now.Sub(timeOfLastFailure)
 		timeOfLastFailure = now
@@ -321,14 +833,67 @@ func (s *userServer) runLoop() {
 	}
 }
 
+// setStopped records that the server stopped with the given error, so that
+// it's no longer considered reachable.
+func (s *userServer) setStopped(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenAndAddr = ""
+	s.lastErr = err
+}
+
+// health returns nil if the server is running and has reported its address,
+// or otherwise an error describing why it's unavailable. It doesn't connect
+// to the server, so it's cheap and doesn't block.
+func (s *userServer) health() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.tokenAndAddr != "" {
+		return nil
+	}
+	if s.lastErr != nil {
+		return fmt.Errorf("file server for user %q stopped: %w", s.username, s.lastErr)
+	}
+	return fmt.Errorf("file server for user %q not started", s.username)
+}
+
 // Run runs the user server using the configured executable. This function only
 // works on UNIX systems, but those are the only ones on which we use
 // userServers anyway.
 func (s *userServer) run() error {
 	// set up the command
 	args := []string{"serve-taildrive"}
-	for _, s := range s.shares {
-		args = append(args, s.Name, s.Path)
+	if s.tempFiles.Dir != "" {
+		args = append(args, "--temp-dir="+s.tempFiles.Dir)
+	}
+	if s.tempFiles.Prefix != "" {
+		args = append(args, "--temp-prefix="+s.tempFiles.Prefix)
+	}
+	if s.tempFiles.MaxAge != 0 {
+		args = append(args, "--temp-max-age="+s.tempFiles.MaxAge.String())
+	}
+	for _, share := range s.shares {
+		if share.ReadOnly {
+			args = append(args, "--read-only="+share.Name)
+		}
+		if dotfilesHidden(share, s.hideDotfilesByDefault) {
+			args = append(args, "--hide-dotfiles="+share.Name)
+		}
+		if share.Fsync {
+			args = append(args, "--fsync="+share.Name)
+		}
+		if share.NormalizeUnicode {
+			args = append(args, "--normalize-unicode="+share.Name)
+		}
+		if share.Quota > 0 {
+			args = append(args, "--quota="+share.Name+"="+strconv.FormatInt(share.Quota, 10))
+		}
+		for _, p := range share.ExtraPaths {
+			args = append(args, "--extra-path="+share.Name+"="+p)
+		}
+	}
+	for _, share := range s.shares {
+		args = append(args, share.Name, share.Path)
 	}
 	var cmd *exec.Cmd
 
@@ -376,31 +941,65 @@ func (s *userServer) run() error {
 	s.cmd = cmd
 	s.mu.Unlock()
 
-	// read address
+	// send stderr to logger to avoid blocking
+	stderrScanner := bufio.NewScanner(stderr)
+	go func() {
+		for stderrScanner.Scan() {
+			s.logf("tailscaled serve-taildrive stderr: %v", stderrScanner.Text())
+		}
+	}()
+
+	// read address, giving up on the file server if it doesn't print one in
+	// time so that a hung file server doesn't break its shares indefinitely
 	stdoutScanner := bufio.NewScanner(stdout)
-	stdoutScanner.Scan()
-	if stdoutScanner.Err() != nil {
-		return fmt.Errorf("read addr: %w", stdoutScanner.Err())
-	}
-	addr := stdoutScanner.Text()
-	// send the rest of stdout and stderr to logger to avoid blocking
+	addrc := make(chan string, 1)
 	go func() {
-		for stdoutScanner.Scan() {
-			s.logf("tailscaled serve-taildrive stdout: %v", stdoutScanner.Text())
+		defer close(addrc)
+		if stdoutScanner.Scan() {
+			addrc <- strings.TrimSpace(stdoutScanner.Text())
 		}
 	}()
-	stderrScanner := bufio.NewScanner(stderr)
+	timeout := cmp.Or(s.startupTimeout, DefaultUserServerStartupTimeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var addr string
+	select {
+	case addr = <-addrc:
+	case <-timer.C:
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("no address from file server after %v", timeout)
+	}
+	if addr == "" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err := stdoutScanner.Err(); err != nil {
+			return fmt.Errorf("read addr: %w", err)
+		}
+		return errors.New("file server didn't print its address")
+	}
+
+	// send the rest of stdout to logger to avoid blocking
 	go func() {
-		for stderrScanner.Scan() {
-			s.logf("tailscaled serve-taildrive stderr: %v", stderrScanner.Text())
+		for stdoutScanner.Scan() {
+			s.logf("tailscaled serve-taildrive stdout: %v", stdoutScanner.Text())
 		}
 	}()
 	s.mu.Lock()
-	s.tokenAndAddr = strings.TrimSpace(addr)
+	s.tokenAndAddr = addr
 	s.mu.Unlock()
 	return cmd.Wait()
 }
 
+// readMethods and readWriteMethods are the methods advertised in response to
+// OPTIONS for shares to which the connecting principal has read-only and
+// read-write access, respectively.
+var (
+	readMethods      = []string{"OPTIONS", "GET", "HEAD", "PROPFIND"}
+	readWriteMethods = append(slices.Clone(readMethods),
+		"PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK")
+)
+
 var writeMethods = map[string]bool{
 	"PUT":       true,
 	"POST":      true,
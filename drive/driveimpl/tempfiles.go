@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTempFilePrefix is the default filename prefix of temporary
+	// files written by Taildrive while transferring files.
+	DefaultTempFilePrefix = ".taildrive-tmp-"
+
+	// DefaultTempFileMaxAge is the default age after which a temporary file
+	// is assumed to have been orphaned by a crashed or interrupted transfer.
+	DefaultTempFileMaxAge = 24 * time.Hour
+)
+
+// TempFileConfig configures how a FileServer handles temporary files.
+type TempFileConfig struct {
+	// Dir is the directory in which temporary files, such as the staging
+	// files of ranged PUTs, are kept. It should be dedicated to them, as
+	// CleanupTempFiles removes old files from it. If empty, ranged PUTs
+	// aren't supported.
+	Dir string
+
+	// Prefix is the filename prefix identifying temporary files. If empty,
+	// DefaultTempFilePrefix is used.
+	Prefix string
+
+	// MaxAge is the age after which a temporary file is considered orphaned
+	// and is removed by CleanupTempFiles. If zero, DefaultTempFileMaxAge is
+	// used.
+	MaxAge time.Duration
+}
+
+func (c TempFileConfig) prefix() string {
+	if c.Prefix == "" {
+		return DefaultTempFilePrefix
+	}
+	return c.Prefix
+}
+
+func (c TempFileConfig) maxAge() time.Duration {
+	if c.MaxAge == 0 {
+		return DefaultTempFileMaxAge
+	}
+	return c.MaxAge
+}
+
+// SetTempFileConfig sets the configuration for temporary files.
+func (s *FileServer) SetTempFileConfig(cfg TempFileConfig) {
+	s.sharesMu.Lock()
+	defer s.sharesMu.Unlock()
+	s.tempFiles = cfg
+}
+
+// CleanupTempFiles removes orphaned temporary files, that is, files in the
+// configured temp directory whose names start with the configured prefix and
+// which haven't been modified for longer than the configured maximum age.
+// Subdirectories and symlinks are left alone.
+//
+// It's meant to be called at startup, before interrupted transfers could be
+// resumed.
+func (s *FileServer) CleanupTempFiles() error {
+	s.sharesMu.RLock()
+	cfg := s.tempFiles
+	s.sharesMu.RUnlock()
+	if cfg.Dir == "" {
+		return nil
+	}
+	return removeStaleTempFiles(cfg.Dir, cfg.prefix(), time.Now().Add(-cfg.maxAge()))
+}
+
+// removeStaleTempFiles removes the regular files in dir whose names start with
+// prefix and which were last modified before cutoff.
+func removeStaleTempFiles(dir, prefix string, cutoff time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Before(cutoff) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupTempFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefix     string // empty means default
+		maxAge     time.Duration
+		filePrefix string // prefix of the temp files that should be cleaned up
+	}{
+		{name: "defaults", filePrefix: ".taildrive-tmp-"},
+		{name: "custom", prefix: ".partial-", maxAge: time.Hour, filePrefix: ".partial-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewFileServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			shareDir := t.TempDir()
+			tempDir := t.TempDir()
+			s.SetShares(map[string]string{"share": shareDir})
+			s.SetTempFileConfig(TempFileConfig{
+				Dir:    tempDir,
+				Prefix: tt.prefix,
+				MaxAge: tt.maxAge,
+			})
+
+			prefix := tt.filePrefix
+			maxAge := tt.maxAge
+			if maxAge == 0 {
+				maxAge = DefaultTempFileMaxAge
+			}
+			old := time.Now().Add(-2 * maxAge)
+
+			write := func(p string, mtime time.Time) string {
+				t.Helper()
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(p, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				return p
+			}
+			stale := write(filepath.Join(tempDir, prefix+"1"), old)
+			recent := write(filepath.Join(tempDir, prefix+"2"), time.Now())
+			oldRegular := write(filepath.Join(tempDir, "regular.txt"), old)
+			oldInSubdir := write(filepath.Join(tempDir, "sub", prefix+"3"), old)
+			oldInShare := write(filepath.Join(shareDir, prefix+"4"), old)
+
+			if err := s.CleanupTempFiles(); err != nil {
+				t.Fatalf("CleanupTempFiles: %v", err)
+			}
+
+			if _, err := os.Stat(stale); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("stale temp file %s still exists (err=%v)", stale, err)
+			}
+			for _, p := range []string{recent, oldRegular, oldInSubdir, oldInShare} {
+				if _, err := os.Stat(p); err != nil {
+					t.Errorf("%s should have been preserved: %v", p, err)
+				}
+			}
+		})
+	}
+}
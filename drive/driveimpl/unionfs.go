@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/drive/driveimpl/shared"
+	"tailscale.com/util/set"
+)
+
+// unionFS is a read-only webdav.FileSystem that merges the contents of
+// several file systems, its layers, into a single tree, for shares with
+// drive.Share.ExtraPaths. Whereas compositedav places each of its children
+// under its own name, unionFS overlays them at the same root.
+//
+// When several layers have a file or directory with the same name, the first
+// layer that has one wins. A directory's listing contains the entries of all
+// layers that have a directory with its name, except those shadowed by an
+// entry of the same name in an earlier layer.
+type unionFS struct {
+	layers []webdav.FileSystem
+}
+
+// newUnionFS returns a unionFS of the local directories at the given paths,
+// in order of precedence.
+func newUnionFS(paths []string) *unionFS {
+	layers := make([]webdav.FileSystem, len(paths))
+	for i, p := range paths {
+		layers[i] = webdav.Dir(p)
+	}
+	return &unionFS{layers: layers}
+}
+
+func (fs *unionFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *unionFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *unionFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// Stat returns the info of the file with the given name in the first layer
+// that has one.
+func (fs *unionFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, fi, err := fs.lookup(ctx, name)
+	return fi, err
+}
+
+// lookup returns the info of the file with the given name in the first layer
+// that has one, along with the indexes of the layers that contribute to it:
+// that layer and, if the file is a directory, the later layers that have a
+// directory with its name too. A layer doesn't contribute to a path if an
+// earlier layer has a file in place of one of its parent directories. If no
+// layer has the file, lookup returns the first error it got.
+func (fs *unionFS) lookup(ctx context.Context, name string) ([]int, os.FileInfo, error) {
+	layers := make([]int, len(fs.layers))
+	for i := range layers {
+		layers[i] = i
+	}
+	p := "/"
+	parts := shared.CleanAndSplit(name)
+	if parts[0] == "" {
+		parts = nil
+	}
+	for depth := 0; ; depth++ {
+		var fi os.FileInfo
+		var next []int
+		var firstErr error
+		for _, i := range layers {
+			lfi, err := fs.layers[i].Stat(ctx, p)
+			switch {
+			case err != nil:
+				if firstErr == nil {
+					firstErr = err
+				}
+			case fi == nil:
+				fi = lfi
+				next = append(next, i)
+			case fi.IsDir() && lfi.IsDir():
+				next = append(next, i)
+			}
+			if fi != nil && !fi.IsDir() {
+				break
+			}
+		}
+		if fi == nil {
+			return nil, nil, firstErr
+		}
+		if depth == len(parts) {
+			return next, fi, nil
+		}
+		layers = next
+		p = path.Join(p, parts[depth])
+	}
+}
+
+func (fs *unionFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&writeFlags != 0 {
+		return nil, os.ErrPermission
+	}
+	layers, fi, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.layers[layers[0]].OpenFile(ctx, name, flag, perm)
+	if err != nil || !fi.IsDir() {
+		return f, err
+	}
+	return &unionDir{File: f, ctx: ctx, fs: fs, name: name, layers: layers}, nil
+}
+
+// unionDir is a directory of a unionFS. Its Stat, Read and Seek methods are
+// those of the directory in the first layer that has it, while Readdir
+// merges the entries of all layers.
+type unionDir struct {
+	webdav.File
+	ctx    context.Context
+	fs     *unionFS
+	name   string
+	layers []int // indexes of the layers that have the directory
+
+	read    bool          // whether the entries have been read
+	entries []fs.FileInfo // merged entries yet to be returned by Readdir
+}
+
+func (d *unionDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.read {
+		entries, err := d.readEntries()
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// readEntries reads the entries of the directory in all of its layers, leaving
+// out those shadowed by entries with the same name in earlier layers. The
+// entries are sorted by name.
+func (d *unionDir) readEntries() ([]fs.FileInfo, error) {
+	entries, err := d.File.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(set.Set[string])
+	for _, fi := range entries {
+		seen.Add(fi.Name())
+	}
+	for _, i := range d.layers[1:] {
+		f, err := d.fs.layers[i].OpenFile(d.ctx, d.name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		more, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range more {
+			if !seen.Contains(fi.Name()) {
+				seen.Add(fi.Name())
+				entries = append(entries, fi)
+			}
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.FileInfo) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
@@ -0,0 +1,265 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/xnet/webdav"
+)
+
+const (
+	// UploadIDHeader is the HTTP header identifying a resumable upload. A
+	// PUT with a Content-Range header writes just that range of the file,
+	// and must carry an upload ID chosen by the client. All ranges of the
+	// same file must be sent with the same upload ID.
+	UploadIDHeader = "X-Taildrive-Upload-ID"
+
+	// UploadOffsetHeader is the HTTP header in which responses to ranged
+	// PUTs report how many bytes of the upload have been received so far,
+	// which is where the next range has to start.
+	UploadOffsetHeader = "X-Taildrive-Upload-Offset"
+
+	// maxUploadIDLen is the maximum length of an upload ID.
+	maxUploadIDLen = 128
+
+	// maxStagedUploads is the maximum number of ranged PUTs that can be
+	// under way at once, counting those that have been abandoned until
+	// their staging files are removed. Each can take up as much space in
+	// the temp directory as the file being uploaded.
+	maxStagedUploads = 64
+)
+
+// serveRangePut handles a PUT of a byte range of the file at r.URL.Path in the
+// given share, whose files are served by h and whose quota is kept by qfs.
+//
+// Ranges have to be sent in order, each starting where the previous one ended,
+// and are appended to a staging file in the temp directory (see
+// TempFileConfig), so an interrupted upload can be resumed by sending the rest
+// of the file, and an abandoned one is eventually removed by
+// CleanupTempFiles. Ranges that would leave a gap or overlap what has already
+// been received are rejected with 409 Conflict. Once the last range has been
+// received, the assembled file is written with a regular PUT, which is subject
+// to the same checks as any other.
+//
+// Since the staging file isn't written through h, the first range of an upload
+// is only accepted if that PUT could succeed (see checkNewUpload), so that a
+// client doesn't send a whole file only to have it refused.
+func (s *FileServer) serveRangePut(w http.ResponseWriter, r *http.Request, h *webdav.Handler, qfs *quotaFS, share string, cfg TempFileConfig) {
+	first, last, complete, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.Header.Get(UploadIDHeader)
+	if id == "" || len(id) > maxUploadIDLen {
+		http.Error(w, "ranged PUT requires a valid "+UploadIDHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	// Key the staging file by everything identifying the upload, so that
+	// uploads can't collide even though they share the temp dir.
+	key := sha256.Sum256(fmt.Appendf(nil, "%s\x00%s\x00%s\x00%d", share, r.URL.Path, id, complete))
+	staging := filepath.Join(cfg.Dir, cfg.prefix()+"upload-"+hex.EncodeToString(key[:16]))
+
+	s.uploadsMu.Lock()
+	busy := s.uploading.Contains(staging)
+	if !busy {
+		s.uploading.Add(staging)
+	}
+	s.uploadsMu.Unlock()
+	if busy {
+		http.Error(w, "another range of this upload is in progress", http.StatusConflict)
+		return
+	}
+	defer func() {
+		s.uploadsMu.Lock()
+		s.uploading.Delete(staging)
+		s.uploadsMu.Unlock()
+	}()
+
+	f, err := os.OpenFile(staging, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		if first != 0 {
+			w.Header().Set(UploadOffsetHeader, "0")
+			http.Error(w, "range must start at offset 0", http.StatusConflict)
+			return
+		}
+		if status, err := s.checkNewUpload(r.Context(), h.FileSystem, qfs, share, r.URL.Path, complete, cfg); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		f, err = os.OpenFile(staging, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if received := fi.Size(); first != received {
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(received, 10))
+		http.Error(w, fmt.Sprintf("range must start at offset %d", received), http.StatusConflict)
+		return
+	}
+
+	want := last - first + 1
+	n, err := io.Copy(io.NewOffsetWriter(f, first), io.LimitReader(r.Body, want+1))
+	if err == nil && n != want {
+		err = fmt.Errorf("got %d bytes for a range of %d bytes", n, want)
+	}
+	if err != nil {
+		// Discard the partial range, so the client can send it again.
+		f.Truncate(first)
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(first, 10))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if last+1 < complete {
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(last+1, 10))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// That was the last range, write the assembled file.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	put := r.Clone(r.Context())
+	put.Header.Del("Content-Range")
+	put.Header.Del(UploadIDHeader)
+	put.Body = io.NopCloser(f)
+	put.ContentLength = complete
+	sw := &statusResponseWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, put)
+	if sw.status/100 == 2 {
+		f.Close()
+		os.Remove(staging)
+	} else {
+		// Let the client retry the last range.
+		f.Truncate(first)
+	}
+}
+
+// checkNewUpload checks, before the first range of an upload of size bytes to
+// the named file is staged, that the file could then be written to fsys, the
+// share's file system with all of its layers, and that it fits in the share's
+// quota, or else in the free space of the filesystems holding the share and the
+// temp directory. It returns the status to refuse the upload with, and why.
+func (s *FileServer) checkNewUpload(ctx context.Context, fsys webdav.FileSystem, qfs *quotaFS, share, name string, size int64, cfg TempFileConfig) (int, error) {
+	if s.dotfilesHidden(share) && hasDotfile(name) {
+		// Hidden files can't be created, see dotfilesFS.
+		return http.StatusNotFound, errors.New("file not found")
+	}
+	var replaced int64
+	fi, err := fsys.Stat(ctx, name)
+	switch {
+	case err == nil && fi.IsDir():
+		return http.StatusMethodNotAllowed, errors.New("cannot PUT to a collection")
+	case err == nil:
+		replaced = fi.Size()
+	case !errors.Is(err, fs.ErrNotExist):
+		return http.StatusInternalServerError, err
+	default:
+		parent, err := fsys.Stat(ctx, path.Dir(path.Clean("/"+name)))
+		if err != nil || !parent.IsDir() {
+			return http.StatusConflict, errors.New("parent collection does not exist")
+		}
+	}
+	if ok, err := qfs.fits(ctx, size-replaced); err != nil {
+		return http.StatusInternalServerError, err
+	} else if !ok {
+		return http.StatusInsufficientStorage, errors.New("file does not fit in the share")
+	}
+	if free, err := diskFree(cfg.Dir); err == nil && size > free {
+		return http.StatusInsufficientStorage, errors.New("file does not fit in the temp directory")
+	}
+	if n, err := countStagedUploads(cfg); err != nil {
+		return http.StatusInternalServerError, err
+	} else if n >= maxStagedUploads {
+		return http.StatusServiceUnavailable, errors.New("too many uploads in progress")
+	}
+	return 0, nil
+}
+
+// countStagedUploads returns the number of staging files of ranged PUTs in the
+// temp directory.
+func countStagedUploads(cfg TempFileConfig) (int, error) {
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), cfg.prefix()+"upload-") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// parseContentRange parses the value of a Content-Range header of the form
+// "bytes first-last/complete", as sent with a ranged PUT. The complete length
+// has to be known.
+func parseContentRange(v string) (first, last, complete int64, err error) {
+	errInvalid := fmt.Errorf("invalid Content-Range %q", v)
+	spec, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, 0, errInvalid
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, errInvalid
+	}
+	a, b, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, errInvalid
+	}
+	first, err1 := strconv.ParseInt(a, 10, 64)
+	last, err2 := strconv.ParseInt(b, 10, 64)
+	complete, err3 := strconv.ParseInt(total, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || first < 0 || last < first || last >= complete || complete == math.MaxInt64 {
+		return 0, 0, 0, errInvalid
+	}
+	return first, last, complete, nil
+}
+
+// statusResponseWriter is an http.ResponseWriter that records the status code
+// of the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusResponseWriter) WriteHeader(statusCode int) {
+	if sw.status == 0 {
+		sw.status = statusCode
+	}
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sw *statusResponseWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
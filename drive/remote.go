@@ -7,9 +7,20 @@
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"math"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
+
+	"tailscale.com/types/opt"
+	"tailscale.com/types/views"
 )
 
 var (
@@ -18,6 +29,7 @@
 	DisallowShareAs     = false
 	ErrDriveNotEnabled  = errors.New("Taildrive not enabled")
 	ErrInvalidShareName = errors.New("Share names may only contain the letters a-z, underscore _, parentheses (), or spaces")
+	ErrInvalidShare     = errors.New("invalid share")
 )
 
 // AllowShareAs reports whether sharing files as a specific user is allowed.
@@ -46,6 +58,75 @@ type Share struct {
 	// hold on to a security-scoped bookmark. That bookmark is stored here. See
 	// https://developer.apple.com/documentation/security/app_sandbox/accessing_files_from_the_macos_app_sandbox#4144043
 	BookmarkData []byte `json:"bookmarkData,omitempty"`
+
+	// ReadOnly, if true, makes the share's contents unmodifiable by remote
+	// nodes, regardless of the permissions granted to them. It's meant for
+	// sharing things like backups or snapshots.
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// RequireSecret, if non-empty, is a secret that remote nodes must present
+	// in the X-Taildrive-Secret header of every request for the share, in
+	// addition to having been granted access to it. Requests without the
+	// matching secret are rejected with 401 Unauthorized.
+	RequireSecret string `json:"requireSecret,omitempty"`
+
+	// MaxRequestsPerSec, if positive, limits the rate at which each remote
+	// principal may make requests for the share. Requests in excess of the
+	// limit are rejected with 429 Too Many Requests.
+	MaxRequestsPerSec float64 `json:"maxRequestsPerSec,omitempty"`
+
+	// HideDotfiles, if true, hides files and directories whose names begin
+	// with a period from remote principals: they're left out of directory
+	// listings and can't be accessed, so that sharing a home directory
+	// doesn't expose files like .ssh or .bashrc. If false, they're visible
+	// like any other file. If unset, the default of the node sharing the
+	// files applies, which is to show them unless configured otherwise.
+	//
+	// Dotfiles can only be hidden where shares are served by user servers,
+	// that is, if AllowShareAs reports true.
+	HideDotfiles opt.Bool `json:"hideDotfiles,omitempty"`
+
+	// Fsync, if true, makes the server flush written files and their
+	// containing directories to stable storage after a successful PUT, COPY
+	// or MOVE, before responding. This protects against data loss if the
+	// sharing machine crashes or loses power, at the cost of noticeably
+	// higher latency for writes, especially on spinning disks and network
+	// filesystems. It requires user servers (see AllowShareAs).
+	Fsync bool `json:"fsync,omitempty"`
+
+	// Quota, if positive, is the number of bytes that the share's files are
+	// meant to take up at most. It's reported to WebDAV clients that support
+	// quotas (RFC 4331), so that they can show how much space is left. It
+	// isn't enforced, except that ranged PUTs of files that wouldn't fit are
+	// refused up front. Without a quota, the free space of the filesystem
+	// holding the share is reported instead. It requires user servers (see
+	// AllowShareAs).
+	Quota int64 `json:"quota,omitempty"`
+
+	// NormalizeUnicode, if true, makes the server find files and directories
+	// whose names are in a different Unicode normalization form than the
+	// requested ones. macOS stores names decomposed (NFD) while other
+	// platforms usually keep them composed (NFC), so without it, a client
+	// requesting "café" in one form doesn't find a file stored in the other.
+	//
+	// The policy is: a path that exists exactly as requested is always used
+	// as is. Otherwise, each of its components is matched with the directory
+	// entry with the same NFC form, if any. Names aren't normalized when
+	// creating files or directories, or when listing them.
+	//
+	// It requires user servers (see AllowShareAs).
+	NormalizeUnicode bool `json:"normalizeUnicode,omitempty"`
+
+	// ExtraPaths, if non-empty, are the paths to more directories on this
+	// machine whose contents are merged with those of Path into a single
+	// tree, as in a union mount. Such shares are always read-only. When
+	// several directories contain a file or directory with the same path
+	// within them, the one in the directory listed first wins, with Path
+	// coming before all ExtraPaths. Directories found at the same path in
+	// several directories are merged too, recursively, unless one listed
+	// earlier has a file there instead. It requires user servers (see
+	// AllowShareAs).
+	ExtraPaths []string `json:"extraPaths,omitempty"`
 }
 
 func ShareViewsEqual(a, b ShareView) bool {
@@ -55,7 +136,18 @@ func ShareViewsEqual(a, b ShareView) bool {
 	if !a.Valid() || !b.Valid() {
 		return false
 	}
-	return a.Name() == b.Name() && a.Path() == b.Path() && a.As() == b.As() && a.BookmarkData().Equal(b.ж.BookmarkData)
+	return a.Name() == b.Name() &&
+		a.Path() == b.Path() &&
+		a.As() == b.As() &&
+		a.BookmarkData().Equal(b.ж.BookmarkData) &&
+		a.ReadOnly() == b.ReadOnly() &&
+		a.RequireSecret() == b.RequireSecret() &&
+		a.MaxRequestsPerSec() == b.MaxRequestsPerSec() &&
+		a.HideDotfiles() == b.HideDotfiles() &&
+		a.Fsync() == b.Fsync() &&
+		a.Quota() == b.Quota() &&
+		a.NormalizeUnicode() == b.NormalizeUnicode() &&
+		views.SliceEqual(a.ExtraPaths(), b.ExtraPaths())
 }
 
 func SharesEqual(a, b *Share) bool {
@@ -65,7 +157,18 @@ func SharesEqual(a, b *Share) bool {
 	if a == nil || b == nil {
 		return false
 	}
-	return a.Name == b.Name && a.Path == b.Path && a.As == b.As && bytes.Equal(a.BookmarkData, b.BookmarkData)
+	return a.Name == b.Name &&
+		a.Path == b.Path &&
+		a.As == b.As &&
+		bytes.Equal(a.BookmarkData, b.BookmarkData) &&
+		a.ReadOnly == b.ReadOnly &&
+		a.RequireSecret == b.RequireSecret &&
+		a.MaxRequestsPerSec == b.MaxRequestsPerSec &&
+		a.HideDotfiles == b.HideDotfiles &&
+		a.Fsync == b.Fsync &&
+		a.Quota == b.Quota &&
+		a.NormalizeUnicode == b.NormalizeUnicode &&
+		slices.Equal(a.ExtraPaths, b.ExtraPaths)
 }
 
 func CompareShares(a, b *Share) int {
@@ -101,13 +204,68 @@ type FileSystemForRemote interface {
 	// server configured via SetFileServerAddr.
 	SetShares(shares []*Share)
 
+	// SetShareEnabled enables or disables the named share without removing
+	// it from the shares set with SetShares, for pausing it temporarily.
+	// Requests for a disabled share from principals with access to it fail
+	// with 503 Service Unavailable, and no user server runs for it. Shares
+	// are enabled by default, and stay disabled across calls to SetShares
+	// until reenabled.
+	SetShareEnabled(name string, enabled bool)
+
 	// ServeHTTPWithPerms behaves like the similar method from http.Handler but
 	// also accepts a Permissions map that captures the permissions of the
 	// connecting node.
 	ServeHTTPWithPerms(permissions Permissions, w http.ResponseWriter, r *http.Request)
 
+	// SetProgressHook sets a func to be called periodically while the contents
+	// of a file are transferred by a GET or PUT, for instance to show the
+	// progress of large transfers in a UI. It's called with the share name,
+	// the path of the file within the share, the number of bytes transferred
+	// so far and the total number of bytes, or -1 if that's not known. It's
+	// called at least once per transfer, after the last byte. A nil hook
+	// disables progress reporting.
+	SetProgressHook(hook func(share, path string, transferred, total int64))
+
+	// ActiveTransfers returns the file transfers by GET or PUT that are in
+	// progress, in the order in which they started.
+	ActiveTransfers() []TransferInfo
+
+	// Healthy reports whether the file servers backing all shares are
+	// running and have reported their addresses. If not, it returns one
+	// error per unavailable share. It's cheap and doesn't block.
+	Healthy() (bool, []error)
+
 	// Close() stops serving the WebDAV content
 	Close() error
+
+	// CloseContext is like Close, but first stops accepting new requests
+	// and waits for requests that are in flight to complete, or for ctx to
+	// be done, whichever happens first. It returns ctx.Err() if it stopped
+	// waiting because ctx was done.
+	CloseContext(ctx context.Context) error
+}
+
+// TransferDirection is the direction of a file transfer, from the point of view
+// of the node sharing the file.
+type TransferDirection string
+
+const (
+	TransferDownload TransferDirection = "download" // file read by a GET
+	TransferUpload   TransferDirection = "upload"   // file written by a PUT
+)
+
+// TransferInfo describes a file transfer in progress.
+type TransferInfo struct {
+	Share       string
+	Path        string // path of the file within the share
+	Direction   TransferDirection
+	Transferred int64 // bytes transferred so far
+	Total       int64 // total bytes to transfer, or -1 if not known
+	Started     time.Time
+
+	// Principal is the name of the peer that requested the transfer, if
+	// known (see WithPrincipalName).
+	Principal string `json:",omitempty"`
 }
 
 // NormalizeShareName normalizes the given share name and returns an error if
@@ -143,3 +301,128 @@ func validShareName(name string) bool {
 	}
 	return true
 }
+
+// ValidateShares checks the given shares, keyed by name, without applying
+// them, so that problems can be reported before a share configuration is
+// committed. It checks that:
+//
+//   - names are valid (see NormalizeShareName), unique once normalized and
+//     match the shares' Name fields, if set
+//   - paths are absolute and refer to existing directories, unless the share
+//     has BookmarkData, in which case only the Sandboxed Mac application can
+//     access them; ExtraPaths are always checked
+//   - shares are only shared As a specific user, or configured with
+//     options that only user servers support, if that's allowed (see
+//     AllowShareAs), and their limits are sensible
+//   - no share's directory is the same as, or contains, another's
+//
+// It returns all the problems it finds, in a stable order, or nil if there are
+// none.
+func ValidateShares(shares map[string]*Share) []error {
+	var errs []error
+	names := make(map[string]string) // normalized name => name
+	var dirs []string                // names of shares with a checked path
+	for _, name := range slices.Sorted(maps.Keys(shares)) {
+		share := shares[name]
+		if share == nil {
+			errs = append(errs, fmt.Errorf("share %q: missing configuration", name))
+			continue
+		}
+		if normalized, err := NormalizeShareName(name); err != nil {
+			errs = append(errs, fmt.Errorf("share %q: %w", name, err))
+		} else if other, dup := names[normalized]; dup {
+			errs = append(errs, fmt.Errorf("share %q: duplicate of share %q", name, other))
+		} else {
+			names[normalized] = name
+		}
+		if share.Name != "" && share.Name != name {
+			errs = append(errs, fmt.Errorf("share %q: configured with name %q", name, share.Name))
+		}
+		if share.As != "" && !AllowShareAs() {
+			errs = append(errs, fmt.Errorf("share %q: sharing as user %q is not supported on this platform", name, share.As))
+		}
+		if share.HideDotfiles.EqualBool(true) && !AllowShareAs() {
+			errs = append(errs, fmt.Errorf("share %q: hiding dotfiles is not supported on this platform", name))
+		}
+		if share.Fsync && !AllowShareAs() {
+			errs = append(errs, fmt.Errorf("share %q: fsync is not supported on this platform", name))
+		}
+		if share.Quota > 0 && !AllowShareAs() {
+			errs = append(errs, fmt.Errorf("share %q: quota is not supported on this platform", name))
+		}
+		if share.NormalizeUnicode && !AllowShareAs() {
+			errs = append(errs, fmt.Errorf("share %q: Unicode normalization is not supported on this platform", name))
+		}
+		if len(share.ExtraPaths) > 0 && !AllowShareAs() {
+			errs = append(errs, fmt.Errorf("share %q: merging extra paths is not supported on this platform", name))
+		}
+		if share.MaxRequestsPerSec < 0 || math.IsNaN(share.MaxRequestsPerSec) {
+			errs = append(errs, fmt.Errorf("share %q: invalid MaxRequestsPerSec %v", name, share.MaxRequestsPerSec))
+		}
+
+		if share.Path == "" {
+			errs = append(errs, fmt.Errorf("share %q: missing path", name))
+			continue
+		}
+		if !filepath.IsAbs(share.Path) {
+			errs = append(errs, fmt.Errorf("share %q: path %q is not absolute", name, share.Path))
+			continue
+		}
+		if len(share.BookmarkData) == 0 {
+			fi, err := os.Stat(share.Path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("share %q: %w", name, err))
+				continue
+			}
+			if !fi.IsDir() {
+				errs = append(errs, fmt.Errorf("share %q: path %q is not a directory", name, share.Path))
+				continue
+			}
+		}
+		for _, p := range share.ExtraPaths {
+			if !filepath.IsAbs(p) {
+				errs = append(errs, fmt.Errorf("share %q: extra path %q is not absolute", name, p))
+			} else if fi, err := os.Stat(p); err != nil {
+				errs = append(errs, fmt.Errorf("share %q: %w", name, err))
+			} else if !fi.IsDir() {
+				errs = append(errs, fmt.Errorf("share %q: extra path %q is not a directory", name, p))
+			}
+		}
+		for _, other := range dirs {
+			if pathsOverlap(share.Path, shares[other].Path) {
+				errs = append(errs, fmt.Errorf("share %q: path %q overlaps share %q at %q", name, share.Path, other, shares[other].Path))
+			}
+		}
+		dirs = append(dirs, name)
+	}
+	return errs
+}
+
+// pathsOverlap reports whether the absolute paths a and b are the same or one
+// contains the other.
+func pathsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	contains := func(dir, p string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return contains(a, b) || contains(b, a)
+}
+
+// principalNameKey is the context key for the value set by WithPrincipalName.
+type principalNameKey struct{}
+
+// WithPrincipalName returns a copy of ctx that carries name, a human-friendly
+// name for the principal on whose behalf a request is made, such as its login
+// name. FileSystemForRemote.ServeHTTPWithPerms uses it as the owner of locks
+// taken by the request, so that lock conflicts show who holds the lock.
+func WithPrincipalName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, principalNameKey{}, name)
+}
+
+// PrincipalName returns the name stored in ctx by WithPrincipalName, or the
+// empty string if there's none.
+func PrincipalName(ctx context.Context) string {
+	name, _ := ctx.Value(principalNameKey{}).(string)
+	return name
+}
@@ -4,8 +4,16 @@
 package drive
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"tailscale.com/types/opt"
 )
 
 func TestNormalizeShareName(t *testing.T) {
@@ -38,3 +46,149 @@ func TestNormalizeShareName(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateShares(t *testing.T) {
+	root := t.TempDir()
+	dir := func(name string) string {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(root, "missing")
+
+	tests := []struct {
+		name   string
+		shares map[string]*Share
+		want   []string // substrings of the wanted errors, in order
+	}{
+		{
+			name: "valid",
+			shares: map[string]*Share{
+				"a": {Name: "a", Path: dir("a")},
+				"b": {Path: dir("b")},
+			},
+		},
+		{
+			name:   "nonexistent path",
+			shares: map[string]*Share{"a": {Path: missing}},
+			want:   []string{`share "a": stat ` + missing},
+		},
+		{
+			name:   "file not dir",
+			shares: map[string]*Share{"a": {Path: file}},
+			want:   []string{`share "a": path "` + file + `" is not a directory`},
+		},
+		{
+			name: "duplicate name",
+			shares: map[string]*Share{
+				"docs": {Path: dir("docs")},
+				"Docs": {Path: dir("Docs2")},
+			},
+			want: []string{`share "docs": duplicate of share "Docs"`},
+		},
+		{
+			name: "overlap",
+			shares: map[string]*Share{
+				"outer": {Path: dir("outer")},
+				"inner": {Path: dir("outer/inner")},
+			},
+			want: []string{`share "outer": path "` + filepath.Join(root, "outer") + `" overlaps share "inner"`},
+		},
+		{
+			name:   "relative path",
+			shares: map[string]*Share{"a": {Path: "a"}},
+			want:   []string{`share "a": path "a" is not absolute`},
+		},
+		{
+			name: "extra paths",
+			shares: map[string]*Share{
+				"good": {Path: dir("g"), ExtraPaths: []string{dir("g2"), dir("g3")}},
+				"bad":  {Path: dir("h"), ExtraPaths: []string{"rel", missing, file}},
+			},
+			want: []string{
+				`share "bad": extra path "rel" is not absolute`,
+				`share "bad": stat ` + missing,
+				`share "bad": extra path "` + file + `" is not a directory`,
+			},
+		},
+		{
+			name: "all errors",
+			shares: map[string]*Share{
+				"bad.name": {Path: dir("c")},
+				"missing":  {Path: missing},
+				"file":     {Path: file},
+				"limit":    {Path: dir("d"), MaxRequestsPerSec: -1},
+				"renamed":  {Name: "other", Path: dir("e")},
+			},
+			want: []string{
+				`share "bad.name": ` + ErrInvalidShareName.Error(),
+				`share "file": path "` + file + `" is not a directory`,
+				`share "limit": invalid MaxRequestsPerSec -1`,
+				`share "missing": stat ` + missing,
+				`share "renamed": configured with name "other"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateShares(tt.shares)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got errors %q, want %d errors", errs, len(tt.want))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.want[i]) {
+					t.Errorf("error %d = %q, want it to contain %q", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+
+	errs := ValidateShares(map[string]*Share{"a": {Path: missing}, "b.": {Path: dir("f")}})
+	if len(errs) != 2 || !errors.Is(errs[0], fs.ErrNotExist) || !errors.Is(errs[1], ErrInvalidShareName) {
+		t.Errorf("got errors %q, want wrapped fs.ErrNotExist and ErrInvalidShareName", errs)
+	}
+}
+
+func TestValidateSharesWithoutShareAs(t *testing.T) {
+	DisallowShareAs = true
+	t.Cleanup(func() { DisallowShareAs = false })
+
+	root := t.TempDir()
+	dir := func(name string) string {
+		p := filepath.Join(root, name)
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	shares := map[string]*Share{
+		"as":       {Path: dir("as"), As: "someone"},
+		"dotfiles": {Path: dir("dotfiles"), HideDotfiles: opt.NewBool(true)},
+		"shown":    {Path: dir("shown"), HideDotfiles: opt.NewBool(false)},
+		"fsync":    {Path: dir("fsync"), Fsync: true},
+		"quota":    {Path: dir("quota"), Quota: 1 << 20},
+		"unicode":  {Path: dir("unicode"), NormalizeUnicode: true},
+		"union":    {Path: dir("union"), ExtraPaths: []string{dir("extra")}},
+	}
+	want := []string{
+		`share "as": sharing as user "someone" is not supported on this platform`,
+		`share "dotfiles": hiding dotfiles is not supported on this platform`,
+		`share "fsync": fsync is not supported on this platform`,
+		`share "quota": quota is not supported on this platform`,
+		`share "unicode": Unicode normalization is not supported on this platform`,
+		`share "union": merging extra paths is not supported on this platform`,
+	}
+	var got []string
+	for _, err := range ValidateShares(shares) {
+		got = append(got, err.Error())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got errors %q, want %q", got, want)
+	}
+}
@@ -9,6 +9,10 @@
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
@@ -20,9 +24,6 @@
 	"tailscale.com/tstest/integration/testcontrol"
 )
 
-// TODO(bradfitz): add test where control doesn't send tailcfg.CapabilityFileSharing
-// and verify that we get the "file sharing not enabled by Tailscale admin" error.
-
 // TODO(bradfitz): add test between different users with the peercap to permit that?
 
 func TestTaildropIntegration(t *testing.T) {
@@ -194,3 +195,274 @@ func testTaildropIntegration(t *testing.T, freshProfiles bool) {
 	d1.MustCleanShutdown(t)
 	d2.MustCleanShutdown(t)
 }
+
+// TestTaildropInbox tests sending several files with the tailscale file CLI,
+// including a zero-byte file, files with the same name as ones that were
+// received before, and a file sent while the receiver is offline, and checks
+// what ends up in the receiver's target directory.
+func TestTaildropInbox(t *testing.T) {
+	tstest.Parallel(t)
+	controlOpt := integration.ConfigureControl(func(s *testcontrol.Server) {
+		s.AllNodesSameUser = true // required for Taildrop
+	})
+	env := integration.NewTestEnv(t, controlOpt)
+
+	n1 := integration.NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n2 := integration.NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+
+	n1.AwaitListening()
+	n2.AwaitListening()
+	n1.MustUp()
+	n2.MustUp()
+	n1.AwaitRunning()
+	n2.AwaitRunning()
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	target := n2.AwaitIP4().String() + ":"
+
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeSrc := func(name, contents string) string {
+		t.Helper()
+		p := filepath.Join(src, name)
+		if err := os.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	cp := func(files ...string) {
+		t.Helper()
+		args := append([]string{"file", "cp"}, files...)
+		if out, err := n1.Tailscale(append(args, target)...).CombinedOutput(); err != nil {
+			t.Fatalf("file cp %q: %v\n%s", files, err, out)
+		}
+	}
+	get := func(extraArgs ...string) {
+		t.Helper()
+		args := append([]string{"file", "get"}, extraArgs...)
+		if out, err := n2.Tailscale(append(args, dst)...).CombinedOutput(); err != nil {
+			t.Fatalf("file get: %v\n%s", err, out)
+		}
+	}
+	want := map[string]string{}
+	wantDst := func() {
+		t.Helper()
+		des, err := os.ReadDir(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, de := range des {
+			names = append(names, de.Name())
+		}
+		if wantNames := slices.Sorted(maps.Keys(want)); !slices.Equal(names, wantNames) {
+			t.Fatalf("target directory has %q; want %q", names, wantNames)
+		}
+		for name, contents := range want {
+			got, err := os.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != contents {
+				t.Errorf("%s has %q; want %q", name, got, contents)
+			}
+		}
+	}
+	ctx := t.Context()
+	wantWaiting := func(names ...string) {
+		t.Helper()
+		files, err := n2.LocalClient().WaitingFiles(ctx)
+		if err != nil {
+			t.Fatalf("WaitingFiles: %v", err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Name)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, names) {
+			t.Fatalf("waiting files are %q; want %q", got, names)
+		}
+	}
+
+	// Several files in one invocation, then one by one, including a
+	// zero-byte file.
+	cp(writeSrc("a.txt", "first a"), writeSrc("b.txt", "first b"))
+	cp(writeSrc("c.txt", "first c"))
+	cp(writeSrc("empty.txt", ""))
+	wantWaiting("a.txt", "b.txt", "c.txt", "empty.txt")
+	get()
+	want["a.txt"] = "first a"
+	want["b.txt"] = "first b"
+	want["c.txt"] = "first c"
+	want["empty.txt"] = ""
+	wantDst()
+	wantWaiting()
+
+	// Files with the same name as files that were already received. By
+	// default, file get leaves them in the inbox.
+	cp(writeSrc("a.txt", "second a"))
+	cp(writeSrc("empty.txt", "no longer empty"))
+	wantWaiting("a.txt", "empty.txt")
+	if out, err := n2.Tailscale("file", "get", dst).CombinedOutput(); err == nil {
+		t.Fatalf("file get with conflicting files succeeded; want error\n%s", out)
+	}
+	wantDst()
+	wantWaiting("a.txt", "empty.txt")
+	get("--conflict=overwrite")
+	want["a.txt"] = "second a"
+	want["empty.txt"] = "no longer empty"
+	wantDst()
+	wantWaiting()
+
+	// Sending a file again while the previous copy is still in the inbox
+	// is deduplicated if it has the same contents, and gets a new name if
+	// it doesn't.
+	cp(writeSrc("d.txt", "first d"))
+	cp(writeSrc("d.txt", "first d"))
+	wantWaiting("d.txt")
+	cp(writeSrc("d.txt", "second d"))
+	wantWaiting("d (1).txt", "d.txt")
+	cp(writeSrc("b.txt", "second b"))
+	get("--conflict=rename")
+	want["d.txt"] = "first d"
+	want["d (1).txt"] = "second d"
+	want["b (1).txt"] = "second b"
+	wantDst()
+	wantWaiting()
+
+	// A file sent while the receiver is offline is delivered once it
+	// comes back.
+	d2.MustCleanShutdown(t)
+	offlineFile := writeSrc("offline.txt", "sent while offline")
+	cpErr := make(chan error, 1)
+	go func() {
+		out, err := n1.Tailscale("file", "cp", offlineFile, target).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%w\n%s", err, out)
+		}
+		cpErr <- err
+	}()
+	// Give file cp a chance to start sending before the receiver is back.
+	time.Sleep(2 * time.Second)
+	d2 = n2.StartDaemon()
+	n2.AwaitListening()
+	n2.AwaitRunning()
+	select {
+	case err := <-cpErr:
+		if err != nil {
+			t.Fatalf("file cp to offline peer: %v", err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("timeout waiting for file cp to offline peer")
+	}
+	wantWaiting("offline.txt")
+	get()
+	want["offline.txt"] = "sent while offline"
+	wantDst()
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+// TestTaildropToggledForNode tests that control can take away and give back a
+// single node's Taildrop capability mid-session, and that the node can't send
+// files while it doesn't have it.
+func TestTaildropToggledForNode(t *testing.T) {
+	tstest.Parallel(t)
+	controlOpt := integration.ConfigureControl(func(s *testcontrol.Server) {
+		s.AllNodesSameUser = true // required for Taildrop
+	})
+	env := integration.NewTestEnv(t, controlOpt)
+
+	n1 := integration.NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n2 := integration.NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+
+	n1.AwaitListening()
+	n2.AwaitListening()
+	n1.MustUp()
+	n2.MustUp()
+	n1.AwaitRunning()
+	n2.AwaitRunning()
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	k1 := n1.MustStatus().Self.PublicKey
+	target := n2.AwaitIP4().String() + ":"
+	file := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	awaitCapFileSharing := func(n *integration.TestNode, want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			if got := n.MustStatus().Self.HasCap(tailcfg.CapabilityFileSharing); got != want {
+				return fmt.Errorf("has file sharing capability = %v; want %v", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// peerAPIServices returns the peerapi services that n1 reports to
+	// control in its Hostinfo.
+	peerAPIServices := func() []tailcfg.Service {
+		t.Helper()
+		var svcs []tailcfg.Service
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			svcs = nil
+			if hi := env.Control.NodeHostinfo(k1); hi != nil {
+				for _, s := range hi.Services {
+					if s.Proto == tailcfg.PeerAPI4 || s.Proto == tailcfg.PeerAPI6 {
+						svcs = append(svcs, s)
+					}
+				}
+			}
+			if len(svcs) == 0 {
+				return errors.New("no peerapi services reported")
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return svcs
+	}
+	svcs := peerAPIServices()
+	sameService := func(a, b tailcfg.Service) bool {
+		return a.Proto == b.Proto && a.Port == b.Port
+	}
+
+	env.Control.SetNodeFeatureDisabled(k1, "taildrop")
+	awaitCapFileSharing(n1, false)
+	awaitCapFileSharing(n2, true) // its peers keep theirs
+	out, err := n1.Tailscale("file", "cp", file, target).CombinedOutput()
+	if err == nil {
+		t.Fatalf("file cp succeeded with Taildrop disabled for the sender\n%s", out)
+	}
+	if want := "Taildrop is not enabled for this node"; !bytes.Contains(out, []byte(want)) {
+		t.Fatalf("file cp output doesn't contain %q:\n%s", want, out)
+	}
+	// Taildrop has no service of its own: it's served by the peerapi,
+	// which also serves other features, so the node keeps advertising it.
+	if got := peerAPIServices(); !slices.EqualFunc(got, svcs, sameService) {
+		t.Errorf("peerapi services with Taildrop disabled = %v; want unchanged %v", got, svcs)
+	}
+	env.Control.SetNodeFeatureEnabled(k1, "taildrop")
+	awaitCapFileSharing(n1, true)
+	if out, err := n1.Tailscale("file", "cp", file, target).CombinedOutput(); err != nil {
+		t.Fatalf("file cp: %v\n%s", err, out)
+	}
+	if out, err := n2.Tailscale("file", "get", t.TempDir()).CombinedOutput(); err != nil {
+		t.Fatalf("file get: %v\n%s", err, out)
+	}
+	if got := peerAPIServices(); !slices.EqualFunc(got, svcs, sameService) {
+		t.Errorf("peerapi services with Taildrop re-enabled = %v; want unchanged %v", got, svcs)
+	}
+}
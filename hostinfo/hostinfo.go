@@ -40,12 +40,27 @@ func RegisterHostinfoNewHook(f func(*tailcfg.Hostinfo)) {
 	newHooks = append(newHooks, f)
 }
 
+// testHookIPNVersion, if non-nil, returns the IPNVersion to report in
+// Hostinfo in place of the real one, if non-empty. It's only set in binaries
+// built for integration tests.
+var testHookIPNVersion func() string
+
+// ipnVersion returns the version to report in Hostinfo.IPNVersion.
+func ipnVersion() string {
+	if testHookIPNVersion != nil {
+		if v := testHookIPNVersion(); v != "" {
+			return v
+		}
+	}
+	return version.Long()
+}
+
 // New returns a partially populated Hostinfo for the current host.
 func New() *tailcfg.Hostinfo {
 	hostname, _ := Hostname()
 	hostname = dnsname.FirstLabel(hostname)
 	hi := &tailcfg.Hostinfo{
-		IPNVersion:      version.Long(),
+		IPNVersion:      ipnVersion(),
 		Hostname:        hostname,
 		App:             appTypeCached(),
 		OS:              version.OS(),
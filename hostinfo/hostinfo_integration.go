@@ -0,0 +1,16 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_integration_test
+
+package hostinfo
+
+import "tailscale.com/envknob"
+
+func init() {
+	testHookIPNVersion = fakeIPNVersion
+}
+
+// fakeIPNVersion, if set, overrides the IPNVersion reported in Hostinfo, so
+// that integration tests can simulate upgrades and downgrades.
+var fakeIPNVersion = envknob.RegisterString("TS_DEBUG_FAKE_IPN_VERSION")
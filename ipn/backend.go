@@ -461,6 +461,12 @@ type Notify struct {
 	// empty value means that there are no shares.
 	DriveShares views.SliceView[*drive.Share, drive.ShareView]
 
+	// DriveTransferProgress, if non-nil, reports how far along a transfer of
+	// a file in one of this node's Taildrive shares is. It's sent
+	// periodically while the transfer is in progress, and once more when it
+	// ends.
+	DriveTransferProgress *DriveTransferProgress `json:",omitzero"`
+
 	// Health is the last-known health state of the backend. When this field is
 	// non-nil, a change in health verified, and the API client should surface
 	// any changes to the user in the UI.
@@ -584,6 +590,9 @@ func (n Notify) String() string {
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if n.DriveTransferProgress != nil {
+		sb.WriteString("DriveTransferProgress ")
+	}
 	if n.Health != nil {
 		sb.WriteString("Health{...} ")
 	}
@@ -630,6 +639,15 @@ type OutgoingFile struct {
 	Succeeded    bool                 // for a finished transfer, indicates whether or not it was successful
 }
 
+// DriveTransferProgress represents the progress of a transfer of a file in
+// one of this node's Taildrive shares.
+type DriveTransferProgress struct {
+	Share       string // name of the share, e.g. "docs"
+	Path        string // path of the file within the share
+	Transferred int64  // bytes transferred thus far
+	Total       int64  // or -1 if unknown
+}
+
 // StateKey is an opaque identifier for a set of LocalBackend state
 // (preferences, private keys, etc.). It is also used as a key for
 // the various LoginProfiles that the instance may be signed into.
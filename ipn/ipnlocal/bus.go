@@ -240,6 +240,7 @@ func isNotableNotify(n *ipn.Notify) bool {
 		len(n.UserProfiles) > 0 ||
 		len(n.PeerState) > 0 ||
 		!n.DriveShares.IsNil() ||
+		n.DriveTransferProgress != nil ||
 		n.Health != nil ||
 		len(n.IncomingFiles) > 0 ||
 		len(n.OutgoingFiles) > 0 ||
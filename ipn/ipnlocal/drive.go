@@ -6,6 +6,7 @@
 package ipnlocal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@
 	"net/netip"
 	"os"
 	"slices"
+	"time"
 
 	"tailscale.com/drive"
 	"tailscale.com/ipn"
@@ -26,6 +28,53 @@
 func init() {
 	hookSetNetMapLockedDrive.Set(setNetMapLockedDrive)
 	hookInstallDriveRemoteSource.Set(installDriveRemoteSource)
+	hookInstallDriveProgressHook.Set(installDriveProgressHook)
+	hookDriveHealthMessagesLocked.Set(driveHealthMessagesLocked)
+	hookShutdownDrive.Set(shutdownDrive)
+}
+
+// driveShutdownTimeout is how long [shutdownDrive] waits for in-flight
+// Taildrive requests to finish before closing the file system anyway.
+const driveShutdownTimeout = 5 * time.Second
+
+// shutdownDrive stops serving this node's shares, giving requests that are
+// already in flight up to driveShutdownTimeout to finish so that transfers
+// aren't cut off mid-file. See [drive.FileSystemForRemote.CloseContext].
+func shutdownDrive(b *LocalBackend) {
+	fs, ok := b.sys.DriveForRemote.GetOK()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), driveShutdownTimeout)
+	defer cancel()
+	if err := fs.CloseContext(ctx); err != nil {
+		b.logf("taildrive: shutdown: %v", err)
+	}
+}
+
+// driveHealthMessagesLocked returns a health message for each problem that
+// keeps Taildrive from serving this node's shares, such as a user server that
+// crashed, so that it shows up in status. It's cheap and doesn't block; see
+// [drive.FileSystemForRemote.Healthy].
+//
+// b.mu must be held.
+func driveHealthMessagesLocked(b *LocalBackend) []string {
+	if !b.DriveSharingEnabled() || b.pm.prefs.DriveShares().Len() == 0 {
+		return nil
+	}
+	fs, ok := b.sys.DriveForRemote.GetOK()
+	if !ok {
+		return nil
+	}
+	healthy, errs := fs.Healthy()
+	if healthy {
+		return nil
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, "Taildrive: "+err.Error())
+	}
+	return msgs
 }
 
 // setNetMapLockedDrive runs on every full netmap install (the only path that
@@ -54,6 +103,29 @@ func installDriveRemoteSource(b *LocalBackend) {
 	fs.SetRemoteSource(driveRemoteSource{b})
 }
 
+// installDriveProgressHook makes the Taildrive filesystem report the progress
+// of transfers of this node's shares to the IPN bus as
+// [ipn.Notify.DriveTransferProgress], so that GUIs can show it.
+//
+// The notifications are sent asynchronously so that a slow IPN bus watcher
+// doesn't slow down the transfers themselves.
+func installDriveProgressHook(b *LocalBackend) {
+	fs, ok := b.sys.DriveForRemote.GetOK()
+	if !ok {
+		return
+	}
+	fs.SetProgressHook(func(share, path string, transferred, total int64) {
+		b.extHost.SendNotifyAsync(ipn.Notify{
+			DriveTransferProgress: &ipn.DriveTransferProgress{
+				Share:       share,
+				Path:        path,
+				Transferred: transferred,
+				Total:       total,
+			},
+		})
+	})
+}
+
 // DriveSetServerAddr tells Taildrive to use the given address for connecting
 // to the drive.FileServer that's exposing local files as an unprivileged
 // user.
@@ -70,7 +142,10 @@ func (b *LocalBackend) DriveSetServerAddr(addr string) error {
 // DriveSetShare adds the given share if no share with that name exists, or
 // replaces the existing share if one with the same name already exists. To
 // avoid potential incompatibilities across file systems, share names are
-// limited to alphanumeric characters and the underscore _.
+// limited to alphanumeric characters and the underscore _. The resulting
+// shares are checked with [drive.ValidateShares], and an error wrapping
+// [drive.ErrInvalidShare] is returned if there's a problem with any of them,
+// such as the share overlapping an existing one.
 func (b *LocalBackend) DriveSetShare(share *drive.Share) error {
 	var err error
 	share.Name, err = drive.NormalizeShareName(share.Name)
@@ -113,6 +188,16 @@ func (b *LocalBackend) driveSetShareLocked(share *drive.Share) (views.SliceView[
 		shares = append(shares, share)
 	}
 
+	// Check the share along with the existing ones, so that it can't overlap
+	// any of them.
+	byName := make(map[string]*drive.Share, len(shares))
+	for _, s := range shares {
+		byName[s.Name] = s
+	}
+	if errs := drive.ValidateShares(byName); len(errs) > 0 {
+		return existingShares, fmt.Errorf("%w: %w", drive.ErrInvalidShare, errors.Join(errs...))
+	}
+
 	err := b.driveSetSharesLocked(shares)
 	if err != nil {
 		return existingShares, err
@@ -238,6 +323,39 @@ func (b *LocalBackend) driveRemoveShareLocked(name string) (views.SliceView[*dri
 	return b.pm.prefs.DriveShares(), nil
 }
 
+// DriveSetShareEnabled enables or disables the named share without removing it,
+// for pausing it temporarily. Disabled shares stay configured, with their
+// permissions, but can't be accessed by remote nodes until they're enabled
+// again or tailscaled restarts. See [drive.FileSystemForRemote.SetShareEnabled].
+func (b *LocalBackend) DriveSetShareEnabled(name string, enabled bool) error {
+	var err error
+	name, err = drive.NormalizeShareName(name)
+	if err != nil {
+		return err
+	}
+
+	fs, ok := b.sys.DriveForRemote.GetOK()
+	if !ok {
+		return drive.ErrDriveNotEnabled
+	}
+
+	found := false
+	b.mu.Lock()
+	for _, share := range b.pm.prefs.DriveShares().All() {
+		if share.Name() == name {
+			found = true
+			break
+		}
+	}
+	b.mu.Unlock()
+	if !found {
+		return os.ErrNotExist
+	}
+
+	fs.SetShareEnabled(name, enabled)
+	return nil
+}
+
 func (b *LocalBackend) driveSetSharesLocked(shares []*drive.Share) error {
 	prefs := b.pm.prefs.AsStruct()
 	prefs.ApplyEdits(&ipn.MaskedPrefs{
@@ -299,6 +417,16 @@ func driveShareViewsEqual(a *views.SliceView[*drive.Share, drive.ShareView], b v
 	return true
 }
 
+// DriveActiveTransfers returns the transfers of files from or to this node's
+// shares that are in progress. See [drive.FileSystemForRemote.ActiveTransfers].
+func (b *LocalBackend) DriveActiveTransfers() ([]drive.TransferInfo, error) {
+	fs, ok := b.sys.DriveForRemote.GetOK()
+	if !ok {
+		return nil, drive.ErrDriveNotEnabled
+	}
+	return fs.ActiveTransfers(), nil
+}
+
 // DriveGetShares gets the current list of Taildrive shares, sorted by name.
 func (b *LocalBackend) DriveGetShares() views.SliceView[*drive.Share, drive.ShareView] {
 	b.mu.Lock()
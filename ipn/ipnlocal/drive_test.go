@@ -6,13 +6,16 @@
 package ipnlocal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"os"
 	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -73,6 +76,76 @@ func (m *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	return nil, m.err
 }
 
+// okDriveForRemote is a [drive.FileSystemForRemote] that responds to every
+// request with status 200 OK.
+type okDriveForRemote struct {
+	drive.FileSystemForRemote
+}
+
+func (okDriveForRemote) ServeHTTPWithPerms(_ drive.Permissions, w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (okDriveForRemote) CloseContext(context.Context) error { return nil }
+
+func (okDriveForRemote) SetProgressHook(func(share, path string, transferred, total int64)) {}
+
+// TestDriveAccessLogPrincipal verifies that Taildrive access log lines name
+// the principal making the request.
+func TestDriveAccessLogPrincipal(t *testing.T) {
+	sys := tsd.NewSystemWithBus(eventbustest.NewBus(t))
+	sys.Set(okDriveForRemote{})
+	b := newTestLocalBackendWithSys(t, sys)
+	var logBuf tstest.MemLogger
+	b.logf = logBuf.Logf
+
+	selfAddr := netip.MustParseAddr("100.64.0.1")
+	peerAddr := netip.MustParseAddr("100.64.0.2")
+	selfNode := (&tailcfg.Node{
+		ID:        1,
+		Key:       makeNodeKeyFromID(1),
+		Addresses: []netip.Prefix{netip.PrefixFrom(selfAddr, 32)},
+	}).View()
+	peerNode := (&tailcfg.Node{
+		ID:           2,
+		Key:          makeNodeKeyFromID(2),
+		ComputedName: "laptop",
+		Addresses:    []netip.Prefix{netip.PrefixFrom(peerAddr, 32)},
+	}).View()
+	b.currentNode().SetNetMap(&netmap.NetworkMap{
+		SelfNode: selfNode,
+		Peers:    []tailcfg.NodeView{peerNode},
+		AllCaps:  set.Of(tailcfg.NodeAttrsTaildriveShare),
+	})
+	if !b.UpdatePacketFilter(views.Slice[tailcfg.FilterRule]{}, []filtertype.Match{{
+		IPProto: views.SliceOf([]ipproto.Proto{ipproto.TCP}),
+		Srcs:    []netip.Prefix{netip.PrefixFrom(peerAddr, 32)},
+		Caps: []filtertype.CapMatch{{
+			Dst:    netip.PrefixFrom(selfAddr, 32),
+			Cap:    tailcfg.PeerCapabilityTaildrive,
+			Values: []tailcfg.RawMessage{`{"shares":["*"],"access":"ro"}`},
+		}},
+	}}) {
+		t.Fatal("UpdatePacketFilter returned false")
+	}
+
+	h := &peerAPIHandler{
+		ps:         &peerAPIServer{b: b},
+		remoteAddr: netip.AddrPortFrom(peerAddr, 12345),
+		selfNode:   selfNode,
+		peerNode:   peerNode,
+		peerUser:   tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	rr := httptest.NewRecorder()
+	handleServeDrive(h, rr, httptest.NewRequest("GET", taildrivePrefix+"/share/file.txt", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if want := `principal="alice@example.com (laptop)" status-code=200`; !strings.Contains(logBuf.String(), want) {
+		t.Errorf("log doesn't contain %q; got:\n%s", want, logBuf.String())
+	}
+}
+
 // TestDriveGenBumps verifies that driveGen increments at each of the three
 // call sites the [driveRemoteSource] cache invalidation depends on:
 // full netmap installs, netmap deltas, and packet-filter updates. If any of
@@ -542,3 +615,177 @@ func TestDriveRemotesEndToEnd(t *testing.T) {
 	})
 	h.waitForDir([]string{"bravo", "charlie"})
 }
+
+// TestDriveHealthInStatus verifies that shares that Taildrive can't serve are
+// reported in the health messages of the status.
+func TestDriveHealthInStatus(t *testing.T) {
+	drive.DisallowShareAs = true
+	t.Cleanup(func() { drive.DisallowShareAs = false })
+
+	b := newTestLocalBackend(t)
+	fs := driveimpl.NewFileSystemForRemote(b.logf)
+	t.Cleanup(func() { fs.Close() })
+	b.sys.Set(drive.FileSystemForRemote(fs))
+
+	shares := []*drive.Share{{Name: "a", Path: t.TempDir()}}
+	b.mu.Lock()
+	b.setNetMapLocked(&netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ID:  1,
+			Key: makeNodeKeyFromID(1),
+		}).View(),
+		AllCaps: set.Of(tailcfg.NodeAttrsTaildriveShare),
+	})
+	if err := b.driveSetSharesLocked(shares); err != nil {
+		b.mu.Unlock()
+		t.Fatal(err)
+	}
+	b.mu.Unlock()
+	fs.SetShares(shares)
+
+	driveHealth := func() []string {
+		var msgs []string
+		for _, m := range b.Status().Health {
+			if strings.HasPrefix(m, "Taildrive: ") {
+				msgs = append(msgs, m)
+			}
+		}
+		return msgs
+	}
+	want := []string{`Taildrive: share "a" is unavailable: file server address not set`}
+	if got := driveHealth(); !slices.Equal(got, want) {
+		t.Errorf("Taildrive health without file server: got %q, want %q", got, want)
+	}
+
+	fs.SetFileServerAddr("token|127.0.0.1:1")
+	if got := driveHealth(); len(got) != 0 {
+		t.Errorf("Taildrive health with file server: got %q, want none", got)
+	}
+}
+
+// TestDriveSetShareEnabled verifies that shares can be disabled and enabled
+// again by name, and that unknown shares are reported as such.
+func TestDriveSetShareEnabled(t *testing.T) {
+	drive.DisallowShareAs = true
+	t.Cleanup(func() { drive.DisallowShareAs = false })
+
+	b := newTestLocalBackend(t)
+	fs := driveimpl.NewFileSystemForRemote(b.logf)
+	t.Cleanup(func() { fs.Close() })
+	b.sys.Set(drive.FileSystemForRemote(fs))
+
+	shares := []*drive.Share{{Name: "a", Path: t.TempDir()}}
+	b.mu.Lock()
+	if err := b.driveSetSharesLocked(shares); err != nil {
+		b.mu.Unlock()
+		t.Fatal(err)
+	}
+	b.mu.Unlock()
+	fs.SetShares(shares)
+	fs.SetFileServerAddr("token|127.0.0.1:1")
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		fs.ServeHTTPWithPerms(drive.Permissions{"a": drive.PermissionReadOnly}, w, httptest.NewRequest("PROPFIND", "/a", nil))
+		return w.Code
+	}
+
+	if err := b.DriveSetShareEnabled("b", false); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("disabling unknown share: got error %v, want %v", err, os.ErrNotExist)
+	}
+	if err := b.DriveSetShareEnabled(" A ", false); err != nil {
+		t.Fatalf("disabling share: %v", err)
+	}
+	if got := serve(); got != http.StatusServiceUnavailable {
+		t.Errorf("request for disabled share: got status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	if err := b.DriveSetShareEnabled("a", true); err != nil {
+		t.Fatalf("enabling share: %v", err)
+	}
+	if got := serve(); got == http.StatusServiceUnavailable {
+		t.Errorf("request for reenabled share: got status %d", got)
+	}
+}
+
+// closeRecordingDriveForRemote is a [drive.FileSystemForRemote] that records
+// whether it was closed.
+type closeRecordingDriveForRemote struct {
+	okDriveForRemote
+	closed *bool
+}
+
+func (fs closeRecordingDriveForRemote) CloseContext(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("CloseContext called without a deadline")
+	}
+	*fs.closed = true
+	return nil
+}
+
+// TestDriveClosedOnShutdown verifies that shutting down the LocalBackend
+// closes the Taildrive file system.
+func TestDriveClosedOnShutdown(t *testing.T) {
+	var closed bool
+	sys := tsd.NewSystemWithBus(eventbustest.NewBus(t))
+	sys.Set(closeRecordingDriveForRemote{closed: &closed})
+	b := newTestLocalBackendWithSys(t, sys)
+	b.Shutdown()
+	if !closed {
+		t.Error("Taildrive file system was not closed on shutdown")
+	}
+}
+
+// progressHookDriveForRemote is a [drive.FileSystemForRemote] that keeps the
+// progress hook it's given.
+type progressHookDriveForRemote struct {
+	okDriveForRemote
+	hook chan func(share, path string, transferred, total int64)
+}
+
+func (fs progressHookDriveForRemote) SetProgressHook(hook func(share, path string, transferred, total int64)) {
+	fs.hook <- hook
+}
+
+func (progressHookDriveForRemote) SetShares([]*drive.Share) {}
+
+// TestDriveTransferProgressNotify verifies that the progress of transfers of
+// this node's shares is sent to the IPN bus.
+func TestDriveTransferProgressNotify(t *testing.T) {
+	fs := progressHookDriveForRemote{hook: make(chan func(share, path string, transferred, total int64), 1)}
+	sys := tsd.NewSystemWithBus(eventbustest.NewBus(t))
+	sys.Set(fs)
+	b := newTestLocalBackendWithSys(t, sys)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	var hook func(share, path string, transferred, total int64)
+	select {
+	case hook = <-fs.hook:
+	default:
+		t.Fatal("no progress hook was set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	watchAdded := make(chan struct{})
+	got := make(chan *ipn.DriveTransferProgress, 1)
+	go b.WatchNotificationsAs(ctx, nil, 0, func() { close(watchAdded) }, func(n *ipn.Notify) bool {
+		if n.DriveTransferProgress == nil {
+			return true
+		}
+		got <- n.DriveTransferProgress
+		return false
+	})
+	<-watchAdded
+
+	hook("docs", "/a/b.txt", 10, 20)
+	want := ipn.DriveTransferProgress{Share: "docs", Path: "/a/b.txt", Transferred: 10, Total: 20}
+	select {
+	case p := <-got:
+		if *p != want {
+			t.Errorf("got progress %+v, want %+v", *p, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for progress notification")
+	}
+}
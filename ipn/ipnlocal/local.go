@@ -718,6 +718,9 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 		if f, ok := hookInstallDriveRemoteSource.GetOk(); ok {
 			f(b)
 		}
+		if f, ok := hookInstallDriveProgressHook.GetOk(); ok {
+			f(b)
+		}
 	}
 
 	return b, nil
@@ -1344,6 +1347,9 @@ func (b *LocalBackend) Shutdown() {
 	b.appConnector.Close()
 	b.mu.Unlock()
 	b.webClientShutdown()
+	if f, ok := hookShutdownDrive.GetOk(); ok {
+		f(b)
+	}
 
 	if b.sockstatLogger != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -1476,6 +1482,9 @@ func (b *LocalBackend) updateStatusLocked(sb *ipnstate.StatusBuilder) {
 		if m := b.sshOnButUnusableHealthCheckMessageLocked(); m != "" {
 			s.Health = append(s.Health, m)
 		}
+		if f, ok := hookDriveHealthMessagesLocked.GetOk(); ok {
+			s.Health = append(s.Health, f(b)...)
+		}
 		if nm != nil {
 			s.CertDomains = append([]string(nil), nm.DNS.CertDomains...)
 			s.ExtraRecords = append([]tailcfg.DNSRecord(nil), nm.DNS.ExtraRecords...)
@@ -3753,7 +3762,8 @@ func (b *LocalBackend) WatchNotificationsAs(ctx context.Context, actor ipnauth.A
 	const initialBits = ipn.NotifyInitialState | ipn.NotifyInitialPrefs |
 		ipn.NotifyInitialNetMap | ipn.NotifyInitialStatus |
 		ipn.NotifyInitialDriveShares | ipn.NotifyInitialSuggestedExitNode |
-		ipn.NotifyInitialClientVersion | ipn.NotifySysPolicyChanges | ipn.NotifyPeerWireGuardState
+		ipn.NotifyInitialClientVersion | ipn.NotifySysPolicyChanges | ipn.NotifyPeerWireGuardState |
+		ipn.NotifyInitialHealthState
 	if mask&initialBits != 0 {
 		cn := b.currentNode()
 		ini = &ipn.Notify{Version: version.Long()}
@@ -7457,6 +7467,18 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 // update.
 var hookInstallDriveRemoteSource feature.Hook[func(*LocalBackend)]
 
+// hookInstallDriveProgressHook is invoked from [NewLocalBackend] to forward
+// the progress of transfers of this node's Taildrive shares to the IPN bus.
+var hookInstallDriveProgressHook feature.Hook[func(*LocalBackend)]
+
+// hookDriveHealthMessagesLocked is invoked by [LocalBackend.UpdateStatus]
+// with b.mu held to report Taildrive shares that can't currently be served.
+var hookDriveHealthMessagesLocked feature.Hook[func(*LocalBackend) []string]
+
+// hookShutdownDrive is invoked by [LocalBackend.Shutdown] to stop serving
+// Taildrive shares once in-flight requests have finished.
+var hookShutdownDrive feature.Hook[func(*LocalBackend)]
+
 // roundTraffic rounds bytes. This is used to preserve user privacy within logs.
 func roundTraffic(bytes int64) float64 {
 	var x float64
@@ -4975,6 +4975,8 @@ func TestTCPHandlerForDstWithVIPService(t *testing.T) {
 }
 
 func TestDriveManageShares(t *testing.T) {
+	// Shares that are set must have existing directories, so the paths of
+	// shares here are relative to a directory created for each test.
 	tests := []struct {
 		name     string
 		disabled bool
@@ -4987,53 +4989,61 @@ func TestDriveManageShares(t *testing.T) {
 		{
 			name: "append",
 			existing: []*drive.Share{
-				{Name: "b"},
-				{Name: "d"},
+				{Name: "b", Path: "b"},
+				{Name: "d", Path: "d"},
 			},
-			add: &drive.Share{Name: "  E  "},
+			add: &drive.Share{Name: "  E  ", Path: "e"},
 			expect: []*drive.Share{
-				{Name: "b"},
-				{Name: "d"},
-				{Name: "e"},
+				{Name: "b", Path: "b"},
+				{Name: "d", Path: "d"},
+				{Name: "e", Path: "e"},
 			},
 		},
 		{
 			name: "prepend",
 			existing: []*drive.Share{
-				{Name: "b"},
-				{Name: "d"},
+				{Name: "b", Path: "b"},
+				{Name: "d", Path: "d"},
 			},
-			add: &drive.Share{Name: "  A  "},
+			add: &drive.Share{Name: "  A  ", Path: "a"},
 			expect: []*drive.Share{
-				{Name: "a"},
-				{Name: "b"},
-				{Name: "d"},
+				{Name: "a", Path: "a"},
+				{Name: "b", Path: "b"},
+				{Name: "d", Path: "d"},
 			},
 		},
 		{
 			name: "insert",
 			existing: []*drive.Share{
-				{Name: "b"},
-				{Name: "d"},
+				{Name: "b", Path: "b"},
+				{Name: "d", Path: "d"},
 			},
-			add: &drive.Share{Name: "  C  "},
+			add: &drive.Share{Name: "  C  ", Path: "c"},
 			expect: []*drive.Share{
-				{Name: "b"},
-				{Name: "c"},
-				{Name: "d"},
+				{Name: "b", Path: "b"},
+				{Name: "c", Path: "c"},
+				{Name: "d", Path: "d"},
 			},
 		},
 		{
 			name: "replace",
 			existing: []*drive.Share{
 				{Name: "b", Path: "i"},
-				{Name: "d"},
+				{Name: "d", Path: "d"},
 			},
 			add: &drive.Share{Name: "  B  ", Path: "ii"},
 			expect: []*drive.Share{
 				{Name: "b", Path: "ii"},
-				{Name: "d"},
+				{Name: "d", Path: "d"},
+			},
+		},
+		{
+			name: "add_overlapping",
+			existing: []*drive.Share{
+				{Name: "b", Path: "b"},
 			},
+			add:    &drive.Share{Name: "c", Path: filepath.Join("b", "c")},
+			expect: drive.ErrInvalidShare,
 		},
 		{
 			name:   "add_bad_name",
@@ -5125,10 +5135,26 @@ func TestDriveManageShares(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			inRoot := func(shares ...*drive.Share) []*drive.Share {
+				var ret []*drive.Share
+				for _, share := range shares {
+					share = share.Clone()
+					if share.Path != "" {
+						share.Path = filepath.Join(root, share.Path)
+						if err := os.MkdirAll(share.Path, 0755); err != nil {
+							t.Fatal(err)
+						}
+					}
+					ret = append(ret, share)
+				}
+				return ret
+			}
+
 			b := newTestBackend(t)
 			b.mu.Lock()
 			if tt.existing != nil {
-				b.driveSetSharesLocked(tt.existing)
+				b.driveSetSharesLocked(inRoot(tt.existing...))
 			}
 			if !tt.disabled {
 				nm := new(*b.currentNode().NetMap())
@@ -5165,7 +5191,7 @@ func(n *ipn.Notify) bool {
 			var err error
 			switch {
 			case tt.add != nil:
-				err = b.DriveSetShare(tt.add)
+				err = b.DriveSetShare(inRoot(tt.add)[0])
 			case tt.remove != "":
 				err = b.DriveRemoveShare(tt.remove)
 			default:
@@ -5187,7 +5213,7 @@ func(n *ipn.Notify) bool {
 					if err != nil {
 						t.Fatalf("can't marshal got: %v", err)
 					}
-					want, err := json.MarshalIndent(e, "", "  ")
+					want, err := json.MarshalIndent(inRoot(e...), "", "  ")
 					if err != nil {
 						t.Fatalf("can't marshal want: %v", err)
 					}
@@ -8482,6 +8508,21 @@ func TestWatchNotificationsInitialClientVersion(t *testing.T) {
 	nw3.check()
 }
 
+// TestWatchNotificationsInitialHealthState verifies that watching with only
+// NotifyInitialHealthState set still sends an initial notification.
+func TestWatchNotificationsInitialHealthState(t *testing.T) {
+	lb := newTestLocalBackend(t)
+
+	nw := newNotificationWatcher(t, lb, ipnauth.Self)
+	nw.watch(ipn.NotifyInitialHealthState, []wantedNotification{{
+		name: "Health",
+		cond: func(_ testing.TB, _ ipnauth.Actor, n *ipn.Notify) bool {
+			return n.Health != nil
+		},
+	}})
+	nw.check()
+}
+
 func wantClientVersionNotify(wantLatest string) wantedNotification {
 	return wantedNotification{
 		name: fmt.Sprintf("ClientVersion-%s", wantLatest),
@@ -6,6 +6,7 @@
 package ipnlocal
 
 import (
+	"fmt"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -66,6 +67,7 @@ func handleServeDrive(hi PeerAPIHandler, w http.ResponseWriter, r *http.Request)
 		ReadCloser: r.Body,
 	}
 	r.Body = bw
+	principal := drivePrincipalName(h.peerNode, h.peerUser)
 
 	defer func() {
 		switch wr.statusCode {
@@ -81,14 +83,27 @@ func handleServeDrive(hi PeerAPIHandler, w http.ResponseWriter, r *http.Request)
 				contentType = ct
 			}
 
-			log("taildrive: share: %s from %s to %s: status-code=%d ext=%q content-type=%q tx=%.f rx=%.f", r.Method, h.peerNode.Key().ShortString(), h.selfNode.Key().ShortString(), wr.statusCode, parseDriveFileExtensionForLog(r.URL.Path), contentType, roundTraffic(wr.contentLength), roundTraffic(bw.bytesRead))
+			log("taildrive: share: %s from %s to %s: principal=%q status-code=%d ext=%q content-type=%q tx=%.f rx=%.f", r.Method, h.peerNode.Key().ShortString(), h.selfNode.Key().ShortString(), principal, wr.statusCode, parseDriveFileExtensionForLog(r.URL.Path), contentType, roundTraffic(wr.contentLength), roundTraffic(bw.bytesRead))
 		}
 	}()
 
 	r.URL.Path = strings.TrimPrefix(r.URL.Path, taildrivePrefix)
+	r = r.WithContext(drive.WithPrincipalName(r.Context(), principal))
 	fs.ServeHTTPWithPerms(p, wr, r)
 }
 
+// drivePrincipalName returns a human-friendly name for the peer node making a
+// Taildrive request, which is logged and recorded as the owner of locks that it
+// takes.
+// Nodes owned by users are named after the user and the node, as in
+// "alice@example.com (laptop)", and tagged nodes after just the node.
+func drivePrincipalName(node tailcfg.NodeView, user tailcfg.UserProfile) string {
+	if node.IsTagged() || user.LoginName == "" {
+		return node.ComputedName()
+	}
+	return fmt.Sprintf("%s (%s)", user.LoginName, node.ComputedName())
+}
+
 // parseDriveFileExtensionForLog parses the file extension, if available.
 // If a file extension is not present or parsable, the file extension is
 // set to "unknown". If the file extension contains a double quote, it is
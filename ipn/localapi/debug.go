@@ -16,6 +16,7 @@
 	"net/http"
 	"net/netip"
 	"reflect"
+	"runtime"
 	"slices"
 	"strconv"
 	"sync"
@@ -248,6 +249,8 @@ func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
 		}
 	case "clear-netmap-cache":
 		h.b.ClearNetmapCache(r.Context())
+	case "gc":
+		runtime.GC()
 	case "current-netmap":
 		// Return the current netmap (with peers populated) as JSON. This
 		// is a debug-only path: the netmap.NetworkMap shape is an
@@ -12,6 +12,7 @@
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 
 	"tailscale.com/drive"
 	"tailscale.com/util/httpm"
@@ -20,6 +21,8 @@
 func init() {
 	Register("drive/fileserver-address", (*Handler).serveDriveServerAddr)
 	Register("drive/shares", (*Handler).serveShares)
+	Register("drive/transfers", (*Handler).serveDriveTransfers)
+	Register("drive/share-enabled", (*Handler).serveDriveShareEnabled)
 }
 
 // serveDriveServerAddr handles updates of the Taildrive file server address.
@@ -83,6 +86,10 @@ func (h *Handler) serveShares(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "invalid share name", http.StatusBadRequest)
 				return
 			}
+			if errors.Is(err, drive.ErrInvalidShare) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -139,3 +146,60 @@ func (h *Handler) serveShares(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 	}
 }
+
+// serveDriveTransfers returns the transfers of files from or to this node's
+// Taildrive shares that are in progress.
+func (h *Handler) serveDriveTransfers(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	transfers, err := h.b.DriveActiveTransfers()
+	if err != nil {
+		if errors.Is(err, drive.ErrDriveNotEnabled) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
+
+// serveDriveShareEnabled handles enabling and disabling Taildrive shares. It
+// accepts PUT requests with the share's name in the "name" query parameter and
+// whether it's enabled, as a boolean, in "enabled".
+func (h *Handler) serveDriveShareEnabled(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.PUT {
+		http.Error(w, "only PUT allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+	err = h.b.DriveSetShareEnabled(r.FormValue("name"), enabled)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "share not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, drive.ErrInvalidShareName) {
+			http.Error(w, "invalid share name", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
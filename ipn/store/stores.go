@@ -17,6 +17,7 @@
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"tailscale.com/atomicfile"
 	"tailscale.com/ipn"
@@ -223,9 +224,18 @@ func (s *FileStore) WriteState(id ipn.StateKey, bs []byte) error {
 	if err != nil {
 		return err
 	}
+	if testHookWriteDelay != nil {
+		if d := testHookWriteDelay(); d > 0 {
+			time.Sleep(d)
+		}
+	}
 	return atomicfile.WriteFile(s.path, bs, 0600)
 }
 
+// testHookWriteDelay, if non-nil, returns how long to delay each FileStore
+// write by. It's only set in binaries built for integration tests.
+var testHookWriteDelay func() time.Duration
+
 func (s *FileStore) All() iter.Seq2[ipn.StateKey, []byte] {
 	return func(yield func(ipn.StateKey, []byte) bool) {
 		s.mu.Lock()
@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_integration_test
+
+package store
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/envknob"
+)
+
+func init() {
+	testHookWriteDelay = debugStateWriteDelay
+}
+
+// debugStateWriteDelayFile is the path of a file that, if it exists, holds a
+// duration (e.g. "2s") by which to delay each FileStore write. It lets
+// integration tests simulate a slow or hanging disk and toggle it while
+// tailscaled is running.
+var debugStateWriteDelayFile = envknob.RegisterString("TS_DEBUG_STATE_WRITE_DELAY_FILE")
+
+func debugStateWriteDelay() time.Duration {
+	f := debugStateWriteDelayFile()
+	if f == "" {
+		return 0
+	}
+	bs, err := os.ReadFile(f)
+	if err != nil {
+		return 0
+	}
+	d, _ := time.ParseDuration(strings.TrimSpace(string(bs)))
+	return d
+}
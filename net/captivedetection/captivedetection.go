@@ -78,6 +78,16 @@ func (d *Detector) Detect(ctx context.Context, netMon *netmon.Monitor, derpMap *
 }
 
 func (d *Detector) detectCaptivePortalWithGOOS(ctx context.Context, netMon *netmon.Monitor, derpMap *tailcfg.DERPMap, preferredDERPRegionID int, goos string) (found bool) {
+	if testHookDebugEndpoint != nil {
+		if e, ok := testHookDebugEndpoint(d.logf); ok {
+			// Tests point us at a local endpoint, which we can reach
+			// without picking an interface.
+			found := d.detectOnInterface(ctx, 0, []Endpoint{e})
+			d.logf("DetectCaptivePortal(found=%v,debugEndpoint=%v)", found, e.URL)
+			return found
+		}
+	}
+
 	ifState := netMon.InterfaceState()
 	if !ifState.AnyInterfaceUp() {
 		d.logf("[v2] DetectCaptivePortal: no interfaces up, returning false")
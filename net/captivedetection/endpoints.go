@@ -74,6 +74,11 @@ func (e Endpoint) Equal(other Endpoint) bool {
 		e.Provider == other.Provider
 }
 
+// testHookDebugEndpoint, if non-nil, returns the only Endpoint to use for
+// captive portal detection, if ok. It's only set in binaries built for
+// integration tests.
+var testHookDebugEndpoint func(logf logger.Logf) (_ Endpoint, ok bool)
+
 // availableEndpoints returns a set of Endpoints which can be used for captive portal detection by performing
 // one or more HTTP requests and looking at the response. The returned Endpoints are ordered by preference,
 // with the most preferred Endpoint being the first in the slice.
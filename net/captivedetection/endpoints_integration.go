@@ -0,0 +1,38 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_integration_test
+
+package captivedetection
+
+import (
+	"net/http"
+	"net/url"
+
+	"tailscale.com/envknob"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	testHookDebugEndpoint = debugEndpoint
+}
+
+// debugCaptiveDetectionURL, if set, is the URL of the only endpoint to use for
+// captive portal detection. It's used by integration tests, which serve it
+// from their test control server.
+var debugCaptiveDetectionURL = envknob.RegisterString("TS_DEBUG_CAPTIVE_DETECTION_URL")
+
+// debugEndpoint returns the Endpoint for debugCaptiveDetectionURL, if set and
+// valid.
+func debugEndpoint(logf logger.Logf) (_ Endpoint, ok bool) {
+	s := debugCaptiveDetectionURL()
+	if s == "" {
+		return Endpoint{}, false
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		logf("captivedetection: failed to parse TS_DEBUG_CAPTIVE_DETECTION_URL %q: %v", s, err)
+		return Endpoint{}, false
+	}
+	return Endpoint{u, http.StatusNoContent, "", false, Tailscale}, true
+}
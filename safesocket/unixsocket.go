@@ -46,7 +46,11 @@ func listen(path string) (net.Listener, error) {
 
 	sockDir := filepath.Dir(path)
 	if _, err := os.Stat(sockDir); os.IsNotExist(err) {
-		os.MkdirAll(sockDir, 0755) // best effort
+		// Without the directory, listening can only fail, and with a less
+		// helpful error than the one for creating it.
+		if err := os.MkdirAll(sockDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating socket directory: %w", err)
+		}
 
 		// If we're on a platform where we want the socket
 		// world-readable, open up the permissions on the
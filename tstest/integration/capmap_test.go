@@ -5,11 +5,13 @@
 
 import (
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
+	"tailscale.com/tstest/integration/testcontrol"
 )
 
 // TestPeerCapMap tests that the node capability map (CapMap) is included in peer information.
@@ -143,3 +145,99 @@ func TestSetNodeCapMap(t *testing.T) {
 	d1.MustCleanShutdown(t)
 	d2.MustCleanShutdown(t)
 }
+
+// TestSelfCapMap tests that capabilities set with SetNodeSelfCapMap are
+// applied by the node they're granted to, but aren't seen by its peers.
+func TestSelfCapMap(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		// Don't grant file sharing to all nodes, so that it's only granted
+		// by the self capability below.
+		control.DefaultNodeCapabilities = &tailcfg.NodeCapMap{}
+	}))
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n1.AwaitListening()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	n2.AwaitListening()
+	n2.MustUp()
+	n2.AwaitRunning()
+
+	if err := n2.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	k1 := n1.MustStatus().Self.PublicKey
+
+	ctx := t.Context()
+	if _, err := n1.LocalClient().FileTargets(ctx); err == nil {
+		t.Fatal("FileTargets succeeded without the file sharing capability")
+	}
+
+	const selfOnly, shared = "example:self-only", "example:shared"
+	env.Control.SetNodeSelfCapMap(k1, tailcfg.NodeCapMap{
+		tailcfg.CapabilityFileSharing: nil,
+		selfOnly:                      []tailcfg.RawMessage{`true`},
+	})
+	// Set a capability that peers do see after the self-only ones, so that
+	// once n2 sees it, it has been sent n1's self-only capabilities too, if
+	// they leak.
+	env.Control.SetNodeCapMap(k1, tailcfg.NodeCapMap{
+		shared: []tailcfg.RawMessage{`true`},
+	})
+
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		self := n1.MustStatus().Self
+		for _, c := range []tailcfg.NodeCapability{tailcfg.CapabilityFileSharing, selfOnly, shared} {
+			if !self.CapMap.Contains(c) {
+				return fmt.Errorf("self CapMap %v doesn't have %q", self.CapMap, c)
+			}
+		}
+		if _, err := n1.LocalClient().FileTargets(ctx); err != nil {
+			return fmt.Errorf("FileTargets: %w", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var peerCaps tailcfg.NodeCapMap
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		st := n2.MustStatus()
+		p := st.Peer[k1]
+		if p == nil {
+			return errors.New("n1 not a peer of n2")
+		}
+		if !p.CapMap.Contains(shared) {
+			return fmt.Errorf("peer CapMap %v doesn't have %q", p.CapMap, shared)
+		}
+		peerCaps = p.CapMap
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []tailcfg.NodeCapability{tailcfg.CapabilityFileSharing, selfOnly} {
+		if peerCaps.Contains(c) {
+			t.Errorf("peer CapMap %v has self-only capability %q", peerCaps, c)
+		}
+	}
+
+	// Removing the self-only capabilities takes them away from the node
+	// again.
+	env.Control.SetNodeSelfCapMap(k1, nil)
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if _, err := n1.LocalClient().FileTargets(ctx); err == nil {
+			return errors.New("FileTargets still succeeds")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
@@ -12,6 +12,7 @@
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -32,28 +34,35 @@
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"go4.org/mem"
 	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/derp/derpserver"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/tstest/tlstest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
+	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
 	"tailscale.com/util/cibuild"
 	"tailscale.com/util/rands"
 	"tailscale.com/util/zstdframe"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/filter"
 )
 
 var (
@@ -229,12 +238,16 @@ func buildTestBinaries(dir string) error {
 	return nil
 }
 
+// integrationBuildTags are the build tags for binaries built by build. They
+// enable test-only hooks, such as the one behind [TestNode.SetStateWriteDelay].
+const integrationBuildTags = "ts_integration_test"
+
 func build(outDir string, targets ...string) error {
 	goBin, err := findGo()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(goBin, "install")
+	cmd := exec.Command(goBin, "install", "-tags="+integrationBuildTags)
 	if version.IsRace() {
 		cmd.Args = append(cmd.Args, "-race")
 	}
@@ -248,7 +261,7 @@ func build(outDir string, targets ...string) error {
 		// Fallback slow path for cross-compiled binaries.
 		for _, target := range targets {
 			outFile := filepath.Join(outDir, path.Base(target)+exe())
-			cmd := exec.Command(goBin, "build", "-o", outFile)
+			cmd := exec.Command(goBin, "build", "-tags="+integrationBuildTags, "-o", outFile)
 			if version.IsRace() {
 				cmd.Args = append(cmd.Args, "-race")
 			}
@@ -370,12 +383,77 @@ func RunDERPAndSTUN(t testing.TB, logf logger.Logf, ipAddress string) (derpMap *
 
 // LogCatcher is a minimal logcatcher for the logtail upload client.
 type LogCatcher struct {
-	mu     sync.Mutex
-	logf   logger.Logf
-	buf    bytes.Buffer
-	gotErr error
-	reqs   int
-	raw    bool // indicates whether to store the raw JSON logs uploaded, instead of just the text
+	mu      sync.Mutex
+	logf    logger.Logf
+	buf     bytes.Buffer
+	entries []LogEntry
+	gotErr  error
+	reqs    int
+	raw     bool // indicates whether to store the raw JSON logs uploaded, instead of just the text
+}
+
+// LogEntry is a log entry caught by a LogCatcher.
+type LogEntry struct {
+	// Text is the text of the entry or, for a structured entry, its record
+	// as JSON, without the "logtail", "metrics" and "v" members.
+	Text string
+
+	// Category is the subsystem that logged a text entry, taken from its
+	// "subsystem: " prefix, or the record type of a structured entry, such
+	// as "controltime". It's empty if the entry has neither.
+	Category string
+
+	// Verbosity is the verbosity level of the entry: 0 for regular logs,
+	// or 1 or 2 for those logged with a "[v1] " or "[v2] " prefix.
+	Verbosity int
+
+	// Error is whether the entry is error-level: a panic, a fatal error, a
+	// log marked "[unexpected]", or data that logtail couldn't encode.
+	Error bool
+}
+
+// logCategoryRx matches the "subsystem: " prefix of a text log entry.
+var logCategoryRx = regexp.MustCompile(`^([\w.-]+): `)
+
+// newLogEntry returns the LogEntry for the text and members of an uploaded
+// log entry. Text log entries have a "text" member, while structured ones
+// have a member named for their record type instead.
+func newLogEntry(text string, members map[string]json.RawMessage) LogEntry {
+	ent := LogEntry{Text: strings.TrimSpace(text)}
+	if v, ok := members["v"]; ok {
+		json.Unmarshal(v, &ent.Verbosity)
+	}
+	var lt struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if v, ok := members["logtail"]; ok {
+		json.Unmarshal(v, &lt)
+	}
+	if _, isText := members["text"]; isText || len(members) == 0 {
+		if m := logCategoryRx.FindStringSubmatch(ent.Text); m != nil {
+			ent.Category = m[1]
+		}
+	} else {
+		record := make(map[string]json.RawMessage)
+		for k, v := range members {
+			switch k {
+			case "logtail", "metrics", "v":
+			default:
+				record[k] = v
+				if ent.Category == "" || k < ent.Category {
+					ent.Category = k
+				}
+			}
+		}
+		if b, err := json.Marshal(record); err == nil {
+			ent.Text = string(b)
+		}
+	}
+	ent.Error = len(lt.Error) > 0 ||
+		strings.Contains(ent.Text, "[unexpected]") ||
+		strings.HasPrefix(ent.Text, "panic: ") ||
+		strings.HasPrefix(ent.Text, "fatal error: ")
+	return ent
 }
 
 // UseLogf makes the logcatcher implementation use a given logf function
@@ -399,6 +477,48 @@ func (lc *LogCatcher) logsContains(sub mem.RO) bool {
 	return mem.Contains(mem.B(lc.buf.Bytes()), sub)
 }
 
+// CountMatching returns the number of log entries caught by lc whose text
+// matches re.
+func (lc *LogCatcher) CountMatching(re *regexp.Regexp) int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	n := 0
+	for _, ent := range lc.entries {
+		if re.MatchString(ent.Text) {
+			n++
+		}
+	}
+	return n
+}
+
+// Entries returns the log entries caught by lc in the given category, or all
+// of them if category is empty, in the order they were uploaded.
+func (lc *LogCatcher) Entries(category string) []LogEntry {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	var ents []LogEntry
+	for _, ent := range lc.entries {
+		if category == "" || ent.Category == category {
+			ents = append(ents, ent)
+		}
+	}
+	return ents
+}
+
+// ErrorEntries returns the error-level log entries caught by lc, in the order
+// they were uploaded.
+func (lc *LogCatcher) ErrorEntries() []LogEntry {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	var ents []LogEntry
+	for _, ent := range lc.entries {
+		if ent.Error {
+			ents = append(ents, ent)
+		}
+	}
+	return ents
+}
+
 func (lc *LogCatcher) numRequests() int {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
@@ -416,6 +536,7 @@ func (lc *LogCatcher) Reset() {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
 	lc.buf.Reset()
+	lc.entries = nil
 }
 
 func (lc *LogCatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -462,12 +583,21 @@ type Entry struct {
 		Text string `json:"text"`
 	}
 	var jreq []Entry
+	var members []map[string]json.RawMessage
 	if len(bodyBytes) > 0 && bodyBytes[0] == '[' {
 		err = json.Unmarshal(bodyBytes, &jreq)
+		if err == nil {
+			err = json.Unmarshal(bodyBytes, &members)
+		}
 	} else {
 		var ent Entry
+		var m map[string]json.RawMessage
 		err = json.Unmarshal(bodyBytes, &ent)
+		if err == nil {
+			err = json.Unmarshal(bodyBytes, &m)
+		}
 		jreq = append(jreq, ent)
+		members = append(members, m)
 	}
 
 	lc.mu.Lock()
@@ -483,7 +613,8 @@ type Entry struct {
 		}
 	} else {
 		id := privID.Public().String()[:3] // good enough for integration tests
-		for _, ent := range jreq {
+		for i, ent := range jreq {
+			lc.entries = append(lc.entries, newLogEntry(ent.Text, members[i]))
 			if lc.raw {
 				lc.buf.Write(bodyBytes)
 				continue
@@ -508,6 +639,10 @@ type TestEnv struct {
 	loopbackPort           *int
 	neverDirectUDP         bool
 	relayServerUseLoopback bool
+	controlTLS             *ControlTLS      // if non-nil, control is served over HTTPS
+	controlRootCAFile      string           // if non-empty, a PEM file of extra roots for nodes to trust
+	derpDisabled           bool             // whether SetDERPDisabled(true) is in effect
+	derpMapBeforeDisabled  *tailcfg.DERPMap // control's DERPMap before SetDERPDisabled(true)
 
 	LogCatcher       *LogCatcher
 	LogCatcherServer *httptest.Server
@@ -520,15 +655,64 @@ type TestEnv struct {
 }
 
 // ControlURL returns e.ControlServer.URL, panicking if it's the empty string,
-// which it should never be in tests.
+// which it should never be in tests. If control is served over HTTPS (see
+// [ControlTLS]), the URL's host is "localhost" rather than an IP address.
 func (e *TestEnv) ControlURL() string {
 	s := e.ControlServer.URL
 	if s == "" {
 		panic("control server not set")
 	}
+	if e.controlTLS != nil {
+		u, err := url.Parse(s)
+		if err != nil {
+			panic(err)
+		}
+		u.Host = net.JoinHostPort("localhost", u.Port())
+		return u.String()
+	}
 	return s
 }
 
+// SeedNetmap registers nodes stub nodes in e's control server, without
+// running daemons for them, so that tests of large netmaps don't need to
+// register that many real nodes. If peersVisible, the stub nodes are peers of
+// each other and of all real nodes; otherwise they're registered but kept out
+// of all netmaps. It's typically called before starting any daemons, but
+// running nodes are sent the new peers too.
+//
+// It returns the node keys of the stub nodes.
+func (e *TestEnv) SeedNetmap(nodes int, peersVisible bool) []key.NodePublic {
+	return e.Control.SeedNodes(nodes, peersVisible)
+}
+
+// SetDERPDisabled sets whether e's control server withholds all DERP servers
+// from nodes, so that they can only communicate over direct WireGuard
+// connections. It takes effect immediately, including for running nodes.
+func (e *TestEnv) SetDERPDisabled(disabled bool) {
+	if disabled == e.derpDisabled {
+		return
+	}
+	e.derpDisabled = disabled
+	if disabled {
+		e.derpMapBeforeDisabled = e.Control.DERPMap
+		e.Control.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}})
+	} else {
+		e.Control.SetDERPMap(e.derpMapBeforeDisabled)
+		e.derpMapBeforeDisabled = nil
+	}
+}
+
+// SetCaptivePortal sets whether e simulates its nodes' network being behind a
+// captive portal. While it is, the connectivity check that nodes use to detect
+// captive portals gets a login page instead of 204 No Content, and the portal
+// blocks traffic to the DERP servers, which is modeled by withholding them from
+// nodes as SetDERPDisabled does. Losing their DERP home is what prompts
+// running nodes to check for a captive portal.
+func (e *TestEnv) SetCaptivePortal(captive bool) {
+	e.Control.SetCaptivePortal(captive)
+	e.SetDERPDisabled(captive)
+}
+
 // TestEnvOpt represents an option that can be passed to NewTestEnv.
 type TestEnvOpt interface {
 	ModifyTestEnv(*TestEnv)
@@ -541,6 +725,32 @@ func (f ConfigureControl) ModifyTestEnv(te *TestEnv) {
 	f(te.Control)
 }
 
+// ControlTLS is a test option that serves the test control server over HTTPS
+// at https://localhost:<port>, with a certificate signed by
+// [tlstest.TestRootCA].
+type ControlTLS struct {
+	// CertDomain is the name in control's certificate. If empty, it's
+	// "localhost", matching [TestEnv.ControlURL].
+	CertDomain tlstest.Domain
+
+	// UntrustedRoot, if true, makes nodes not trust the test root CA, so
+	// they reject control's certificate.
+	UntrustedRoot bool
+}
+
+func (c ControlTLS) ModifyTestEnv(te *TestEnv) {
+	if c.CertDomain == "" {
+		c.CertDomain = "localhost"
+	}
+	te.controlTLS = &c
+	if !c.UntrustedRoot {
+		te.controlRootCAFile = filepath.Join(te.t.TempDir(), "root-ca.pem")
+		if err := os.WriteFile(te.controlRootCAFile, tlstest.TestRootCA(), 0644); err != nil {
+			te.t.Fatal(err)
+		}
+	}
+}
+
 // canRunAsServiceOnWindowsOpt is the TestEnvOpt returned by canRunAsServiceOnWindows.
 type canRunAsServiceOnWindowsOpt struct{}
 
@@ -599,7 +809,13 @@ func NewTestEnv(t testing.TB, opts ...TestEnvOpt) *TestEnv {
 	for _, o := range opts {
 		o.ModifyTestEnv(e)
 	}
-	control.HTTPTestServer.Start()
+	if e.controlTLS != nil {
+		control.HTTPTestServer.TLS = e.controlTLS.CertDomain.ServerTLSConfig()
+		control.HTTPTestServer.StartTLS()
+		control.ExplicitBaseURL = e.ControlURL()
+	} else {
+		control.HTTPTestServer.Start()
+	}
 	t.Cleanup(func() {
 		// Shut down e.
 		if err := e.TrafficTrap.Err(); err != nil {
@@ -609,6 +825,7 @@ func NewTestEnv(t testing.TB, opts ...TestEnvOpt) *TestEnv {
 		e.LogCatcherServer.Close()
 		e.TrafficTrapServer.Close()
 		e.ControlServer.Close()
+		e.Control.Close()
 	})
 	t.Logf("control URL: %v", e.ControlURL())
 	return e
@@ -626,9 +843,14 @@ type TestNode struct {
 	sockFile     string
 	stateFile    string
 	upFlagGOOS   string // if non-empty, sets TS_DEBUG_UP_FLAG_GOOS for cmd/tailscale CLI
+	ipnVersion   string // if non-empty, sets TS_DEBUG_FAKE_IPN_VERSION for tailscaled
 	encryptState bool
 	allowUpdates bool
 
+	// daemon is the process of the tailscaled most recently started by
+	// StartDaemon, if any.
+	daemon *os.Process
+
 	mu        sync.Mutex
 	onLogLine []func([]byte)
 	lc        *local.Client
@@ -712,6 +934,39 @@ func (n *TestNode) diskPrefs() *ipn.Prefs {
 	return p.AsStruct()
 }
 
+// readStateFile returns the contents of n's plaintext state file, keyed by
+// state key.
+func (n *TestNode) readStateFile() (map[ipn.StateKey][]byte, error) {
+	buf, err := os.ReadFile(n.stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var content map[ipn.StateKey][]byte
+	if err := json.Unmarshal(buf, &content); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", n.stateFile, err)
+	}
+	return content, nil
+}
+
+// AwaitStateKeyAbsent waits for key to no longer be present in n's
+// plaintext state file.
+func (n *TestNode) AwaitStateKeyAbsent(key string) {
+	t := n.env.t
+	t.Helper()
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		content, err := n.readStateFile()
+		if err != nil {
+			return err
+		}
+		if _, ok := content[ipn.StateKey(key)]; ok {
+			return fmt.Errorf("state file still contains key %q", key)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // AwaitResponding waits for n's tailscaled to be up enough to be
 // responding, but doesn't wait for any particular state.
 func (n *TestNode) AwaitResponding() {
@@ -870,15 +1125,23 @@ func (n *TestNode) daemonEnv(ipnGOOS string) []string {
 		"HTTPS_PROXY=" + n.env.TrafficTrapServer.URL,
 		"TS_DEBUG_FAKE_GOOS=" + ipnGOOS,
 		"TS_LOGS_DIR=" + n.dir,
-		"TS_NETCHECK_GENERATE_204_URL=" + n.env.ControlServer.URL + "/generate_204",
+		"TS_DEBUG_CAPTIVE_DETECTION_URL=" + n.env.ControlServer.URL + "/generate_204",
 		"TS_ASSUME_NETWORK_UP_FOR_TEST=1", // don't pause control client in airplane mode (no wifi, etc)
 		"TS_PANIC_IF_HIT_MAIN_CONTROL=1",
 		"TS_DISABLE_PORTMAPPER=1", // shouldn't be needed; test is all localhost
 		"TS_DEBUG_LOG_RATE=all",
+		"TS_DEBUG_STATE_WRITE_DELAY_FILE=" + n.stateWriteDelayFile(),
+		"TS_DEBUG_MAGICSOCK_BIND_ADDR_FILE=" + n.bindAddrFile(),
 	}
 	if n.allowUpdates {
 		env = append(env, "TS_TEST_ALLOW_AUTO_UPDATE=1")
 	}
+	if n.ipnVersion != "" {
+		env = append(env, "TS_DEBUG_FAKE_IPN_VERSION="+n.ipnVersion)
+	}
+	if n.env.controlRootCAFile != "" {
+		env = append(env, "SSL_CERT_FILE="+n.env.controlRootCAFile)
+	}
 	if n.env.loopbackPort != nil {
 		env = append(env, "TS_DEBUG_NETSTACK_LOOPBACK_PORT="+strconv.Itoa(*n.env.loopbackPort))
 	}
@@ -894,6 +1157,80 @@ func (n *TestNode) daemonEnv(ipnGOOS string) []string {
 	return env
 }
 
+// stateWriteDelayFile returns the path of the file that controls the
+// artificial delay of tailscaled's state file writes.
+// See [TestNode.SetStateWriteDelay].
+func (n *TestNode) stateWriteDelayFile() string {
+	return filepath.Join(n.dir, "state-write-delay")
+}
+
+// SetStateWriteDelay makes the node's tailscaled delay each write of its state
+// file by d, simulating a slow disk. A zero d removes the delay. It takes
+// effect immediately, including for a running tailscaled.
+func (n *TestNode) SetStateWriteDelay(d time.Duration) {
+	t := n.env.t
+	t.Helper()
+	if d == 0 {
+		if err := os.Remove(n.stateWriteDelayFile()); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err := os.WriteFile(n.stateWriteDelayFile(), []byte(d.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bindAddrFile returns the path of the file that holds the local IP address
+// the node's tailscaled binds its magicsock UDP sockets to.
+// See [TestNode.SimulateRoam].
+func (n *TestNode) bindAddrFile() string {
+	return filepath.Join(n.dir, "magicsock-bind-addr")
+}
+
+// SimulateRoam simulates n moving to a network on which its local IP address
+// is newLocalIP, by rebinding its tailscaled's magicsock UDP sockets to that
+// address. Peers then can't reach n at its old endpoints, and have to learn
+// its new ones to communicate with it directly again.
+//
+// On Linux, every address in 127.0.0.0/8 is a usable loopback address.
+func (n *TestNode) SimulateRoam(newLocalIP netip.Addr) error {
+	if err := os.WriteFile(n.bindAddrFile(), []byte(newLocalIP.String()), 0644); err != nil {
+		return err
+	}
+	for _, action := range []string{"rebind", "restun"} {
+		cmd := n.Tailscale("debug", action)
+		cmd.Stdout = nil // in case --verbose-tailscale was set
+		cmd.Stderr = nil // in case --verbose-tailscale was set
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("tailscale debug %s: %v, %s", action, err, out)
+		}
+	}
+	return nil
+}
+
+// SimulateSuspendResume simulates n's machine sleeping for d and waking up, by
+// freezing its tailscaled for d. As during a real sleep, tailscaled sends and
+// receives nothing and its timers don't fire, and when it resumes its wall
+// clock has jumped ahead by d.
+//
+// Tailscaled only notices time jumps of more than 1.5 times its wall time
+// polling interval of 15s, so shorter suspensions, like short sleeps, may go
+// unnoticed.
+func (n *TestNode) SimulateSuspendResume(d time.Duration) error {
+	if n.daemon == nil {
+		return errors.New("tailscaled not started with StartDaemon")
+	}
+	if err := suspendProcess(n.daemon); err != nil {
+		return fmt.Errorf("suspending tailscaled: %w", err)
+	}
+	time.Sleep(d)
+	if err := resumeProcess(n.daemon); err != nil {
+		return fmt.Errorf("resuming tailscaled: %w", err)
+	}
+	return nil
+}
+
 // StartDaemon starts the node's tailscaled, failing if it fails to start.
 // StartDaemon ensures that the process will exit when the test completes.
 func (n *TestNode) StartDaemon() *Daemon {
@@ -954,11 +1291,55 @@ func (n *TestNode) StartDaemonAsIPNGOOS(ipnGOOS string) *Daemon {
 		t.Fatalf("starting tailscaled: %v", err)
 	}
 	t.Cleanup(func() { cmd.Process.Kill() })
+	n.daemon = cmd.Process
 	return &Daemon{
 		Process: cmd.Process,
 	}
 }
 
+// RestartDaemonAsVersion shuts down d and restarts n's tailscaled reporting
+// the given version to control, simulating an upgrade or downgrade to it. It
+// waits for the node to be Running again without logging in, and fails the
+// test if the node's on-disk prefs changed across the restart or if it came
+// back as a different node.
+func (n *TestNode) RestartDaemonAsVersion(d *Daemon, version string) *Daemon {
+	t := n.env.t
+	t.Helper()
+
+	prefs := n.diskPrefs()
+	nodeKey := n.MustStatus().Self.PublicKey
+	numNodes := len(n.env.Control.AllNodes())
+
+	d.MustCleanShutdown(t)
+	n.ipnVersion = version
+	d = n.StartDaemon()
+	n.AwaitResponding()
+	n.AwaitRunning()
+
+	if got := n.diskPrefs(); !got.Equals(prefs) {
+		t.Fatalf("prefs changed across restart as %q:\n got: %v\nwant: %v", version, got.Pretty(), prefs.Pretty())
+	}
+	if got := n.MustStatus().Self.PublicKey; got != nodeKey {
+		t.Fatalf("node key changed across restart as %q: got %v, want %v", version, got.ShortString(), nodeKey.ShortString())
+	}
+	if got := len(n.env.Control.AllNodes()); got != numNodes {
+		t.Fatalf("control has %d nodes after restart as %q; want %d", got, version, numNodes)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		node := n.env.Control.Node(nodeKey)
+		if node == nil {
+			return fmt.Errorf("node %v not found in control", nodeKey.ShortString())
+		}
+		if got := node.Hostinfo.IPNVersion(); got != version {
+			return fmt.Errorf("control sees version %q; want %q", got, version)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
 func (n *TestNode) MustUp(extraArgs ...string) {
 	t := n.env.t
 	t.Helper()
@@ -1014,19 +1395,45 @@ func (n *TestNode) Ping(otherNode *TestNode) error {
 	return n.Tailscale("ping", "--timeout=1s", ip).Run()
 }
 
+// PingDetailed sends a disco ping from n to peer's IPv4 address via the
+// LocalAPI and returns the structured result, including the latency and
+// whether the pong came over a direct endpoint, DERP or a peer relay.
+//
+// It returns an error if the ping failed, including if the result reports
+// an error.
+func (n *TestNode) PingDetailed(peer *TestNode) (*ipnstate.PingResult, error) {
+	ip := peer.AwaitIP4()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := n.LocalClient().Ping(ctx, ip, tailcfg.PingDisco)
+	if err != nil {
+		return nil, err
+	}
+	if res.Err != "" {
+		return res, fmt.Errorf("ping %v: %s", ip, res.Err)
+	}
+	return res, nil
+}
+
 // AwaitListening waits for the tailscaled to be serving local clients
 // over its localhost IPC mechanism. (Unix socket, etc)
 func (n *TestNode) AwaitListening() {
 	t := n.env.t
-	if err := tstest.WaitFor(20*time.Second, func() (err error) {
+	if err := n.awaitListening(20 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// awaitListening is like AwaitListening, but gives up after the given
+// timeout, returning the last error from connecting.
+func (n *TestNode) awaitListening(timeout time.Duration) error {
+	return tstest.WaitFor(timeout, func() (err error) {
 		c, err := safesocket.ConnectContext(context.Background(), n.sockFile)
 		if err == nil {
 			c.Close()
 		}
 		return err
-	}); err != nil {
-		t.Fatal(err)
-	}
+	})
 }
 
 func (n *TestNode) AwaitIPs() []netip.Addr {
@@ -1078,6 +1485,51 @@ func (n *TestNode) AwaitIP6() netip.Addr {
 	return ips[1]
 }
 
+// AwaitPeerFilterBlocks waits until TCP connections from n to addr:port,
+// which is expected to be served through peer, fail, while peer is still
+// in n's netmap. It's meant for checking that a pref or policy change that
+// should cut off traffic takes effect live.
+func (n *TestNode) AwaitPeerFilterBlocks(peer *TestNode, addr netip.Addr, port uint16) {
+	t := n.env.t
+	t.Helper()
+	if err := n.awaitPeerDial(peer, addr, port, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitPeerFilterAllows is the opposite of AwaitPeerFilterBlocks: it waits
+// until TCP connections from n to addr:port through peer succeed.
+func (n *TestNode) AwaitPeerFilterAllows(peer *TestNode, addr netip.Addr, port uint16) {
+	t := n.env.t
+	t.Helper()
+	if err := n.awaitPeerDial(peer, addr, port, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (n *TestNode) awaitPeerDial(peer *TestNode, addr netip.Addr, port uint16, wantOK bool) error {
+	peerKey := peer.MustStatus().Self.PublicKey
+	dst := netip.AddrPortFrom(addr, port)
+	return tstest.WaitFor(20*time.Second, func() error {
+		if _, ok := n.MustStatus().Peer[peerKey]; !ok {
+			return fmt.Errorf("peer %v not in netmap", peerKey.ShortString())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c, err := n.LocalClient().DialTCP(ctx, addr.String(), port)
+		if err == nil {
+			c.Close()
+		}
+		switch {
+		case wantOK && err != nil:
+			return fmt.Errorf("dial %v through %v: %v; want success", dst, peerKey.ShortString(), err)
+		case !wantOK && err == nil:
+			return fmt.Errorf("dial %v through %v succeeded; want it blocked", dst, peerKey.ShortString())
+		}
+		return nil
+	})
+}
+
 // AwaitRunning waits for n to reach the IPN state "Running".
 func (n *TestNode) AwaitRunning() {
 	t := n.env.t
@@ -1085,6 +1537,70 @@ func (n *TestNode) AwaitRunning() {
 	n.AwaitBackendState("Running")
 }
 
+// AwaitPeers waits up to timeout for n's status to list exactly want peers.
+// If it doesn't, the returned error includes the peers it has.
+func (n *TestNode) AwaitPeers(want int, timeout time.Duration) error {
+	return n.awaitPeers(timeout, peerCountIs(want))
+}
+
+// AwaitPeer waits up to timeout for n's status to list the peer with node key
+// k.
+func (n *TestNode) AwaitPeer(k key.NodePublic, timeout time.Duration) error {
+	return n.awaitPeers(timeout, func(st *ipnstate.Status) error {
+		if _, ok := st.Peer[k]; !ok {
+			return fmt.Errorf("peer %v not in status", k.ShortString())
+		}
+		return nil
+	})
+}
+
+// peerCountIs returns an awaitPeers check that n's status lists exactly want
+// peers.
+func peerCountIs(want int) func(*ipnstate.Status) error {
+	return func(st *ipnstate.Status) error {
+		if got := len(st.Peer); got != want {
+			return fmt.Errorf("got %d peers; want %d", got, want)
+		}
+		return nil
+	}
+}
+
+// awaitPeers polls n's status until check accepts it, for up to timeout. If
+// check never does, the returned error includes the last peer set seen.
+func (n *TestNode) awaitPeers(timeout time.Duration, check func(*ipnstate.Status) error) error {
+	return tstest.WaitFor(timeout, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		st, err := n.LocalClient().Status(ctx)
+		if err != nil {
+			return err
+		}
+		if err := check(st); err != nil {
+			return fmt.Errorf("%w; peers: %s", err, formatPeers(st))
+		}
+		return nil
+	})
+}
+
+// formatPeers returns a short description of the peers in st, for error
+// messages.
+func formatPeers(st *ipnstate.Status) string {
+	const maxShown = 10
+	peers := st.Peers()
+	descs := make([]string, 0, min(len(peers), maxShown+1))
+	for i, k := range peers {
+		if i == maxShown {
+			descs = append(descs, fmt.Sprintf("and %d more", len(peers)-maxShown))
+			break
+		}
+		ps := st.Peer[k]
+		descs = append(descs, fmt.Sprintf("%s (%v %v)", ps.HostName, k.ShortString(), ps.TailscaleIPs))
+	}
+	return "[" + strings.Join(descs, ", ") + "]"
+}
+
+// AwaitBackendState waits for n to reach the IPN state with the given name,
+// such as "NeedsMachineAuth" or "Running".
 func (n *TestNode) AwaitBackendState(state string) {
 	t := n.env.t
 	t.Helper()
@@ -1098,7 +1614,7 @@ func (n *TestNode) AwaitBackendState(state string) {
 		}
 		return nil
 	}); err != nil {
-		t.Fatalf("failure/timeout waiting for transition to Running status: %v", err)
+		t.Fatalf("failure/timeout waiting for transition to %s status: %v", state, err)
 	}
 }
 
@@ -1148,6 +1664,56 @@ func (n *TestNode) Tailscale(arg ...string) *exec.Cmd {
 	return cmd
 }
 
+// DNSQuery sends a DNS query for fqdn of type qtype to the Tailscale DNS
+// resolver at quad-100 and returns its response. The network is one of "udp4",
+// "udp6", "tcp4" or "tcp6", and determines both the transport and which of the
+// Tailscale service IPs is queried.
+//
+// Queries go through the host's network stack, so n must be running in TUN
+// mode.
+func (n *TestNode) DNSQuery(network, fqdn string, qtype uint16) (*dns.Msg, error) {
+	serviceIP := tsaddr.TailscaleServiceIP()
+	if strings.HasSuffix(network, "6") {
+		serviceIP = tsaddr.TailscaleServiceIPv6()
+	}
+	conn, err := net.DialTimeout(network, net.JoinHostPort(serviceIP.String(), "53"), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, qtype)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, _, err := new(dns.Client).ExchangeWithConnContext(ctx, m, &dns.Conn{Conn: conn})
+	return resp, err
+}
+
+// DNSSearchDomains returns the DNS search domains that n's tailscaled applies,
+// in order, as read from its LocalAPI. That's the search domains of the DNS
+// config from control, or none if n doesn't accept it.
+func (n *TestNode) DNSSearchDomains() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lc := n.LocalClient()
+	prefs, err := lc.GetPrefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !prefs.CorpDNS {
+		return nil, nil
+	}
+	cfg, err := lc.DNSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, nil
+	}
+	return cfg.Domains, nil
+}
+
 func (n *TestNode) Status() (*ipnstate.Status, error) {
 	cmd := n.Tailscale("status", "--json")
 	cmd.Stdout = nil // in case --verbose-tailscale was set
@@ -1173,6 +1739,109 @@ func (n *TestNode) MustStatus() *ipnstate.Status {
 	return st
 }
 
+// GoroutineCount returns the number of goroutines currently running in the
+// node's tailscaled, as reported by its goroutine dump.
+func (n *TestNode) GoroutineCount() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dump, err := n.LocalClient().Goroutines(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("fetching goroutine dump: %w", err)
+	}
+	var count int
+	for line := range bytes.Lines(dump) {
+		if bytes.HasPrefix(line, []byte("goroutine ")) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ClientMetric returns the value of the named client metric (see package
+// clientmetric) of n's tailscaled.
+func (n *TestNode) ClientMetric(name string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	metrics, err := n.LocalClient().DaemonMetrics(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("fetching metrics: %w", err)
+	}
+	for line := range bytes.Lines(metrics) {
+		f := strings.Fields(string(line))
+		if len(f) == 2 && f[0] == name {
+			return strconv.ParseInt(f[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no metric %q", name)
+}
+
+// NetCheck runs "tailscale netcheck --format=json" for n and returns the
+// report it prints. The CLI checks the network itself rather than asking
+// tailscaled, but uses the DERP map of n's tailscaled.
+func (n *TestNode) NetCheck() (*netcheck.Report, error) {
+	cmd := n.TailscaleForOutput("netcheck", "--format=json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("tailscale netcheck: %w; stderr: %s", err, stderr.Bytes())
+	}
+	report := new(netcheck.Report)
+	if err := json.Unmarshal(out, report); err != nil {
+		return nil, fmt.Errorf("parsing netcheck report %q: %w", out, err)
+	}
+	return report, nil
+}
+
+// NetMap returns the current netmap of n's tailscaled, as sent on the IPN bus
+// to a new watcher.
+func (n *TestNode) NetMap() (*netmap.NetworkMap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w, err := n.LocalClient().WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	for {
+		nt, err := w.Next()
+		if err != nil {
+			return nil, err
+		}
+		if nt.NetMap != nil {
+			return nt.NetMap, nil
+		}
+	}
+}
+
+// PacketFilter returns the packet filter rules that n's tailscaled compiled
+// from the filter in its netmap, as reported by the LocalAPI.
+func (n *TestNode) PacketFilter() ([]filter.Match, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/debug-packet-filter-matches", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.LocalClient().DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching packet filter: %v: %s", res.Status, body)
+	}
+	var matches []filter.Match
+	if err := json.Unmarshal(body, &matches); err != nil {
+		return nil, fmt.Errorf("decoding packet filter: %w\njson:\n%s", err, body)
+	}
+	return matches, nil
+}
+
 // PublicKey returns the hex-encoded public key of this node,
 // e.g. `nodekey:123456abc`
 func (n *TestNode) PublicKey() string {
@@ -0,0 +1,19 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package integration
+
+import (
+	"errors"
+	"os"
+)
+
+var errSuspendUnsupported = errors.New("suspending processes is not supported on Windows")
+
+func suspendProcess(*os.Process) error {
+	return errSuspendUnsupported
+}
+
+func resumeProcess(*os.Process) error {
+	return errSuspendUnsupported
+}
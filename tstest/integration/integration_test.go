@@ -8,6 +8,7 @@
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -31,8 +32,10 @@
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/miekg/dns"
 	"go4.org/mem"
+	"golang.org/x/crypto/ssh"
 	"tailscale.com/client/local"
 	"tailscale.com/cmd/testwrapper/flakytest"
 	"tailscale.com/envknob"
@@ -41,17 +44,26 @@
 	"tailscale.com/health"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/ipn/store"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tstun"
 	"tailscale.com/net/udprelay/status"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/tstest/tlstest"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/opt"
+	"tailscale.com/types/views"
 	"tailscale.com/util/must"
 	"tailscale.com/util/set"
+	"tailscale.com/version"
+	"tailscale.com/wgengine/filter"
 )
 
 func TestMain(m *testing.M) {
@@ -154,6 +166,107 @@ func TestOneNodeExpiredKey(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
+// TestReauthRequiredPeriodically tests that a node on a tailnet whose login
+// sessions expire periodically is prompted to reauthenticate when its session
+// elapses, and is running again once it has.
+func TestReauthRequiredPeriodically(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	const session = 5 * time.Second
+	env.Control.RequireReauthEvery(session)
+	for i := range 2 {
+		n1.AwaitNeedsLogin()
+
+		var authURLCount atomic.Int32
+		cmd := n1.Tailscale("up", "--force-reauth", "--login-server="+env.ControlURL())
+		cmd.Stdout = &authURLParserWriter{t: t, authURLFn: completeLogin(t, env.Control, &authURLCount)}
+		cmd.Stderr = cmd.Stdout
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("reauth %d: up: %v", i, err)
+		}
+		if n := authURLCount.Load(); n != 1 {
+			t.Errorf("reauth %d: auth URLs completed = %d; want 1", i, n)
+		}
+		n1.AwaitRunning()
+	}
+}
+
+// TestForceLogout tests that a node logged out remotely by control goes to
+// NeedsLogin without affecting its peers, and that it can log back in as the
+// same node with a new node key.
+func TestForceLogout(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	nodes := make([]*TestNode, 3)
+	for i := range nodes {
+		nodes[i] = NewTestNode(t, env)
+		d := nodes[i].StartDaemon()
+		defer d.MustCleanShutdown(t)
+		nodes[i].AwaitResponding()
+		nodes[i].MustUp()
+		nodes[i].AwaitRunning()
+	}
+	n1, n2, n3 := nodes[0], nodes[1], nodes[2]
+	if err := n1.AwaitPeers(2, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	oldKey := n1.MustStatus().Self.PublicKey
+	nodeID := env.Control.Node(oldKey).ID
+
+	env.Control.ForceLogout(oldKey)
+	n1.AwaitNeedsLogin()
+
+	// The other nodes carry on as before.
+	for _, n := range []*TestNode{n2, n3} {
+		if st := n.MustStatus(); st.BackendState != "Running" {
+			t.Errorf("peer in state %q; want Running", st.BackendState)
+		}
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		return n2.Ping(n3)
+	}); err != nil {
+		t.Errorf("ping between peers: %v", err)
+	}
+
+	// Logging back in requires visiting an auth URL.
+	var authURLCount atomic.Int32
+	cmd := n1.Tailscale("up", "--login-server="+env.ControlURL())
+	cmd.Stdout = &authURLParserWriter{t: t, authURLFn: completeLogin(t, env.Control, &authURLCount)}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if n := authURLCount.Load(); n != 1 {
+		t.Errorf("auth URLs completed = %d; want 1", n)
+	}
+	n1.AwaitRunning()
+
+	newKey := n1.MustStatus().Self.PublicKey
+	if newKey == oldKey {
+		t.Error("node key unchanged after forced logout")
+	}
+	if cn := env.Control.Node(newKey); cn == nil || cn.ID != nodeID {
+		t.Errorf("node after logging back in = %v; want node ID %v", cn, nodeID)
+	}
+	if err := n1.AwaitPeers(2, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		return n1.Ping(n2)
+	}); err != nil {
+		t.Errorf("ping after logging back in: %v", err)
+	}
+}
+
 func TestControlKnobs(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
@@ -184,6 +297,53 @@ func TestControlKnobs(t *testing.T) {
 	}
 }
 
+// TestDebugFlags tests that debug flags set by control for a node are
+// delivered to it in its netmap and reflected in its control knobs as they
+// change.
+func TestDebugFlags(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+	k1 := n1.MustStatus().Self.PublicKey
+
+	// awaitForceBackgroundSTUN waits for "tailscale debug control-knobs" to
+	// report the ForceBackgroundSTUN knob as want.
+	awaitForceBackgroundSTUN := func(want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			cmd := n1.Tailscale("debug", "control-knobs")
+			cmd.Stdout = nil // in case --verbose-tailscale was set
+			cmd.Stderr = nil // in case --verbose-tailscale was set
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%v: %s", err, out)
+			}
+			var m map[string]any
+			if err := json.Unmarshal(out, &m); err != nil {
+				return err
+			}
+			if got := m["ForceBackgroundSTUN"]; got != want {
+				return fmt.Errorf("control-knobs ForceBackgroundSTUN = %v; want %v", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	awaitForceBackgroundSTUN(false)
+	env.Control.SetDebugFlags(k1, []string{string(tailcfg.NodeAttrDebugForceBackgroundSTUN)})
+	awaitForceBackgroundSTUN(true)
+	env.Control.SetDebugFlags(k1, nil)
+	awaitForceBackgroundSTUN(false)
+}
+
 func TestExpectedFeaturesLinked(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
@@ -247,6 +407,93 @@ func TestCollectPanic(t *testing.T) {
 	}
 }
 
+// TestUnwritableSocketPath tests that tailscaled exits promptly with an error
+// naming the problem when it can't listen on its socket path, rather than
+// hanging or panicking.
+func TestUnwritableSocketPath(t *testing.T) {
+	tstest.Parallel(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("tailscaled listens on a named pipe on Windows")
+	}
+	env := NewTestEnv(t)
+
+	tests := []struct {
+		name     string
+		sockFile func(dir string) string
+		wantErr  string
+		skip     string // if non-empty, reason to skip the test
+	}{
+		{
+			name: "parent-is-file",
+			sockFile: func(dir string) string {
+				f := filepath.Join(dir, "file")
+				must.Do(os.WriteFile(f, nil, 0644))
+				return filepath.Join(f, "tailscale.sock")
+			},
+			wantErr: "not a directory",
+		},
+		{
+			name: "unwritable-parent",
+			sockFile: func(dir string) string {
+				ro := filepath.Join(dir, "ro")
+				must.Do(os.Mkdir(ro, 0500))
+				return filepath.Join(ro, "sub", "tailscale.sock")
+			},
+			wantErr: "creating socket directory: mkdir",
+			skip: func() string {
+				if os.Geteuid() == 0 {
+					return "root can write to any directory"
+				}
+				return ""
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.skip != "" {
+				t.Skip(tt.skip)
+			}
+			n := NewTestNode(t, env)
+			n.sockFile = tt.sockFile(t.TempDir())
+			d := n.StartDaemon()
+
+			exited := make(chan *os.ProcessState, 1)
+			go func() {
+				ps, _ := d.Process.Wait()
+				exited <- ps
+			}()
+			select {
+			case ps := <-exited:
+				if ps.Success() {
+					t.Errorf("tailscaled exited successfully; want failure")
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("tailscaled still running 30s after failing to listen")
+			}
+			if err := n.awaitListening(2 * time.Second); err == nil {
+				t.Errorf("node is listening at unwritable socket path %q", n.sockFile)
+			}
+
+			if err := tstest.WaitFor(10*time.Second, func() error {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				out := n.tailscaledParser.allBuf.String()
+				for _, want := range []string{"safesocket.Listen: ", n.sockFile, tt.wantErr} {
+					if !strings.Contains(out, want) {
+						return fmt.Errorf("tailscaled output doesn't contain %q; got:\n%s", want, out)
+					}
+				}
+				if strings.Contains(out, "panic: ") {
+					return fmt.Errorf("tailscaled panicked:\n%s", out)
+				}
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
 func TestControlTimeLogLine(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
@@ -269,6 +516,119 @@ func TestControlTimeLogLine(t *testing.T) {
 	}
 }
 
+// TestNoErrorLogs tests that a node going up and down again logs no
+// error-level entries.
+func TestNoErrorLogs(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	// By default, control sends a ControlTime before the epoch that peer
+	// expiry checks trust, which those checks log as unexpected.
+	env.Control.SetControlTimeOffset(0)
+	n := NewTestNode(t, env)
+
+	d := n.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	n.AwaitResponding()
+	n.MustUp()
+	n.AwaitRunning()
+	n.MustDown()
+	n.AwaitBackendState("Stopped")
+
+	// Logs are uploaded in batches, so wait for the last state change to be
+	// caught before checking the rest.
+	stopped := regexp.MustCompile(`^Switching ipn state Running -> Stopped\b`)
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if got := env.LogCatcher.CountMatching(stopped); got != 1 {
+			return fmt.Errorf("got %d logs matching %#q, want 1", got, stopped)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ent := range env.LogCatcher.ErrorEntries() {
+		t.Errorf("error-level log: %s", ent.Text)
+	}
+	if len(env.LogCatcher.Entries("control")) == 0 {
+		t.Error("no logs in category control")
+	}
+	controlTimes := env.LogCatcher.Entries("controltime")
+	if len(controlTimes) == 0 {
+		t.Fatal("no structured logs in category controltime")
+	}
+	if ent := controlTimes[0]; !strings.HasPrefix(ent.Text, `{"controltime":`) || ent.Verbosity != 1 {
+		t.Errorf("controltime log = %q at verbosity %d, want its record at verbosity 1", ent.Text, ent.Verbosity)
+	}
+}
+
+// TestClockSkew tests that a node whose clock is badly skewed, in either
+// direction, still comes up, and judges its peers' key expiry by control's
+// clock rather than its own.
+func TestClockSkew(t *testing.T) {
+	tstest.Parallel(t)
+	const skew = 3 * time.Hour
+	tests := []struct {
+		name string
+		skew time.Duration // how far the node's clock is ahead of control's
+		// peerExpiry is the peer's key expiry relative to the node's clock.
+		// It's between the node's time and control's, so whether the peer
+		// is expired depends on whose time the node goes by.
+		peerExpiry  time.Duration
+		wantExpired bool
+	}{
+		{name: "ahead", skew: skew, peerExpiry: -skew / 2, wantExpired: false},
+		{name: "behind", skew: -skew, peerExpiry: skew / 2, wantExpired: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstest.Parallel(t)
+			env := NewTestEnv(t)
+			env.LogCatcher.StoreRawJSON()
+			env.Control.SetControlTimeOffset(-tt.skew)
+			n := NewTestNode(t, env)
+
+			d := n.StartDaemon()
+			defer d.MustCleanShutdown(t)
+			n.AwaitResponding()
+			n.MustUp()
+			n.AwaitRunning()
+
+			if err := tstest.WaitFor(20*time.Second, func() error {
+				const sub = "netmap: flagExpiredPeers: setting clock delta to "
+				if !env.LogCatcher.logsContains(mem.S(sub)) {
+					return fmt.Errorf("log catcher didn't see %#q; got %s", sub, env.LogCatcher.logsString())
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			peerKey := env.Control.SeedNodes(1, true)[0]
+			peer := env.Control.Node(peerKey)
+			peer.KeyExpiry = time.Now().Add(tt.peerExpiry)
+			env.Control.UpdateNode(peer)
+
+			if err := tstest.WaitFor(20*time.Second, func() error {
+				for _, ps := range n.MustStatus().Peer {
+					if ps.ID != peer.StableID {
+						continue
+					}
+					if ps.Expired != tt.wantExpired {
+						return fmt.Errorf("peer Expired = %v, want %v", ps.Expired, tt.wantExpired)
+					}
+					return nil
+				}
+				return errors.New("peer not in status yet")
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if st := n.MustStatus(); st.BackendState != "Running" {
+				t.Errorf("BackendState = %q, want Running", st.BackendState)
+			}
+		})
+	}
+}
+
 // test Issue 2321: Start with UpdatePrefs should save prefs to disk
 func TestStateSavedOnStart(t *testing.T) {
 	tstest.Parallel(t)
@@ -306,69 +666,252 @@ func TestStateSavedOnStart(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
-// This handler receives auth URLs, and logs into control.
-//
-// It counts how many URLs it sees, and will fail the test if it
-// sees multiple login URLs.
-func completeLogin(t *testing.T, control *testcontrol.Server, counter *atomic.Int32) func(string) error {
-	return func(urlStr string) error {
-		t.Logf("saw auth URL %q", urlStr)
-		if control.CompleteAuth(urlStr) {
-			if counter.Add(1) > 1 {
-				err := errors.New("completed multiple auth URLs")
-				t.Error(err)
-				return err
-			}
-			t.Logf("completed login to %s", urlStr)
-			return nil
-		} else {
-			err := fmt.Errorf("failed to complete initial login to %q", urlStr)
-			t.Fatal(err)
-			return err
+// TestUpIdempotent tests that running "tailscale up" again with the same flags
+// neither changes the prefs nor makes the node register or poll control again,
+// while running it with different flags edits the prefs without registering
+// again.
+func TestUpIdempotent(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitResponding()
+	n1.MustUp("--hostname=idempotent")
+	n1.AwaitRunning()
+
+	nodeKey := n1.MustStatus().Self.PublicKey
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if env.Control.MapPollCount(nodeKey) == 0 {
+			return errors.New("no map poll yet")
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-}
-
-// This handler receives device approval URLs, and approves the device.
-//
-// It counts how many URLs it sees, and will fail the test if it
-// sees multiple device approval URLs, or if you try to approve a device
-// with the wrong control server.
-func completeDeviceApproval(t *testing.T, node *TestNode, counter *atomic.Int32) func(string) error {
-	return func(urlStr string) error {
-		control := node.env.Control
-		nodeKey := node.MustStatus().Self.PublicKey
-		t.Logf("saw device approval URL %q", urlStr)
-		if control.CompleteDeviceApproval(node.env.ControlURL(), urlStr, &nodeKey) {
-			if counter.Add(1) > 1 {
-				err := errors.New("completed multiple device approval URLs")
-				t.Error(err)
-				return err
-			}
-			t.Log("completed device approval")
-			return nil
-		} else {
-			err := errors.New("failed to complete device approval")
-			t.Fatal(err)
-			return err
+	wantRegistrations := func(label string) {
+		t.Helper()
+		if got := env.Control.RegisterCount(nodeKey); got != 1 {
+			t.Errorf("%s: node registered %d times; want 1", label, got)
 		}
 	}
-}
+	wantRegistrations("after first up")
+	prefs := n1.diskPrefs()
+	polls := env.Control.MapPollCount(nodeKey)
 
-func TestOneNodeUpAuth(t *testing.T) {
-	type step struct {
-		args []string
-		//
-		// Do we expect to log in again with a new /auth/ URL?
-		wantAuthURL bool
-		//
-		// Do we expect to need a device approval URL?
-		wantDeviceApprovalURL bool
+	n1.MustUp("--hostname=idempotent")
+	n1.AwaitRunning()
+	// Give any reconnection the second "up" caused time to start.
+	time.Sleep(time.Second)
+	if got := n1.diskPrefs(); !got.Equals(prefs) {
+		t.Errorf("identical up changed prefs\nbefore: %s\nafter:  %s", prefs.Pretty(), got.Pretty())
+	}
+	wantRegistrations("after identical up")
+	if got := env.Control.MapPollCount(nodeKey); got != polls {
+		t.Errorf("identical up made %d new map polls; want 0", got-polls)
+	}
+
+	n1.MustUp("--hostname=changed")
+	if got := n1.diskPrefs().Hostname; got != "changed" {
+		t.Errorf("after up with new hostname, Prefs.Hostname = %q; want %q", got, "changed")
 	}
+	wantRegistrations("after up with new hostname")
+}
+
+// TestPrefsSurviveVersionChange tests that a node's prefs and state survive
+// restarting tailscaled as a newer and then an older version, and that the
+// node comes back up as the same node without logging in again.
+func TestPrefsSurviveVersionChange(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+	n1.ipnVersion = "1.80.0"
+
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+	n1.MustUp("--hostname=versioned", "--shields-up")
+	n1.AwaitRunning()
 
 	for _, tt := range []struct {
-		name string
-		args []string
+		name    string
+		version string
+	}{
+		{"upgrade", "1.82.0"},
+		{"downgrade", "1.78.0"},
+	} {
+		t.Logf("%s to %s", tt.name, tt.version)
+		d1 = n1.RestartDaemonAsVersion(d1, tt.version)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestSlowStateWrites tests that tailscaled copes with a slow disk: prefs
+// changes made while state writes are slow still complete and persist, and
+// the daemon doesn't deadlock.
+func TestSlowStateWrites(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+
+	const delay = 2 * time.Second
+	n1.SetStateWriteDelay(delay)
+
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	if err := n1.Tailscale("set", "--hostname=slowdisk").Run(); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if got := n1.diskPrefs().Hostname; got != "slowdisk" {
+			return fmt.Errorf("on-disk Prefs.Hostname = %q; want slowdisk", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Disable the delay mid-run and check that writes are prompt again.
+	n1.SetStateWriteDelay(0)
+	start := time.Now()
+	if err := n1.Tailscale("set", "--hostname=fastdisk").Run(); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if d := time.Since(start); d >= delay {
+		t.Errorf("set took %v after removing the %v write delay", d, delay)
+	}
+	if got := n1.diskPrefs().Hostname; got != "fastdisk" {
+		t.Errorf("on-disk Prefs.Hostname = %q; want fastdisk", got)
+	}
+
+	n1.MustDown()
+	d1.MustCleanShutdown(t)
+}
+
+// TestControlHTTPS tests that a node can log in to a control server served
+// over HTTPS with a certificate it trusts.
+func TestControlHTTPS(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t, ControlTLS{})
+	if u := env.ControlURL(); !strings.HasPrefix(u, "https://localhost:") {
+		t.Fatalf("control URL = %q; want https://localhost:<port>", u)
+	}
+	n1 := NewTestNode(t, env)
+
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	if got := env.Control.NumNodes(); got != 1 {
+		t.Errorf("control has %d nodes; want 1", got)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestControlHTTPSBadCert tests that a node refuses to log in to an HTTPS
+// control server whose certificate it can't verify.
+func TestControlHTTPSBadCert(t *testing.T) {
+	tstest.Parallel(t)
+	tests := []struct {
+		name string
+		opt  ControlTLS
+	}{
+		{"untrusted-root", ControlTLS{UntrustedRoot: true}},
+		{"wrong-name", ControlTLS{CertDomain: tlstest.ControlPlane}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstest.Parallel(t)
+			env := NewTestEnv(t, tt.opt)
+			n1 := NewTestNode(t, env)
+
+			d1 := n1.StartDaemon()
+			n1.AwaitResponding()
+			out, err := n1.Tailscale("up", "--login-server="+env.ControlURL(), "--timeout=5s").CombinedOutput()
+			if err == nil {
+				t.Fatalf("up succeeded with a bad control certificate; output: %s", out)
+			}
+			if st := n1.MustStatus(); st.BackendState == "Running" {
+				t.Errorf("backend state is Running with a bad control certificate")
+			}
+			if got := env.Control.NumNodes(); got != 0 {
+				t.Errorf("control has %d nodes; want 0", got)
+			}
+
+			d1.MustCleanShutdown(t)
+		})
+	}
+}
+
+// This handler receives auth URLs, and logs into control.
+//
+// It counts how many URLs it sees, and will fail the test if it
+// sees multiple login URLs.
+func completeLogin(t *testing.T, control *testcontrol.Server, counter *atomic.Int32) func(string) error {
+	return func(urlStr string) error {
+		t.Logf("saw auth URL %q", urlStr)
+		if control.CompleteAuth(urlStr) {
+			if counter.Add(1) > 1 {
+				err := errors.New("completed multiple auth URLs")
+				t.Error(err)
+				return err
+			}
+			t.Logf("completed login to %s", urlStr)
+			return nil
+		} else {
+			err := fmt.Errorf("failed to complete initial login to %q", urlStr)
+			t.Fatal(err)
+			return err
+		}
+	}
+}
+
+// This handler receives device approval URLs, and approves the device.
+//
+// It counts how many URLs it sees, and will fail the test if it
+// sees multiple device approval URLs, or if you try to approve a device
+// with the wrong control server.
+func completeDeviceApproval(t *testing.T, node *TestNode, counter *atomic.Int32) func(string) error {
+	return func(urlStr string) error {
+		control := node.env.Control
+		nodeKey := node.MustStatus().Self.PublicKey
+		t.Logf("saw device approval URL %q", urlStr)
+		if control.CompleteDeviceApproval(node.env.ControlURL(), urlStr, &nodeKey) {
+			if counter.Add(1) > 1 {
+				err := errors.New("completed multiple device approval URLs")
+				t.Error(err)
+				return err
+			}
+			t.Log("completed device approval")
+			return nil
+		} else {
+			err := errors.New("failed to complete device approval")
+			t.Fatal(err)
+			return err
+		}
+	}
+}
+
+func TestOneNodeUpAuth(t *testing.T) {
+	type step struct {
+		args []string
+		//
+		// Do we expect to log in again with a new /auth/ URL?
+		wantAuthURL bool
+		//
+		// Do we expect to need a device approval URL?
+		wantDeviceApprovalURL bool
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
 		//
 		// What auth key should we use for control?
 		authKey string
@@ -538,6 +1081,71 @@ func(control *testcontrol.Server) {
 	}
 }
 
+// TestNewDeviceVerification tests that when control requires new devices to
+// be verified, a brand-new node has to complete the verification URL before
+// it can reach Running, while a node re-registering from a machine that was
+// already verified doesn't.
+func TestNewDeviceVerification(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.RequireNewDeviceVerification = true
+		control.AllNodesSameUser = true
+	}))
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
+
+	// up runs "tailscale up" on n, completing any auth URL it prints, and
+	// returns how many it completed.
+	up := func(n *TestNode) int32 {
+		t.Helper()
+		var authURLCount atomic.Int32
+		completeAuth := completeLogin(t, env.Control, &authURLCount)
+		cmd := n.Tailscale("up", "--login-server="+env.ControlURL())
+		cmd.Stdout = &authURLParserWriter{t: t,
+			authURLFn: func(urlStr string) error {
+				// The node mustn't get anywhere before it's verified.
+				if st := n.MustStatus(); st.BackendState != "NeedsLogin" {
+					return fmt.Errorf("BackendState = %q before verification; want NeedsLogin", st.BackendState)
+				}
+				return completeAuth(urlStr)
+			},
+		}
+		cmd.Stderr = cmd.Stdout
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("up: %v", err)
+		}
+		n.AwaitRunning()
+		return authURLCount.Load()
+	}
+
+	if n := up(n1); n != 1 {
+		t.Fatalf("new device completed %d auth URLs; want 1", n)
+	}
+	nodeKey := n1.MustStatus().Self.PublicKey
+
+	// Logging out and back in registers the node again, with a new node
+	// key, but from the same, already verified, machine.
+	n1.MustLogOut()
+	if n := up(n1); n != 0 {
+		t.Errorf("known device completed %d auth URLs; want 0", n)
+	}
+	if got := n1.MustStatus().Self.PublicKey; got == nodeKey {
+		t.Errorf("node key %v unchanged after logout; want a new one", got)
+	}
+
+	// Verifying n1 doesn't verify other machines.
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n2.AwaitListening()
+	if n := up(n2); n != 1 {
+		t.Errorf("second new device completed %d auth URLs; want 1", n)
+	}
+}
+
 // TestRetagStaleMapRequestRace reproduces tailscale/tailscale#20365: a node
 // tagged tag:tag1, where tag:tag1 owns tag:tag2, is retagged with "tailscale
 // up --advertise-tags=tag:tag2". This should always succeed, but sometimes
@@ -670,6 +1278,99 @@ func TestRetagStaleMapRequestRace(t *testing.T) {
 	}
 }
 
+// TestTagRevocation tests an admin removing tags from a running node. Removing
+// one of its tags changes which packet filter rules apply to it and how peers
+// see it, without affecting its login. Removing all of its tags leaves it
+// without an owner, so it has to be reauthenticated.
+func TestTagRevocation(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.TagOwners = map[string][]string{
+			"tag:server": nil,
+			"tag:web":    nil,
+		}
+	}))
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n1.AwaitListening()
+	n1.MustUp("--advertise-tags=tag:server,tag:web")
+	n1.AwaitRunning()
+	n2.AwaitListening()
+	n2.MustUp()
+	n2.AwaitRunning()
+	k1 := n1.MustStatus().Self.PublicKey
+	ip1 := n1.AwaitIP4()
+
+	// Only nodes tagged tag:web accept connections.
+	env.Control.SetPacketFilter([]tailcfg.FilterRule{{
+		SrcIPs:   []string{"*"},
+		DstPorts: []tailcfg.NetPortRange{{IP: "tag:web", Ports: tailcfg.PortRangeAny}},
+	}})
+
+	// wantTags waits for n1 to have the given tags, as seen by itself and
+	// by n2.
+	wantTags := func(tags []string) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			st := n1.MustStatus()
+			if st.BackendState != "Running" {
+				return fmt.Errorf("BackendState = %q; want Running", st.BackendState)
+			}
+			if got := st.Self.Tags.AsSlice(); !slices.Equal(got, tags) {
+				return fmt.Errorf("self tags = %q; want %q", got, tags)
+			}
+			ps, ok := n2.MustStatus().Peer[k1]
+			if !ok {
+				return fmt.Errorf("n1 not in n2's netmap")
+			}
+			if got := ps.Tags.AsSlice(); !slices.Equal(got, tags) {
+				return fmt.Errorf("tags of n1 seen by n2 = %q; want %q", got, tags)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantTags([]string{"tag:server", "tag:web"})
+
+	// wantReachable waits for ICMP pings from n2 to n1, which are subject
+	// to n1's packet filter, to succeed or not.
+	wantReachable := func(want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			res, err := n2.LocalClient().Ping(ctx, ip1, tailcfg.PingICMP)
+			if got := err == nil && res.Err == ""; got != want {
+				return fmt.Errorf("ping reachable = %v (err %v, res %+v); want %v", got, err, res, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantReachable(true)
+
+	env.Control.SetNodeTags(k1, []string{"tag:server"})
+	wantTags([]string{"tag:server"})
+	wantReachable(false)
+	got, err := n1.PacketFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("n1 packet filter = %v; want no matches", got)
+	}
+
+	env.Control.SetNodeTags(k1, nil)
+	n1.AwaitNeedsLogin()
+}
+
 // Returns true if the error returned by [exec.Run] fails with a non-zero
 // exit code, false otherwise.
 func isNonZeroExitCode(err error) bool {
@@ -844,50 +1545,206 @@ func(control *testcontrol.Server) {
 	n.AwaitRunning()
 }
 
-func TestConfigFileAuthKey(t *testing.T) {
-	t.Parallel()
-	const authKey = "opensesame"
+// TestSetMachineAuthorized verifies that in a tailnet requiring device
+// approval, a node waits in NeedsMachineAuth without peers until control
+// authorizes it, and that it's removed from its peers' netmaps again if its
+// authorization is revoked.
+func TestSetMachineAuthorized(t *testing.T) {
+	tstest.Parallel(t)
 	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
-		control.RequireAuthKey = authKey
+		control.RequireMachineAuth = true
 	}))
 
-	n1 := NewTestNode(t, env)
-	n1.configFile = filepath.Join(n1.dir, "config.json")
-	authKeyFile := filepath.Join(n1.dir, "my-auth-key")
-	must.Do(os.WriteFile(authKeyFile, fmt.Appendf(nil, "%s\n", authKey), 0666))
-	must.Do(os.WriteFile(n1.configFile, must.Get(json.Marshal(ipn.ConfigVAlpha{
-		Version:   "alpha0",
-		AuthKey:   new("file:" + authKeyFile),
-		ServerURL: new(n1.env.ControlServer.URL),
-	})), 0644))
-	d1 := n1.StartDaemon()
-
-	n1.AwaitListening()
-	t.Logf("Got IP: %v", n1.AwaitIP4())
-	n1.AwaitRunning()
-
-	d1.MustCleanShutdown(t)
-}
-
-func TestTwoNodes(t *testing.T) {
-	tstest.Parallel(t)
-	env := NewTestEnv(t)
+	// upAndAuthorize runs "tailscale up" on n, which blocks until the node
+	// is authorized, and authorizes it once it's waiting for approval.
+	upAndAuthorize := func(n *TestNode, check func()) {
+		t.Helper()
+		cmd := n.Tailscale("up", "--login-server="+env.ControlURL())
+		cmd.Stdout = nil
+		cmd.Stderr = nil
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		n.AwaitBackendState("NeedsMachineAuth")
+		if check != nil {
+			check()
+		}
+		env.Control.SetMachineAuthorized(n.MustStatus().Self.PublicKey, true)
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("up: %v", err)
+		}
+		n.AwaitRunning()
+	}
 
-	// Create two nodes:
 	n1 := NewTestNode(t, env)
-	n1SocksAddrCh := n1.socks5AddrChan()
 	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
+	upAndAuthorize(n1, nil)
 
 	n2 := NewTestNode(t, env)
-	n2SocksAddrCh := n2.socks5AddrChan()
 	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n2.AwaitListening()
 
-	// Drop some logs to disk on test failure.
-	//
-	// TODO(bradfitz): make all nodes for all tests do this? give each node a
-	// unique integer within the test? But for now only do this test because
-	// this is what we often saw flaking.
-	t.Cleanup(func() {
+	awaitPeers := func(n *TestNode, want int) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			if got := len(n.MustStatus().Peer); got != want {
+				return fmt.Errorf("got %d peers; want %d", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upAndAuthorize(n2, func() {
+		// While awaiting approval, n2 must stay out of the tailnet.
+		time.Sleep(time.Second)
+		if st := n2.MustStatus(); st.BackendState != "NeedsMachineAuth" {
+			t.Errorf("unauthorized node in state %q; want NeedsMachineAuth", st.BackendState)
+		}
+		if got := len(n2.MustStatus().Peer); got != 0 {
+			t.Errorf("unauthorized node has %d peers; want 0", got)
+		}
+		if got := len(n1.MustStatus().Peer); got != 0 {
+			t.Errorf("n1 sees %d peers while n2 is unauthorized; want 0", got)
+		}
+	})
+	awaitPeers(n1, 1)
+	awaitPeers(n2, 1)
+
+	env.Control.SetMachineAuthorized(n2.MustStatus().Self.PublicKey, false)
+	n2.AwaitBackendState("NeedsMachineAuth")
+	awaitPeers(n1, 0)
+}
+
+// TestNeedsMachineAuthUntilAuthorized verifies that a node in a tailnet
+// requiring device approval stays in the NeedsMachineAuth state until control
+// authorizes it, and only then moves on to Running.
+func TestNeedsMachineAuthUntilAuthorized(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.RequireMachineAuth = true
+	}))
+	n := NewTestNode(t, env)
+	d := n.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	n.AwaitListening()
+
+	// Record every state the node passes through.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := n.LocalClient().WatchIPNBus(ctx, ipn.NotifyInitialState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var (
+		mu     sync.Mutex
+		states []ipn.State
+	)
+	go func() {
+		for {
+			not, err := w.Next()
+			if err != nil {
+				return
+			}
+			if not.State != nil {
+				mu.Lock()
+				states = append(states, *not.State)
+				mu.Unlock()
+			}
+		}
+	}()
+
+	cmd := n.Tailscale("up", "--login-server="+env.ControlURL())
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	n.AwaitBackendState("NeedsMachineAuth")
+
+	// The node must stay there for as long as it's not authorized.
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if st := n.MustStatus(); st.BackendState != "NeedsMachineAuth" {
+			t.Fatalf("unauthorized node in state %q; want %q", st.BackendState, "NeedsMachineAuth")
+		}
+	}
+
+	mu.Lock()
+	before := slices.Clone(states)
+	mu.Unlock()
+	env.Control.SetMachineAuthorized(n.MustStatus().Self.PublicKey, true)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	n.AwaitBackendState("Running")
+
+	if !slices.Contains(before, ipn.NeedsMachineAuth) {
+		t.Errorf("states before authorization = %v; want them to include %v", before, ipn.NeedsMachineAuth)
+	}
+	if slices.Contains(before, ipn.Running) {
+		t.Errorf("states before authorization = %v; want them not to include %v", before, ipn.Running)
+	}
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Contains(states[len(before):], ipn.Running) {
+			return fmt.Errorf("states after authorization = %v; want them to include %v", states[len(before):], ipn.Running)
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigFileAuthKey(t *testing.T) {
+	t.Parallel()
+	const authKey = "opensesame"
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.RequireAuthKey = authKey
+	}))
+
+	n1 := NewTestNode(t, env)
+	n1.configFile = filepath.Join(n1.dir, "config.json")
+	authKeyFile := filepath.Join(n1.dir, "my-auth-key")
+	must.Do(os.WriteFile(authKeyFile, fmt.Appendf(nil, "%s\n", authKey), 0666))
+	must.Do(os.WriteFile(n1.configFile, must.Get(json.Marshal(ipn.ConfigVAlpha{
+		Version:   "alpha0",
+		AuthKey:   new("file:" + authKeyFile),
+		ServerURL: new(n1.env.ControlServer.URL),
+	})), 0644))
+	d1 := n1.StartDaemon()
+
+	n1.AwaitListening()
+	t.Logf("Got IP: %v", n1.AwaitIP4())
+	n1.AwaitRunning()
+
+	d1.MustCleanShutdown(t)
+}
+
+func TestTwoNodes(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	// Create two nodes:
+	n1 := NewTestNode(t, env)
+	n1SocksAddrCh := n1.socks5AddrChan()
+	d1 := n1.StartDaemon()
+
+	n2 := NewTestNode(t, env)
+	n2SocksAddrCh := n2.socks5AddrChan()
+	d2 := n2.StartDaemon()
+
+	// Drop some logs to disk on test failure.
+	//
+	// TODO(bradfitz): make all nodes for all tests do this? give each node a
+	// unique integer within the test? But for now only do this test because
+	// this is what we often saw flaking.
+	t.Cleanup(func() {
 		if !t.Failed() {
 			return
 		}
@@ -926,26 +1783,17 @@ func TestTwoNodes(t *testing.T) {
 	n2.AwaitRunning()
 	t.Logf("n2 is running")
 
-	if err := tstest.WaitFor(2*time.Second, func() error {
-		st := n1.MustStatus()
-		if len(st.Peer) == 0 {
-			return errors.New("no peers")
-		}
-		if len(st.Peer) > 1 {
-			return fmt.Errorf("got %d peers; want 1", len(st.Peer))
-		}
-		peer := st.Peer[st.Peers()[0]]
+	if err := n1.AwaitPeers(1, 2*time.Second); err != nil {
+		t.Error(err)
+	}
+	st := n1.MustStatus()
+	for _, peer := range st.Peer {
 		if peer.ID == st.Self.ID {
-			return errors.New("peer is self")
-		}
-
-		if len(st.TailscaleIPs) == 0 {
-			return errors.New("no Tailscale IPs")
+			t.Error("peer is self")
 		}
-
-		return nil
-	}); err != nil {
-		t.Error(err)
+	}
+	if len(st.TailscaleIPs) == 0 {
+		t.Error("no Tailscale IPs")
 	}
 
 	d1.MustCleanShutdown(t)
@@ -994,21 +1842,17 @@ func TestIncrementalMapUpdatePeersRemoved(t *testing.T) {
 
 	t.Logf("node1=%v, node2=%v", tnode1.ID, tnode2.ID)
 
-	if err := tstest.WaitFor(2*time.Second, func() error {
-		st := n1.MustStatus()
-		if len(st.Peer) == 0 {
-			return errors.New("no peers")
-		}
-		if len(st.Peer) > 1 {
-			return fmt.Errorf("got %d peers; want 1", len(st.Peer))
-		}
-		peer := st.Peer[st.Peers()[0]]
+	if err := n1.AwaitPeers(1, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	st := n1.MustStatus()
+	if _, ok := st.Peer[tnode2.Key]; !ok {
+		t.Fatalf("peer is not node2; peers: %s", formatPeers(st))
+	}
+	for _, peer := range st.Peer {
 		if peer.ID == st.Self.ID {
-			return errors.New("peer is self")
+			t.Fatal("peer is self")
 		}
-		return nil
-	}); err != nil {
-		t.Fatal(err)
 	}
 
 	t.Logf("node1 saw node2")
@@ -1021,13 +1865,7 @@ func TestIncrementalMapUpdatePeersRemoved(t *testing.T) {
 	}
 
 	// And see that node1 saw that.
-	if err := tstest.WaitFor(2*time.Second, func() error {
-		st := n1.MustStatus()
-		if len(st.Peer) == 0 {
-			return nil
-		}
-		return fmt.Errorf("got %d peers; want 0", len(st.Peer))
-	}); err != nil {
+	if err := n1.AwaitPeers(0, 2*time.Second); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1037,1139 +1875,4725 @@ func TestIncrementalMapUpdatePeersRemoved(t *testing.T) {
 	d2.MustCleanShutdown(t)
 }
 
-// TestIncrementalMapUpdatePeerAllowedIPsReachability verifies that an incremental
-// peer upsert changing a peer's AllowedIPs reprograms the local WireGuard config.
-// This covers VIP additions at runtime, where the VIP route is not reachable
-// before the map mutation but is reachable over TSMP afterward.
-func TestIncrementalMapUpdatePeerAllowedIPsReachability(t *testing.T) {
+// TestOmitPeersMapResponse tests that a node keeps its peers when it gets a
+// MapResponse without a list of peers, and that incremental updates still
+// apply on top of them afterwards.
+func TestOmitPeersMapResponse(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
 
-	n1 := NewTestNode(t, env)
-	d1 := n1.StartDaemon()
-	defer d1.MustCleanShutdown(t)
-	n1.AwaitListening()
-	n1.MustUp()
-	n1.AwaitRunning()
+	var nodes []*TestNode
+	for range 3 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1 := nodes[0]
+	if err := n1.AwaitPeers(2, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	n1Key := n1.MustStatus().Self.PublicKey
+	n2 := env.Control.Node(nodes[1].MustStatus().Self.PublicKey)
+	n3 := env.Control.Node(nodes[2].MustStatus().Self.PublicKey)
 
-	n2 := NewTestNode(t, env)
-	d2 := n2.StartDaemon()
-	defer d2.MustCleanShutdown(t)
-	n2.AwaitListening()
-	n2.MustUp()
-	n2.AwaitRunning()
+	if !env.Control.AddOmitPeersMapResponse(n1Key) {
+		t.Fatal("failed to add omit-peers map response")
+	}
+	// Messages are delivered in order, so once n1 answers this PingRequest,
+	// it has processed the omit-peers MapResponse.
+	pt := env.Control.NewPingTarget(0, 0)
+	if !env.Control.AddPingRequest(n1Key, &tailcfg.PingRequest{URL: pt.URL}) {
+		t.Fatal("failed to add ping request")
+	}
+	select {
+	case <-pt.Requests():
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for n1 to answer PingRequest")
+	}
+	if st := n1.MustStatus(); len(st.Peer) != 2 {
+		t.Fatalf("after omit-peers MapResponse, got %d peers; want 2", len(st.Peer))
+	}
 
-	n1Status := n1.MustStatus()
-	n2Status := n2.MustStatus()
-	tnode1 := env.Control.Node(n1Status.Self.PublicKey)
-	if tnode1 == nil {
-		t.Fatalf("control has no node for %v", n1Status.Self.PublicKey)
+	// An incremental update applies on top of the retained peers.
+	if !env.Control.AddRawMapResponse(n1Key, &tailcfg.MapResponse{
+		PeersRemoved: []tailcfg.NodeID{n2.ID},
+	}) {
+		t.Fatal("failed to add map response")
 	}
-	tnode2 := env.Control.Node(n2Status.Self.PublicKey)
-	if tnode2 == nil {
-		t.Fatalf("control has no node for %v", n2Status.Self.PublicKey)
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := n1.AwaitPeer(n3.Key, 20*time.Second); err != nil {
+		t.Fatal(err)
 	}
+}
 
-	vip := netip.MustParseAddr("100.99.99.99")
-	vipPrefix := netip.PrefixFrom(vip, vip.BitLen())
+// TestForceFullMap tests that a node that gets a full MapResponse after a
+// series of incremental ones describing the same changes ends up with the
+// same netmap, and that it rebuilds its netmap from the full one.
+func TestForceFullMap(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
 
-	if err := n1.Tailscale("ping", "--tsmp", "--c=1", "--timeout=5s", n2.AwaitIP4().String()).Run(); err != nil {
-		t.Fatalf("initial ping n1 -> n2: %v", err)
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
 	}
-	if err := n1.Tailscale("ping", "--tsmp", "--c=1", "--timeout=1s", vip.String()).Run(); err == nil {
-		t.Fatalf("ping n1 -> n2 VIP %v before AllowedIPs delta succeeded unexpectedly", vip)
+	n1, n2 := nodes[0], nodes[1]
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
 	}
+	k1 := n1.MustStatus().Self.PublicKey
+	k2 := n2.MustStatus().Self.PublicKey
 
-	mr, err := env.Control.MapResponse(&tailcfg.MapRequest{NodeKey: tnode1.Key})
-	if err != nil {
-		t.Fatalf("MapResponse: %v", err)
-	}
-	var replacement *tailcfg.Node
-	for _, p := range mr.Peers {
-		if p.ID == tnode2.ID {
-			replacement = p.Clone()
-			break
+	const (
+		incremental = "controlclient_map_response_handled_incrementally"
+		fullRebuild = "controlclient_map_response_handled_full_rebuild"
+	)
+	metric := func(name string) int64 {
+		t.Helper()
+		v, err := n1.ClientMetric(name)
+		if err != nil {
+			t.Fatal(err)
 		}
+		return v
 	}
-	if replacement == nil {
-		t.Fatalf("MapResponse for n1 has no peer n2")
+	incrementalBefore := metric(incremental)
+
+	// Change n2 in control, and tell n1 about the changes incrementally,
+	// with patches that the client applies without rebuilding its netmap.
+	peer := env.Control.Node(k2)
+	lastSeen := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	patches := []*tailcfg.PeerChange{
+		{NodeID: peer.ID, Online: new(false)},
+		{NodeID: peer.ID, LastSeen: &lastSeen},
+		{NodeID: peer.ID, Online: new(true)},
+	}
+	for _, pc := range patches {
+		if !env.Control.AddRawMapResponse(k1, &tailcfg.MapResponse{
+			PeersChangedPatch: []*tailcfg.PeerChange{pc},
+		}) {
+			t.Fatal("failed to add map response")
+		}
 	}
+	peer.Online = new(true)
+	peer.LastSeen = &lastSeen
+	env.Control.UpdateNode(peer)
 
-	replacement.AllowedIPs = append(replacement.AllowedIPs, vipPrefix)
-	if !env.Control.AddRawMapResponse(tnode1.Key, &tailcfg.MapResponse{
-		PeersChanged: []*tailcfg.Node{replacement},
-	}) {
-		t.Fatalf("failed to add map response")
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if got, want := metric(incremental), incrementalBefore+int64(len(patches)); got < want {
+			return fmt.Errorf("%s = %d; want %d", incremental, got, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ps := n1.MustStatus().Peer[k2]
+	if ps == nil {
+		t.Fatal("n2 not a peer of n1")
+	}
+	if !ps.Online || !ps.LastSeen.Equal(lastSeen) {
+		t.Fatalf("incremental updates not applied: Online = %v, LastSeen = %v", ps.Online, ps.LastSeen)
 	}
 
-	if err := tstest.WaitFor(5*time.Second, func() error {
-		st := n1.MustStatus()
-		p, ok := st.Peer[tnode2.Key]
-		if !ok {
-			return fmt.Errorf("node 1 doesn't see node 2 as a peer")
+	nmJSON := func() map[string]any {
+		t.Helper()
+		nm, err := n1.NetMap()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if p.AllowedIPs == nil {
-			return fmt.Errorf("node 1 sees node 2 with no AllowedIPs")
+		var m map[string]any
+		if err := json.Unmarshal(must.Get(json.Marshal(nm)), &m); err != nil {
+			t.Fatal(err)
 		}
-		for _, allowedIP := range p.AllowedIPs.All() {
-			if allowedIP == vipPrefix {
-				return nil
-			}
+		return m
+	}
+	before := nmJSON()
+	fullRebuildBefore := metric(fullRebuild)
+
+	if !env.Control.ForceFullMap(k1) {
+		t.Fatal("failed to force full map")
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if got := metric(fullRebuild); got == fullRebuildBefore {
+			return fmt.Errorf("%s = %d; want more", fullRebuild, got)
 		}
-		return fmt.Errorf("node 1 sees node 2 AllowedIPs %v; want %v", p.AllowedIPs, vipPrefix)
+		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	if err := n1.Tailscale("ping", "--tsmp", "--c=1", "--timeout=5s", vip.String()).Run(); err != nil {
-		t.Fatalf("ping n1 -> n2 VIP %v after AllowedIPs delta: %v", vip, err)
+	if got := metric(fullRebuild); got != fullRebuildBefore+1 {
+		t.Errorf("%s = %d after forcing a full map; want %d", fullRebuild, got, fullRebuildBefore+1)
+	}
+	if diff := cmp.Diff(before, nmJSON()); diff != "" {
+		t.Errorf("netmap changed after full map (-incremental +full):\n%s", diff)
 	}
 }
 
-func TestNodeAddressIPFields(t *testing.T) {
-	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/7008")
+// TestMapResponseInconsistentSelf verifies that the client survives control
+// sending MapResponses that treat the self node as a peer, warning about them
+// and recovering once a consistent MapResponse arrives.
+func TestMapResponseInconsistentSelf(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
+
 	n1 := NewTestNode(t, env)
 	d1 := n1.StartDaemon()
-
+	defer d1.MustCleanShutdown(t)
 	n1.AwaitListening()
 	n1.MustUp()
 	n1.AwaitRunning()
 
-	testNodes := env.Control.AllNodes()
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n2.AwaitListening()
+	n2.MustUp()
+	n2.AwaitRunning()
 
-	if len(testNodes) != 1 {
-		t.Errorf("Expected %d nodes, got %d", 1, len(testNodes))
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
 	}
-	node := testNodes[0]
-	if len(node.Addresses) == 0 {
-		t.Errorf("Empty Addresses field in node")
+	n1Key := n1.MustStatus().Self.PublicKey
+	self := env.Control.Node(n1Key)
+	peer := env.Control.Node(n2.MustStatus().Self.PublicKey)
+
+	warnings := make(chan string, 10)
+	n1.addLogLineHook(func(line []byte) {
+		if bytes.Contains(line, []byte("[unexpected] netmap: control")) {
+			select {
+			case warnings <- string(line):
+			default:
+			}
+		}
+	})
+	awaitWarning := func(sub string) {
+		t.Helper()
+		timeout := time.After(20 * time.Second)
+		for {
+			select {
+			case w := <-warnings:
+				if strings.Contains(w, sub) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for warning containing %q", sub)
+			}
+		}
 	}
-	if len(node.AllowedIPs) == 0 {
-		t.Errorf("Empty AllowedIPs field in node")
+	checkStatus := func() {
+		t.Helper()
+		st := n1.MustStatus()
+		if st.BackendState != "Running" {
+			t.Errorf("BackendState = %q; want Running", st.BackendState)
+		}
+		if st.Self.PublicKey != n1Key {
+			t.Errorf("self key = %v; want %v", st.Self.PublicKey, n1Key)
+		}
+		if _, ok := st.Peer[peer.Key]; !ok {
+			t.Errorf("peer %v missing from status", peer.Key)
+		}
 	}
 
-	d1.MustCleanShutdown(t)
-}
-
-func TestAddPingRequest(t *testing.T) {
-	tstest.Parallel(t)
-	env := NewTestEnv(t)
-	n1 := NewTestNode(t, env)
-	n1.StartDaemon()
-
-	n1.AwaitListening()
-	n1.MustUp()
-	n1.AwaitRunning()
-
-	gotPing := make(chan bool, 1)
-	waitPing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gotPing <- true
-	}))
-	defer waitPing.Close()
-
-	nodes := env.Control.AllNodes()
-	if len(nodes) != 1 {
-		t.Fatalf("expected 1 node, got %d nodes", len(nodes))
+	// Control removing the self node as if it were a peer is ignored.
+	if !env.Control.AddRawMapResponse(n1Key, &tailcfg.MapResponse{
+		PeersRemoved: []tailcfg.NodeID{self.ID},
+	}) {
+		t.Fatal("failed to add map response")
 	}
+	awaitWarning("removed self node")
+	checkStatus()
 
-	nodeKey := nodes[0].Key
-
-	// Check that we get at least one ping reply after 10 tries.
-	for try := 1; try <= 10; try++ {
-		t.Logf("ping %v ...", try)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		if err := env.Control.AwaitNodeInMapRequest(ctx, nodeKey); err != nil {
-			t.Fatal(err)
-		}
-		cancel()
+	// Control listing the self node among the peers is survived.
+	if !env.Control.AddRawMapResponse(n1Key, &tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{self, peer},
+	}) {
+		t.Fatal("failed to add map response")
+	}
+	awaitWarning("as a peer")
+	checkStatus()
 
-		pr := &tailcfg.PingRequest{URL: fmt.Sprintf("%s/ping-%d", waitPing.URL, try), Log: true}
-		if !env.Control.AddPingRequest(nodeKey, pr) {
-			t.Logf("failed to AddPingRequest")
-			continue
+	// A consistent MapResponse brings things back to normal.
+	if !env.Control.AddRawMapResponse(n1Key, &tailcfg.MapResponse{
+		Node:  self,
+		Peers: []*tailcfg.Node{peer},
+	}) {
+		t.Fatal("failed to add map response")
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st := n1.MustStatus()
+		if st.BackendState != "Running" {
+			return fmt.Errorf("BackendState = %q; want Running", st.BackendState)
 		}
-
-		// Wait for PingRequest to come back
-		pingTimeout := time.NewTimer(2 * time.Second)
-		defer pingTimeout.Stop()
-		select {
-		case <-gotPing:
-			t.Logf("got ping; success")
-			return
-		case <-pingTimeout.C:
-			// Try again.
+		if _, ok := st.Peer[n1Key]; ok || len(st.Peer) != 1 {
+			return fmt.Errorf("got %d peers, including self: %v; want 1", len(st.Peer), ok)
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n1.Ping(n2); err != nil {
+		t.Fatal(err)
 	}
-	t.Error("all ping attempts failed")
 }
 
-func TestC2NPingRequest(t *testing.T) {
+// TestIncrementalMapUpdatePeerAllowedIPsReachability verifies that an incremental
+// peer upsert changing a peer's AllowedIPs reprograms the local WireGuard config.
+// This covers VIP additions at runtime, where the VIP route is not reachable
+// before the map mutation but is reachable over TSMP afterward.
+func TestIncrementalMapUpdatePeerAllowedIPsReachability(t *testing.T) {
 	tstest.Parallel(t)
-
 	env := NewTestEnv(t)
 
 	n1 := NewTestNode(t, env)
-	n1.StartDaemon()
-
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
 	n1.AwaitListening()
 	n1.MustUp()
 	n1.AwaitRunning()
 
-	nodes := env.Control.AllNodes()
-	if len(nodes) != 1 {
-		t.Fatalf("expected 1 node, got %d nodes", len(nodes))
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n2.AwaitListening()
+	n2.MustUp()
+	n2.AwaitRunning()
+
+	n1Status := n1.MustStatus()
+	n2Status := n2.MustStatus()
+	tnode1 := env.Control.Node(n1Status.Self.PublicKey)
+	if tnode1 == nil {
+		t.Fatalf("control has no node for %v", n1Status.Self.PublicKey)
+	}
+	tnode2 := env.Control.Node(n2Status.Self.PublicKey)
+	if tnode2 == nil {
+		t.Fatalf("control has no node for %v", n2Status.Self.PublicKey)
 	}
 
-	nodeKey := nodes[0].Key
+	vip := netip.MustParseAddr("100.99.99.99")
+	vipPrefix := netip.PrefixFrom(vip, vip.BitLen())
 
-	// Check that we get at least one ping reply after 10 tries.
-	for try := 1; try <= 10; try++ {
-		t.Logf("ping %v ...", try)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		if err := env.Control.AwaitNodeInMapRequest(ctx, nodeKey); err != nil {
-			t.Fatal(err)
+	if err := n1.Tailscale("ping", "--tsmp", "--c=1", "--timeout=5s", n2.AwaitIP4().String()).Run(); err != nil {
+		t.Fatalf("initial ping n1 -> n2: %v", err)
+	}
+	if err := n1.Tailscale("ping", "--tsmp", "--c=1", "--timeout=1s", vip.String()).Run(); err == nil {
+		t.Fatalf("ping n1 -> n2 VIP %v before AllowedIPs delta succeeded unexpectedly", vip)
+	}
+
+	mr, err := env.Control.MapResponse(&tailcfg.MapRequest{NodeKey: tnode1.Key})
+	if err != nil {
+		t.Fatalf("MapResponse: %v", err)
+	}
+	var replacement *tailcfg.Node
+	for _, p := range mr.Peers {
+		if p.ID == tnode2.ID {
+			replacement = p.Clone()
+			break
 		}
-		cancel()
+	}
+	if replacement == nil {
+		t.Fatalf("MapResponse for n1 has no peer n2")
+	}
 
-		ctx, cancel = context.WithTimeout(t.Context(), 2*time.Second)
-		defer cancel()
+	replacement.AllowedIPs = append(replacement.AllowedIPs, vipPrefix)
+	if !env.Control.AddRawMapResponse(tnode1.Key, &tailcfg.MapResponse{
+		PeersChanged: []*tailcfg.Node{replacement},
+	}) {
+		t.Fatalf("failed to add map response")
+	}
 
-		req, err := http.NewRequestWithContext(ctx, "POST", "/echo", bytes.NewReader([]byte("abc")))
-		if err != nil {
-			t.Errorf("failed to create request: %v", err)
-			continue
-		}
-		r, err := env.Control.NodeRoundTripper(nodeKey).RoundTrip(req)
-		if err != nil {
-			t.Errorf("RoundTrip failed: %v", err)
-			continue
-		}
-		if r.StatusCode != 200 {
-			t.Errorf("unexpected status code: %d", r.StatusCode)
-			continue
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		st := n1.MustStatus()
+		p, ok := st.Peer[tnode2.Key]
+		if !ok {
+			return fmt.Errorf("node 1 doesn't see node 2 as a peer")
 		}
-		b, err := io.ReadAll(r.Body)
-		if err != nil {
-			t.Errorf("error reading body: %v", err)
-			continue
+		if p.AllowedIPs == nil {
+			return fmt.Errorf("node 1 sees node 2 with no AllowedIPs")
 		}
-		if string(b) != "abc" {
-			t.Errorf("body = %q; want %q", b, "abc")
-			continue
+		for _, allowedIP := range p.AllowedIPs.All() {
+			if allowedIP == vipPrefix {
+				return nil
+			}
 		}
-		return
+		return fmt.Errorf("node 1 sees node 2 AllowedIPs %v; want %v", p.AllowedIPs, vipPrefix)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n1.Tailscale("ping", "--tsmp", "--c=1", "--timeout=5s", vip.String()).Run(); err != nil {
+		t.Fatalf("ping n1 -> n2 VIP %v after AllowedIPs delta: %v", vip, err)
 	}
-	t.Error("all ping attempts failed")
 }
 
-// Issue 2434: when "down" (WantRunning false), tailscaled shouldn't
-// be connected to control.
-func TestNoControlConnWhenDown(t *testing.T) {
+// TestSubnetRouterFailover tests high-availability subnet routing: two
+// subnet routers advertise the same route, and when the primary router is
+// withdrawn, the route moves to the backup in the other peers' AllowedIPs.
+// TestMapResponseUnknownFields tests that the client ignores MapResponse
+// fields it doesn't know about, as sent by a newer control server, while
+// still applying the fields it does know.
+func TestMapResponseUnknownFields(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
 	n1 := NewTestNode(t, env)
-
 	d1 := n1.StartDaemon()
-	n1.AwaitResponding()
-
-	// Come up the first time.
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
 	n1.MustUp()
-	ip1 := n1.AwaitIP4()
 	n1.AwaitRunning()
 
-	// Then bring it down and stop the daemon.
-	n1.MustDown()
-	d1.MustCleanShutdown(t)
-
-	env.LogCatcher.Reset()
-	d2 := n1.StartDaemon()
-	n1.AwaitResponding()
-
-	n1.AwaitBackendState("Stopped")
+	const searchDomain = "future.example.com"
+	mr := []byte(`{
+		"FieldFromTheFuture": {"Enabled": true, "Items": [1, 2, 3]},
+		"AnotherNewField": "some-value",
+		"DNSConfig": {
+			"Domains": ["` + searchDomain + `"],
+			"NewDNSKnob": 42
+		}
+	}`)
+	if !env.Control.AddRawMapResponseJSON(n1.MustStatus().Self.PublicKey, mr) {
+		t.Fatal("failed to add map response")
+	}
 
-	// The real test: verify our daemon doesn't have an HTTP request open.
-	// Stopping the client may take some time to disconnect from testcontrol.
-	if err := tstest.WaitFor(time.Second, func() error {
-		if n := env.Control.InServeMap(); n != 0 {
-			return fmt.Errorf("in serve map = %d; want 0", n)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		nm, err := fetchNetMapForTest(ctx, n1.LocalClient())
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(nm.DNS.Domains, searchDomain) {
+			return fmt.Errorf("DNS search domains = %q; want to contain %q", nm.DNS.Domains, searchDomain)
 		}
 		return nil
 	}); err != nil {
-		t.Fatalf("unexpected connections while stopped: %v", err)
+		t.Fatal(err)
+	}
+	if st := n1.MustStatus(); st.BackendState != "Running" {
+		t.Errorf("BackendState = %q after unknown MapResponse fields; want Running", st.BackendState)
 	}
+}
 
-	ip2 := n1.AwaitIP4()
-	if ip1 != ip2 {
-		t.Errorf("IPs different: %q vs %q", ip1, ip2)
+func TestSubnetRouterFailover(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	route := netip.MustParsePrefix("10.123.0.0/24")
+
+	var nodes []*TestNode
+	var keys []key.NodePublic
+	for range 3 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp("--advertise-routes=" + route.String())
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+		keys = append(keys, n.MustStatus().Self.PublicKey)
 	}
+	client, r1, r2 := nodes[0], keys[1], keys[2]
 
-	if n := env.Control.InServeMap(); n != 0 {
-		t.Fatalf("unexpected connection triggered by tailscale ip: in serve map = %d; want 0", n)
+	// wantPrimary waits until client sees route in the AllowedIPs and
+	// PrimaryRoutes of primary only.
+	wantPrimary := func(primary key.NodePublic) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			st := client.MustStatus()
+			for _, k := range []key.NodePublic{r1, r2} {
+				ps, ok := st.Peer[k]
+				if !ok {
+					return fmt.Errorf("client doesn't see router %v as a peer", k.ShortString())
+				}
+				var gotAllowed, gotPrimary bool
+				if ps.AllowedIPs != nil {
+					gotAllowed = slices.Contains(ps.AllowedIPs.AsSlice(), route)
+				}
+				if ps.PrimaryRoutes != nil {
+					gotPrimary = slices.Contains(ps.PrimaryRoutes.AsSlice(), route)
+				}
+				want := k == primary
+				if gotAllowed != want || gotPrimary != want {
+					return fmt.Errorf("router %v: route in AllowedIPs = %v, in PrimaryRoutes = %v; want %v",
+						k.ShortString(), gotAllowed, gotPrimary, want)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	d2.MustCleanShutdown(t)
+	// Both routers serve the route, with r1 as the primary.
+	env.Control.SetSubnetRoutes(r1, []netip.Prefix{route})
+	env.Control.SetSubnetRoutes(r2, []netip.Prefix{route})
+	env.Control.SetPrimaryRoutes(r2, nil)
+	wantPrimary(r1)
+
+	// r1 goes away; control fails the route over to r2.
+	env.Control.SetPrimaryRoutes(r1, nil)
+	env.Control.SetPrimaryRoutes(r2, []netip.Prefix{route})
+	wantPrimary(r2)
+
+	// And r2's routes are withdrawn entirely, making r1 primary again.
+	env.Control.SetSubnetRoutes(r2, nil)
+	env.Control.SetPrimaryRoutes(r2, nil)
+	env.Control.SetPrimaryRoutes(r1, []netip.Prefix{route})
+	wantPrimary(r1)
 }
 
-// Issue 2137: make sure Windows tailscaled works with the CLI alone,
-// without the GUI to kick off a Start.
-func TestOneNodeUpWindowsStyle(t *testing.T) {
+// TestOverlappingSubnetRoutes tests that when control sends two routers with
+// the same subnet route in their AllowedIPs, a client consistently sends
+// traffic for the route to one of them, the one with the lowest node ID, and
+// that moving the primary route with control, which takes it out of the old
+// router's AllowedIPs, moves the traffic to the new primary.
+func TestOverlappingSubnetRoutes(t *testing.T) {
 	tstest.Parallel(t)
-	env := NewTestEnv(t, canRunAsServiceOnWindows())
-	n1 := NewTestNode(t, env)
-	n1.upFlagGOOS = "windows"
+	env := NewTestEnv(t)
+	env.Control.SetStandbyRoutesInAllowedIPs(true)
+	route := netip.MustParsePrefix("10.124.0.0/24")
+	routeIP := netip.MustParseAddr("10.124.0.1")
 
-	d1 := n1.StartDaemonAsIPNGOOS("windows")
-	n1.AwaitResponding()
-	n1.MustUp("--unattended")
+	var nodes []*TestNode
+	var keys []key.NodePublic
+	for i := range 3 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		if i == 0 {
+			n.MustUp("--accept-routes")
+		} else {
+			n.MustUp("--advertise-routes=" + route.String())
+		}
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+		keys = append(keys, n.MustStatus().Self.PublicKey)
+	}
+	client, r1, r2 := nodes[0], keys[1], keys[2]
+	routerIPs := map[string]key.NodePublic{
+		nodes[1].AwaitIP4().String(): r1,
+		nodes[2].AwaitIP4().String(): r2,
+	}
 
-	t.Logf("Got IP: %v", n1.AwaitIP4())
-	n1.AwaitRunning()
+	env.Control.SetSubnetRoutes(r1, []netip.Prefix{route})
+	env.Control.SetSubnetRoutes(r2, []netip.Prefix{route})
+	env.Control.SetPrimaryRoutes(r2, nil)
 
-	d1.MustCleanShutdown(t)
+	// routerFor returns the router that client sends traffic for the
+	// route to, as reported by a disco ping of an address in it.
+	routerFor := func() (key.NodePublic, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		res, err := client.LocalClient().Ping(ctx, routeIP, tailcfg.PingDisco)
+		if err != nil {
+			return key.NodePublic{}, err
+		}
+		if res.Err != "" {
+			return key.NodePublic{}, errors.New(res.Err)
+		}
+		k, ok := routerIPs[res.NodeIP]
+		if !ok {
+			return key.NodePublic{}, fmt.Errorf("ping of %v answered by %v, which isn't a router", routeIP, res.NodeIP)
+		}
+		return k, nil
+	}
+	// wantRouter waits until client sees the route in the AllowedIPs of
+	// the routers in withRoute and no others, and checks that client then
+	// consistently uses want for the route.
+	wantRouter := func(want key.NodePublic, withRoute ...key.NodePublic) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			st := client.MustStatus()
+			for _, k := range []key.NodePublic{r1, r2} {
+				ps, ok := st.Peer[k]
+				if !ok {
+					return fmt.Errorf("client doesn't see router %v as a peer", k.ShortString())
+				}
+				var got bool
+				if ps.AllowedIPs != nil {
+					got = slices.Contains(ps.AllowedIPs.AsSlice(), route)
+				}
+				if want := slices.Contains(withRoute, k); got != want {
+					return fmt.Errorf("router %v: route in AllowedIPs = %v; want %v", k.ShortString(), got, want)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			got, err := routerFor()
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("traffic for %v goes to %v; want %v", route, got.ShortString(), want.ShortString())
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for range 3 {
+			if got, err := routerFor(); err != nil {
+				t.Fatal(err)
+			} else if got != want {
+				t.Fatalf("traffic for %v went to %v after settling on %v", route, got.ShortString(), want.ShortString())
+			}
+		}
+	}
+
+	// Both routers have the route; the one with the lower node ID wins.
+	lowest := r1
+	if env.Control.Node(r2).ID < env.Control.Node(r1).ID {
+		lowest = r2
+	}
+	wantRouter(lowest, r1, r2)
+
+	// With only primary routes in AllowedIPs, control fails the route
+	// over to r2, and back.
+	env.Control.SetStandbyRoutesInAllowedIPs(false)
+	wantRouter(r1, r1)
+	env.Control.SetPrimaryRoutes(r1, nil)
+	env.Control.SetPrimaryRoutes(r2, []netip.Prefix{route})
+	wantRouter(r2, r2)
+	env.Control.SetPrimaryRoutes(r2, nil)
+	env.Control.SetPrimaryRoutes(r1, []netip.Prefix{route})
+	wantRouter(r1, r1)
 }
 
-// TestClientSideJailing tests that when one node is jailed for another, the
-// jailed node cannot initiate connections to the other node however the other
-// node can initiate connections to the jailed node.
-func TestClientSideJailing(t *testing.T) {
-	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/17419")
+// TestAdvertiseRoutesLive tests that a subnet router starts and stops
+// serving a route as soon as --advertise-routes is changed, without a
+// restart.
+//
+// It toggles the route on the router rather than --accept-routes on the
+// client, as in userspace-networking mode the client's dials use a peer's
+// routes regardless of --accept-routes.
+func TestAdvertiseRoutesLive(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
-	registerNode := func() (*TestNode, key.NodePublic) {
-		n := NewTestNode(t, env)
-		n.StartDaemon()
-		n.AwaitListening()
-		n.MustUp()
-		n.AwaitRunning()
-		k := n.MustStatus().Self.PublicKey
-		return n, k
-	}
-	n1, k1 := registerNode()
-	n2, k2 := registerNode()
 
-	ln, err := net.Listen("tcp", "localhost:0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
 	port := uint16(ln.Addr().(*net.TCPAddr).Port)
 
-	lc1 := &local.Client{
-		Socket:        n1.sockFile,
-		UseSocketOnly: true,
+	// Use a 4via6 route to the listener, so that it's only reachable through
+	// the subnet router and not also directly from the client.
+	via, err := tsaddr.MapVia(7, netip.MustParsePrefix("127.0.0.1/32"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	lc2 := &local.Client{
-		Socket:        n2.sockFile,
-		UseSocketOnly: true,
+	viaAddr := via.Addr()
+
+	router := NewTestNode(t, env)
+	d1 := router.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	router.AwaitListening()
+	router.MustUp()
+	router.AwaitRunning()
+	// Control keeps the route approved throughout; only the router's own
+	// prefs change.
+	env.Control.SetSubnetRoutes(router.MustStatus().Self.PublicKey, []netip.Prefix{via})
+
+	client := NewTestNode(t, env)
+	d2 := client.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	client.AwaitListening()
+	client.MustUp()
+	client.AwaitRunning()
+
+	setAdvertiseRoutes := func(routes string) {
+		t.Helper()
+		if out, err := router.TailscaleForOutput("set", "--advertise-routes="+routes).CombinedOutput(); err != nil {
+			t.Fatalf("setting advertise-routes to %q: %v, %s", routes, err, out)
+		}
 	}
 
-	ip1 := n1.AwaitIP4()
-	ip2 := n2.AwaitIP4()
+	client.AwaitPeerFilterBlocks(router, viaAddr, port)
 
-	tests := []struct {
-		name          string
-		n1JailedForN2 bool
-		n2JailedForN1 bool
-	}{
-		{
-			name:          "not_jailed",
-			n1JailedForN2: false,
-			n2JailedForN1: false,
-		},
-		{
-			name:          "uni_jailed",
-			n1JailedForN2: true,
-			n2JailedForN1: false,
-		},
-		{
-			name:          "bi_jailed", // useless config?
-			n1JailedForN2: true,
-			n2JailedForN1: true,
-		},
+	setAdvertiseRoutes(via.String())
+	client.AwaitPeerFilterAllows(router, viaAddr, port)
+
+	setAdvertiseRoutes("")
+	client.AwaitPeerFilterBlocks(router, viaAddr, port)
+
+	setAdvertiseRoutes(via.String())
+	client.AwaitPeerFilterAllows(router, viaAddr, port)
+}
+
+// TestEphemeralNode verifies that control deletes an ephemeral node once it's
+// been offline for a while, and that restarting its daemon registers a new
+// node rather than resurrecting the deleted one.
+func TestEphemeralNode(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	const timeout = 3 * time.Second
+	env.Control.EphemeralNodeTimeout = timeout
+	// The restarted daemon below reconnects with its persisted node key
+	// before it's given the auth key again. Like real control, ask it to
+	// log in rather than refusing it.
+	env.Control.AllowMissingAuthKey = true
+	env.Control.AddAuthKey("regular-key", testcontrol.AuthKeyOpts{})
+	env.Control.AddAuthKey("ephemeral-key", testcontrol.AuthKeyOpts{Ephemeral: true})
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
+	n1.MustUp("--auth-key=regular-key")
+	n1.AwaitRunning()
+
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	n2.AwaitListening()
+	n2.MustUp("--auth-key=ephemeral-key")
+	n2.AwaitRunning()
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
 	}
+	oldKey := n2.MustStatus().Self.PublicKey
+	oldNode := env.Control.Node(oldKey)
 
-	testDial := func(t *testing.T, lc *local.Client, ip netip.Addr, port uint16, shouldFail bool) {
-		t.Helper()
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		c, err := lc.DialTCP(ctx, ip.String(), port)
-		failed := err != nil
-		if failed != shouldFail {
-			t.Errorf("failed = %v; want %v", failed, shouldFail)
-		}
-		if c != nil {
-			c.Close()
+	// The node outlives its daemon for EphemeralNodeTimeout, then it's
+	// deleted and disappears from its peers.
+	d2.MustCleanShutdown(t)
+	stopped := time.Now()
+	for time.Since(stopped) < timeout/2 {
+		if env.Control.Node(oldKey) == nil {
+			t.Fatalf("ephemeral node deleted %v after it went offline; want at least %v", time.Since(stopped), timeout)
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
-
-	b1, err := lc1.WatchIPNBus(context.Background(), 0)
-	if err != nil {
+	if err := tstest.WaitFor(timeout+20*time.Second, func() error {
+		if env.Control.Node(oldKey) != nil {
+			return errors.New("ephemeral node not deleted yet")
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
-	b2, err := lc2.WatchIPNBus(context.Background(), 0)
-	if err != nil {
+	if elapsed := time.Since(stopped); elapsed < timeout {
+		t.Errorf("ephemeral node deleted after %v; want at least %v", elapsed, timeout)
+	}
+	if err := n1.AwaitPeers(0, 20*time.Second); err != nil {
 		t.Fatal(err)
 	}
-	waitPeerIsJailed := func(t *testing.T, b *local.IPNBusWatcher, lc *local.Client, jailed bool) {
-		t.Helper()
-		for {
-			_, err := b.Next()
-			if err != nil {
-				t.Fatal(err)
-			}
-			nm, err := fetchNetMapForTest(context.Background(), lc)
-			if err != nil || nm == nil || len(nm.Peers) == 0 {
-				continue
-			}
-			if j := nm.Peers[0].IsJailed(); j == jailed {
-				break
+
+	// Restarting the daemon registers a new node.
+	d2 = n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n2.AwaitListening()
+	n2.MustUp("--auth-key=ephemeral-key")
+	n2.AwaitRunning()
+	newNode := env.Control.Node(n2.MustStatus().Self.PublicKey)
+	if newNode == nil {
+		t.Fatal("control has no node for restarted daemon")
+	}
+	if newNode.ID == oldNode.ID || newNode.StableID == oldNode.StableID {
+		t.Errorf("restarted daemon got node %v (%v); want a new node, not %v (%v)", newNode.ID, newNode.StableID, oldNode.ID, oldNode.StableID)
+	}
+	if slices.Equal(newNode.Addresses, oldNode.Addresses) {
+		t.Errorf("restarted daemon got the deleted node's addresses %v", newNode.Addresses)
+	}
+	if got := env.Control.NumNodes(); got != 2 {
+		t.Errorf("control has %d nodes; want 2", got)
+	}
+
+	// Peers see the new node.
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st := n1.MustStatus()
+		if len(st.Peer) != 1 {
+			return fmt.Errorf("got %d peers; want 1", len(st.Peer))
+		}
+		for _, ps := range st.Peer {
+			if ps.ID != newNode.StableID {
+				return fmt.Errorf("peer is %v; want %v", ps.ID, newNode.StableID)
 			}
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			env.Control.SetJailed(k1, k2, tc.n2JailedForN1)
-			env.Control.SetJailed(k2, k1, tc.n1JailedForN2)
+}
 
-			// Wait for the jailed status to propagate.
-			waitPeerIsJailed(t, b1, lc1, tc.n2JailedForN1)
-			waitPeerIsJailed(t, b2, lc2, tc.n1JailedForN2)
+// TestEphemeralNodeChurn tests that a stable node's view of its peers keeps
+// up with ephemeral nodes rapidly joining and leaving, each join registering
+// a new node and each leave deleting one, with no stale peers lingering and
+// no new ones missing once the churn stops.
+func TestEphemeralNodeChurn(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	const timeout = time.Second
+	env.Control.EphemeralNodeTimeout = timeout
+	env.Control.AddAuthKey("regular-key", testcontrol.AuthKeyOpts{})
+	env.Control.AddAuthKey("ephemeral-key", testcontrol.AuthKeyOpts{Ephemeral: true})
 
-			testDial(t, lc1, ip2, port, tc.n1JailedForN2)
-			testDial(t, lc2, ip1, port, tc.n2JailedForN1)
-		})
+	stable := NewTestNode(t, env)
+	d := stable.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	stable.AwaitListening()
+	stable.MustUp("--auth-key=regular-key")
+	stable.AwaitRunning()
+
+	const (
+		poolSize = 3
+		rounds   = 8
+	)
+	pool := make([]*TestNode, poolSize)
+	daemons := make([]*Daemon, poolSize) // nil for nodes that are down
+	for i := range pool {
+		pool[i] = NewTestNode(t, env)
 	}
-}
 
-// TestNATPing creates two nodes, n1 and n2, sets up masquerades for both and
-// tries to do bi-directional pings between them.
-func TestNATPing(t *testing.T) {
-	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/12169")
-	tstest.Parallel(t)
-	for _, v6 := range []bool{false, true} {
-		env := NewTestEnv(t)
-		registerNode := func() (*TestNode, key.NodePublic) {
-			n := NewTestNode(t, env)
-			n.StartDaemon()
+	// Each round, all but one node of the pool either joins or leaves,
+	// without waiting for the stable node to see the previous round, so
+	// that joins, leaves and the deletions of nodes that left earlier
+	// overlap.
+	for round := range rounds {
+		for i, n := range pool {
+			if i == round%poolSize {
+				continue
+			}
+			if daemons[i] != nil {
+				t.Logf("round %d: node %d leaves", round, i)
+				daemons[i].MustCleanShutdown(t)
+				daemons[i] = nil
+				continue
+			}
+			t.Logf("round %d: node %d joins", round, i)
+			daemons[i] = n.StartDaemon()
 			n.AwaitListening()
-			n.MustUp()
+			n.MustUp("--auth-key=ephemeral-key")
 			n.AwaitRunning()
-			k := n.MustStatus().Self.PublicKey
-			return n, k
 		}
-		n1, k1 := registerNode()
-		n2, k2 := registerNode()
+	}
 
-		var n1IP, n2IP netip.Addr
-		if v6 {
-			n1IP = n1.AwaitIP6()
-			n2IP = n2.AwaitIP6()
-		} else {
-			n1IP = n1.AwaitIP4()
-			n2IP = n2.AwaitIP4()
+	want := make(set.Set[key.NodePublic])
+	for i, n := range pool {
+		if daemons[i] != nil {
+			want.Add(n.MustStatus().Self.PublicKey)
+		}
+	}
+	if len(want) == 0 {
+		t.Fatal("no ephemeral nodes up after churn")
+	}
+	// Wait for control to delete the nodes that left, so that the
+	// stable node's peers are expected to match the live nodes.
+	if err := tstest.WaitFor(timeout+20*time.Second, func() error {
+		if got := env.Control.NumNodes(); got != len(want)+1 {
+			return fmt.Errorf("control has %d nodes; want %d", got, len(want)+1)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st := stable.MustStatus()
+		var stale, missing []string
+		for k := range st.Peer {
+			if !want.Contains(k) {
+				stale = append(stale, k.ShortString())
+			}
+		}
+		for k := range want {
+			if _, ok := st.Peer[k]; !ok {
+				missing = append(missing, k.ShortString())
+			}
 		}
+		if len(stale) > 0 || len(missing) > 0 {
+			return fmt.Errorf("stale peers %v, missing peers %v", stale, missing)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-		n1ExternalIP := netip.MustParseAddr("100.64.1.1")
-		n2ExternalIP := netip.MustParseAddr("100.64.2.1")
-		if v6 {
-			n1ExternalIP = netip.MustParseAddr("fd7a:115c:a1e0::1a")
-			n2ExternalIP = netip.MustParseAddr("fd7a:115c:a1e0::1b")
+	// Once the rest leave, they're all deleted and the stable node has no
+	// peers. Waiting for that also keeps control from deleting nodes after
+	// the test is done.
+	for i, d := range daemons {
+		if d != nil {
+			d.MustCleanShutdown(t)
+			daemons[i] = nil
+		}
+	}
+	if err := tstest.WaitFor(timeout+20*time.Second, func() error {
+		if got := env.Control.NumNodes(); got != 1 {
+			return fmt.Errorf("control has %d nodes; want 1", got)
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stable.AwaitPeers(0, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
 
-		tests := []struct {
-			name       string
-			pairs      []testcontrol.MasqueradePair
-			n1SeesN2IP netip.Addr
-			n2SeesN1IP netip.Addr
-		}{
-			{
-				name:       "no_nat",
-				n1SeesN2IP: n2IP,
-				n2SeesN1IP: n1IP,
-			},
-			{
-				name: "n1_has_external_ip",
-				pairs: []testcontrol.MasqueradePair{
-					{
-						Node:              k1,
-						Peer:              k2,
-						NodeMasqueradesAs: n1ExternalIP,
-					},
-				},
-				n1SeesN2IP: n2IP,
-				n2SeesN1IP: n1ExternalIP,
+// TestPacketFilterRules tests that the packet filter rules that a node
+// compiles from the filter control sends match it exactly, sources,
+// destinations, port ranges and protocols included.
+func TestPacketFilterRules(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	for _, n := range []*TestNode{n1, n2} {
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+	}
+	ip2 := n2.AwaitIP4()
+
+	env.Control.SetPacketFilter([]tailcfg.FilterRule{
+		{
+			SrcIPs: []string{ip2.String()},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "10.0.0.0/8", Ports: tailcfg.PortRange{First: 8000, Last: 8100}},
+				{IP: "*", Ports: tailcfg.PortRange{First: 22, Last: 22}},
 			},
-			{
-				name: "n2_has_external_ip",
-				pairs: []testcontrol.MasqueradePair{
-					{
-						Node:              k2,
-						Peer:              k1,
-						NodeMasqueradesAs: n2ExternalIP,
-					},
-				},
-				n1SeesN2IP: n2ExternalIP,
-				n2SeesN1IP: n1IP,
+			IPProto: []int{int(ipproto.TCP)},
+		},
+		{
+			SrcIPs:   []string{"100.64.0.0/10"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "100.100.1.1-100.100.1.3", Ports: tailcfg.PortRangeAny}},
+		},
+	})
+
+	want := []filter.Match{
+		{
+			IPProto: views.SliceOf([]ipproto.Proto{ipproto.TCP}),
+			Srcs:    []netip.Prefix{netip.PrefixFrom(ip2, 32)},
+			Dsts: []filter.NetPortRange{
+				{Net: netip.MustParsePrefix("10.0.0.0/8"), Ports: filter.PortRange{First: 8000, Last: 8100}},
+				{Net: netip.MustParsePrefix("0.0.0.0/0"), Ports: filter.PortRange{First: 22, Last: 22}},
+				{Net: netip.MustParsePrefix("::/0"), Ports: filter.PortRange{First: 22, Last: 22}},
 			},
-			{
-				name: "both_have_external_ips",
-				pairs: []testcontrol.MasqueradePair{
-					{
-						Node:              k1,
-						Peer:              k2,
-						NodeMasqueradesAs: n1ExternalIP,
-					},
-					{
-						Node:              k2,
-						Peer:              k1,
-						NodeMasqueradesAs: n2ExternalIP,
-					},
-				},
-				n1SeesN2IP: n2ExternalIP,
-				n2SeesN1IP: n1ExternalIP,
+		},
+		{
+			// Rules without protocols match the default ones.
+			IPProto: views.SliceOf([]ipproto.Proto{ipproto.TCP, ipproto.UDP, ipproto.ICMPv4, ipproto.ICMPv6}),
+			Srcs:    []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")},
+			Dsts: []filter.NetPortRange{
+				{Net: netip.MustParsePrefix("100.100.1.1/32"), Ports: filter.PortRange{First: 0, Last: 65535}},
+				{Net: netip.MustParsePrefix("100.100.1.2/31"), Ports: filter.PortRange{First: 0, Last: 65535}},
 			},
+		},
+	}
+	opts := []cmp.Option{
+		cmpopts.IgnoreFields(filter.Match{}, "SrcsContains"),
+		cmpopts.EquateComparable(netip.Prefix{}),
+		cmpopts.EquateEmpty(),
+		cmp.Transformer("IPProto", func(v views.Slice[ipproto.Proto]) []ipproto.Proto { return v.AsSlice() }),
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		got, err := n1.PacketFilter()
+		if err != nil {
+			return err
 		}
-
-		for _, tc := range tests {
-			t.Run(fmt.Sprintf("v6=%t/%v", v6, tc.name), func(t *testing.T) {
-				env.Control.SetMasqueradeAddresses(tc.pairs)
-
-				ipIdx := 0
-				if v6 {
-					ipIdx = 1
-				}
-
-				s1 := n1.MustStatus()
-				n2AsN1Peer := s1.Peer[k2]
-				if got := n2AsN1Peer.TailscaleIPs[ipIdx]; got != tc.n1SeesN2IP {
-					t.Fatalf("n1 sees n2 as %v; want %v", got, tc.n1SeesN2IP)
-				}
-
-				s2 := n2.MustStatus()
-				n1AsN2Peer := s2.Peer[k1]
-				if got := n1AsN2Peer.TailscaleIPs[ipIdx]; got != tc.n2SeesN1IP {
-					t.Fatalf("n2 sees n1 as %v; want %v", got, tc.n2SeesN1IP)
-				}
-
-				if err := n1.Tailscale("ping", tc.n1SeesN2IP.String()).Run(); err != nil {
-					t.Fatal(err)
-				}
-
-				if err := n1.Tailscale("ping", "-peerapi", tc.n1SeesN2IP.String()).Run(); err != nil {
-					t.Fatal(err)
-				}
-
-				if err := n2.Tailscale("ping", tc.n2SeesN1IP.String()).Run(); err != nil {
-					t.Fatal(err)
-				}
-
-				if err := n2.Tailscale("ping", "-peerapi", tc.n2SeesN1IP.String()).Run(); err != nil {
-					t.Fatal(err)
-				}
-			})
+		if diff := cmp.Diff(want, got, opts...); diff != "" {
+			return fmt.Errorf("packet filter mismatch (-want +got):\n%s", diff)
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestLogoutRemovesAllPeers(t *testing.T) {
+// TestPauseNode tests that when control stalls for a single node, other nodes
+// keep getting updates, and that the stalled node catches up with what it
+// missed once control resumes.
+func TestPauseNode(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
-	// Spin up some nodes.
-	nodes := make([]*TestNode, 2)
-	for i := range nodes {
-		nodes[i] = NewTestNode(t, env)
-		nodes[i].StartDaemon()
-		nodes[i].AwaitResponding()
-		nodes[i].MustUp()
-		nodes[i].AwaitIP4()
-		nodes[i].AwaitRunning()
-	}
-	expectedPeers := len(nodes) - 1
 
-	// Make every node ping every other node.
-	// This makes sure magicsock is fully populated.
-	for i := range nodes {
-		for j := range nodes {
-			if i <= j {
-				continue
-			}
-			if err := tstest.WaitFor(20*time.Second, func() error {
-				return nodes[i].Ping(nodes[j])
-			}); err != nil {
-				t.Fatalf("ping %v -> %v: %v", nodes[i].AwaitIP4(), nodes[j].AwaitIP4(), err)
+	var nodes []*TestNode
+	for range 3 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2, n3 := nodes[0], nodes[1], nodes[2]
+	for _, n := range nodes {
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			if got := len(n.MustStatus().Peer); got != 2 {
+				return fmt.Errorf("got %d peers, want 2", got)
 			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
 		}
 	}
 
-	// wantNode0PeerCount waits until node[0] status includes exactly want peers.
-	wantNode0PeerCount := func(want int) {
+	n2Key := n2.MustStatus().Self.PublicKey
+	// peerHostName returns the host name of n2 as seen by n.
+	peerHostName := func(n *TestNode) string {
+		if ps := n.MustStatus().Peer[n2Key]; ps != nil {
+			return ps.HostName
+		}
+		return ""
+	}
+	awaitPeerHostName := func(n *TestNode, want string) {
+		t.Helper()
 		if err := tstest.WaitFor(20*time.Second, func() error {
-			s := nodes[0].MustStatus()
-			if peers := s.Peers(); len(peers) != want {
-				return fmt.Errorf("want %d peer(s) in status, got %v", want, peers)
+			if got := peerHostName(n); got != want {
+				return fmt.Errorf("peer host name = %q; want %q", got, want)
 			}
 			return nil
 		}); err != nil {
 			t.Fatal(err)
 		}
 	}
+	oldName := peerHostName(n1)
 
-	wantNode0PeerCount(expectedPeers) // all other nodes are peers
-	nodes[0].MustLogOut()
-	wantNode0PeerCount(0) // node[0] is logged out, so it should not have any peers
+	n1Key := n1.MustStatus().Self.PublicKey
+	env.Control.PauseNode(n1Key)
+	const newName = "renamed"
+	if out, err := n2.TailscaleForOutput("set", "--hostname="+newName).CombinedOutput(); err != nil {
+		t.Fatalf("setting hostname: %v, %s", err, out)
+	}
+	awaitPeerHostName(n3, newName)
 
-	nodes[0].MustUp() // This will create a new node
-	expectedPeers++
+	// n3 got the update, so n1 would have too by now if it weren't paused.
+	// Give it a little longer to be sure.
+	time.Sleep(time.Second)
+	if got := peerHostName(n1); got != oldName {
+		t.Fatalf("paused node sees peer host name %q; want the old %q", got, oldName)
+	}
+	if st := n1.MustStatus(); st.BackendState != "Running" {
+		t.Errorf("paused node is in state %q; want Running", st.BackendState)
+	}
 
-	nodes[0].AwaitIP4()
-	wantNode0PeerCount(expectedPeers) // all existing peers and the new node
+	env.Control.ResumeNode(n1Key)
+	awaitPeerHostName(n1, newName)
 }
 
-func TestAutoUpdateDefaults(t *testing.T)     { testAutoUpdateDefaults(t, false) }
-func TestAutoUpdateDefaults_cap(t *testing.T) { testAutoUpdateDefaults(t, true) }
+// TestAuthKeyPreauthorizedRoutes tests that a node registering with an auth
+// key that carries preauthorized routes has those routes approved without
+// any further admin action, while other advertised routes stay unapproved.
+func TestAuthKeyPreauthorizedRoutes(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	env.Control.AddAuthKey("router-key", testcontrol.AuthKeyOpts{
+		Tags:                []string{"tag:router"},
+		PreauthorizedRoutes: []netip.Prefix{netip.MustParsePrefix("10.123.0.0/16")},
+	})
+	env.Control.AddAuthKey("client-key", testcontrol.AuthKeyOpts{})
+	approved := netip.MustParsePrefix("10.123.4.0/24")
+	unapproved := netip.MustParsePrefix("10.200.0.0/24")
 
-// useCap is whether to use NodeAttrDefaultAutoUpdate (as opposed to the old
-// DeprecatedDefaultAutoUpdate top-level MapResponse field).
-func testAutoUpdateDefaults(t *testing.T, useCap bool) {
-	t.Cleanup(feature.HookCanAutoUpdate.SetForTest(func() bool { return true }))
+	router := NewTestNode(t, env)
+	d1 := router.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	router.AwaitListening()
+	router.MustUp("--auth-key=router-key", "--advertise-tags=tag:router",
+		"--advertise-routes="+approved.String()+","+unapproved.String())
+	router.AwaitRunning()
 
-	env := NewTestEnv(t)
+	client := NewTestNode(t, env)
+	d2 := client.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	client.AwaitListening()
+	client.MustUp("--auth-key=client-key")
+	client.AwaitRunning()
 
-	var (
-		modifyMu               sync.Mutex
-		modifyFirstMapResponse = func(*tailcfg.MapResponse, *tailcfg.MapRequest) {}
-	)
-	env.Control.ModifyFirstMapResponse = func(mr *tailcfg.MapResponse, req *tailcfg.MapRequest) {
-		modifyMu.Lock()
-		defer modifyMu.Unlock()
-		modifyFirstMapResponse(mr, req)
+	st := router.MustStatus()
+	if st.Self.Tags == nil || !slices.Equal(st.Self.Tags.AsSlice(), []string{"tag:router"}) {
+		t.Errorf("router tags = %v; want [tag:router]", st.Self.Tags)
 	}
+	routerKey := st.Self.PublicKey
 
-	checkDefault := func(n *TestNode, want bool) error {
-		enabled, ok := n.diskPrefs().AutoUpdate.Apply.Get()
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		ps, ok := client.MustStatus().Peer[routerKey]
 		if !ok {
-			return fmt.Errorf("auto-update for node is unset, should be set as %v", want)
+			return errors.New("client doesn't see router as a peer")
 		}
-		if enabled != want {
-			return fmt.Errorf("auto-update for node is %v, should be set as %v", enabled, want)
+		var allowed []netip.Prefix
+		if ps.AllowedIPs != nil {
+			allowed = ps.AllowedIPs.AsSlice()
+		}
+		if !slices.Contains(allowed, approved) {
+			return fmt.Errorf("router AllowedIPs = %v; want it to contain %v", allowed, approved)
+		}
+		if slices.Contains(allowed, unapproved) {
+			return fmt.Errorf("router AllowedIPs = %v; want it to not contain %v", allowed, unapproved)
 		}
 		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
+}
 
-	setDefaultAutoUpdate := func(send bool) {
-		modifyMu.Lock()
-		defer modifyMu.Unlock()
-		modifyFirstMapResponse = func(mr *tailcfg.MapResponse, req *tailcfg.MapRequest) {
-			if mr.Node == nil {
-				mr.Node = &tailcfg.Node{}
+// TestExitNodeApproval tests that a node advertising itself as an exit node
+// can't be used as one by its peers until control approves it, and that only
+// then does the exit route appear in its AllowedIPs in their netmaps.
+func TestExitNodeApproval(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	exit := NewTestNode(t, env)
+	d1 := exit.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	exit.AwaitListening()
+	exit.MustUp("--advertise-exit-node")
+	exit.AwaitRunning()
+
+	client := NewTestNode(t, env)
+	d2 := client.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	client.AwaitListening()
+	client.MustUp()
+	client.AwaitRunning()
+
+	exitKey := exit.MustStatus().Self.PublicKey
+	exitIP := exit.AwaitIP4()
+	allIPv4 := netip.MustParsePrefix("0.0.0.0/0")
+
+	// wantExitRoute waits until the exit node's AllowedIPs in the client's
+	// netmap contain the IPv4 exit route, or don't.
+	wantExitRoute := func(want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			nm, err := client.NetMap()
+			if err != nil {
+				return err
 			}
-			if useCap {
-				if mr.Node.CapMap == nil {
-					mr.Node.CapMap = make(tailcfg.NodeCapMap)
-				}
-				mr.Node.CapMap[tailcfg.NodeAttrDefaultAutoUpdate] = []tailcfg.RawMessage{
-					tailcfg.RawMessage(fmt.Sprintf("%t", send)),
-				}
-			} else {
-				mr.DeprecatedDefaultAutoUpdate = opt.NewBool(send)
+			i := slices.IndexFunc(nm.Peers, func(p tailcfg.NodeView) bool { return p.Key() == exitKey })
+			if i < 0 {
+				return errors.New("client doesn't see the exit node as a peer")
+			}
+			allowed := nm.Peers[i].AllowedIPs()
+			if got := views.SliceContains(allowed, allIPv4); got != want {
+				return fmt.Errorf("exit node AllowedIPs = %v; want %v in them = %v", allowed.AsSlice(), allIPv4, want)
 			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setExitNode := func() error {
+		out, err := client.TailscaleForOutput("set", "--exit-node="+exitIP.String()).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, out)
 		}
+		return nil
 	}
 
-	tests := []struct {
-		desc string
-		run  func(t *testing.T, n *TestNode)
-	}{
-		{
-			desc: "tailnet-default-false",
-			run: func(t *testing.T, n *TestNode) {
+	// The exit node's advertisement alone isn't enough.
+	wantExitRoute(false)
+	if err := setExitNode(); err == nil {
+		t.Fatal("using exit node before approval succeeded; want error")
+	} else if !strings.Contains(err.Error(), "is not advertising an exit node") {
+		t.Fatalf("using exit node before approval: %v; want not advertising error", err)
+	}
 
-				// First the server sends "false", and client should remember that.
-				setDefaultAutoUpdate(false)
-				n.MustUp()
-				n.AwaitRunning()
-				checkDefault(n, false)
+	env.Control.SetExitNodeApproved(exitKey, true)
+	wantExitRoute(true)
+	if err := setExitNode(); err != nil {
+		t.Fatalf("using exit node after approval: %v", err)
+	}
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		st := client.MustStatus()
+		if st.ExitNodeStatus == nil || st.ExitNodeStatus.ID != exit.MustStatus().Self.ID {
+			return fmt.Errorf("exit node status = %+v; want the exit node", st.ExitNodeStatus)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-				// Now we disconnect and change the server to send "true", which
-				// the client should ignore, having previously remembered
-				// "false".
-				n.MustDown()
-				setDefaultAutoUpdate(true) // control sends default "true"
-				n.MustUp()
-				n.AwaitRunning()
-				checkDefault(n, false) // still false
+	// Revoking the approval takes the route away again.
+	env.Control.SetExitNodeApproved(exitKey, false)
+	wantExitRoute(false)
+}
 
-				// But can be changed explicitly by the user.
-				if out, err := n.TailscaleForOutput("set", "--auto-update").CombinedOutput(); err != nil {
-					t.Fatalf("failed to enable auto-update on node: %v\noutput: %s", err, out)
-				}
-				checkDefault(n, true)
-			},
-		},
-		{
-			desc: "tailnet-default-true",
-			run: func(t *testing.T, n *TestNode) {
-				// Same as above but starting with default "true".
-
-				// First the server sends "true", and client should remember that.
-				setDefaultAutoUpdate(true)
-				n.MustUp()
-				n.AwaitRunning()
-				checkDefault(n, true)
+func TestNodeAddressIPFields(t *testing.T) {
+	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/7008")
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
 
-				// Now we disconnect and change the server to send "false", which
-				// the client should ignore, having previously remembered
-				// "true".
-				n.MustDown()
-				setDefaultAutoUpdate(false) // control sends default "false"
-				n.MustUp()
-				n.AwaitRunning()
-				checkDefault(n, true) // still true
+	n1.AwaitListening()
+	n1.MustUp()
+	n1.AwaitRunning()
 
-				// But can be changed explicitly by the user.
-				if out, err := n.TailscaleForOutput("set", "--auto-update=false").CombinedOutput(); err != nil {
-					t.Fatalf("failed to enable auto-update on node: %v\noutput: %s", err, out)
-				}
-				checkDefault(n, false)
-			},
-		},
-		{
-			desc: "user-sets-first",
-			run: func(t *testing.T, n *TestNode) {
-				// User sets auto-update first, before receiving defaults.
-				if out, err := n.TailscaleForOutput("set", "--auto-update=false").CombinedOutput(); err != nil {
-					t.Fatalf("failed to disable auto-update on node: %v\noutput: %s", err, out)
-				}
+	testNodes := env.Control.AllNodes()
 
-				setDefaultAutoUpdate(true)
-				n.MustUp()
-				n.AwaitRunning()
-				checkDefault(n, false)
-			},
-		},
+	if len(testNodes) != 1 {
+		t.Errorf("Expected %d nodes, got %d", 1, len(testNodes))
 	}
-	for _, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			n := NewTestNode(t, env)
-			n.allowUpdates = true
-			d := n.StartDaemon()
-			defer d.MustCleanShutdown(t)
-			n.AwaitResponding()
-			tt.run(t, n)
-		})
+	node := testNodes[0]
+	if len(node.Addresses) == 0 {
+		t.Errorf("Empty Addresses field in node")
+	}
+	if len(node.AllowedIPs) == 0 {
+		t.Errorf("Empty AllowedIPs field in node")
 	}
+
+	d1.MustCleanShutdown(t)
 }
 
-// TestDNSOverTCPIntervalResolver tests that the quad-100 resolver successfully
-// serves TCP queries. It exercises the host's TCP stack, a TUN device, and
-// gVisor/netstack.
-// https://github.com/tailscale/corp/issues/22511
-func TestDNSOverTCPIntervalResolver(t *testing.T) {
-	tstest.RequireRoot(t)
+// TestSubnetRouteAllowedIPs tests that a client routes traffic for a subnet
+// route through the peer whose AllowedIPs contain it, as set by control, even
+// though the route isn't one of that peer's addresses.
+func TestSubnetRouteAllowedIPs(t *testing.T) {
+	tstest.Parallel(t)
 	env := NewTestEnv(t)
-	env.tunMode = true
-	n1 := NewTestNode(t, env)
-	d1 := n1.StartDaemon()
-
-	n1.AwaitResponding()
-	n1.MustUp()
-	n1.AwaitRunning()
 
-	const dnsSymbolicFQDN = "magicdns.localhost-tailscale-daemon."
-
-	cases := []struct {
-		network     string
-		serviceAddr netip.Addr
-	}{
-		{
-			"tcp4",
-			tsaddr.TailscaleServiceIP(),
-		},
-		{
-			"tcp6",
-			tsaddr.TailscaleServiceIPv6(),
-		},
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, c := range cases {
-		err := tstest.WaitFor(time.Second*5, func() error {
-			m := new(dns.Msg)
-			m.SetQuestion(dnsSymbolicFQDN, dns.TypeA)
-			conn, err := net.DialTimeout(c.network, net.JoinHostPort(c.serviceAddr.String(), "53"), time.Second*1)
-			if err != nil {
-				return err
-			}
-			defer conn.Close()
-			dnsConn := &dns.Conn{
-				Conn: conn,
-			}
-			dnsClient := &dns.Client{}
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-			defer cancel()
-			resp, _, err := dnsClient.ExchangeWithConnContext(ctx, m, dnsConn)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
 			if err != nil {
-				return err
-			}
-			if len(resp.Answer) != 1 {
-				return fmt.Errorf("unexpected DNS resp: %s", resp)
-			}
-			var gotAddr net.IP
-			answer, ok := resp.Answer[0].(*dns.A)
-			if !ok {
-				return fmt.Errorf("unexpected answer type: %s", resp.Answer[0])
+				return
 			}
-			gotAddr = answer.A
-			if !bytes.Equal(gotAddr, tsaddr.TailscaleServiceIP().AsSlice()) {
-				return fmt.Errorf("got (%s) != want (%s)", gotAddr, tsaddr.TailscaleServiceIP())
+			c.Close()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	// Use a 4via6 route to the listener, so that it's only reachable through
+	// a subnet router and not also directly from the client.
+	via, err := tsaddr.MapVia(7, netip.MustParsePrefix("127.0.0.1/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	viaAddr := via.Addr()
+
+	// The router serves the route. The other peer doesn't, so traffic only
+	// gets through if it's sent to the router.
+	var nodes []*TestNode
+	for _, upArgs := range [][]string{{"--advertise-routes=" + via.String()}, nil, nil} {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp(upArgs...)
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	router, other, client := nodes[0], nodes[1], nodes[2]
+	routerKey := router.MustStatus().Self.PublicKey
+	otherKey := other.MustStatus().Self.PublicKey
+
+	// wantRouteVia waits until client sees via in the AllowedIPs of only
+	// the given peer, and never in a peer's addresses.
+	wantRouteVia := func(k key.NodePublic) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			st := client.MustStatus()
+			for _, pk := range []key.NodePublic{routerKey, otherKey} {
+				ps, ok := st.Peer[pk]
+				if !ok {
+					return fmt.Errorf("client doesn't see peer %v", pk.ShortString())
+				}
+				if slices.Contains(ps.TailscaleIPs, viaAddr) {
+					return fmt.Errorf("peer %v has route %v as an address", pk.ShortString(), via)
+				}
+				var got bool
+				if ps.AllowedIPs != nil {
+					got = slices.Contains(ps.AllowedIPs.AsSlice(), via)
+				}
+				if want := pk == k; got != want {
+					return fmt.Errorf("peer %v: route in AllowedIPs = %v; want %v", pk.ShortString(), got, want)
+				}
 			}
 			return nil
-		})
-		if err != nil {
+		}); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	d1.MustCleanShutdown(t)
-}
+	// Without the route in any peer's AllowedIPs, there's no way through.
+	client.AwaitPeerFilterBlocks(router, viaAddr, port)
 
-// TestNetstackTCPLoopback tests netstack loopback of a TCP stream, in both
-// directions.
-func TestNetstackTCPLoopback(t *testing.T) {
-	tstest.RequireRoot(t)
+	env.Control.SetSubnetRoutes(routerKey, []netip.Prefix{via})
+	wantRouteVia(routerKey)
+	client.AwaitPeerFilterAllows(router, viaAddr, port)
+
+	// Control moves the route to the other peer. The router still serves
+	// it, but the client no longer sends it traffic for the route.
+	env.Control.SetSubnetRoutes(routerKey, nil)
+	env.Control.SetSubnetRoutes(otherKey, []netip.Prefix{via})
+	wantRouteVia(otherKey)
+	client.AwaitPeerFilterBlocks(other, viaAddr, port)
+
+	env.Control.SetSubnetRoutes(otherKey, nil)
+	env.Control.SetSubnetRoutes(routerKey, []netip.Prefix{via})
+	wantRouteVia(routerKey)
+	client.AwaitPeerFilterAllows(router, viaAddr, port)
+}
 
+func TestAddPingRequest(t *testing.T) {
+	tstest.Parallel(t)
 	env := NewTestEnv(t)
-	env.tunMode = true
-	loopbackPort := 5201
-	env.loopbackPort = &loopbackPort
-	loopbackPortStr := strconv.Itoa(loopbackPort)
 	n1 := NewTestNode(t, env)
-	d1 := n1.StartDaemon()
+	n1.StartDaemon()
 
-	n1.AwaitResponding()
+	n1.AwaitListening()
 	n1.MustUp()
-
-	n1.AwaitIP4()
 	n1.AwaitRunning()
 
-	cases := []struct {
-		lisAddr  string
-		network  string
-		dialAddr string
-	}{
-		{
-			lisAddr:  net.JoinHostPort("127.0.0.1", loopbackPortStr),
-			network:  "tcp4",
-			dialAddr: net.JoinHostPort(tsaddr.TailscaleServiceIPString, loopbackPortStr),
-		},
-		{
-			lisAddr:  net.JoinHostPort("::1", loopbackPortStr),
-			network:  "tcp6",
-			dialAddr: net.JoinHostPort(tsaddr.TailscaleServiceIPv6String, loopbackPortStr),
-		},
+	gotPing := make(chan bool, 1)
+	waitPing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPing <- true
+	}))
+	defer waitPing.Close()
+
+	nodes := env.Control.AllNodes()
+	if len(nodes) != 1 {
+		t.Fatalf("expected 1 node, got %d nodes", len(nodes))
 	}
 
-	writeBufSize := 128 << 10 // 128KiB, exercise GSO if enabled
-	writeBufIterations := 100 // allow TCP send window to open up
-	wantTotal := writeBufSize * writeBufIterations
+	nodeKey := nodes[0].Key
 
-	for _, c := range cases {
-		lis, err := net.Listen(c.network, c.lisAddr)
-		if err != nil {
+	// Check that we get at least one ping reply after 10 tries.
+	for try := 1; try <= 10; try++ {
+		t.Logf("ping %v ...", try)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := env.Control.AwaitNodeInMapRequest(ctx, nodeKey); err != nil {
 			t.Fatal(err)
 		}
-		defer lis.Close()
+		cancel()
 
-		writeFn := func(conn net.Conn) error {
-			for range writeBufIterations {
-				toWrite := make([]byte, writeBufSize)
-				var wrote int
-				for {
-					n, err := conn.Write(toWrite)
-					if err != nil {
-						return err
-					}
-					wrote += n
-					if wrote == len(toWrite) {
-						break
-					}
-				}
-			}
-			return nil
+		pr := &tailcfg.PingRequest{URL: fmt.Sprintf("%s/ping-%d", waitPing.URL, try), Log: true}
+		if !env.Control.AddPingRequest(nodeKey, pr) {
+			t.Logf("failed to AddPingRequest")
+			continue
 		}
 
-		readFn := func(conn net.Conn) error {
-			var read int
-			for {
-				b := make([]byte, writeBufSize)
-				n, err := conn.Read(b)
-				if err != nil {
-					return err
-				}
-				read += n
-				if read == wantTotal {
-					return nil
-				}
-			}
+		// Wait for PingRequest to come back
+		pingTimeout := time.NewTimer(2 * time.Second)
+		defer pingTimeout.Stop()
+		select {
+		case <-gotPing:
+			t.Logf("got ping; success")
+			return
+		case <-pingTimeout.C:
+			// Try again.
 		}
+	}
+	t.Error("all ping attempts failed")
+}
 
-		lisStepCh := make(chan error)
-		go func() {
-			conn, err := lis.Accept()
-			if err != nil {
-				lisStepCh <- err
-				return
-			}
-			lisStepCh <- readFn(conn)
-			lisStepCh <- writeFn(conn)
-		}()
+// TestPingRequestFailures tests that nodes give up on PingRequests whose
+// targets hang, and report failed pings back to control, even when control
+// fails to accept the report.
+func TestPingRequestFailures(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	// A peer without a running tailscaled, so pings to it go unanswered.
+	stubKey := env.SeedNetmap(1, true)[0]
+	stubIP := env.Control.Node(stubKey).Addresses[0].Addr()
 
-		var conn net.Conn
-		err = tstest.WaitFor(time.Second*5, func() error {
-			conn, err = net.DialTimeout(c.network, c.dialAddr, time.Second*1)
-			if err != nil {
-				return err
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n1.AwaitListening()
+	n1.MustUp()
+	n1.AwaitRunning()
+	nodeKey := n1.MustStatus().Self.PublicKey
+
+	// ping sends pr to n1 and returns the first request n1 makes to pt.
+	ping := func(pt *testcontrol.PingTarget, pr *tailcfg.PingRequest) *testcontrol.PingTargetRequest {
+		t.Helper()
+		pr.URL = pt.URL
+		pr.Log = true
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if err := env.Control.AwaitNodeInMapRequest(ctx, nodeKey); err != nil {
+			t.Fatal(err)
+		}
+		if !env.Control.AddPingRequest(nodeKey, pr) {
+			t.Fatal("AddPingRequest failed")
+		}
+		select {
+		case req := <-pt.Requests():
+			return req
+		case <-time.After(30 * time.Second):
+			t.Fatal("timeout waiting for n1 to answer PingRequest")
+			return nil
+		}
+	}
+
+	t.Run("unanswered-peer", func(t *testing.T) {
+		pt := env.Control.NewPingTarget(0, 0)
+		req := ping(pt, &tailcfg.PingRequest{Types: "disco", IP: stubIP})
+		if req.Method != "POST" || req.Result == nil {
+			t.Fatalf("got %s request with result %v; want POSTed ping result", req.Method, req.Result)
+		}
+		if req.Result.Err == "" || req.Result.LatencySeconds != 0 {
+			t.Errorf("ping of unanswering peer got result %+v; want an error", req.Result)
+		}
+	})
+	t.Run("hanging-target", func(t *testing.T) {
+		pt := env.Control.NewPingTarget(time.Minute, 0)
+		req := ping(pt, &tailcfg.PingRequest{})
+		if req.Method != "HEAD" || !req.Canceled {
+			t.Errorf("got %s request, canceled=%v; want HEAD request that n1 gave up on", req.Method, req.Canceled)
+		}
+	})
+	t.Run("failing-target", func(t *testing.T) {
+		pt := env.Control.NewPingTarget(0, http.StatusInternalServerError)
+		req := ping(pt, &tailcfg.PingRequest{Types: "disco", IP: netip.MustParseAddr("100.64.99.99")})
+		if req.Result == nil || req.Result.Err == "" {
+			t.Fatalf("ping of unknown IP got result %+v; want an error", req.Result)
+		}
+		// n1 still answers PingRequests after control failed one.
+		pt = env.Control.NewPingTarget(0, 0)
+		if req := ping(pt, &tailcfg.PingRequest{}); req.Method != "HEAD" {
+			t.Errorf("got %s request; want HEAD", req.Method)
+		}
+	})
+
+	d1.MustCleanShutdown(t)
+}
+
+func TestC2NPingRequest(t *testing.T) {
+	tstest.Parallel(t)
+
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	n1.StartDaemon()
+
+	n1.AwaitListening()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	nodes := env.Control.AllNodes()
+	if len(nodes) != 1 {
+		t.Fatalf("expected 1 node, got %d nodes", len(nodes))
+	}
+
+	nodeKey := nodes[0].Key
+
+	// Check that we get at least one ping reply after 10 tries.
+	for try := 1; try <= 10; try++ {
+		t.Logf("ping %v ...", try)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := env.Control.AwaitNodeInMapRequest(ctx, nodeKey); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+
+		ctx, cancel = context.WithTimeout(t.Context(), 2*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", "/echo", bytes.NewReader([]byte("abc")))
+		if err != nil {
+			t.Errorf("failed to create request: %v", err)
+			continue
+		}
+		r, err := env.Control.NodeRoundTripper(nodeKey).RoundTrip(req)
+		if err != nil {
+			t.Errorf("RoundTrip failed: %v", err)
+			continue
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("unexpected status code: %d", r.StatusCode)
+			continue
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading body: %v", err)
+			continue
+		}
+		if string(b) != "abc" {
+			t.Errorf("body = %q; want %q", b, "abc")
+			continue
+		}
+		return
+	}
+	t.Error("all ping attempts failed")
+}
+
+// Issue 2434: when "down" (WantRunning false), tailscaled shouldn't
+// be connected to control.
+func TestNoControlConnWhenDown(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+
+	// Come up the first time.
+	n1.MustUp()
+	ip1 := n1.AwaitIP4()
+	n1.AwaitRunning()
+
+	// Then bring it down and stop the daemon.
+	n1.MustDown()
+	d1.MustCleanShutdown(t)
+
+	env.LogCatcher.Reset()
+	d2 := n1.StartDaemon()
+	n1.AwaitResponding()
+
+	n1.AwaitBackendState("Stopped")
+
+	// The real test: verify our daemon doesn't have an HTTP request open.
+	// Stopping the client may take some time to disconnect from testcontrol.
+	if err := tstest.WaitFor(time.Second, func() error {
+		if n := env.Control.InServeMap(); n != 0 {
+			return fmt.Errorf("in serve map = %d; want 0", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected connections while stopped: %v", err)
+	}
+
+	ip2 := n1.AwaitIP4()
+	if ip1 != ip2 {
+		t.Errorf("IPs different: %q vs %q", ip1, ip2)
+	}
+
+	if n := env.Control.InServeMap(); n != 0 {
+		t.Fatalf("unexpected connection triggered by tailscale ip: in serve map = %d; want 0", n)
+	}
+
+	d2.MustCleanShutdown(t)
+}
+
+// TestUpDownGoroutineLeak verifies that repeatedly bringing a node up and
+// down doesn't leak goroutines in tailscaled.
+func TestUpDownGoroutineLeak(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+
+	cycle := func() {
+		t.Helper()
+		n1.MustDown()
+		n1.AwaitBackendState("Stopped")
+		n1.MustUp()
+		n1.AwaitRunning()
+	}
+
+	// Do one cycle before taking the baseline, so that goroutines that are
+	// only started lazily on first use are accounted for.
+	n1.MustUp()
+	n1.AwaitRunning()
+	cycle()
+
+	// settledGoroutineCount returns the number of goroutines in tailscaled
+	// once it has stopped changing. Goroutines belonging to an old session
+	// may take a moment to exit, and some only once a GC runs the finalizers
+	// of what they were serving, so it collects garbage before each count.
+	settledGoroutineCount := func() int {
+		t.Helper()
+		last := -1
+		var n int
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			if err := n1.LocalClient().DebugAction(context.Background(), "gc"); err != nil {
+				return err
+			}
+			var err error
+			n, err = n1.GoroutineCount()
+			if err != nil {
+				return err
+			}
+			if n != last {
+				prev := last
+				last = n
+				return fmt.Errorf("goroutine count went from %d to %d", prev, n)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	baseline := settledGoroutineCount()
+
+	// Do more cycles than the tolerance, so that leaking even one goroutine
+	// per cycle fails the test. The tolerance is slack for unrelated
+	// background work (e.g. in-flight timers or netcheck probes) that happens
+	// to be running at either measurement.
+	const (
+		cycles    = 20
+		tolerance = 5
+	)
+	for range cycles {
+		cycle()
+	}
+	if n := settledGoroutineCount(); n > baseline+tolerance {
+		t.Fatalf("goroutines = %d after %d up/down cycles; want <= %d (baseline %d + %d)", n, cycles, baseline+tolerance, baseline, tolerance)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestDownThenImmediateUp tests that running "up" right after "down", without
+// waiting for the node to disconnect from control, reliably brings the node
+// back to Running as the same node, with the same addresses and without
+// control registering another node.
+func TestDownThenImmediateUp(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	st := n1.MustStatus()
+	nodeKey := st.Self.PublicKey
+	ips := n1.AwaitIPs()
+
+	const cycles = 5
+	for i := range cycles {
+		// Unlike MustDown, don't wait for the node to drop its map
+		// poll before bringing it back up.
+		if out, err := n1.Tailscale("down", "--accept-risk=all").CombinedOutput(); err != nil {
+			t.Fatalf("cycle %d: down: %v, %s", i, err, out)
+		}
+		n1.MustUp()
+		n1.AwaitRunning()
+
+		st := n1.MustStatus()
+		if st.Self.PublicKey != nodeKey {
+			t.Fatalf("cycle %d: node key changed from %v to %v", i, nodeKey.ShortString(), st.Self.PublicKey.ShortString())
+		}
+		if got := n1.AwaitIPs(); !slices.Equal(got, ips) {
+			t.Fatalf("cycle %d: IPs changed from %v to %v", i, ips, got)
+		}
+		// Each "up" after a "down" logs in again with the existing
+		// node key, which is one register request, but mustn't make
+		// control register another node.
+		if got, want := env.Control.RegisterCount(nodeKey), i+2; got != want {
+			t.Fatalf("cycle %d: node sent %d register requests; want %d, one per up", i, got, want)
+		}
+		if got := env.Control.NumNodes(); got != 1 {
+			t.Fatalf("cycle %d: control has %d nodes; want 1", i, got)
+		}
+	}
+
+	// Make sure the node stays up, rather than a late effect of one of the
+	// downs taking it down again.
+	time.Sleep(time.Second)
+	if st := n1.MustStatus(); st.BackendState != "Running" {
+		t.Fatalf("after %d cycles, backend state = %q; want Running", cycles, st.BackendState)
+	}
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if env.Control.InServeMap() == 0 {
+			return errors.New("node has no map poll")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Issue 2137: make sure Windows tailscaled works with the CLI alone,
+// without the GUI to kick off a Start.
+func TestOneNodeUpWindowsStyle(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t, canRunAsServiceOnWindows())
+	n1 := NewTestNode(t, env)
+	n1.upFlagGOOS = "windows"
+
+	d1 := n1.StartDaemonAsIPNGOOS("windows")
+	n1.AwaitResponding()
+	n1.MustUp("--unattended")
+
+	t.Logf("Got IP: %v", n1.AwaitIP4())
+	n1.AwaitRunning()
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestClientSideJailing tests that when one node is jailed for another, the
+// jailed node cannot initiate connections to the other node however the other
+// node can initiate connections to the jailed node.
+func TestClientSideJailing(t *testing.T) {
+	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/17419")
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	registerNode := func() (*TestNode, key.NodePublic) {
+		n := NewTestNode(t, env)
+		n.StartDaemon()
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		k := n.MustStatus().Self.PublicKey
+		return n, k
+	}
+	n1, k1 := registerNode()
+	n2, k2 := registerNode()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	lc1 := &local.Client{
+		Socket:        n1.sockFile,
+		UseSocketOnly: true,
+	}
+	lc2 := &local.Client{
+		Socket:        n2.sockFile,
+		UseSocketOnly: true,
+	}
+
+	ip1 := n1.AwaitIP4()
+	ip2 := n2.AwaitIP4()
+
+	tests := []struct {
+		name          string
+		n1JailedForN2 bool
+		n2JailedForN1 bool
+	}{
+		{
+			name:          "not_jailed",
+			n1JailedForN2: false,
+			n2JailedForN1: false,
+		},
+		{
+			name:          "uni_jailed",
+			n1JailedForN2: true,
+			n2JailedForN1: false,
+		},
+		{
+			name:          "bi_jailed", // useless config?
+			n1JailedForN2: true,
+			n2JailedForN1: true,
+		},
+	}
+
+	testDial := func(t *testing.T, lc *local.Client, ip netip.Addr, port uint16, shouldFail bool) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c, err := lc.DialTCP(ctx, ip.String(), port)
+		failed := err != nil
+		if failed != shouldFail {
+			t.Errorf("failed = %v; want %v", failed, shouldFail)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+
+	b1, err := lc1.WatchIPNBus(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := lc2.WatchIPNBus(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitPeerIsJailed := func(t *testing.T, b *local.IPNBusWatcher, lc *local.Client, jailed bool) {
+		t.Helper()
+		for {
+			_, err := b.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nm, err := fetchNetMapForTest(context.Background(), lc)
+			if err != nil || nm == nil || len(nm.Peers) == 0 {
+				continue
+			}
+			if j := nm.Peers[0].IsJailed(); j == jailed {
+				break
+			}
+		}
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env.Control.SetJailed(k1, k2, tc.n2JailedForN1)
+			env.Control.SetJailed(k2, k1, tc.n1JailedForN2)
+
+			// Wait for the jailed status to propagate.
+			waitPeerIsJailed(t, b1, lc1, tc.n2JailedForN1)
+			waitPeerIsJailed(t, b2, lc2, tc.n1JailedForN2)
+
+			testDial(t, lc1, ip2, port, tc.n1JailedForN2)
+			testDial(t, lc2, ip1, port, tc.n2JailedForN1)
+		})
+	}
+}
+
+// TestShieldsUp tests that when a node has shields up, its peers cannot
+// initiate connections to it, but it can still initiate connections to its
+// peers. It also checks that inbound connections work again once shields are
+// lowered.
+func TestShieldsUp(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	registerNode := func() *TestNode {
+		n := NewTestNode(t, env)
+		n.StartDaemon()
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		return n
+	}
+	n1 := registerNode()
+	n2 := registerNode()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	lc1 := n1.LocalClient()
+	lc2 := n2.LocalClient()
+	ip1 := n1.AwaitIP4()
+	ip2 := n2.AwaitIP4()
+
+	// awaitDial waits for a dial via lc to ip:port to succeed or fail,
+	// per wantOK. The packet filter is reconfigured asynchronously after
+	// a prefs change, so the result may take a moment to flip.
+	awaitDial := func(desc string, lc *local.Client, ip netip.Addr, wantOK bool) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			c, err := lc.DialTCP(ctx, ip.String(), port)
+			if c != nil {
+				c.Close()
+			}
+			if gotOK := err == nil; gotOK != wantOK {
+				return fmt.Errorf("dial succeeded = %v; want %v (err: %v)", gotOK, wantOK, err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+	}
+
+	awaitDial("n2 -> n1 before shields-up", lc2, ip1, true)
+	awaitDial("n1 -> n2 before shields-up", lc1, ip2, true)
+
+	if out, err := n1.TailscaleForOutput("set", "--shields-up=true").CombinedOutput(); err != nil {
+		t.Fatalf("enabling shields-up: %v, %s", err, out)
+	}
+	if p := n1.diskPrefs(); !p.ShieldsUp {
+		t.Fatalf("ShieldsUp = false after set --shields-up=true")
+	}
+	awaitDial("n2 -> n1 with shields-up", lc2, ip1, false)
+	awaitDial("n1 -> n2 with shields-up", lc1, ip2, true)
+
+	if out, err := n1.TailscaleForOutput("set", "--shields-up=false").CombinedOutput(); err != nil {
+		t.Fatalf("disabling shields-up: %v, %s", err, out)
+	}
+	awaitDial("n2 -> n1 after shields-down", lc2, ip1, true)
+	awaitDial("n1 -> n2 after shields-down", lc1, ip2, true)
+}
+
+// TestPrefsChurn tests that rapidly toggling shields-up, the exit node and
+// accept-routes on a running node doesn't break its reconfiguration: once the
+// churn stops, the node has the prefs it was last given, its peer can reach
+// it and it can reach its peer, and it hasn't leaked goroutines.
+func TestPrefsChurn(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	registerNode := func() (*TestNode, *Daemon) {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		return n, d
+	}
+	n1, d1 := registerNode()
+	defer d1.MustCleanShutdown(t)
+	n2, d2 := registerNode()
+	defer d2.MustCleanShutdown(t)
+
+	// Make n2 an exit node that n1 can select.
+	env.Control.SetSubnetRoutes(n2.MustStatus().Self.PublicKey, tsaddr.ExitRoutes())
+	var exitNodeID tailcfg.StableNodeID
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st := n1.MustStatus()
+		for _, ps := range st.Peer {
+			if ps.ExitNodeOption {
+				exitNodeID = ps.ID
+				return nil
+			}
+		}
+		return errors.New("n2 not yet offered as an exit node")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	lc1 := n1.LocalClient()
+	lc2 := n2.LocalClient()
+	ip1 := n1.AwaitIP4()
+	ip2 := n2.AwaitIP4()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	setPrefs := func(shieldsUp, useExitNode, routeAll bool) {
+		t.Helper()
+		mp := &ipn.MaskedPrefs{
+			Prefs: ipn.Prefs{
+				ShieldsUp: shieldsUp,
+				RouteAll:  routeAll,
+			},
+			ShieldsUpSet:  true,
+			ExitNodeIDSet: true,
+			RouteAllSet:   true,
+		}
+		if useExitNode {
+			mp.ExitNodeID = exitNodeID
+		}
+		if _, err := lc1.EditPrefs(ctx, mp); err != nil {
+			t.Fatalf("EditPrefs(shieldsUp=%v, exitNode=%v, routeAll=%v): %v", shieldsUp, useExitNode, routeAll, err)
+		}
+	}
+	// awaitDial waits for a dial via lc to ip:port to succeed. The packet
+	// filter is reconfigured asynchronously, so it may take a moment.
+	awaitDial := func(desc string, lc *local.Client, ip netip.Addr) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			c, err := lc.DialTCP(ctx, ip.String(), port)
+			if err != nil {
+				return err
+			}
+			return c.Close()
+		}); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+	}
+
+	// Go through every combination once before taking the goroutine
+	// baseline, so that goroutines that are only started lazily on first
+	// use are accounted for. The baseline is taken in the state that the
+	// churn ends in: n2 as the exit node and routes accepted.
+	for i := range 8 {
+		setPrefs(i&1 != 0, i&2 != 0, i&4 != 0)
+	}
+	setPrefs(false, true, true)
+	awaitDial("n2 -> n1 before churn", lc2, ip1)
+	awaitDial("n1 -> n2 before churn", lc1, ip2)
+	baseline, err := n1.GoroutineCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Toggle each pref at its own rate, so that the changes overlap in
+	// every combination.
+	const churnFor = 3 * time.Second
+	var changes int
+	for start := time.Now(); time.Since(start) < churnFor; changes++ {
+		setPrefs(changes%2 == 1, changes%3 == 1, changes%5 >= 2)
+	}
+	t.Logf("made %d prefs changes in %v", changes, churnFor)
+
+	// Make sure the node settles in the final state rather than at some
+	// earlier one.
+	setPrefs(false, true, true)
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st := n1.MustStatus()
+		if st.BackendState != "Running" {
+			return fmt.Errorf("backend state = %q; want Running", st.BackendState)
+		}
+		if st.ExitNodeStatus == nil || st.ExitNodeStatus.ID != exitNodeID {
+			return fmt.Errorf("exit node status = %+v; want %v", st.ExitNodeStatus, exitNodeID)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	prefs, err := lc1.GetPrefs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.ShieldsUp || prefs.ExitNodeID != exitNodeID || !prefs.RouteAll {
+		t.Fatalf("after churn, prefs have ShieldsUp=%v ExitNodeID=%q RouteAll=%v; want false, %q, true", prefs.ShieldsUp, prefs.ExitNodeID, prefs.RouteAll, exitNodeID)
+	}
+	awaitDial("n2 -> n1 after churn", lc2, ip1)
+	awaitDial("n1 -> n2 after churn", lc1, ip2)
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		return n1.Ping(n2)
+	}); err != nil {
+		t.Fatalf("ping n1 -> n2 after churn: %v", err)
+	}
+
+	// Goroutines of superseded configurations may take a moment to exit,
+	// so wait for the count to settle, with a little slack for unrelated
+	// background work, as in TestUpDownGoroutineLeak.
+	const tolerance = 5
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		n, err := n1.GoroutineCount()
+		if err != nil {
+			return err
+		}
+		if n > baseline+tolerance {
+			return fmt.Errorf("goroutines = %d after %d prefs changes; want <= %d (baseline %d + %d)", n, changes, baseline+tolerance, baseline, tolerance)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNATPing creates two nodes, n1 and n2, sets up masquerades for both and
+// tries to do bi-directional pings between them.
+func TestNATPing(t *testing.T) {
+	flakytest.Mark(t, "https://github.com/tailscale/tailscale/issues/12169")
+	tstest.Parallel(t)
+	for _, v6 := range []bool{false, true} {
+		env := NewTestEnv(t)
+		registerNode := func() (*TestNode, key.NodePublic) {
+			n := NewTestNode(t, env)
+			n.StartDaemon()
+			n.AwaitListening()
+			n.MustUp()
+			n.AwaitRunning()
+			k := n.MustStatus().Self.PublicKey
+			return n, k
+		}
+		n1, k1 := registerNode()
+		n2, k2 := registerNode()
+
+		var n1IP, n2IP netip.Addr
+		if v6 {
+			n1IP = n1.AwaitIP6()
+			n2IP = n2.AwaitIP6()
+		} else {
+			n1IP = n1.AwaitIP4()
+			n2IP = n2.AwaitIP4()
+		}
+
+		n1ExternalIP := netip.MustParseAddr("100.64.1.1")
+		n2ExternalIP := netip.MustParseAddr("100.64.2.1")
+		if v6 {
+			n1ExternalIP = netip.MustParseAddr("fd7a:115c:a1e0::1a")
+			n2ExternalIP = netip.MustParseAddr("fd7a:115c:a1e0::1b")
+		}
+
+		tests := []struct {
+			name       string
+			pairs      []testcontrol.MasqueradePair
+			n1SeesN2IP netip.Addr
+			n2SeesN1IP netip.Addr
+		}{
+			{
+				name:       "no_nat",
+				n1SeesN2IP: n2IP,
+				n2SeesN1IP: n1IP,
+			},
+			{
+				name: "n1_has_external_ip",
+				pairs: []testcontrol.MasqueradePair{
+					{
+						Node:              k1,
+						Peer:              k2,
+						NodeMasqueradesAs: n1ExternalIP,
+					},
+				},
+				n1SeesN2IP: n2IP,
+				n2SeesN1IP: n1ExternalIP,
+			},
+			{
+				name: "n2_has_external_ip",
+				pairs: []testcontrol.MasqueradePair{
+					{
+						Node:              k2,
+						Peer:              k1,
+						NodeMasqueradesAs: n2ExternalIP,
+					},
+				},
+				n1SeesN2IP: n2ExternalIP,
+				n2SeesN1IP: n1IP,
+			},
+			{
+				name: "both_have_external_ips",
+				pairs: []testcontrol.MasqueradePair{
+					{
+						Node:              k1,
+						Peer:              k2,
+						NodeMasqueradesAs: n1ExternalIP,
+					},
+					{
+						Node:              k2,
+						Peer:              k1,
+						NodeMasqueradesAs: n2ExternalIP,
+					},
+				},
+				n1SeesN2IP: n2ExternalIP,
+				n2SeesN1IP: n1ExternalIP,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(fmt.Sprintf("v6=%t/%v", v6, tc.name), func(t *testing.T) {
+				env.Control.SetMasqueradeAddresses(tc.pairs)
+
+				ipIdx := 0
+				if v6 {
+					ipIdx = 1
+				}
+
+				s1 := n1.MustStatus()
+				n2AsN1Peer := s1.Peer[k2]
+				if got := n2AsN1Peer.TailscaleIPs[ipIdx]; got != tc.n1SeesN2IP {
+					t.Fatalf("n1 sees n2 as %v; want %v", got, tc.n1SeesN2IP)
+				}
+
+				s2 := n2.MustStatus()
+				n1AsN2Peer := s2.Peer[k1]
+				if got := n1AsN2Peer.TailscaleIPs[ipIdx]; got != tc.n2SeesN1IP {
+					t.Fatalf("n2 sees n1 as %v; want %v", got, tc.n2SeesN1IP)
+				}
+
+				if err := n1.Tailscale("ping", tc.n1SeesN2IP.String()).Run(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := n1.Tailscale("ping", "-peerapi", tc.n1SeesN2IP.String()).Run(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := n2.Tailscale("ping", tc.n2SeesN1IP.String()).Run(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := n2.Tailscale("ping", "-peerapi", tc.n2SeesN1IP.String()).Run(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// TestNodeAddressReassignment tests that a node whose tailnet addresses are
+// changed by control mid-session switches to the new ones without
+// restarting, and that its peers follow.
+func TestNodeAddressReassignment(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	nodes := make([]*TestNode, 2)
+	for i := range nodes {
+		nodes[i] = NewTestNode(t, env)
+		d := nodes[i].StartDaemon()
+		defer d.MustCleanShutdown(t)
+		nodes[i].AwaitResponding()
+		nodes[i].MustUp()
+		nodes[i].AwaitRunning()
+	}
+	n1, n2 := nodes[0], nodes[1]
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		return n2.Ping(n1)
+	}); err != nil {
+		t.Fatalf("ping before reassignment: %v", err)
+	}
+
+	oldIP := n1.AwaitIP4()
+	newIP := netip.MustParseAddr("100.64.200.1")
+	newIP6 := tsaddr.Tailscale4To6(newIP)
+	n1Key := n1.MustStatus().Self.PublicKey
+	env.Control.SetNodeAddresses(n1Key, []netip.Prefix{
+		netip.PrefixFrom(newIP, 32),
+		netip.PrefixFrom(newIP6, 128),
+	})
+
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if got := n1.AwaitIP4(); got != newIP {
+			return fmt.Errorf("node IP = %v; want %v", got, newIP)
+		}
+		ps, ok := n2.MustStatus().Peer[n1Key]
+		if !ok {
+			return errors.New("node not in peer's status")
+		}
+		if want := []netip.Addr{newIP, newIP6}; !slices.Equal(ps.TailscaleIPs, want) {
+			return fmt.Errorf("peer sees node IPs %v; want %v", ps.TailscaleIPs, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if st := n1.MustStatus(); st.BackendState != "Running" {
+		t.Fatalf("node in state %q after reassignment; want Running", st.BackendState)
+	}
+
+	// Traffic flows to and from the new address in both directions, which
+	// requires the node to have taken it on locally and the peer to accept
+	// packets from it.
+	for _, tc := range []struct{ from, to *TestNode }{{n2, n1}, {n1, n2}} {
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			ip := tc.to.AwaitIP4()
+			return tc.from.Tailscale("ping", "--tsmp", "--timeout=1s", "--c=1", ip.String()).Run()
+		}); err != nil {
+			t.Errorf("TSMP ping after reassignment: %v", err)
+		}
+	}
+
+	// The old address no longer belongs to anyone.
+	if err := n2.Tailscale("ping", "--timeout=1s", "--c=1", oldIP.String()).Run(); err == nil {
+		t.Errorf("ping to old address %v succeeded", oldIP)
+	}
+}
+
+// TestCapabilityVersionGating tests that control withholds features from a
+// node that it believes to be too old for them, using IPv6 masquerade
+// addresses (capability version 104) as the gated feature.
+func TestCapabilityVersionGating(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	var nodes []*TestNode
+	var keys []key.NodePublic
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+		keys = append(keys, n.MustStatus().Self.PublicKey)
+	}
+	n1, k1, k2 := nodes[0], keys[0], keys[1]
+
+	masqIP := netip.MustParseAddr("fd7a:115c:a1e0::1a")
+	env.Control.SetMasqueradeAddresses([]testcontrol.MasqueradePair{{
+		Node:              k1,
+		Peer:              k2,
+		NodeMasqueradesAs: masqIP,
+	}})
+
+	// wantMasq waits until n1's netmap has, or doesn't have, its IPv6
+	// masquerade address for n2.
+	wantMasq := func(want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			nm, err := fetchNetMapForTest(ctx, n1.LocalClient())
+			if err != nil {
+				return err
+			}
+			for _, p := range nm.Peers {
+				if p.Key() != k2 {
+					continue
+				}
+				got, ok := p.SelfNodeV6MasqAddrForThisPeer().GetOk()
+				if ok != want || (want && got != masqIP) {
+					return fmt.Errorf("n1's IPv6 masquerade address for n2 = %v (set=%v); want set=%v", got, ok, want)
+				}
+				return nil
+			}
+			return errors.New("n2 not in n1's netmap")
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantMasq(true)
+
+	env.Control.SetCapabilityVersion(k1, 103)
+	wantMasq(false)
+
+	env.Control.SetCapabilityVersion(k1, 104)
+	wantMasq(true)
+
+	env.Control.SetCapabilityVersion(k1, 103)
+	wantMasq(false)
+
+	// Removing the override reverts to the node's actual version.
+	env.Control.SetCapabilityVersion(k1, 0)
+	wantMasq(true)
+}
+
+// TestControlResponseJitter verifies that a tailnet still converges when
+// every control request is delayed by a random amount, as it would be with a
+// real control server.
+func TestControlResponseJitter(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	env.Control.ResponseJitterSeed = 1
+	env.Control.SetResponseJitter(10*time.Millisecond, 200*time.Millisecond)
+
+	const numNodes = 3
+	var nodes []*TestNode
+	for range numNodes {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		nodes = append(nodes, n)
+	}
+	for _, n := range nodes {
+		n.AwaitListening()
+		n.MustUp()
+	}
+	for _, n := range nodes {
+		n.AwaitRunning()
+	}
+
+	if err := tstest.WaitFor(30*time.Second, func() error {
+		for i, n := range nodes {
+			st := n.MustStatus()
+			if got := len(st.Peer); got != numNodes-1 {
+				return fmt.Errorf("node %d has %d peers; want %d", i, got, numNodes-1)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestControlEndpointFaults verifies that nodes still reach and stay in the
+// Running state when control's map endpoint intermittently fails.
+func TestControlEndpointFaults(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	env.Control.EndpointFaultSeed = 1
+	env.Control.SetEndpointFaults(map[string]testcontrol.FaultSpec{
+		"map": {Probability: 0.5, StatusCode: http.StatusInternalServerError},
+	})
+
+	const numNodes = 2
+	var nodes []*TestNode
+	for range numNodes {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		nodes = append(nodes, n)
+	}
+	for _, n := range nodes {
+		n.AwaitListening()
+		n.MustUp()
+	}
+	for _, n := range nodes {
+		n.AwaitRunning()
+	}
+	if got := env.Control.InjectedFaults("map"); got == 0 {
+		t.Errorf("no faults injected into map requests")
+	}
+
+	// Nodes stay Running and keep their peers despite the faults.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, n := range nodes {
+			st := n.MustStatus()
+			if st.BackendState != "Running" {
+				t.Fatalf("node %d is in state %q; want Running", i, st.BackendState)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := tstest.WaitFor(30*time.Second, func() error {
+		for i, n := range nodes {
+			if got := len(n.MustStatus().Peer); got != numNodes-1 {
+				return fmt.Errorf("node %d has %d peers; want %d", i, got, numNodes-1)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMinimumClientVersion verifies that a node running a client older than
+// control's minimum version surfaces a health warning, and that the warning
+// clears once the minimum is lowered.
+func TestMinimumClientVersion(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n := NewTestNode(t, env)
+	d := n.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	n.AwaitListening()
+	n.MustUp()
+	n.AwaitRunning()
+
+	const wantHealth = "Update required"
+	wantWarning := func(want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			st := n.MustStatus()
+			got := slices.ContainsFunc(st.Health, func(m string) bool { return strings.Contains(m, wantHealth) })
+			if got != want {
+				return fmt.Errorf("has %q warning = %v; want %v; health: %q", wantHealth, got, want, st.Health)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantWarning(false)
+
+	env.Control.SetMinimumClientVersion("999.0.0")
+	wantWarning(true)
+	if st := n.MustStatus(); st.BackendState != "Running" {
+		t.Errorf("outdated node in state %q; want Running", st.BackendState)
+	}
+
+	env.Control.SetMinimumClientVersion("1.0.0")
+	wantWarning(false)
+}
+
+// TestDisplayMessageSeverity verifies that display messages of each severity
+// sent by control surface as health warnings with the matching severity and
+// primary action, both in status and on the IPN bus, and that they go away
+// once control clears them.
+func TestDisplayMessageSeverity(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n := NewTestNode(t, env)
+	d := n.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	n.AwaitListening()
+	n.MustUp()
+	n.AwaitRunning()
+
+	msgs := map[tailcfg.DisplayMessageID]*tailcfg.DisplayMessage{
+		"test-info": {
+			Title:    "New features available",
+			Text:     "Check out what's new.",
+			Severity: tailcfg.SeverityLow,
+		},
+		"test-warning": {
+			Title:    "Certificate expiring soon",
+			Text:     "The tailnet's certificate expires in 7 days.",
+			Severity: tailcfg.SeverityMedium,
+		},
+		"test-error": {
+			Title:               "Tailnet suspended",
+			Text:                "This tailnet has been suspended.",
+			Severity:            tailcfg.SeverityHigh,
+			ImpactsConnectivity: true,
+			PrimaryAction: &tailcfg.DisplayMessageAction{
+				URL:   "https://example.com/billing",
+				Label: "Review billing",
+			},
+		},
+	}
+	wantStates := map[health.WarnableCode]health.UnhealthyState{
+		"control-health.test-info": {
+			WarnableCode: "control-health.test-info",
+			Severity:     health.SeverityLow,
+			Title:        "New features available",
+			Text:         "Check out what's new.",
+		},
+		"control-health.test-warning": {
+			WarnableCode: "control-health.test-warning",
+			Severity:     health.SeverityMedium,
+			Title:        "Certificate expiring soon",
+			Text:         "The tailnet's certificate expires in 7 days.",
+		},
+		"control-health.test-error": {
+			WarnableCode:        "control-health.test-error",
+			Severity:            health.SeverityHigh,
+			Title:               "Tailnet suspended",
+			Text:                "This tailnet has been suspended.",
+			ImpactsConnectivity: true,
+			PrimaryAction: &health.UnhealthyStateAction{
+				URL:   "https://example.com/billing",
+				Label: "Review billing",
+			},
+		},
+	}
+
+	// wantHealth waits for the node's control health warnings to be want,
+	// in status and on the IPN bus.
+	wantHealth := func(want map[health.WarnableCode]health.UnhealthyState) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Second)
+		defer cancel()
+		w, err := n.LocalClient().WatchIPNBus(ctx, ipn.NotifyInitialHealthState|ipn.NotifyHealthActions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		var diff string
+		for {
+			nt, err := w.Next()
+			if err != nil {
+				t.Fatalf("waiting for health warnings: %v; last mismatch (-want +got):\n%s", err, diff)
+			}
+			if nt.Health == nil {
+				continue
+			}
+			got := map[health.WarnableCode]health.UnhealthyState{}
+			for code, st := range nt.Health.Warnings {
+				if strings.HasPrefix(string(code), "control-health.") {
+					got[code] = st
+				}
+			}
+			diff = cmp.Diff(want, got, cmpopts.IgnoreFields(health.UnhealthyState{}, "ETag"), cmpopts.EquateEmpty())
+			if diff == "" {
+				break
+			}
+		}
+		st := n.MustStatus()
+		for _, s := range want {
+			if !slices.ContainsFunc(st.Health, func(h string) bool { return strings.Contains(h, s.Title) }) {
+				t.Errorf("status health %q doesn't include %q", st.Health, s.Title)
+			}
+		}
+	}
+
+	for id, msg := range msgs {
+		env.Control.SetDisplayMessage(id, msg)
+	}
+	wantHealth(wantStates)
+
+	for id := range msgs {
+		env.Control.SetDisplayMessage(id, nil)
+	}
+	wantHealth(nil)
+	if st := n.MustStatus(); st.BackendState != "Running" {
+		t.Errorf("node in state %q; want Running", st.BackendState)
+	}
+}
+
+// TestSeededNetmap verifies that a node joining a tailnet with a large number
+// of (stub) nodes processes its full netmap, and logs how long that took, to
+// catch performance regressions in large netmap handling.
+func TestSeededNetmap(t *testing.T) {
+	const numSeeded = 500
+	for _, visible := range []bool{true, false} {
+		t.Run(fmt.Sprintf("visible=%v", visible), func(t *testing.T) {
+			tstest.Parallel(t)
+			env := NewTestEnv(t)
+			env.SeedNetmap(numSeeded, visible)
+
+			n := NewTestNode(t, env)
+			d := n.StartDaemon()
+			defer d.MustCleanShutdown(t)
+			n.AwaitListening()
+
+			start := time.Now()
+			n.MustUp()
+			n.AwaitRunning()
+			wantPeers := 0
+			if visible {
+				wantPeers = numSeeded
+			}
+			if err := tstest.WaitFor(30*time.Second, func() error {
+				if got := len(n.MustStatus().Peer); got != wantPeers {
+					return fmt.Errorf("got %d peers; want %d", got, wantPeers)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("processed netmap with %d peers in %v", wantPeers, time.Since(start).Round(time.Millisecond))
+		})
+	}
+}
+
+// TestSyntheticPeersResponsive verifies that a node stays responsive while it
+// applies a netmap with thousands of synthetic peers, and logs how long that
+// took, to catch performance regressions in large netmap handling.
+func TestSyntheticPeersResponsive(t *testing.T) {
+	const numSynthetic = 5000
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	nodes := make([]*TestNode, 2)
+	for i := range nodes {
+		nodes[i] = NewTestNode(t, env)
+		d := nodes[i].StartDaemon()
+		defer d.MustCleanShutdown(t)
+		nodes[i].AwaitResponding()
+		nodes[i].MustUp()
+		nodes[i].AwaitRunning()
+	}
+	n1, n2 := nodes[0], nodes[1]
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Poll the LocalAPI while the netmap is applied, recording the slowest
+	// response.
+	var slowest atomic.Int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			_, err := n1.LocalClient().StatusWithoutPeers(ctx)
+			cancel()
+			if err != nil {
+				t.Errorf("StatusWithoutPeers: %v", err)
+				return
+			}
+			if d := time.Since(start); d > time.Duration(slowest.Load()) {
+				slowest.Store(int64(d))
+			}
+		}
+	})
+
+	env.Control.AddSyntheticPeers(numSynthetic)
+	applyStart := time.Now()
+	if err := n1.AwaitPeers(numSynthetic+1, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	applied := time.Since(applyStart)
+	close(done)
+	wg.Wait()
+	t.Logf("applied netmap with %d synthetic peers in %v; slowest LocalAPI response %v",
+		numSynthetic, applied.Round(time.Millisecond), time.Duration(slowest.Load()).Round(time.Millisecond))
+	if limit := 5 * time.Second; time.Duration(slowest.Load()) > limit {
+		t.Errorf("LocalAPI took %v to respond while applying netmap; want at most %v", time.Duration(slowest.Load()), limit)
+	}
+
+	// Incremental updates and traffic to real peers still work.
+	env.Control.AddSyntheticPeers(1)
+	if err := n1.AwaitPeers(numSynthetic+2, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		return n1.Ping(n2)
+	}); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+}
+
+// TestStatusJSONSchema is a contract test for the output of
+// "tailscale status --json", which integrations parse. It checks that the
+// fields they depend on are present with the expected JSON types, and that the
+// output decodes into ipnstate.Status without unknown fields.
+func TestStatusJSONSchema(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	nodes := make([]*TestNode, 3)
+	for i := range nodes {
+		nodes[i] = NewTestNode(t, env)
+		d := nodes[i].StartDaemon()
+		defer d.MustCleanShutdown(t)
+		nodes[i].AwaitResponding()
+		nodes[i].MustUp()
+		nodes[i].AwaitRunning()
+	}
+	n1 := nodes[0]
+	if err := n1.AwaitPeers(len(nodes)-1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := n1.Tailscale("status", "--json")
+	cmd.Stdout = nil // in case --verbose-tailscale was set
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("tailscale status --json: %v", err)
+	}
+
+	// Check the JSON types of the fields, independently of the Go types.
+	wantStatusKinds := map[string]string{
+		"Version":        "string",
+		"TUN":            "bool",
+		"BackendState":   "string",
+		"AuthURL":        "string",
+		"TailscaleIPs":   "array",
+		"Self":           "object",
+		"Health":         "array",
+		"MagicDNSSuffix": "string",
+		"CurrentTailnet": "object",
+		"Peer":           "object",
+		"User":           "object",
+	}
+	wantPeerKinds := map[string]string{
+		"ID":           "string",
+		"PublicKey":    "string",
+		"HostName":     "string",
+		"DNSName":      "string",
+		"OS":           "string",
+		"UserID":       "number",
+		"TailscaleIPs": "array",
+		"Online":       "bool",
+		"Active":       "bool",
+		"InNetworkMap": "bool",
+		"InMagicSock":  "bool",
+		"InEngine":     "bool",
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(out, &raw); err != nil {
+		t.Fatalf("status is not a JSON object: %v\n%s", err, out)
+	}
+	checkJSONKinds(t, "status", raw, wantStatusKinds)
+	var rawSelf map[string]json.RawMessage
+	if err := json.Unmarshal(raw["Self"], &rawSelf); err != nil {
+		t.Fatalf("Self: %v", err)
+	}
+	checkJSONKinds(t, "Self", rawSelf, wantPeerKinds)
+	var rawPeers map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw["Peer"], &rawPeers); err != nil {
+		t.Fatalf("Peer: %v", err)
+	}
+	for k, p := range rawPeers {
+		checkJSONKinds(t, "Peer["+k+"]", p, wantPeerKinds)
+	}
+
+	// Check that the output decodes into the typed struct, with nothing
+	// left over, and that the key fields are populated.
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.DisallowUnknownFields()
+	var st ipnstate.Status
+	if err := dec.Decode(&st); err != nil {
+		t.Fatalf("decoding into ipnstate.Status: %v", err)
+	}
+	if st.BackendState != "Running" {
+		t.Errorf("BackendState = %q; want Running", st.BackendState)
+	}
+	if ip := n1.AwaitIP4(); !slices.Contains(st.TailscaleIPs, ip) {
+		t.Errorf("TailscaleIPs = %v; want to contain %v", st.TailscaleIPs, ip)
+	}
+	if st.Self == nil {
+		t.Fatal("Self is missing")
+	}
+	if st.Self.PublicKey.IsZero() || st.Self.ID == "" || len(st.Self.TailscaleIPs) == 0 {
+		t.Errorf("Self incomplete: %+v", st.Self)
+	}
+	if !slices.Equal(st.Self.TailscaleIPs, st.TailscaleIPs) {
+		t.Errorf("Self.TailscaleIPs = %v; want %v", st.Self.TailscaleIPs, st.TailscaleIPs)
+	}
+	if _, ok := st.User[st.Self.UserID]; !ok {
+		t.Errorf("User map missing self user %v", st.Self.UserID)
+	}
+
+	if len(st.Peer) != len(nodes)-1 {
+		t.Fatalf("got %d peers; want %d", len(st.Peer), len(nodes)-1)
+	}
+	for _, n := range nodes[1:] {
+		want := n.MustStatus().Self
+		ps, ok := st.Peer[want.PublicKey]
+		if !ok {
+			t.Errorf("Peer map missing %v", want.PublicKey)
+			continue
+		}
+		if ps.PublicKey != want.PublicKey {
+			t.Errorf("Peer[%v].PublicKey = %v", want.PublicKey, ps.PublicKey)
+		}
+		if ps.ID != want.ID || ps.HostName != want.HostName || ps.DNSName != want.DNSName {
+			t.Errorf("Peer[%v] = (%q, %q, %q); want (%q, %q, %q)", want.PublicKey,
+				ps.ID, ps.HostName, ps.DNSName, want.ID, want.HostName, want.DNSName)
+		}
+		if !slices.Equal(ps.TailscaleIPs, want.TailscaleIPs) {
+			t.Errorf("Peer[%v].TailscaleIPs = %v; want %v", want.PublicKey, ps.TailscaleIPs, want.TailscaleIPs)
+		}
+		if _, ok := st.User[ps.UserID]; !ok {
+			t.Errorf("User map missing peer user %v", ps.UserID)
+		}
+	}
+}
+
+// checkJSONKinds checks that obj, a JSON object named what, has all the keys
+// in want, with values of the JSON kinds ("string", "number", "bool",
+// "array" or "object") that want maps them to.
+func checkJSONKinds(t *testing.T, what string, obj map[string]json.RawMessage, want map[string]string) {
+	t.Helper()
+	for k, wantKind := range want {
+		v, ok := obj[k]
+		if !ok {
+			t.Errorf("%s: missing field %q", what, k)
+			continue
+		}
+		var kind string
+		switch b := bytes.TrimSpace(v); {
+		case len(b) == 0:
+		case b[0] == '"':
+			kind = "string"
+		case b[0] == '{':
+			kind = "object"
+		case b[0] == '[':
+			kind = "array"
+		case string(b) == "true" || string(b) == "false":
+			kind = "bool"
+		case string(b) == "null":
+			kind = "null"
+		default:
+			kind = "number"
+		}
+		if kind != wantKind {
+			t.Errorf("%s: field %q is %s (%s); want %s", what, k, kind, v, wantKind)
+		}
+	}
+}
+
+func TestLogoutRemovesAllPeers(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	// Spin up some nodes.
+	nodes := make([]*TestNode, 2)
+	for i := range nodes {
+		nodes[i] = NewTestNode(t, env)
+		nodes[i].StartDaemon()
+		nodes[i].AwaitResponding()
+		nodes[i].MustUp()
+		nodes[i].AwaitIP4()
+		nodes[i].AwaitRunning()
+	}
+	expectedPeers := len(nodes) - 1
+
+	// Make every node ping every other node.
+	// This makes sure magicsock is fully populated.
+	for i := range nodes {
+		for j := range nodes {
+			if i <= j {
+				continue
+			}
+			if err := tstest.WaitFor(20*time.Second, func() error {
+				return nodes[i].Ping(nodes[j])
+			}); err != nil {
+				t.Fatalf("ping %v -> %v: %v", nodes[i].AwaitIP4(), nodes[j].AwaitIP4(), err)
+			}
+		}
+	}
+
+	// all other nodes are peers
+	if err := nodes[0].AwaitPeers(expectedPeers, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Note node[0]'s profile and node key before logging out, so we can check
+	// they're scrubbed from disk afterwards.
+	state, err := nodes[0].readStateFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profileKey := string(state[ipn.CurrentProfileStateKey])
+	if profileKey == "" {
+		t.Fatal("state file has no current profile")
+	}
+	nodeKeyText, err := nodes[0].diskPrefs().Persist.PrivateNodeKey.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes[0].MustLogOut()
+	// node[0] is logged out, so it should not have any peers
+	if err := nodes[0].AwaitPeers(0, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging out deletes the profile, including its node key and other auth
+	// material, but keeps the machine key.
+	nodes[0].AwaitStateKeyAbsent(profileKey)
+	state, err = nodes[0].readStateFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state[ipn.MachineKeyStateKey]) == 0 {
+		t.Error("machine key was removed from state file on logout")
+	}
+	for k, v := range state {
+		if bytes.Contains(v, nodeKeyText) {
+			t.Errorf("state key %q still contains the node private key after logout", k)
+		}
+	}
+
+	nodes[0].MustUp() // This will create a new node
+	expectedPeers++
+
+	nodes[0].AwaitIP4()
+	// all existing peers and the new node
+	if err := nodes[0].AwaitPeers(expectedPeers, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDuplicateMachineKey tests what happens when a second tailscaled starts
+// with the machine key of an existing, logged-in node and registers anew, as
+// when a VM is cloned or a node's state is restored onto another machine. The
+// later registration supersedes the earlier one: control keeps a single node
+// for the machine key, now with the new node key, and peers only see that
+// node.
+func TestDuplicateMachineKey(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	observer := NewTestNode(t, env)
+	d0 := observer.StartDaemon()
+	observer.AwaitResponding()
+	observer.MustUp()
+	observer.AwaitRunning()
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+	n1IP := n1.AwaitIP4()
+	k1 := n1.MustStatus().Self.PublicKey
+	mkey := env.Control.Node(k1).Machine
+
+	// Give n2 a copy of n1's machine key, but none of n1's other state.
+	src, err := store.New(nil, n1.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machineKey, err := src.ReadState(ipn.MachineKeyStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2 := NewTestNode(t, env)
+	dst, err := store.New(nil, n2.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.WriteState(ipn.MachineKeyStateKey, machineKey); err != nil {
+		t.Fatal(err)
+	}
+
+	d2 := n2.StartDaemon()
+	n2.AwaitResponding()
+	n2.MustUp()
+	n2.AwaitRunning()
+	k2 := n2.MustStatus().Self.PublicKey
+	if k2 == k1 {
+		t.Fatalf("n2 has n1's node key %v; want a new one", k1)
+	}
+
+	if n := env.Control.Node(k1); n != nil {
+		t.Errorf("control still has n1's node key %v as node %v", k1, n.ID)
+	}
+	var sameMachine []*tailcfg.Node
+	for _, n := range env.Control.AllNodes() {
+		if n.Machine == mkey {
+			sameMachine = append(sameMachine, n)
+		}
+	}
+	if len(sameMachine) != 1 || sameMachine[0].Key != k2 {
+		t.Fatalf("control has %d nodes with machine key %v, want just n2's node %v", len(sameMachine), mkey, k2)
+	}
+	if got := env.Control.NumNodes(); got != 2 {
+		t.Errorf("control has %d nodes; want 2 (observer and n2)", got)
+	}
+	if got := n2.AwaitIP4(); got != n1IP {
+		t.Errorf("n2 has IP %v; want n1's IP %v, as it took over n1's node", got, n1IP)
+	}
+
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st := observer.MustStatus()
+		if len(st.Peer) != 1 {
+			return fmt.Errorf("observer has %d peers; want 1", len(st.Peer))
+		}
+		if _, ok := st.Peer[k2]; !ok {
+			return fmt.Errorf("observer's peer isn't n2 (%v)", k2)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		return observer.Ping(n2)
+	}); err != nil {
+		t.Fatalf("ping from observer to n2: %v", err)
+	}
+
+	d2.MustCleanShutdown(t)
+	d1.MustCleanShutdown(t)
+	d0.MustCleanShutdown(t)
+}
+
+func TestAutoUpdateDefaults(t *testing.T)     { testAutoUpdateDefaults(t, false) }
+func TestAutoUpdateDefaults_cap(t *testing.T) { testAutoUpdateDefaults(t, true) }
+
+// useCap is whether to use NodeAttrDefaultAutoUpdate (as opposed to the old
+// DeprecatedDefaultAutoUpdate top-level MapResponse field).
+func testAutoUpdateDefaults(t *testing.T, useCap bool) {
+	t.Cleanup(feature.HookCanAutoUpdate.SetForTest(func() bool { return true }))
+
+	env := NewTestEnv(t)
+
+	var (
+		modifyMu               sync.Mutex
+		modifyFirstMapResponse = func(*tailcfg.MapResponse, *tailcfg.MapRequest) {}
+	)
+	env.Control.ModifyFirstMapResponse = func(mr *tailcfg.MapResponse, req *tailcfg.MapRequest) {
+		modifyMu.Lock()
+		defer modifyMu.Unlock()
+		modifyFirstMapResponse(mr, req)
+	}
+
+	checkDefault := func(n *TestNode, want bool) error {
+		enabled, ok := n.diskPrefs().AutoUpdate.Apply.Get()
+		if !ok {
+			return fmt.Errorf("auto-update for node is unset, should be set as %v", want)
+		}
+		if enabled != want {
+			return fmt.Errorf("auto-update for node is %v, should be set as %v", enabled, want)
+		}
+		return nil
+	}
+
+	setDefaultAutoUpdate := func(send bool) {
+		modifyMu.Lock()
+		defer modifyMu.Unlock()
+		modifyFirstMapResponse = func(mr *tailcfg.MapResponse, req *tailcfg.MapRequest) {
+			if mr.Node == nil {
+				mr.Node = &tailcfg.Node{}
+			}
+			if useCap {
+				if mr.Node.CapMap == nil {
+					mr.Node.CapMap = make(tailcfg.NodeCapMap)
+				}
+				mr.Node.CapMap[tailcfg.NodeAttrDefaultAutoUpdate] = []tailcfg.RawMessage{
+					tailcfg.RawMessage(fmt.Sprintf("%t", send)),
+				}
+			} else {
+				mr.DeprecatedDefaultAutoUpdate = opt.NewBool(send)
+			}
+		}
+	}
+
+	tests := []struct {
+		desc string
+		run  func(t *testing.T, n *TestNode)
+	}{
+		{
+			desc: "tailnet-default-false",
+			run: func(t *testing.T, n *TestNode) {
+
+				// First the server sends "false", and client should remember that.
+				setDefaultAutoUpdate(false)
+				n.MustUp()
+				n.AwaitRunning()
+				checkDefault(n, false)
+
+				// Now we disconnect and change the server to send "true", which
+				// the client should ignore, having previously remembered
+				// "false".
+				n.MustDown()
+				setDefaultAutoUpdate(true) // control sends default "true"
+				n.MustUp()
+				n.AwaitRunning()
+				checkDefault(n, false) // still false
+
+				// But can be changed explicitly by the user.
+				if out, err := n.TailscaleForOutput("set", "--auto-update").CombinedOutput(); err != nil {
+					t.Fatalf("failed to enable auto-update on node: %v\noutput: %s", err, out)
+				}
+				checkDefault(n, true)
+			},
+		},
+		{
+			desc: "tailnet-default-true",
+			run: func(t *testing.T, n *TestNode) {
+				// Same as above but starting with default "true".
+
+				// First the server sends "true", and client should remember that.
+				setDefaultAutoUpdate(true)
+				n.MustUp()
+				n.AwaitRunning()
+				checkDefault(n, true)
+
+				// Now we disconnect and change the server to send "false", which
+				// the client should ignore, having previously remembered
+				// "true".
+				n.MustDown()
+				setDefaultAutoUpdate(false) // control sends default "false"
+				n.MustUp()
+				n.AwaitRunning()
+				checkDefault(n, true) // still true
+
+				// But can be changed explicitly by the user.
+				if out, err := n.TailscaleForOutput("set", "--auto-update=false").CombinedOutput(); err != nil {
+					t.Fatalf("failed to enable auto-update on node: %v\noutput: %s", err, out)
+				}
+				checkDefault(n, false)
+			},
+		},
+		{
+			desc: "user-sets-first",
+			run: func(t *testing.T, n *TestNode) {
+				// User sets auto-update first, before receiving defaults.
+				if out, err := n.TailscaleForOutput("set", "--auto-update=false").CombinedOutput(); err != nil {
+					t.Fatalf("failed to disable auto-update on node: %v\noutput: %s", err, out)
+				}
+
+				setDefaultAutoUpdate(true)
+				n.MustUp()
+				n.AwaitRunning()
+				checkDefault(n, false)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			n := NewTestNode(t, env)
+			n.allowUpdates = true
+			d := n.StartDaemon()
+			defer d.MustCleanShutdown(t)
+			n.AwaitResponding()
+			tt.run(t, n)
+		})
+	}
+}
+
+// TestTailnetDomainConfig tests that the tailnet name, display name and
+// MagicDNS suffix configured in control are reflected in the node's status,
+// peer names and DNS config, including when they change after the nodes are
+// up.
+func TestTailnetDomainConfig(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitResponding()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+	peerKey := n2.MustStatus().Self.PublicKey
+
+	const (
+		tailnet     = "example.com"
+		displayName = "Example Tailnet"
+		suffix      = "tail-custom.ts.net"
+	)
+	env.Control.SetDomain(tailnet)
+	env.Control.SetTailnetDisplayName(displayName)
+	env.Control.SetMagicDNSSuffix(suffix)
+
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		st := n1.MustStatus()
+		if st.CurrentTailnet == nil {
+			return errors.New("no CurrentTailnet in status")
+		}
+		if got := st.CurrentTailnet.Name; got != tailnet {
+			return fmt.Errorf("CurrentTailnet.Name = %q; want %q", got, tailnet)
+		}
+		if got := st.CurrentTailnet.MagicDNSSuffix; got != suffix {
+			return fmt.Errorf("CurrentTailnet.MagicDNSSuffix = %q; want %q", got, suffix)
+		}
+		ps, ok := st.Peer[peerKey]
+		if !ok {
+			return errors.New("peer not in status")
+		}
+		if !strings.HasSuffix(ps.DNSName, "."+suffix+".") {
+			return fmt.Errorf("peer DNSName = %q; want suffix %q", ps.DNSName, suffix)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nm, err := fetchNetMapForTest(ctx, n1.LocalClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(nm.DNS.Domains, suffix) {
+		t.Errorf("DNS config search domains = %q; want to contain %q", nm.DNS.Domains, suffix)
+	}
+	if got := nm.MagicDNSSuffix(); got != suffix {
+		t.Errorf("netmap MagicDNSSuffix = %q; want %q", got, suffix)
+	}
+	if got := nm.TailnetDisplayName(); got != displayName {
+		t.Errorf("netmap TailnetDisplayName = %q; want %q", got, displayName)
+	}
+}
+
+// TestReportedHostinfo tests that the Hostinfo that control receives from a
+// node reports the node's OS, version, hostname, and services.
+func TestReportedHostinfo(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
+	const hostname = "reported-host"
+	n1.MustUp("--hostname=" + hostname)
+	n1.AwaitRunning()
+	nodeKey := n1.MustStatus().Self.PublicKey
+
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		hi := env.Control.NodeHostinfo(nodeKey)
+		if hi == nil {
+			return errors.New("no Hostinfo reported")
+		}
+		// version.OS is runtime.GOOS, but for the Apple platforms' names.
+		if hi.OS != version.OS() {
+			return fmt.Errorf("reported OS = %q; want %q", hi.OS, version.OS())
+		}
+		if hi.Hostname != hostname {
+			return fmt.Errorf("reported Hostname = %q; want %q", hi.Hostname, hostname)
+		}
+		if hi.IPNVersion == "" {
+			return errors.New("no IPNVersion reported")
+		}
+		if !slices.ContainsFunc(hi.Services, func(s tailcfg.Service) bool {
+			return s.Proto == tailcfg.PeerAPI4 && s.Port != 0
+		}) {
+			return fmt.Errorf("no peerapi4 service in reported services %v", hi.Services)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new hostname is reported too.
+	const newHostname = "renamed-host"
+	if err := n1.Tailscale("set", "--hostname="+newHostname).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if got := env.Control.NodeHostinfo(nodeKey).Hostname; got != newHostname {
+			return fmt.Errorf("reported Hostname = %q; want %q", got, newHostname)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNodeProfiles tests that the user profiles set with
+// testcontrol.Server.SetNodeProfile are shown in status, both for the node's
+// own user and in WhoIs lookups of peers.
+func TestNodeProfiles(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	for _, n := range []*TestNode{n1, n2} {
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+	}
+
+	p1 := tailcfg.UserProfile{
+		LoginName:     "ada@example.com",
+		DisplayName:   "Ada Lovelace",
+		ProfilePicURL: "https://example.com/ada.png",
+	}
+	p2 := tailcfg.UserProfile{
+		LoginName:     "charles@example.com",
+		DisplayName:   "Charles Babbage",
+		ProfilePicURL: "https://example.com/charles.png",
+	}
+	env.Control.SetNodeProfile(n1.MustStatus().Self.PublicKey, p1)
+	env.Control.SetNodeProfile(n2.MustStatus().Self.PublicKey, p2)
+
+	sameProfile := func(got, want tailcfg.UserProfile) error {
+		if got.LoginName != want.LoginName || got.DisplayName != want.DisplayName || got.ProfilePicURL != want.ProfilePicURL {
+			return fmt.Errorf("got profile %+v; want %+v", got, want)
+		}
+		return nil
+	}
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		st := n1.MustStatus()
+		return sameProfile(st.User[st.Self.UserID], p1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ip2 := n2.AwaitIP4()
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		who, err := n1.LocalClient().WhoIs(context.Background(), ip2.String())
+		if err != nil {
+			return err
+		}
+		if who.UserProfile == nil {
+			return errors.New("WhoIs returned no user profile")
+		}
+		return sameProfile(*who.UserProfile, p2)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDuplicateHostnames tests that when two nodes register with the same
+// hostname, control gives the second one a distinct name and both names
+// resolve via MagicDNS to the right node.
+//
+// Control deduplicates names within the tailnet when a node is first
+// registered: if another machine's node already uses the hostname (ignoring
+// case), it appends the first of "-1", "-2", and so on that's not taken.
+func TestDuplicateHostnames(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	const suffix = "tail-dup.ts.net"
+	env.Control.SetMagicDNSSuffix(suffix)
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitResponding()
+		// Bring the nodes up one at a time, so the first one to
+		// register keeps the plain hostname.
+		n.MustUp("--hostname=dup")
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+
+	wantNames := []string{"dup." + suffix + ".", "dup-1." + suffix + "."}
+	for i, n := range nodes {
+		st := n.MustStatus()
+		if got := st.Self.DNSName; got != wantNames[i] {
+			t.Errorf("node %d status DNSName = %q; want %q", i+1, got, wantNames[i])
+		}
+		cn := env.Control.Node(st.Self.PublicKey)
+		if cn == nil {
+			t.Fatalf("node %d not known to control", i+1)
+		}
+		if got := cn.Name; got != wantNames[i] {
+			t.Errorf("node %d control name = %q; want %q", i+1, got, wantNames[i])
+		}
+		if got := cn.Hostinfo.Hostname(); got != "dup" {
+			t.Errorf("node %d hostname = %q; want %q", i+1, got, "dup")
+		}
+	}
+
+	// Each node should see the other under its own distinct name.
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		for i, n := range nodes {
+			st := n.MustStatus()
+			if len(st.Peer) != 1 {
+				return fmt.Errorf("node %d has %d peers; want 1", i+1, len(st.Peer))
+			}
+			for _, ps := range st.Peer {
+				if want := wantNames[1-i]; ps.DNSName != want {
+					return fmt.Errorf("node %d sees peer DNSName %q; want %q", i+1, ps.DNSName, want)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both names resolve, from either node, to the right node's address.
+	wantIPs := []netip.Addr{n1.AwaitIP4(), n2.AwaitIP4()}
+	if wantIPs[0] == wantIPs[1] {
+		t.Fatalf("both nodes have IP %v", wantIPs[0])
+	}
+	for _, n := range nodes {
+		for i, name := range wantNames {
+			if err := tstest.WaitFor(10*time.Second, func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				res, _, err := n.LocalClient().QueryDNS(ctx, name, "A")
+				if err != nil {
+					return err
+				}
+				var m dns.Msg
+				if err := m.Unpack(res); err != nil {
+					return err
+				}
+				if len(m.Answer) != 1 {
+					return fmt.Errorf("query for %q got %d answers; want 1", name, len(m.Answer))
+				}
+				a, ok := m.Answer[0].(*dns.A)
+				if !ok {
+					return fmt.Errorf("query for %q got answer %v; want A record", name, m.Answer[0])
+				}
+				if got, _ := netip.AddrFromSlice(a.A); got.Unmap() != wantIPs[i] {
+					return fmt.Errorf("%q resolved to %v; want %v", name, got, wantIPs[i])
+				}
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// TestAcceptDNS tests that a node only uses the DNS configuration from control
+// if it accepts DNS, and that toggling --accept-dns at runtime takes effect.
+// Quad-100 serves MagicDNS names either way, as it's only the OS that isn't
+// pointed at it when DNS isn't accepted, so the test checks whether queries for
+// a split DNS domain are forwarded to the resolver that control configured.
+func TestAcceptDNS(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	// Run a resolver for the split DNS domain.
+	const corpName = "www.corp.example."
+	corpIP := netip.MustParseAddr("192.0.2.7")
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if q := req.Question[0]; q.Name == corpName && q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   corpIP.AsSlice(),
+				})
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	env.Control.SetDNSConfig(&tailcfg.DNSConfig{
+		Proxied: true,
+		Routes: map[string][]*dnstype.Resolver{
+			"corp.example": {{Addr: pc.LocalAddr().String()}},
+		},
+	})
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
+	n1.MustUp("--accept-dns=true")
+	n1.AwaitRunning()
+
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n2.AwaitListening()
+	n2.MustUp("--accept-dns=false")
+	n2.AwaitRunning()
+
+	// resolve returns the IPv4 address that n resolves name to using
+	// quad-100.
+	resolve := func(n *TestNode, name string) (netip.Addr, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		res, _, err := n.LocalClient().QueryDNS(ctx, name, "A")
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		var m dns.Msg
+		if err := m.Unpack(res); err != nil {
+			return netip.Addr{}, err
+		}
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				ip, _ := netip.AddrFromSlice(a.A)
+				return ip.Unmap(), nil
+			}
+		}
+		return netip.Addr{}, fmt.Errorf("query for %q got no A record; rcode %s", name, dns.RcodeToString[m.Rcode])
+	}
+	wantResolves := func(n *TestNode, name string, want netip.Addr) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			got, err := resolve(n, name)
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("%q resolved to %v; want %v", name, got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantNotResolves := func(n *TestNode, name string) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			if got, err := resolve(n, name); err == nil {
+				return fmt.Errorf("%q resolved to %v; want no answer", name, got)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setAcceptDNS := func(n *TestNode, accept bool) {
+		t.Helper()
+		if err := n.Tailscale("set", fmt.Sprintf("--accept-dns=%v", accept)).Run(); err != nil {
+			t.Fatalf("tailscale set --accept-dns=%v: %v", accept, err)
+		}
+		prefs, err := n.LocalClient().GetPrefs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefs.CorpDNS != accept {
+			t.Fatalf("after tailscale set --accept-dns=%v, CorpDNS = %v", accept, prefs.CorpDNS)
+		}
+	}
+
+	wantResolves(n1, corpName, corpIP)
+	wantNotResolves(n2, corpName)
+
+	// MagicDNS names resolve on both nodes.
+	n1IP, n2IP := n1.AwaitIP4(), n2.AwaitIP4()
+	wantResolves(n1, n2.MustStatus().Self.DNSName, n2IP)
+	wantResolves(n2, n1.MustStatus().Self.DNSName, n1IP)
+
+	setAcceptDNS(n1, false)
+	wantNotResolves(n1, corpName)
+	setAcceptDNS(n2, true)
+	wantResolves(n2, corpName, corpIP)
+}
+
+// TestDNSSearchDomains tests that the search domains in control's DNS config,
+// including the MagicDNS suffix and split DNS domains, are applied in the
+// order control sends them.
+func TestDNSSearchDomains(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n1.AwaitListening()
+	n1.MustUp("--accept-dns=true")
+	n1.AwaitRunning()
+
+	wantSearchDomains := func(want ...string) {
+		t.Helper()
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			got, err := n1.DNSSearchDomains()
+			if err != nil {
+				return err
+			}
+			if !slices.Equal(got, want) {
+				return fmt.Errorf("search domains = %q; want %q", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No DNS config, so no search domains.
+	wantSearchDomains()
+
+	const suffix = "tail-search.ts.net"
+	splitDNS := map[string][]*dnstype.Resolver{
+		"corp.example": {{Addr: "192.0.2.53"}},
+		"eng.example":  {{Addr: "192.0.2.54"}},
+	}
+	env.Control.SetDNSConfig(&tailcfg.DNSConfig{
+		Proxied: true,
+		Domains: []string{suffix, "eng.example", "corp.example"},
+		Routes:  splitDNS,
+	})
+	wantSearchDomains(suffix, "eng.example", "corp.example")
+
+	// Reordering the domains reorders them on the node too.
+	env.Control.SetDNSConfig(&tailcfg.DNSConfig{
+		Proxied: true,
+		Domains: []string{"corp.example", suffix, "eng.example"},
+		Routes:  splitDNS,
+	})
+	wantSearchDomains("corp.example", suffix, "eng.example")
+
+	env.Control.SetDNSConfig(&tailcfg.DNSConfig{Proxied: true})
+	wantSearchDomains()
+}
+
+// TestDNSOverTCPIntervalResolver tests that the quad-100 resolver successfully
+// serves TCP queries. It exercises the host's TCP stack, a TUN device, and
+// gVisor/netstack.
+// https://github.com/tailscale/corp/issues/22511
+func TestDNSOverTCPIntervalResolver(t *testing.T) {
+	tstest.RequireRoot(t)
+	env := NewTestEnv(t)
+	env.tunMode = true
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	for _, network := range []string{"tcp4", "tcp6"} {
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			return checkDNSSymbolicAnswer(n1, network)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestDNSOverUDPResolver tests that quad-100 answers DNS queries over UDP,
+// and that its answers match those it gives over TCP.
+func TestDNSOverUDPResolver(t *testing.T) {
+	tstest.RequireRoot(t)
+	env := NewTestEnv(t)
+	env.tunMode = true
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	for _, network := range []string{"udp4", "udp6"} {
+		if err := tstest.WaitFor(5*time.Second, func() error {
+			return checkDNSSymbolicAnswer(n1, network)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same queries get the same answers over either transport.
+	for _, q := range []struct {
+		fqdn  string
+		qtype uint16
+	}{
+		{dnsSymbolicFQDN, dns.TypeA},
+		{dnsSymbolicFQDN, dns.TypeAAAA},
+		{"100.100.100.100.in-addr.arpa.", dns.TypePTR},
+	} {
+		for _, family := range []string{"4", "6"} {
+			var answers []string
+			for _, transport := range []string{"udp", "tcp"} {
+				resp, err := n1.DNSQuery(transport+family, q.fqdn, q.qtype)
+				if err != nil {
+					t.Fatalf("%s query for %s %s: %v", transport+family, q.fqdn, dns.TypeToString[q.qtype], err)
+				}
+				var rrs []string
+				for _, rr := range resp.Answer {
+					rrs = append(rrs, rr.String())
+				}
+				answers = append(answers, strings.Join(rrs, "\n"))
+			}
+			if answers[0] != answers[1] {
+				t.Errorf("%s %s over IPv%s: UDP answer %q != TCP answer %q", q.fqdn, dns.TypeToString[q.qtype], family, answers[0], answers[1])
+			}
+		}
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// dnsSymbolicFQDN is a name that quad-100 resolves to itself.
+const dnsSymbolicFQDN = "magicdns.localhost-tailscale-daemon."
+
+// checkDNSSymbolicAnswer checks that n's quad-100, queried over network,
+// resolves dnsSymbolicFQDN to the Tailscale service IP.
+func checkDNSSymbolicAnswer(n *TestNode, network string) error {
+	resp, err := n.DNSQuery(network, dnsSymbolicFQDN, dns.TypeA)
+	if err != nil {
+		return err
+	}
+	if len(resp.Answer) != 1 {
+		return fmt.Errorf("unexpected DNS resp: %s", resp)
+	}
+	answer, ok := resp.Answer[0].(*dns.A)
+	if !ok {
+		return fmt.Errorf("unexpected answer type: %s", resp.Answer[0])
+	}
+	if !bytes.Equal(answer.A, tsaddr.TailscaleServiceIP().AsSlice()) {
+		return fmt.Errorf("got (%s) != want (%s)", answer.A, tsaddr.TailscaleServiceIP())
+	}
+	return nil
+}
+
+// TestNetstackTCPLoopback tests netstack loopback of a TCP stream, in both
+// directions.
+func TestNetstackTCPLoopback(t *testing.T) {
+	tstest.RequireRoot(t)
+
+	env := NewTestEnv(t)
+	env.tunMode = true
+	loopbackPort := 5201
+	env.loopbackPort = &loopbackPort
+	loopbackPortStr := strconv.Itoa(loopbackPort)
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+
+	n1.AwaitResponding()
+	n1.MustUp()
+
+	n1.AwaitIP4()
+	n1.AwaitRunning()
+
+	cases := []struct {
+		lisAddr  string
+		network  string
+		dialAddr string
+	}{
+		{
+			lisAddr:  net.JoinHostPort("127.0.0.1", loopbackPortStr),
+			network:  "tcp4",
+			dialAddr: net.JoinHostPort(tsaddr.TailscaleServiceIPString, loopbackPortStr),
+		},
+		{
+			lisAddr:  net.JoinHostPort("::1", loopbackPortStr),
+			network:  "tcp6",
+			dialAddr: net.JoinHostPort(tsaddr.TailscaleServiceIPv6String, loopbackPortStr),
+		},
+	}
+
+	writeBufSize := 128 << 10 // 128KiB, exercise GSO if enabled
+	writeBufIterations := 100 // allow TCP send window to open up
+	wantTotal := writeBufSize * writeBufIterations
+
+	for _, c := range cases {
+		lis, err := net.Listen(c.network, c.lisAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+
+		writeFn := func(conn net.Conn) error {
+			for range writeBufIterations {
+				toWrite := make([]byte, writeBufSize)
+				var wrote int
+				for {
+					n, err := conn.Write(toWrite)
+					if err != nil {
+						return err
+					}
+					wrote += n
+					if wrote == len(toWrite) {
+						break
+					}
+				}
+			}
+			return nil
+		}
+
+		readFn := func(conn net.Conn) error {
+			var read int
+			for {
+				b := make([]byte, writeBufSize)
+				n, err := conn.Read(b)
+				if err != nil {
+					return err
+				}
+				read += n
+				if read == wantTotal {
+					return nil
+				}
+			}
+		}
+
+		lisStepCh := make(chan error)
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				lisStepCh <- err
+				return
+			}
+			lisStepCh <- readFn(conn)
+			lisStepCh <- writeFn(conn)
+		}()
+
+		var conn net.Conn
+		err = tstest.WaitFor(time.Second*5, func() error {
+			conn, err = net.DialTimeout(c.network, c.dialAddr, time.Second*1)
+			if err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		dialerStepCh := make(chan error)
+		go func() {
+			dialerStepCh <- writeFn(conn)
+			dialerStepCh <- readFn(conn)
+		}()
+
+		var (
+			dialerSteps int
+			lisSteps    int
+		)
+		for {
+			select {
+			case lisErr := <-lisStepCh:
+				if lisErr != nil {
+					t.Fatal(err)
+				}
+				lisSteps++
+				if dialerSteps == 2 && lisSteps == 2 {
+					return
+				}
+			case dialerErr := <-dialerStepCh:
+				if dialerErr != nil {
+					t.Fatal(err)
+				}
+				dialerSteps++
+				if dialerSteps == 2 && lisSteps == 2 {
+					return
+				}
+			}
+		}
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestNetstackUDPLoopback tests netstack loopback of UDP packets, in both
+// directions.
+func TestNetstackUDPLoopback(t *testing.T) {
+	tstest.RequireRoot(t)
+
+	env := NewTestEnv(t)
+	env.tunMode = true
+	loopbackPort := 5201
+	env.loopbackPort = &loopbackPort
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+
+	n1.AwaitResponding()
+	n1.MustUp()
+
+	ip4 := n1.AwaitIP4()
+	ip6 := n1.AwaitIP6()
+	n1.AwaitRunning()
+
+	cases := []struct {
+		pingerLAddr *net.UDPAddr
+		pongerLAddr *net.UDPAddr
+		network     string
+		dialAddr    *net.UDPAddr
+	}{
+		{
+			pingerLAddr: &net.UDPAddr{IP: ip4.AsSlice(), Port: loopbackPort + 1},
+			pongerLAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: loopbackPort},
+			network:     "udp4",
+			dialAddr:    &net.UDPAddr{IP: tsaddr.TailscaleServiceIP().AsSlice(), Port: loopbackPort},
+		},
+		{
+			pingerLAddr: &net.UDPAddr{IP: ip6.AsSlice(), Port: loopbackPort + 1},
+			pongerLAddr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: loopbackPort},
+			network:     "udp6",
+			dialAddr:    &net.UDPAddr{IP: tsaddr.TailscaleServiceIPv6().AsSlice(), Port: loopbackPort},
+		},
+	}
+
+	writeBufSize := int(tstun.DefaultTUNMTU()) - 40 - 8 // mtu - ipv6 header - udp header
+	wantPongs := 100
+
+	for _, c := range cases {
+		pongerConn, err := net.ListenUDP(c.network, c.pongerLAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pongerConn.Close()
+
+		var pingerConn *net.UDPConn
+		err = tstest.WaitFor(time.Second*5, func() error {
+			pingerConn, err = net.DialUDP(c.network, c.pingerLAddr, c.dialAddr)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pingerConn.Close()
+
+		pingerFn := func(conn *net.UDPConn) error {
+			b := make([]byte, writeBufSize)
+			n, err := conn.Write(b)
+			if err != nil {
+				return err
+			}
+			if n != len(b) {
+				return fmt.Errorf("bad write size: %d", n)
+			}
+			err = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+			if err != nil {
+				return err
+			}
+			n, err = conn.Read(b)
+			if err != nil {
+				return err
+			}
+			if n != len(b) {
+				return fmt.Errorf("bad read size: %d", n)
+			}
+			return nil
+		}
+
+		pongerFn := func(conn *net.UDPConn) error {
+			for {
+				b := make([]byte, writeBufSize)
+				n, from, err := conn.ReadFromUDP(b)
+				if err != nil {
+					return err
+				}
+				if n != len(b) {
+					return fmt.Errorf("bad read size: %d", n)
+				}
+				n, err = conn.WriteToUDP(b, from)
+				if err != nil {
+					return err
+				}
+				if n != len(b) {
+					return fmt.Errorf("bad write size: %d", n)
+				}
+			}
+		}
+
+		pongerErrCh := make(chan error, 1)
+		go func() {
+			pongerErrCh <- pongerFn(pongerConn)
+		}()
+
+		err = tstest.WaitFor(time.Second*5, func() error {
+			err = pingerFn(pingerConn)
+			if err != nil {
+				return err
 			}
 			return nil
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer conn.Close()
-
-		dialerStepCh := make(chan error)
-		go func() {
-			dialerStepCh <- writeFn(conn)
-			dialerStepCh <- readFn(conn)
-		}()
 
-		var (
-			dialerSteps int
-			lisSteps    int
-		)
+		var pongsRX int
 		for {
+			pingerErrCh := make(chan error)
+			go func() {
+				pingerErrCh <- pingerFn(pingerConn)
+			}()
+
 			select {
-			case lisErr := <-lisStepCh:
-				if lisErr != nil {
+			case err := <-pongerErrCh:
+				t.Fatal(err)
+			case err := <-pingerErrCh:
+				if err != nil {
 					t.Fatal(err)
 				}
-				lisSteps++
-				if dialerSteps == 2 && lisSteps == 2 {
-					return
+			}
+
+			pongsRX++
+			if pongsRX == wantPongs {
+				break
+			}
+		}
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+func TestEncryptStateMigration(t *testing.T) {
+	if !hostinfo.New().TPM.Present() {
+		t.Skip("TPM not available")
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		t.Skip("--encrypt-state for tailscaled state not supported on this platform")
+	}
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n := NewTestNode(t, env)
+
+	runNode := func(t *testing.T, wantStateKeys []string) {
+		t.Helper()
+
+		// Run the node.
+		d := n.StartDaemon()
+		n.AwaitResponding()
+		n.MustUp()
+		n.AwaitRunning()
+
+		// Check the contents of the state file.
+		buf, err := os.ReadFile(n.stateFile)
+		if err != nil {
+			t.Fatalf("reading %q: %v", n.stateFile, err)
+		}
+		t.Logf("state file content:\n%s", buf)
+		var content map[string]any
+		if err := json.Unmarshal(buf, &content); err != nil {
+			t.Fatalf("parsing %q: %v", n.stateFile, err)
+		}
+		for _, k := range wantStateKeys {
+			if _, ok := content[k]; !ok {
+				t.Errorf("state file is missing key %q", k)
+			}
+		}
+
+		// Stop the node.
+		d.MustCleanShutdown(t)
+	}
+
+	wantPlaintextStateKeys := []string{"_machinekey", "_current-profile", "_profiles"}
+	wantEncryptedStateKeys := []string{"key", "nonce", "data"}
+	t.Run("regular-state", func(t *testing.T) {
+		n.encryptState = false
+		runNode(t, wantPlaintextStateKeys)
+	})
+	t.Run("migrate-to-encrypted", func(t *testing.T) {
+		n.encryptState = true
+		runNode(t, wantEncryptedStateKeys)
+	})
+	t.Run("migrate-to-plaintext", func(t *testing.T) {
+		n.encryptState = false
+		runNode(t, wantPlaintextStateKeys)
+	})
+}
+
+// TestPingDetailedDirect verifies that once two nodes have a direct path,
+// the LocalAPI ping result reports the endpoint used and no DERP region.
+func TestPingDetailedDirect(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+
+	var res *ipnstate.PingResult
+	if err := tstest.WaitFor(20*time.Second, func() (err error) {
+		res, err = n1.PingDetailed(n2)
+		if err != nil {
+			return err
+		}
+		if res.Endpoint == "" {
+			return fmt.Errorf("ping not direct yet (DERP region %d)", res.DERPRegionID)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DERPRegionID != 0 || res.DERPRegionCode != "" {
+		t.Errorf("DERP region = %d %q; want none", res.DERPRegionID, res.DERPRegionCode)
+	}
+	if _, err := netip.ParseAddrPort(res.Endpoint); err != nil {
+		t.Errorf("Endpoint %q: %v", res.Endpoint, err)
+	}
+	if res.PeerRelay != "" {
+		t.Errorf("PeerRelay = %q; want empty", res.PeerRelay)
+	}
+	if want := n2.AwaitIP4().String(); res.NodeIP != want {
+		t.Errorf("NodeIP = %q; want %q", res.NodeIP, want)
+	}
+	if res.LatencySeconds <= 0 {
+		t.Errorf("LatencySeconds = %v; want > 0", res.LatencySeconds)
+	}
+}
+
+// TestDERPOnlyPeer tests that when control stops telling two nodes about
+// each other's endpoints, their connection moves from a direct path to DERP,
+// as reported by tailscale ping, and that it goes direct again once control
+// sends the endpoints back, incrementally.
+func TestDERPOnlyPeer(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+	k1, k2 := n1.MustStatus().Self.PublicKey, n2.MustStatus().Self.PublicKey
+	ip2 := n2.AwaitIP4().String()
+
+	// setDERPOnly hides or shows both nodes' endpoints, as either node
+	// could otherwise learn the other's from the disco pings it gets, and
+	// waits for the nodes to see the change.
+	setDERPOnly := func(derpOnly bool) {
+		t.Helper()
+		env.Control.SetDERPOnly(k1, derpOnly)
+		env.Control.SetDERPOnly(k2, derpOnly)
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			for _, c := range []struct {
+				n    *TestNode
+				peer key.NodePublic
+			}{{n1, k2}, {n2, k1}} {
+				nm, err := c.n.NetMap()
+				if err != nil {
+					return err
 				}
-			case dialerErr := <-dialerStepCh:
-				if dialerErr != nil {
-					t.Fatal(err)
+				i := slices.IndexFunc(nm.Peers, func(p tailcfg.NodeView) bool { return p.Key() == c.peer })
+				if i < 0 {
+					return fmt.Errorf("peer %v not in netmap", c.peer.ShortString())
 				}
-				dialerSteps++
-				if dialerSteps == 2 && lisSteps == 2 {
-					return
+				p := nm.Peers[i]
+				if hidden := p.Endpoints().Len() == 0; hidden != derpOnly {
+					return fmt.Errorf("peer %v has endpoints %v; want DERP-only=%v", c.peer.ShortString(), p.Endpoints(), derpOnly)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// pingVia returns how a single tailscale ping from n1 to n2 got there:
+	// "DERP(region)" or a direct endpoint.
+	viaRx := regexp.MustCompile(`pong from .* via (\S+) in `)
+	pingVia := func() (string, error) {
+		out, err := n1.TailscaleForOutput("ping", "-c", "1", "--until-direct=false", "--timeout=2s", ip2).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("tailscale ping: %v, %s", err, out)
+		}
+		m := viaRx.FindSubmatch(out)
+		if m == nil {
+			return "", fmt.Errorf("unexpected tailscale ping output %q", out)
+		}
+		return string(m[1]), nil
+	}
+	checkVia := func(direct bool) error {
+		via, err := pingVia()
+		if err != nil {
+			return err
+		}
+		if isDERP := strings.HasPrefix(via, "DERP("); isDERP == direct {
+			return fmt.Errorf("ping went via %s; want direct=%v", via, direct)
+		}
+		return nil
+	}
+
+	if err := tstest.WaitFor(30*time.Second, func() error { return checkVia(true) }); err != nil {
+		t.Fatal(err)
+	}
+
+	setDERPOnly(true)
+	if err := tstest.WaitFor(30*time.Second, func() error { return checkVia(false) }); err != nil {
+		t.Fatal(err)
+	}
+
+	const incremental = "controlclient_map_response_handled_incrementally"
+	metric := func() int64 {
+		t.Helper()
+		v, err := n1.ClientMetric(incremental)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	before := metric()
+	setDERPOnly(false)
+	if got := metric(); got <= before {
+		t.Errorf("endpoints not patched incrementally: %s went from %d to %d", incremental, before, got)
+	}
+	if err := tstest.WaitFor(30*time.Second, func() error { return checkVia(true) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDualStackPeerReachability verifies that two nodes can reach each other
+// over both their IPv4 and IPv6 Tailscale addresses, with both disco pings
+// and TCP connections, in both directions. It runs in the default userspace
+// networking mode, in which netstack forwards incoming TCP connections for
+// either address family to the host's IPv4 loopback.
+func TestDualStackPeerReachability(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+
+	// echo dials dst from src and checks that data makes the round trip.
+	echo := func(src *TestNode, dst netip.Addr) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := src.LocalClient().DialTCP(ctx, dst.String(), port)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		want := "hello " + dst.String()
+		if _, err := io.WriteString(c, want); err != nil {
+			return err
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			return err
+		}
+		if string(got) != want {
+			return fmt.Errorf("echo got %q; want %q", got, want)
+		}
+		return nil
+	}
+
+	for i, src := range nodes {
+		dstNode := nodes[1-i]
+		for _, dst := range dstNode.AwaitIPs() {
+			family := "IPv4"
+			if dst.Is6() {
+				family = "IPv6"
+			}
+			t.Run(fmt.Sprintf("n%d-to-n%d-%s", i+1, 2-i, family), func(t *testing.T) {
+				if err := tstest.WaitFor(20*time.Second, func() error {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					res, err := src.LocalClient().Ping(ctx, dst, tailcfg.PingDisco)
+					if err != nil {
+						return err
+					}
+					if res.Err != "" {
+						return errors.New(res.Err)
+					}
+					return nil
+				}); err != nil {
+					t.Fatalf("ping %v: %v", dst, err)
+				}
+				if err := tstest.WaitFor(20*time.Second, func() error {
+					return echo(src, dst)
+				}); err != nil {
+					t.Fatalf("TCP to %v: %v", dst, err)
 				}
+			})
+		}
+	}
+}
+
+// TestCrossRegionDERP verifies that two nodes forced onto different home DERP
+// regions with SetHomeDERP, and unable to connect directly, can reach each
+// other by relaying across the two regions.
+func TestCrossRegionDERP(t *testing.T) {
+	tstest.Parallel(t)
+
+	// Build a DERPMap with two regions, each with its own DERP server.
+	derpMap := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	region2 := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1").Regions[1]
+	region2.RegionID = 2
+	region2.RegionCode = "test2"
+	region2.Nodes[0].Name = "t2"
+	region2.Nodes[0].RegionID = 2
+	derpMap.Regions[2] = region2
+
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.DERPMap = derpMap
+	}))
+	env.neverDirectUDP = true
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+	k1, k2 := n1.MustStatus().Self.PublicKey, n2.MustStatus().Self.PublicKey
+	regionID := map[string]int{"test": 1, "test2": 2}
+	regionCode := map[int]string{1: "test", 2: "test2"}
+
+	// Force each node onto the region it isn't currently using, so that both
+	// actually have to move. The nodes' netchecks are sticky about their home
+	// region, so moving can take a while.
+	otherRegion := func(n *TestNode) (r int) {
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			relay := n.MustStatus().Self.Relay
+			if regionID[relay] == 0 {
+				return fmt.Errorf("no home DERP yet (got %q)", relay)
+			}
+			r = 3 - regionID[relay]
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r1, r2 := otherRegion(n1), otherRegion(n2)
+	env.Control.SetHomeDERP(k1, r1)
+	env.Control.SetHomeDERP(k2, r2)
+	if err := tstest.WaitFor(60*time.Second, func() error {
+		for _, c := range []struct {
+			n              *TestNode
+			self, peer     key.NodePublic
+			home, peerHome int
+		}{
+			{n1, k1, k2, r1, r2},
+			{n2, k2, k1, r2, r1},
+		} {
+			st := c.n.MustStatus()
+			if want := regionCode[c.home]; st.Self.Relay != want {
+				return fmt.Errorf("%v home DERP is %q; want %q", c.self.ShortString(), st.Self.Relay, want)
+			}
+			ps, ok := st.Peer[c.peer]
+			if !ok {
+				return fmt.Errorf("peer %v not in netmap", c.peer.ShortString())
+			}
+			if want := regionCode[c.peerHome]; ps.Relay != want {
+				return fmt.Errorf("peer %v home DERP is %q; want %q", c.peer.ShortString(), ps.Relay, want)
 			}
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 
-	d1.MustCleanShutdown(t)
+	for _, c := range [][2]*TestNode{{n1, n2}, {n2, n1}} {
+		src, dst := c[0], c[1]
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			res, err := src.PingDetailed(dst)
+			if err != nil {
+				return err
+			}
+			if res.DERPRegionID == 0 {
+				return fmt.Errorf("ping went direct via %q; want DERP", res.Endpoint)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
-// TestNetstackUDPLoopback tests netstack loopback of UDP packets, in both
-// directions.
-func TestNetstackUDPLoopback(t *testing.T) {
-	tstest.RequireRoot(t)
+// TestDERPRegionNoHome tests that a node doesn't pick a DERP region marked as
+// NoMeasureNoHome as its home, even if it has the lowest latency.
+func TestDERPRegionNoHome(t *testing.T) {
+	tstest.Parallel(t)
+
+	// Build a DERPMap with three regions, each with its own DERP server.
+	derpMap := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	for id := 2; id <= 3; id++ {
+		r := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1").Regions[1]
+		r.RegionID = id
+		r.RegionCode = fmt.Sprintf("test%d", id)
+		r.Nodes[0].Name = fmt.Sprintf("t%d", id)
+		r.Nodes[0].RegionID = id
+		derpMap.Regions[id] = r
+	}
+	regionCode := map[int]string{1: "test", 2: "test2", 3: "test3"}
+
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.DERPMap = derpMap
+	}))
+	// All the regions are on localhost, so scale their latencies to rank
+	// them: region 1 is the fastest, then region 2, then region 3.
+	env.Control.SetDERPRegionScore(1, 0.001)
+	env.Control.SetDERPRegionScore(2, 0.03)
+	env.Control.SetDERPRegionScore(3, 1)
 
-	env := NewTestEnv(t)
-	env.tunMode = true
-	loopbackPort := 5201
-	env.loopbackPort = &loopbackPort
 	n1 := NewTestNode(t, env)
 	d1 := n1.StartDaemon()
-
-	n1.AwaitResponding()
+	n1.AwaitListening()
 	n1.MustUp()
-
-	ip4 := n1.AwaitIP4()
-	ip6 := n1.AwaitIP6()
 	n1.AwaitRunning()
 
-	cases := []struct {
-		pingerLAddr *net.UDPAddr
-		pongerLAddr *net.UDPAddr
-		network     string
-		dialAddr    *net.UDPAddr
-	}{
-		{
-			pingerLAddr: &net.UDPAddr{IP: ip4.AsSlice(), Port: loopbackPort + 1},
-			pongerLAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: loopbackPort},
-			network:     "udp4",
-			dialAddr:    &net.UDPAddr{IP: tsaddr.TailscaleServiceIP().AsSlice(), Port: loopbackPort},
-		},
-		{
-			pingerLAddr: &net.UDPAddr{IP: ip6.AsSlice(), Port: loopbackPort + 1},
-			pongerLAddr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: loopbackPort},
-			network:     "udp6",
-			dialAddr:    &net.UDPAddr{IP: tsaddr.TailscaleServiceIPv6().AsSlice(), Port: loopbackPort},
-		},
+	wantHome := func(regionID int) {
+		t.Helper()
+		if err := tstest.WaitFor(60*time.Second, func() error {
+			if got, want := n1.MustStatus().Self.Relay, regionCode[regionID]; got != want {
+				return fmt.Errorf("home DERP is %q; want %q", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
 	}
+	wantHome(1)
 
-	writeBufSize := int(tstun.DefaultTUNMTU()) - 40 - 8 // mtu - ipv6 header - udp header
-	wantPongs := 100
+	// A node keeps a home region that's still working, so restart it to
+	// have it pick one from scratch.
+	env.Control.SetDERPRegionNoHome(1, true)
+	d1.MustCleanShutdown(t)
+	d2 := n1.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+	n1.AwaitRunning()
+	wantHome(2)
+}
 
-	for _, c := range cases {
-		pongerConn, err := net.ListenUDP(c.network, c.pongerLAddr)
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer pongerConn.Close()
+// TestDERPRegionAddedLive tests that nodes start using a DERP region that's
+// added to the DERPMap while they're running, as new regions are rolled out,
+// and stop using one that's removed, all without restarting.
+func TestDERPRegionAddedLive(t *testing.T) {
+	tstest.Parallel(t)
 
-		var pingerConn *net.UDPConn
-		err = tstest.WaitFor(time.Second*5, func() error {
-			pingerConn, err = net.DialUDP(c.network, c.pingerLAddr, c.dialAddr)
-			return err
-		})
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer pingerConn.Close()
+	derpMap := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	region2 := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1").Regions[1]
+	region2.RegionID = 2
+	region2.RegionCode = "test2"
+	region2.Nodes[0].Name = "t2"
+	region2.Nodes[0].RegionID = 2
 
-		pingerFn := func(conn *net.UDPConn) error {
-			b := make([]byte, writeBufSize)
-			n, err := conn.Write(b)
-			if err != nil {
-				return err
-			}
-			if n != len(b) {
-				return fmt.Errorf("bad write size: %d", n)
-			}
-			err = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
-			if err != nil {
-				return err
-			}
-			n, err = conn.Read(b)
-			if err != nil {
-				return err
-			}
-			if n != len(b) {
-				return fmt.Errorf("bad read size: %d", n)
-			}
-			return nil
-		}
+	env := NewTestEnv(t, ConfigureControl(func(control *testcontrol.Server) {
+		control.DERPMap = derpMap
+	}))
+	env.neverDirectUDP = true
 
-		pongerFn := func(conn *net.UDPConn) error {
-			for {
-				b := make([]byte, writeBufSize)
-				n, from, err := conn.ReadFromUDP(b)
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+
+	// wantRegion waits for both nodes to have region 2 in their DERPMaps or
+	// not, to be homed on the region with the given code, and to reach each
+	// other through it.
+	wantRegion := func(haveRegion2 bool, home string, homeID int) {
+		t.Helper()
+		for _, n := range nodes {
+			if err := tstest.WaitFor(60*time.Second, func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				dm, err := n.LocalClient().CurrentDERPMap(ctx)
 				if err != nil {
 					return err
 				}
-				if n != len(b) {
-					return fmt.Errorf("bad read size: %d", n)
+				if _, ok := dm.Regions[2]; ok != haveRegion2 {
+					return fmt.Errorf("region 2 in DERPMap = %v; want %v", ok, haveRegion2)
 				}
-				n, err = conn.WriteToUDP(b, from)
+				// A node only picks a home region that its netcheck
+				// has measured.
+				if got := n.MustStatus().Self.Relay; got != home {
+					return fmt.Errorf("home DERP is %q; want %q", got, home)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, c := range [][2]*TestNode{{n1, n2}, {n2, n1}} {
+			src, dst := c[0], c[1]
+			if err := tstest.WaitFor(20*time.Second, func() error {
+				res, err := src.PingDetailed(dst)
 				if err != nil {
 					return err
 				}
-				if n != len(b) {
-					return fmt.Errorf("bad write size: %d", n)
+				if res.DERPRegionID != homeID {
+					return fmt.Errorf("ping went via DERP region %d (endpoint %q); want %d", res.DERPRegionID, res.Endpoint, homeID)
 				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
 			}
 		}
+	}
+	wantRegion(false, "test", 1)
+
+	// Add region 2, scored so that it's the best region by far enough for
+	// the nodes to move to it, as all regions are on localhost.
+	withRegion2 := derpMap.Clone()
+	withRegion2.Regions[2] = region2
+	withRegion2.HomeParams = &tailcfg.DERPHomeParams{
+		RegionScore: map[int]float64{1: 1000},
+	}
+	env.Control.SetDERPMap(withRegion2)
+	wantRegion(true, "test2", 2)
 
-		pongerErrCh := make(chan error, 1)
+	// Remove it again, so the nodes have to move back.
+	env.Control.SetDERPMap(derpMap)
+	wantRegion(false, "test", 1)
+}
+
+// TestNetCheck tests that "tailscale netcheck --format=json" prints a report
+// that parses as a netcheck.Report and reflects the test environment: UDP
+// works, the environment's DERP region is measured, and it's preferred.
+func TestNetCheck(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	n := NewTestNode(t, env)
+	d := n.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	n.AwaitListening()
+	n.MustUp()
+	n.AwaitRunning()
+
+	dm, err := n.LocalClient().CurrentDERPMap(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.Regions) != 1 {
+		t.Fatalf("got %d DERP regions; want 1", len(dm.Regions))
+	}
+	var regionID int
+	for id := range dm.Regions {
+		regionID = id
+	}
+
+	r, err := n.NetCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("netcheck report: %+v", r)
+	if !r.UDP || !r.IPv4 {
+		t.Errorf("UDP = %v, IPv4 = %v; want both true", r.UDP, r.IPv4)
+	}
+	if !r.GlobalV4.IsValid() {
+		t.Errorf("GlobalV4 not set")
+	}
+	if r.Now.IsZero() {
+		t.Errorf("Now not set")
+	}
+	if _, ok := r.RegionLatency[regionID]; !ok {
+		t.Errorf("RegionLatency = %v; want an entry for region %d", r.RegionLatency, regionID)
+	}
+	if _, ok := r.RegionV4Latency[regionID]; !ok {
+		t.Errorf("RegionV4Latency = %v; want an entry for region %d", r.RegionV4Latency, regionID)
+	}
+	if r.PreferredDERP != regionID {
+		t.Errorf("PreferredDERP = %d; want %d", r.PreferredDERP, regionID)
+	}
+}
+
+// TestDERPDisabled tests that two nodes that can connect directly work
+// without any DERP servers, and that they warn about having no home relay
+// server until DERP is enabled again.
+func TestDERPDisabled(t *testing.T) {
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+	env.SetDERPDisabled(true)
+
+	// Without DERP, a node only gets to Running once it has a WireGuard
+	// session with a peer, so "tailscale up" for one node can't return
+	// before the other is up too. Run them concurrently.
+	//
+	// Nodes also only notice new WireGuard sessions when they next check
+	// their engine status, which they do periodically while a GUI or other
+	// client watches for engine updates. Act as such a client.
+	var nodes []*TestNode
+	var ups []*exec.Cmd
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		w, err := n.LocalClient().WatchIPNBus(ctx, ipn.NotifyWatchEngineUpdates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
 		go func() {
-			pongerErrCh <- pongerFn(pongerConn)
+			for {
+				if _, err := w.Next(); err != nil {
+					return
+				}
+			}
 		}()
+		up := n.Tailscale("up", "--login-server="+env.ControlURL())
+		if err := up.Start(); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+		ups = append(ups, up)
+	}
+	n1, n2 := nodes[0], nodes[1]
 
-		err = tstest.WaitFor(time.Second*5, func() error {
-			err = pingerFn(pingerConn)
-			if err != nil {
-				return err
-			}
-			return nil
-		})
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		res, err := n1.PingDetailed(n2)
 		if err != nil {
-			t.Fatal(err)
+			return err
+		}
+		if res.DERPRegionID != 0 || res.Endpoint == "" {
+			return fmt.Errorf("ping went via DERP region %d; want direct", res.DERPRegionID)
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-		var pongsRX int
-		for {
-			pingerErrCh := make(chan error)
-			go func() {
-				pingerErrCh <- pingerFn(pingerConn)
-			}()
+	// Disco pings don't use WireGuard, so send a TSMP ping to establish a
+	// WireGuard session.
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		res, err := n1.LocalClient().Ping(ctx, n2.AwaitIP4(), tailcfg.PingTSMP)
+		if err != nil {
+			return err
+		}
+		if res.Err != "" {
+			return errors.New(res.Err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, up := range ups {
+		nodes[i].AwaitRunning()
+		if err := up.Wait(); err != nil {
+			t.Fatalf("up: %v", err)
+		}
+	}
 
-			select {
-			case err := <-pongerErrCh:
-				t.Fatal(err)
-			case err := <-pingerErrCh:
-				if err != nil {
-					t.Fatal(err)
-				}
-			}
+	const noHomeWarning = "could not connect to any relay server"
+	hasNoHomeWarning := func(st *ipnstate.Status) bool {
+		return slices.ContainsFunc(st.Health, func(h string) bool {
+			return strings.Contains(h, noHomeWarning)
+		})
+	}
+	if err := tstest.WaitFor(30*time.Second, func() error {
+		st := n1.MustStatus()
+		if st.Self.Relay != "" {
+			return fmt.Errorf("home DERP is %q; want none", st.Self.Relay)
+		}
+		if !hasNoHomeWarning(st) {
+			return fmt.Errorf("health = %q; want warning containing %q", st.Health, noHomeWarning)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-			pongsRX++
-			if pongsRX == wantPongs {
-				break
-			}
+	env.SetDERPDisabled(false)
+	if err := tstest.WaitFor(30*time.Second, func() error {
+		st := n1.MustStatus()
+		if st.Self.Relay != "test" {
+			return fmt.Errorf("home DERP is %q; want %q", st.Self.Relay, "test")
 		}
+		if hasNoHomeWarning(st) {
+			return fmt.Errorf("health = %q; want no warning containing %q", st.Health, noHomeWarning)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-
-	d1.MustCleanShutdown(t)
 }
 
-func TestEncryptStateMigration(t *testing.T) {
-	if !hostinfo.New().TPM.Present() {
-		t.Skip("TPM not available")
-	}
-	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
-		t.Skip("--encrypt-state for tailscaled state not supported on this platform")
-	}
+// TestCaptivePortal tests that a node whose network starts intercepting
+// traffic with a captive portal detects the portal and warns about it, and
+// that it's connected again once the portal is cleared.
+func TestCaptivePortal(t *testing.T) {
 	tstest.Parallel(t)
 	env := NewTestEnv(t)
 	n := NewTestNode(t, env)
+	d := n.StartDaemon()
+	defer d.MustCleanShutdown(t)
+	n.AwaitResponding()
+	n.MustUp()
+	n.AwaitRunning()
 
-	runNode := func(t *testing.T, wantStateKeys []string) {
-		t.Helper()
+	const captiveWarning = "This network requires you to log in using your web browser."
+	hasCaptiveWarning := func(st *ipnstate.Status) bool {
+		return slices.ContainsFunc(st.Health, func(h string) bool {
+			return strings.Contains(h, captiveWarning)
+		})
+	}
+	if st := n.MustStatus(); hasCaptiveWarning(st) {
+		t.Fatalf("health = %q before captive portal; want no captive portal warning", st.Health)
+	}
 
-		// Run the node.
-		d := n.StartDaemon()
-		n.AwaitResponding()
-		n.MustUp()
-		n.AwaitRunning()
+	env.SetCaptivePortal(true)
+	if err := tstest.WaitFor(30*time.Second, func() error {
+		if st := n.MustStatus(); !hasCaptiveWarning(st) {
+			return fmt.Errorf("health = %q; want warning containing %q", st.Health, captiveWarning)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-		// Check the contents of the state file.
-		buf, err := os.ReadFile(n.stateFile)
-		if err != nil {
-			t.Fatalf("reading %q: %v", n.stateFile, err)
+	env.SetCaptivePortal(false)
+	if err := tstest.WaitFor(30*time.Second, func() error {
+		st := n.MustStatus()
+		if st.BackendState != "Running" {
+			return fmt.Errorf("in state %q; want Running", st.BackendState)
 		}
-		t.Logf("state file content:\n%s", buf)
-		var content map[string]any
-		if err := json.Unmarshal(buf, &content); err != nil {
-			t.Fatalf("parsing %q: %v", n.stateFile, err)
+		if st.Self.Relay == "" {
+			return errors.New("no home DERP yet")
 		}
-		for _, k := range wantStateKeys {
-			if _, ok := content[k]; !ok {
-				t.Errorf("state file is missing key %q", k)
-			}
+		if hasCaptiveWarning(st) {
+			return fmt.Errorf("health = %q; want no captive portal warning", st.Health)
 		}
-
-		// Stop the node.
-		d.MustCleanShutdown(t)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-
-	wantPlaintextStateKeys := []string{"_machinekey", "_current-profile", "_profiles"}
-	wantEncryptedStateKeys := []string{"key", "nonce", "data"}
-	t.Run("regular-state", func(t *testing.T) {
-		n.encryptState = false
-		runNode(t, wantPlaintextStateKeys)
-	})
-	t.Run("migrate-to-encrypted", func(t *testing.T) {
-		n.encryptState = true
-		runNode(t, wantEncryptedStateKeys)
-	})
-	t.Run("migrate-to-plaintext", func(t *testing.T) {
-		n.encryptState = false
-		runNode(t, wantPlaintextStateKeys)
-	})
 }
 
 // TestPeerRelayPing creates three nodes with one acting as a peer relay.
@@ -2629,3 +7053,353 @@ func TestNodeWithBadStateFile(t *testing.T) {
 
 	d1.MustCleanShutdown(t)
 }
+
+// TestSSHHostKeyVerification tests that "tailscale ssh" verifies the peer
+// against the SSH host keys that control advertises for it, refusing to
+// connect when they don't match the peer's actual keys.
+func TestSSHHostKeyVerification(t *testing.T) {
+	tstest.Parallel(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("Tailscale SSH server only tested on Linux")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Tailscale SSH server requires root")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh client in $PATH")
+	}
+
+	env := NewTestEnv(t)
+	env.Control.SSHPolicy = &tailcfg.SSHPolicy{
+		Rules: []*tailcfg.SSHRule{{
+			Principals: []*tailcfg.SSHPrincipal{{Any: true}},
+			SSHUsers:   map[string]string{"*": "="},
+			Action:     &tailcfg.SSHAction{Accept: true},
+		}},
+	}
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n1.AwaitResponding()
+	n1.MustUp()
+	n1.AwaitRunning()
+
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	n2.AwaitResponding()
+	n2.MustUp("--ssh")
+	n2.AwaitRunning()
+	n2IP := n2.AwaitIP4()
+	k2 := n2.MustStatus().Self.PublicKey
+
+	var realKeys []string
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		node := env.Control.Node(k2)
+		if node == nil || node.Hostinfo.SSH_HostKeys().Len() == 0 {
+			return errors.New("n2 has not reported its SSH host keys")
+		}
+		realKeys = node.Hostinfo.SSH_HostKeys().AsSlice()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	// setHostKeys makes control advertise keys for n2, and waits for n1 to
+	// see them.
+	setHostKeys := func(keys []string) {
+		t.Helper()
+		env.Control.SetSSHHostKeys(k2, keys)
+		if err := tstest.WaitFor(10*time.Second, func() error {
+			st := n1.MustStatus()
+			ps, ok := st.Peer[k2]
+			if !ok {
+				return errors.New("n2 not yet a peer of n1")
+			}
+			if !slices.Equal(ps.SSH_HostKeys, keys) {
+				return fmt.Errorf("n1 sees n2 host keys %q; want %q", ps.SSH_HostKeys, keys)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sshTrue runs "true" on n2 over Tailscale SSH from n1.
+	sshTrue := func() ([]byte, error) {
+		cmd := n1.Tailscale("ssh", "root@"+n2IP.String(), "true")
+		home := t.TempDir()
+		cmd.Env = append(cmd.Env, "HOME="+home, "XDG_CONFIG_HOME="+home)
+		cmd.Stdout = nil // in case --verbose-tailscale was set
+		cmd.Stderr = nil // in case --verbose-tailscale was set
+		return cmd.CombinedOutput()
+	}
+
+	setHostKeys([]string{wrongKey})
+	if out, err := sshTrue(); err == nil {
+		t.Fatalf("ssh with mismatched host key succeeded; output:\n%s", out)
+	} else if !bytes.Contains(out, []byte("Host key verification failed")) {
+		t.Fatalf("ssh with mismatched host key: %v, want host key verification failure; output:\n%s", err, out)
+	}
+
+	setHostKeys(realKeys)
+	if out, err := sshTrue(); err != nil {
+		t.Fatalf("ssh with correct host keys: %v; output:\n%s", err, out)
+	}
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+// TestRoaming tests that a node's peers find it again over a direct path, and
+// that it reports its new endpoints to control, after it moves to a network
+// where it has a different local IP address.
+func TestRoaming(t *testing.T) {
+	tstest.Parallel(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("test roams between addresses in 127.0.0.0/8, which are only all loopback addresses on Linux")
+	}
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+
+	n1.AwaitListening()
+	n1.MustUp()
+	n1.AwaitRunning()
+	n2.AwaitListening()
+	n2.MustUp()
+	n2.AwaitRunning()
+	k2 := n2.MustStatus().Self.PublicKey
+
+	// awaitDirect waits for n1's disco pings to reach n2 over a direct path,
+	// to an endpoint with IP address want if it's valid, and returns the
+	// endpoint.
+	awaitDirect := func(want netip.Addr) netip.AddrPort {
+		t.Helper()
+		var ep netip.AddrPort
+		if err := tstest.WaitFor(30*time.Second, func() error {
+			res, err := n1.PingDetailed(n2)
+			if err != nil {
+				return err
+			}
+			if res.DERPRegionID != 0 || res.Endpoint == "" {
+				return fmt.Errorf("ping not direct: %+v", res)
+			}
+			ep, err = netip.ParseAddrPort(res.Endpoint)
+			if err != nil {
+				return err
+			}
+			if want.IsValid() && ep.Addr() != want {
+				return fmt.Errorf("ping went to %v, want an endpoint with IP %v", ep, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ep
+	}
+
+	before := awaitDirect(netip.Addr{})
+	t.Logf("n1 reaches n2 directly at %v", before)
+
+	roamIP := netip.MustParseAddr("127.0.0.2")
+	if before.Addr() == roamIP {
+		roamIP = roamIP.Next()
+	}
+	if err := n2.SimulateRoam(roamIP); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		node := env.Control.Node(k2)
+		if node == nil {
+			return errors.New("n2 not known to control")
+		}
+		for _, ep := range node.Endpoints {
+			if ep.Addr() == roamIP {
+				return nil
+			}
+		}
+		return fmt.Errorf("control has n2 endpoints %v, want one with IP %v", node.Endpoints, roamIP)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	after := awaitDirect(roamIP)
+	t.Logf("after roaming, n1 reaches n2 directly at %v", after)
+
+	// Check that WireGuard traffic flows over the new path too.
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		res, err := n1.LocalClient().Ping(ctx, n2.AwaitIP4(), tailcfg.PingTSMP)
+		if err != nil {
+			return err
+		}
+		if res.Err != "" {
+			return errors.New(res.Err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("TSMP ping after roaming: %v", err)
+	}
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+// TestSuspendResume tests that a node whose machine sleeps notices when it
+// wakes up, checks its network again, and can reach its peers again soon
+// after.
+func TestSuspendResume(t *testing.T) {
+	tstest.Parallel(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("suspending processes is not supported on Windows")
+	}
+	env := NewTestEnv(t)
+
+	var nodes []*TestNode
+	for range 2 {
+		n := NewTestNode(t, env)
+		d := n.StartDaemon()
+		defer d.MustCleanShutdown(t)
+		n.AwaitListening()
+		n.MustUp()
+		n.AwaitRunning()
+		nodes = append(nodes, n)
+	}
+	n1, n2 := nodes[0], nodes[1]
+
+	// awaitReachable waits for each node to be able to reach the other over
+	// WireGuard.
+	awaitReachable := func() {
+		t.Helper()
+		for _, c := range [][2]*TestNode{{n1, n2}, {n2, n1}} {
+			src, dst := c[0], c[1]
+			if err := tstest.WaitFor(20*time.Second, func() error {
+				ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+				defer cancel()
+				res, err := src.LocalClient().Ping(ctx, dst.AwaitIP4(), tailcfg.PingTSMP)
+				if err != nil {
+					return err
+				}
+				if res.Err != "" {
+					return errors.New(res.Err)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	awaitReachable()
+
+	metric := func(name string) int64 {
+		t.Helper()
+		v, err := n1.ClientMetric(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	const (
+		timeJumps = "netmon_link_change_timejump"
+		netchecks = "netcheck_report"
+	)
+	timeJumpsBefore, netchecksBefore := metric(timeJumps), metric(netchecks)
+
+	// Sleep for long enough for tailscaled to notice.
+	if err := n1.SimulateSuspendResume(25 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	resumed := time.Now()
+
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if got := metric(timeJumps); got <= timeJumpsBefore {
+			return fmt.Errorf("%s = %d; want more than %d", timeJumps, got, timeJumpsBefore)
+		}
+		if got := metric(netchecks); got <= netchecksBefore {
+			return fmt.Errorf("%s = %d; want more than %d", netchecks, got, netchecksBefore)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("wake not handled: %v", err)
+	}
+	awaitReachable()
+	t.Logf("peers reachable again %v after resuming", time.Since(resumed).Round(time.Millisecond))
+}
+
+// TestTaildropDisabled tests that "tailscale file cp" fails with a clear error
+// while Taildrop is disabled tailnet-wide, and works again once it's enabled.
+func TestTaildropDisabled(t *testing.T) {
+	tstest.Parallel(t)
+	controlOpt := ConfigureControl(func(s *testcontrol.Server) {
+		s.AllNodesSameUser = true // required for Taildrop
+	})
+	env := NewTestEnv(t, controlOpt)
+
+	n1 := NewTestNode(t, env)
+	d1 := n1.StartDaemon()
+	defer d1.MustCleanShutdown(t)
+	n2 := NewTestNode(t, env)
+	d2 := n2.StartDaemon()
+	defer d2.MustCleanShutdown(t)
+
+	n1.AwaitListening()
+	n2.AwaitListening()
+	n1.MustUp()
+	n2.MustUp()
+	n1.AwaitRunning()
+	n2.AwaitRunning()
+	if err := n1.AwaitPeers(1, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	target := n2.AwaitIP4().String() + ":"
+	file := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	awaitCapFileSharing := func(want bool) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			st := n1.MustStatus()
+			if got := st.Self.HasCap(tailcfg.CapabilityFileSharing); got != want {
+				return fmt.Errorf("has file sharing capability = %v; want %v", got, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env.Control.SetFeatureDisabled("taildrop")
+	awaitCapFileSharing(false)
+	out, err := n1.Tailscale("file", "cp", file, target).CombinedOutput()
+	if err == nil {
+		t.Fatalf("file cp succeeded with Taildrop disabled\n%s", out)
+	}
+	if want := "Taildrop is not enabled for this node"; !bytes.Contains(out, []byte(want)) {
+		t.Fatalf("file cp output doesn't contain %q:\n%s", want, out)
+	}
+
+	env.Control.SetFeatureEnabled("taildrop")
+	awaitCapFileSharing(true)
+	if out, err := n1.Tailscale("file", "cp", file, target).CombinedOutput(); err != nil {
+		t.Fatalf("file cp: %v\n%s", err, out)
+	}
+	if out, err := n2.Tailscale("file", "get", t.TempDir()).CombinedOutput(); err != nil {
+		t.Fatalf("file get: %v\n%s", err, out)
+	}
+}
@@ -38,6 +38,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/opt"
+	"tailscale.com/util/cmpver"
 	"tailscale.com/util/httpm"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
@@ -66,6 +67,21 @@ type Server struct {
 	// grants rules.
 	PeerRelayGrants bool
 
+	// RequireNewDeviceVerification makes nodes registering from a machine
+	// that hasn't completed an interactive login before visit an auth URL
+	// to verify the new device, whether or not RequireAuth is set or an
+	// auth key is used. Nodes that register from a verified machine again,
+	// for instance after logging out, skip the verification.
+	RequireNewDeviceVerification bool
+
+	// AllowMissingAuthKey, if true, accepts registration requests without an
+	// auth key when one is required (see RequireAuthKey and AddAuthKey),
+	// like real control does. Nodes that are already registered, such as
+	// ones restarting with their persisted node key, register again, and
+	// other nodes are sent an AuthURL to log in interactively. By default,
+	// such requests are refused with "invalid authkey".
+	AllowMissingAuthKey bool
+
 	// SSHPolicy, if non-nil, is sent to every node in MapResponses.
 	// Each node also gets [tailcfg.CapabilitySSH] added to its capability
 	// map, permitting "tailscale up --ssh".
@@ -137,6 +153,22 @@ type Server struct {
 	// AltMapStream, if non-nil, takes over serveMap. See [AltMapStreamFunc].
 	AltMapStream AltMapStreamFunc
 
+	// ResponseJitterSeed seeds the random source used for the delays
+	// configured by SetResponseJitter, making the sequence of delays
+	// reproducible. It must be set before SetResponseJitter is called.
+	ResponseJitterSeed uint64
+
+	// EphemeralNodeTimeout is how long an ephemeral node may go without a
+	// map request in progress before it's deleted, as happens some time
+	// after it goes offline. If zero, DefaultEphemeralNodeTimeout is used.
+	EphemeralNodeTimeout time.Duration
+
+	// EndpointFaultSeed seeds the random source used to decide which
+	// requests fail with the faults configured by SetEndpointFaults, making
+	// the sequence of failures reproducible. It must be set before
+	// SetEndpointFaults is called.
+	EndpointFaultSeed uint64
+
 	initMuxOnce sync.Once
 	mux         *http.ServeMux
 
@@ -146,10 +178,37 @@ type Server struct {
 	pubKey     key.MachinePublic
 	privKey    key.ControlPrivate // not strictly needed vs. MachinePrivate, but handy to test type interactions.
 
+	// registerCounts and mapPollCounts are the numbers of register
+	// requests and streaming map requests received from each node key.
+	registerCounts map[key.NodePublic]int
+	mapPollCounts  map[key.NodePublic]int
+
+	// pausedNodes are the nodes whose map requests are held by PauseNode,
+	// each with a channel that ResumeNode closes.
+	pausedNodes map[key.NodePublic]chan struct{}
+
+	// authKeys are the auth keys added with AddAuthKey, keyed by the
+	// auth key string.
+	authKeys map[string]AuthKeyOpts
+
 	// nodeSubnetRoutes is a list of subnet routes that are served
 	// by the specified node.
 	nodeSubnetRoutes map[key.NodePublic][]netip.Prefix
 
+	// nodePrimaryRoutes, if it has an entry for a node, overrides which of
+	// that node's subnet routes it is the primary router for. Nodes without
+	// an entry are primary for all of their nodeSubnetRoutes.
+	nodePrimaryRoutes map[key.NodePublic][]netip.Prefix
+
+	// exitNodeApproved is the set of nodes whose advertised exit routes are
+	// in their AllowedIPs. See SetExitNodeApproved.
+	exitNodeApproved set.Set[key.NodePublic]
+
+	// standbyRoutesInAllowedIPs is whether nodes' subnet routes are in
+	// their AllowedIPs even if they're not the primary router for them.
+	// See SetStandbyRoutesInAllowedIPs.
+	standbyRoutesInAllowedIPs bool
+
 	// peerIsJailed is the set of peers that are jailed for a node.
 	peerIsJailed map[key.NodePublic]map[key.NodePublic]bool // node => peer => isJailed
 
@@ -159,9 +218,35 @@ type Server struct {
 	// masquerade address to use for that peer.
 	masquerades map[key.NodePublic]map[key.NodePublic]netip.Addr // node => peer => SelfNodeV{4,6}MasqAddrForThisPeer IP
 
+	// nodeCapVersions overrides the capability version that the server
+	// believes a node supports. See SetCapabilityVersion.
+	nodeCapVersions map[key.NodePublic]tailcfg.CapabilityVersion
+
 	// nodeCapMaps overrides the capability map sent down to a client.
 	nodeCapMaps map[key.NodePublic]tailcfg.NodeCapMap
 
+	// nodeSelfCapMaps are capabilities sent to a node in its own CapMap, on
+	// top of those in nodeCapMaps, but never to its peers. See
+	// SetNodeSelfCapMap.
+	nodeSelfCapMaps map[key.NodePublic]tailcfg.NodeCapMap
+
+	// derpOnly is the set of nodes whose endpoints are hidden from their
+	// peers. See SetDERPOnly.
+	derpOnly set.Set[key.NodePublic]
+
+	// loggedOut is the set of node keys whose nodes have logged out and
+	// not registered again since.
+	loggedOut map[key.NodePublic]bool
+
+	// nodeDebugFlags are extra node attributes, such as
+	// [tailcfg.NodeAttrDebugForceBackgroundSTUN], sent to a node in its
+	// MapResponses. See SetDebugFlags.
+	nodeDebugFlags map[key.NodePublic][]tailcfg.NodeCapability
+
+	// sshHostKeys overrides the SSH host keys a node is advertised as
+	// having in MapResponses. See SetSSHHostKeys.
+	sshHostKeys map[key.NodePublic][]string
+
 	// globalAppCaps configures global app capabilities, equivalent to:
 	//	"grants": [
 	//	   {
@@ -172,6 +257,89 @@ type Server struct {
 	//	]
 	globalAppCaps tailcfg.PeerCapMap
 
+	// packetFilter, if non-nil, replaces the default packet filter sent to
+	// all nodes. See SetPacketFilter.
+	packetFilter []tailcfg.FilterRule
+
+	// tailnetDomain, if non-empty, overrides the default tailnet name sent
+	// in MapResponse.Domain and used for new users' login names.
+	tailnetDomain string
+
+	// tailnetDisplayName, if non-empty, is sent to all nodes via the
+	// [tailcfg.NodeAttrTailnetDisplayName] node capability.
+	tailnetDisplayName string
+
+	// jitterMin and jitterMax bound the random delay added before handling
+	// each control request. See SetResponseJitter. jitterRand is non-nil
+	// if jitter is enabled.
+	jitterMin, jitterMax time.Duration
+	jitterRand           *rand.Rand
+
+	// endpointFaults are the faults injected into requests to each control
+	// endpoint, and faultsInjected counts how many requests to each endpoint
+	// they've failed. See SetEndpointFaults. faultRand is non-nil if any
+	// faults are configured.
+	endpointFaults map[string]FaultSpec
+	faultsInjected map[string]int
+	faultRand      *rand.Rand
+
+	// homeDERP is the DERP region that each node, if present, is forced to
+	// use as its home region. See SetHomeDERP.
+	homeDERP map[key.NodePublic]int
+
+	// minClientVersion, if non-empty, is the minimum client version below
+	// which nodes are told to update. minClientVersionSet is whether it was
+	// ever set, so that nodes can be told to clear the warning when it's
+	// lowered or removed. See SetMinimumClientVersion.
+	minClientVersion    string
+	minClientVersionSet bool
+
+	// displayMessages are the display messages set with SetDisplayMessage.
+	// Cleared messages stay with nil values, so that nodes are told to
+	// clear them.
+	displayMessages map[tailcfg.DisplayMessageID]*tailcfg.DisplayMessage
+
+	// controlTimeOffset, if controlTimeOffsetSet, is how far the
+	// ControlTime sent in MapResponses is ahead of the real time. Otherwise
+	// a fixed date is sent. See SetControlTimeOffset.
+	controlTimeOffset    time.Duration
+	controlTimeOffsetSet bool
+
+	// reauthEvery, if non-zero, is how long a node's login session lasts
+	// before it must reauthenticate. sessionStart is when each node's
+	// current session started. See RequireReauthEvery.
+	reauthEvery  time.Duration
+	sessionStart map[tailcfg.NodeID]time.Time
+
+	// loggedOutRemotely is the set of nodes whose sessions were ended by
+	// ForceLogout and that haven't reauthenticated since.
+	loggedOutRemotely set.Set[tailcfg.NodeID]
+
+	// disabledFeatures is the set of features, as named in featureCaps,
+	// that are disabled tailnet-wide. See SetFeatureDisabled.
+	disabledFeatures set.Set[string]
+
+	// nodeDisabledFeatures is the set of features, as named in
+	// featureCaps, that are disabled for each node, in addition to those
+	// disabled tailnet-wide. See SetNodeFeatureDisabled.
+	nodeDisabledFeatures map[key.NodePublic]set.Set[string]
+
+	// captivePortal is whether /generate_204 serves a captive portal login
+	// page instead of 204 No Content. See SetCaptivePortal.
+	captivePortal bool
+
+	// ephemeralNodes is the state of each ephemeral node, keyed by node ID.
+	// See EphemeralNodeTimeout.
+	ephemeralNodes map[tailcfg.NodeID]*ephemeralNode
+
+	// closed is whether Close has been called, after which ephemeral nodes
+	// are no longer deleted.
+	closed bool
+
+	// deletedNodes is how many nodes have been deleted, so that the IDs and
+	// addresses of new nodes don't reuse those of deleted ones.
+	deletedNodes int
+
 	// suppressAutoMapResponses is the set of nodes that should not be sent
 	// automatic map responses from serveMap. (They should only get manually sent ones)
 	suppressAutoMapResponses set.Set[key.NodePublic]
@@ -185,13 +353,19 @@ type Server struct {
 	updates       map[tailcfg.NodeID]chan updateType
 	authPath      map[string]*AuthPath
 	nodeKeyAuthed set.Set[key.NodePublic]
-	msgToSend     map[key.NodePublic][]any // FIFO queue per node; values are *tailcfg.PingRequest or *tailcfg.MapResponse
+	msgToSend     map[key.NodePublic][]any // FIFO queue per node; values are *tailcfg.PingRequest, *tailcfg.MapResponse, json.RawMessage or omitPeersMapResponse
 	allExpired    bool                     // All nodes will be told their node key is expired.
 
+	// verifiedMachines are the machines that have completed an
+	// interactive login. See RequireNewDeviceVerification.
+	verifiedMachines set.Set[key.MachinePublic]
+
 	// tkaStorage records the Tailnet Lock state, if any.
 	// If nil, Tailnet Lock is not enabled in the Tailnet.
 	tkaStorage tka.CompactableChonk
 
+	pingTargets syncs.Map[string, *PingTarget] // token => target; see NewPingTarget
+
 	// onMapRequest, if non-nil, is called at the start of each map poll request.
 	// It can be used in tests to panic or fail if a node contacts control unexpectedly.
 	onMapRequest func(nodeKey key.NodePublic)
@@ -271,6 +445,94 @@ func (s *Server) AddPingRequest(nodeKeyDst key.NodePublic, pr *tailcfg.PingReque
 	return s.addDebugMessage(nodeKeyDst, pr)
 }
 
+// PingTarget is an HTTP endpoint on a Server at which tests can point the URLs
+// of PingRequests. It records the requests that nodes make to it: the HEAD
+// requests of plain pings, and the POSTed results of typed pings such as disco
+// pings. It can be made to respond slowly or to fail, to test how nodes cope.
+type PingTarget struct {
+	// URL is the target's URL, for use as a [tailcfg.PingRequest.URL].
+	URL string
+
+	delay  time.Duration
+	status int
+	reqs   chan *PingTargetRequest
+}
+
+// PingTargetRequest is a request that a PingTarget received.
+type PingTargetRequest struct {
+	// Method is the request's HTTP method.
+	Method string
+
+	// Result is the ping result that the node POSTed, if any.
+	Result *tailcfg.PingResponse
+
+	// Canceled is whether the node gave up on the request before the
+	// PingTarget responded to it.
+	Canceled bool
+}
+
+// NewPingTarget returns a new PingTarget on s that waits for delay before
+// responding to each request, giving up early if the node does, and then
+// responds with the given HTTP status code. A zero status means 200 OK.
+func (s *Server) NewPingTarget(delay time.Duration, status int) *PingTarget {
+	token := rands.HexString(10)
+	pt := &PingTarget{
+		URL:    s.BaseURL() + "/ping-target/" + token,
+		delay:  delay,
+		status: cmp.Or(status, http.StatusOK),
+		reqs:   make(chan *PingTargetRequest, 16),
+	}
+	s.pingTargets.Store(token, pt)
+	return pt
+}
+
+// Requests returns a channel that receives each request made to pt once pt
+// has responded to it or the node has given up on it.
+func (pt *PingTarget) Requests() <-chan *PingTargetRequest {
+	return pt.reqs
+}
+
+func (s *Server) servePingTarget(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.URL.Path, "/ping-target/")
+	pt, ok := s.pingTargets.Load(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	req := &PingTargetRequest{Method: r.Method}
+	if r.Method == httpm.POST {
+		res := new(tailcfg.PingResponse)
+		if err := json.NewDecoder(io.LimitReader(r.Body, msgLimit)).Decode(res); err != nil {
+			s.logf("testcontrol: bad ping result: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Result = res
+	}
+	if pt.delay > 0 {
+		timer := time.NewTimer(pt.delay)
+		select {
+		case <-r.Context().Done():
+			req.Canceled = true
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	select {
+	case pt.reqs <- req:
+	default:
+		s.logf("testcontrol: dropping request to ping target %s, channel full", token)
+	}
+	if req.Canceled {
+		return
+	}
+	if pt.status != http.StatusOK {
+		http.Error(w, http.StatusText(pt.status), pt.status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 // c2nRoundTripper is an http.RoundTripper that sends requests to a node via C2N.
 type c2nRoundTripper struct {
 	s *Server
@@ -330,6 +592,86 @@ func (s *Server) AddRawMapResponse(nodeKeyDst key.NodePublic, mr *tailcfg.MapRes
 	return s.addDebugMessage(nodeKeyDst, mr)
 }
 
+// AddRawMapResponseJSON is like AddRawMapResponse, but takes a JSON-encoded
+// MapResponse. It's meant for testing how clients handle messages that
+// [tailcfg.MapResponse] can't represent, such as ones containing fields
+// added by newer control servers.
+func (s *Server) AddRawMapResponseJSON(nodeKeyDst key.NodePublic, mrJSON []byte) bool {
+	return s.addDebugMessage(nodeKeyDst, json.RawMessage(mrJSON))
+}
+
+// AddOmitPeersMapResponse delivers to nodeKeyDst the MapResponse it would
+// otherwise be sent, but with its list of peers omitted, as if nothing about
+// the node's peers had changed. Clients must keep the peers they already have
+// when they get such a response. It's meant for testing that clients tell
+// full and incremental map updates apart.
+//
+// Unlike AddRawMapResponse, it doesn't suppress future automatic
+// MapResponses to the node.
+//
+// It reports whether the message was enqueued. That is, it reports whether
+// nodeKeyDst was connected.
+func (s *Server) AddOmitPeersMapResponse(nodeKeyDst key.NodePublic) bool {
+	return s.addDebugMessage(nodeKeyDst, omitPeersMapResponse{})
+}
+
+// omitPeersMapResponse is queued in msgToSend by AddOmitPeersMapResponse. It's
+// replaced by the node's current MapResponse without its peers when sent.
+type omitPeersMapResponse struct{}
+
+// ForceFullMap delivers to nodeKeyDst the full MapResponse it would be sent
+// if it had just started polling, with all of its peers, so that it has to
+// rebuild its netmap from scratch. It's meant for testing that clients end up
+// with the same netmap after incremental updates, as sent with
+// AddRawMapResponse, as after a full one describing the same state.
+//
+// Unlike AddRawMapResponse, it doesn't suppress future automatic
+// MapResponses to the node, but the full MapResponse is sent even if they're
+// already suppressed.
+//
+// It reports whether the message was enqueued. That is, it reports whether
+// nodeKeyDst was connected.
+func (s *Server) ForceFullMap(nodeKeyDst key.NodePublic) bool {
+	return s.addDebugMessage(nodeKeyDst, fullMapResponse{})
+}
+
+// fullMapResponse is queued in msgToSend by ForceFullMap. It's replaced by
+// the node's current full MapResponse when sent.
+type fullMapResponse struct{}
+
+// SetDERPOnly hides the endpoints of the node with the given node key from
+// its peers if derpOnly is true, so that they can only reach it via DERP,
+// and shows them again otherwise. It's meant for testing how clients move
+// connections from direct paths to DERP and back as control changes what it
+// tells them about their peers.
+//
+// The change is pushed to the connected peers incrementally, without a full
+// MapResponse: hiding the endpoints sends the node in PeersChanged with no
+// endpoints, as PeersChangedPatch can't represent that, while showing them
+// sends them in PeersChangedPatch. Later full MapResponses also leave out
+// the endpoints of nodes that are DERP-only.
+func (s *Server) SetDERPOnly(nodeKey key.NodePublic, derpOnly bool) {
+	s.mu.Lock()
+	if derpOnly {
+		mak.Set(&s.derpOnly, nodeKey, struct{}{})
+	} else {
+		s.derpOnly.Delete(nodeKey)
+	}
+	s.mu.Unlock()
+	for _, n := range s.AllNodes() {
+		if n.Key != nodeKey {
+			s.addDebugMessage(n.Key, peerEndpointsMapResponse{peer: nodeKey})
+		}
+	}
+}
+
+// peerEndpointsMapResponse is queued in msgToSend by SetDERPOnly. It's
+// replaced by an incremental MapResponse with the current endpoints of peer
+// when sent.
+type peerEndpointsMapResponse struct {
+	peer key.NodePublic
+}
+
 func (s *Server) addDebugMessage(nodeKeyDst key.NodePublic, msg any) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -344,7 +686,8 @@ func (s *Server) addDebugMessage(nodeKeyDst key.NodePublic, msg any) bool {
 		return false
 	}
 
-	if _, ok := msg.(*tailcfg.MapResponse); ok {
+	switch msg.(type) {
+	case *tailcfg.MapResponse, json.RawMessage:
 		if s.suppressAutoMapResponses == nil {
 			s.suppressAutoMapResponses = set.Set[key.NodePublic]{}
 		}
@@ -373,6 +716,72 @@ func (s *Server) SetExpireAllNodes(expired bool) {
 	}
 }
 
+// RequireReauthEvery makes nodes' login sessions last for d, after which the
+// node must reauthenticate interactively, as on tailnets with a session
+// policy. Once a node's session has elapsed, it's told that its node key has
+// expired, which puts it in the NeedsLogin state, and its next registration
+// requires visiting an auth URL, whether or not RequireAuth is set. Completing
+// the login starts a new session.
+//
+// Sessions start when nodes register, or for already registered nodes, when
+// RequireReauthEvery is called. A zero d disables reauthentication.
+func (s *Server) RequireReauthEvery(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reauthEvery = d
+	clear(s.sessionStart)
+	for _, n := range s.nodes {
+		s.startSessionLocked(n.ID)
+	}
+}
+
+// startSessionLocked starts a new login session for the given node and, if
+// sessions expire, arranges for the node to be told when this one does.
+// s.mu must be held.
+func (s *Server) startSessionLocked(nodeID tailcfg.NodeID) {
+	s.loggedOutRemotely.Delete(nodeID)
+	if s.reauthEvery == 0 {
+		return
+	}
+	mak.Set(&s.sessionStart, nodeID, time.Now())
+	time.AfterFunc(s.reauthEvery, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		sendUpdate(s.updates[nodeID], updateSelfChanged)
+	})
+}
+
+// sessionExpiredLocked reports whether the given node's login session has
+// elapsed or been ended by ForceLogout, requiring it to reauthenticate. See
+// RequireReauthEvery. s.mu must be held.
+func (s *Server) sessionExpiredLocked(nodeID tailcfg.NodeID) bool {
+	if s.loggedOutRemotely.Contains(nodeID) {
+		return true
+	}
+	start, ok := s.sessionStart[nodeID]
+	return ok && s.reauthEvery > 0 && time.Since(start) >= s.reauthEvery
+}
+
+// ForceLogout logs out the node with the given node key remotely, as an admin
+// can from the admin console. The node is told that its node key has expired
+// in its next MapResponse, or registration if it's not polling, which puts it
+// in the NeedsLogin state, and logging back in requires authenticating
+// interactively, whether or not RequireAuth is set.
+//
+// Unlike deleting the node, this keeps the node and its machine key, so when
+// it logs back in with a new node key, it's still the same node.
+func (s *Server) ForceLogout(nodeKey key.NodePublic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.nodes[nodeKey]
+	if !ok {
+		return
+	}
+	s.logf("Forcing logout of %s", nodeKey.ShortString())
+	mak.Set(&s.loggedOutRemotely, node.ID, struct{}{})
+	sendUpdate(s.updates[node.ID], updateSelfChanged)
+}
+
 type AuthPath struct {
 	nodeKey key.NodePublic
 
@@ -403,15 +812,101 @@ func (s *Server) logf(format string, a ...any) {
 func (s *Server) initMux() {
 	s.mux = http.NewServeMux()
 	s.mux.HandleFunc("/", s.serveUnhandled)
-	s.mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	})
+	s.mux.HandleFunc("/generate_204", s.serveGenerate204)
 	s.mux.HandleFunc("/key", s.serveKey)
 	s.mux.HandleFunc("/machine/tka/", s.serveTKA)
 	s.mux.HandleFunc("/machine/webclient/", s.serveWebClient)
 	s.mux.HandleFunc("/machine/", s.serveMachine)
 	s.mux.HandleFunc("/ts2021", s.serveNoiseUpgrade)
 	s.mux.HandleFunc("/c2n/", s.serveC2N)
+	s.mux.HandleFunc("/ping-target/", s.servePingTarget)
+}
+
+// serveGenerate204 serves the connectivity check that nodes use to detect
+// captive portals. See SetCaptivePortal.
+func (s *Server) serveGenerate204(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	captive := s.captivePortal
+	s.mu.Unlock()
+	if captive {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><body>Please log in to use this network.</body></html>")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// featureCaps are the node capabilities through which control enables each
+// feature that can be disabled with SetFeatureDisabled.
+var featureCaps = map[string]tailcfg.NodeCapability{
+	"taildrop": tailcfg.CapabilityFileSharing,
+	"ssh":      tailcfg.CapabilitySSH,
+}
+
+// SetFeatureDisabled disables the named feature, "taildrop" or "ssh",
+// throughout the tailnet, as a tailnet admin could in the tailnet policy, by
+// leaving the node capability that enables it out of the MapResponses sent to
+// nodes. Nodes are sent the change immediately.
+func (s *Server) SetFeatureDisabled(feature string) {
+	s.setFeatureDisabled(feature, true)
+}
+
+// SetFeatureEnabled undoes SetFeatureDisabled for the named feature.
+func (s *Server) SetFeatureEnabled(feature string) {
+	s.setFeatureDisabled(feature, false)
+}
+
+func (s *Server) setFeatureDisabled(feature string, disabled bool) {
+	if _, ok := featureCaps[feature]; !ok {
+		panic(fmt.Sprintf("testcontrol: unknown feature %q", feature))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if disabled {
+		mak.Set(&s.disabledFeatures, feature, struct{}{})
+	} else {
+		s.disabledFeatures.Delete(feature)
+	}
+	s.updateLocked("setFeatureDisabled", s.nodeIDsLocked(0))
+}
+
+// SetNodeFeatureDisabled is like SetFeatureDisabled, but disables the named
+// feature for just the node with the given key, as a tailnet admin could by
+// changing which nodes the tailnet policy grants it to.
+func (s *Server) SetNodeFeatureDisabled(nodeKey key.NodePublic, feature string) {
+	s.setNodeFeatureDisabled(nodeKey, feature, true)
+}
+
+// SetNodeFeatureEnabled undoes SetNodeFeatureDisabled for the named feature
+// and node. It doesn't undo SetFeatureDisabled.
+func (s *Server) SetNodeFeatureEnabled(nodeKey key.NodePublic, feature string) {
+	s.setNodeFeatureDisabled(nodeKey, feature, false)
+}
+
+func (s *Server) setNodeFeatureDisabled(nodeKey key.NodePublic, feature string, disabled bool) {
+	if _, ok := featureCaps[feature]; !ok {
+		panic(fmt.Sprintf("testcontrol: unknown feature %q", feature))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if disabled {
+		if s.nodeDisabledFeatures[nodeKey] == nil {
+			mak.Set(&s.nodeDisabledFeatures, nodeKey, make(set.Set[string]))
+		}
+		s.nodeDisabledFeatures[nodeKey].Add(feature)
+	} else {
+		s.nodeDisabledFeatures[nodeKey].Delete(feature)
+	}
+	s.updateLocked("setNodeFeatureDisabled", s.nodeIDsLocked(0))
+}
+
+// SetCaptivePortal sets whether the server's /generate_204 connectivity check
+// is intercepted as if by a captive portal, returning a login page instead of
+// 204 No Content.
+func (s *Server) SetCaptivePortal(captive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captivePortal = captive
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -533,6 +1028,20 @@ func (s *Server) serveMachine(w http.ResponseWriter, r *http.Request) {
 		panic("no peer machine public key in context")
 	}
 
+	if d := s.nextResponseJitter(); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if code := s.nextEndpointFault(strings.TrimPrefix(r.URL.Path, "/machine/")); code != 0 {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, "testcontrol: injected fault", code)
+		return
+	}
+
 	switch r.URL.Path {
 	case "/machine/map":
 		s.serveMap(w, r, mkey)
@@ -632,7 +1141,190 @@ func (s *Server) certDomainsLocked(node *tailcfg.Node) []string {
 		ret = append(ret, s.DNSConfig.CertDomains...)
 	}
 	if s.MagicDNSDomain != "" {
-		ret = append(ret, node.Hostinfo.Hostname()+"."+s.MagicDNSDomain)
+		ret = append(ret, nodeNameLabel(node.Name)+"."+s.MagicDNSDomain)
+	}
+	return ret
+}
+
+// AuthKeyOpts are the properties of an auth key added with
+// [Server.AddAuthKey].
+type AuthKeyOpts struct {
+	// Tags are the tags applied to nodes registering with the key.
+	Tags []string
+
+	// PreauthorizedRoutes are subnet routes that are approved without
+	// any admin action when a node registering with the key advertises
+	// them. Advertised routes not covered by one of these prefixes are
+	// left unapproved.
+	PreauthorizedRoutes []netip.Prefix
+
+	// Ephemeral is whether nodes registering with the key are ephemeral,
+	// as if they had requested it with RegisterRequest.Ephemeral. See
+	// Server.EphemeralNodeTimeout.
+	Ephemeral bool
+}
+
+// AddAuthKey adds an auth key that nodes may register with, in addition to
+// RequireAuthKey. Once any auth key has been added, registration requests
+// must present either RequireAuthKey or one of the added keys, unless
+// AllowMissingAuthKey is set.
+func (s *Server) AddAuthKey(authKey string, opts AuthKeyOpts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mak.Set(&s.authKeys, authKey, opts)
+}
+
+// validAuthKey reports whether req carries an auth key that the server
+// accepts, and returns the options of that key, if it was added with
+// AddAuthKey.
+func (s *Server) validAuthKey(req *tailcfg.RegisterRequest) (_ AuthKeyOpts, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RequireAuthKey == "" && len(s.authKeys) == 0 {
+		return AuthKeyOpts{}, true
+	}
+	if req.Auth == nil || req.Auth.AuthKey == "" {
+		return AuthKeyOpts{}, false
+	}
+	if opts, ok := s.authKeys[req.Auth.AuthKey]; ok {
+		return opts, true
+	}
+	return AuthKeyOpts{}, req.Auth.AuthKey == s.RequireAuthKey
+}
+
+// DefaultEphemeralNodeTimeout is the default value of
+// Server.EphemeralNodeTimeout.
+const DefaultEphemeralNodeTimeout = 5 * time.Second
+
+// ephemeralNode is the state of an ephemeral node.
+type ephemeralNode struct {
+	inMapRequest int         // number of map requests in progress
+	idleSince    time.Time   // when inMapRequest last dropped to zero
+	deleteTimer  *time.Timer // if non-nil, deletes the node once it's idle long enough
+}
+
+// Close stops the timers that delete idle ephemeral nodes. It doesn't close
+// HTTPTestServer, which the caller owns.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, en := range s.ephemeralNodes {
+		if en.deleteTimer != nil {
+			en.deleteTimer.Stop()
+		}
+	}
+}
+
+// startEphemeralMapRequest records that a map request from the node with the
+// given ID is in progress, if it's ephemeral, and reports whether it is.
+func (s *Server) startEphemeralMapRequest(nodeID tailcfg.NodeID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	en, ok := s.ephemeralNodes[nodeID]
+	if ok {
+		en.inMapRequest++
+		if en.deleteTimer != nil {
+			en.deleteTimer.Stop()
+			en.deleteTimer = nil
+		}
+	}
+	return ok
+}
+
+// endEphemeralMapRequest records that a map request started with
+// startEphemeralMapRequest is done, and deletes the node once it's gone
+// without one for s.EphemeralNodeTimeout.
+func (s *Server) endEphemeralMapRequest(nodeID tailcfg.NodeID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	en, ok := s.ephemeralNodes[nodeID]
+	if !ok || s.closed {
+		return
+	}
+	if en.inMapRequest--; en.inMapRequest > 0 {
+		return
+	}
+	en.idleSince = time.Now()
+	timeout := cmp.Or(s.EphemeralNodeTimeout, DefaultEphemeralNodeTimeout)
+	if en.deleteTimer != nil {
+		en.deleteTimer.Stop()
+	}
+	en.deleteTimer = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		en, ok := s.ephemeralNodes[nodeID]
+		if s.closed || !ok || en.inMapRequest > 0 || time.Since(en.idleSince) < timeout {
+			// Closed, deleted already, back online, or offline again
+			// more recently, in which case a later timer handles it.
+			return
+		}
+		s.deleteNodeLocked(nodeID)
+	})
+}
+
+// deleteNodeLocked deletes the node with the given ID, if any, and tells
+// the other nodes that it's gone.
+//
+// s.mu must be held.
+func (s *Server) deleteNodeLocked(nodeID tailcfg.NodeID) {
+	for nk, n := range s.nodes {
+		if n.ID != nodeID {
+			continue
+		}
+		s.logf("testcontrol: deleting node %v (%v)", nodeID, nk.ShortString())
+		delete(s.nodes, nk)
+		delete(s.users, nk)
+		delete(s.logins, nk)
+		delete(s.updates, nodeID)
+		delete(s.ephemeralNodes, nodeID)
+		delete(s.sessionStart, nodeID)
+		s.loggedOutRemotely.Delete(nodeID)
+
+		// Forget the node's per-key settings, so that a node registering
+		// later with the same key, such as a restarted ephemeral node
+		// with persisted state, starts afresh.
+		delete(s.nodeSubnetRoutes, nk)
+		delete(s.nodePrimaryRoutes, nk)
+		s.exitNodeApproved.Delete(nk)
+		delete(s.peerIsJailed, nk)
+		for _, m := range s.peerIsJailed {
+			delete(m, nk)
+		}
+		delete(s.masquerades, nk)
+		for _, m := range s.masquerades {
+			delete(m, nk)
+		}
+		delete(s.nodeCapVersions, nk)
+		delete(s.nodeCapMaps, nk)
+		delete(s.nodeSelfCapMaps, nk)
+		s.derpOnly.Delete(nk)
+		delete(s.loggedOut, nk)
+		delete(s.nodeDebugFlags, nk)
+		delete(s.sshHostKeys, nk)
+		delete(s.homeDERP, nk)
+		delete(s.nodeDisabledFeatures, nk)
+		s.suppressAutoMapResponses.Delete(nk)
+		s.nodeKeyAuthed.Delete(nk)
+		delete(s.msgToSend, nk)
+
+		s.deletedNodes++
+		s.updateLocked("deleteNode", s.nodeIDsLocked(0))
+		return
+	}
+}
+
+// preauthorizedRoutes returns the routes in advertised that are covered
+// by one of the prefixes in preauthorized.
+func preauthorizedRoutes(advertised, preauthorized []netip.Prefix) []netip.Prefix {
+	var ret []netip.Prefix
+	for _, r := range advertised {
+		for _, p := range preauthorized {
+			if p.Bits() <= r.Bits() && p.Contains(r.Addr()) {
+				ret = append(ret, r)
+				break
+			}
+		}
 	}
 	return ret
 }
@@ -643,16 +1335,138 @@ func (s *Server) SetSubnetRoutes(nodeKey key.NodePublic, routes []netip.Prefix)
 	defer s.mu.Unlock()
 	s.logf("Setting subnet routes for %s: %v", nodeKey.ShortString(), routes)
 	mak.Set(&s.nodeSubnetRoutes, nodeKey, routes)
-	if node, ok := s.nodes[nodeKey]; ok {
-		sendUpdate(s.updates[node.ID], updateSelfChanged)
-		// Also notify all other peers so they get the updated AllowedIPs
-		// in their next MapResponse.
-		for _, n := range s.nodes {
-			if n.ID != node.ID {
-				sendUpdate(s.updates[n.ID], updatePeerChanged)
+	s.notifyRoutesChangedLocked(nodeKey)
+}
+
+// SetPrimaryRoutes sets which subnet routes nodeKey is the primary router
+// for, modeling high-availability subnet routing where several nodes
+// advertise the same routes but only the primary for each route has it
+// in its AllowedIPs. A nil or empty routes marks the node as a standby
+// router for all of its routes.
+//
+// Routes are not required to have been set with [Server.SetSubnetRoutes].
+// Until SetPrimaryRoutes is called for a node, it's considered primary for
+// all of the routes set by SetSubnetRoutes.
+func (s *Server) SetPrimaryRoutes(nodeKey key.NodePublic, routes []netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logf("Setting primary routes for %s: %v", nodeKey.ShortString(), routes)
+	mak.Set(&s.nodePrimaryRoutes, nodeKey, routes)
+	s.notifyRoutesChangedLocked(nodeKey)
+}
+
+// SetExitNodeApproved sets whether the node with the given node key is
+// approved to be an exit node, as an admin would do separately from
+// approving its subnet routes. While it's approved, the exit routes it
+// advertises in its Hostinfo.RoutableIPs (as with "tailscale up
+// --advertise-exit-node") are in its AllowedIPs, so that its peers can use
+// it as an exit node. Nodes are sent the change immediately.
+//
+// Exit routes set with [Server.SetSubnetRoutes] are in the node's AllowedIPs
+// regardless.
+func (s *Server) SetExitNodeApproved(nodeKey key.NodePublic, approved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logf("Setting exit node approval for %s: %v", nodeKey.ShortString(), approved)
+	if approved {
+		mak.Set(&s.exitNodeApproved, nodeKey, struct{}{})
+	} else {
+		s.exitNodeApproved.Delete(nodeKey)
+	}
+	s.notifyRoutesChangedLocked(nodeKey)
+}
+
+// SetStandbyRoutesInAllowedIPs sets whether the AllowedIPs of a node's peers
+// include all of the subnet routes set with [Server.SetSubnetRoutes], rather
+// than just those they're the primary router for. With it on, nodes see
+// several peers with the same route in their AllowedIPs, and have to use
+// their PrimaryRoutes to choose between them. Nodes are sent the change
+// immediately.
+func (s *Server) SetStandbyRoutesInAllowedIPs(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.standbyRoutesInAllowedIPs = on
+	s.updateLocked("SetStandbyRoutesInAllowedIPs", s.nodeIDsLocked(0))
+}
+
+// allowedRoutesLocked returns the routes to include in nodeKey's AllowedIPs.
+// s.mu must be held.
+func (s *Server) allowedRoutesLocked(nodeKey key.NodePublic) []netip.Prefix {
+	primary := s.primaryRoutesLocked(nodeKey)
+	routes := slices.Clone(primary)
+	if s.standbyRoutesInAllowedIPs {
+		routes = slices.Clone(s.nodeSubnetRoutes[nodeKey])
+		for _, r := range primary {
+			if !slices.Contains(routes, r) {
+				routes = append(routes, r)
 			}
 		}
 	}
+	for _, r := range s.approvedExitRoutesLocked(nodeKey) {
+		if !slices.Contains(routes, r) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// approvedExitRoutesLocked returns the exit routes that nodeKey advertises,
+// if it's approved to be an exit node. s.mu must be held.
+func (s *Server) approvedExitRoutesLocked(nodeKey key.NodePublic) []netip.Prefix {
+	node, ok := s.nodes[nodeKey]
+	if !ok || !s.exitNodeApproved.Contains(nodeKey) || !node.Hostinfo.Valid() {
+		return nil
+	}
+	var routes []netip.Prefix
+	for _, r := range node.Hostinfo.RoutableIPs().All() {
+		if tsaddr.IsExitRoute(r) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// primaryRoutesLocked returns the routes that nodeKey is the primary
+// router for. s.mu must be held.
+func (s *Server) primaryRoutesLocked(nodeKey key.NodePublic) []netip.Prefix {
+	if routes, ok := s.nodePrimaryRoutes[nodeKey]; ok {
+		return routes
+	}
+	return s.nodeSubnetRoutes[nodeKey]
+}
+
+// notifyRoutesChangedLocked wakes up the map polls of nodeKey and all of
+// its peers after a change to nodeKey's routes or addresses. s.mu must be
+// held.
+func (s *Server) notifyRoutesChangedLocked(nodeKey key.NodePublic) {
+	node, ok := s.nodes[nodeKey]
+	if !ok {
+		return
+	}
+	sendUpdate(s.updates[node.ID], updateSelfChanged)
+	// Also notify all other peers so they get the updated AllowedIPs
+	// in their next MapResponse.
+	for _, n := range s.nodes {
+		if n.ID != node.ID {
+			sendUpdate(s.updates[n.ID], updatePeerChanged)
+		}
+	}
+}
+
+// SetNodeAddresses reassigns the tailnet addresses of the node with the given
+// node key, as if an admin had changed its IP. The node and its peers are sent
+// the change immediately, in their next incremental MapResponses.
+func (s *Server) SetNodeAddresses(nodeKey key.NodePublic, addrs []netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.nodes[nodeKey]
+	if !ok {
+		return
+	}
+	s.logf("Setting addresses for %s: %v", nodeKey.ShortString(), addrs)
+	node.Addresses = slices.Clone(addrs)
+	node.AllowedIPs = slices.Clone(addrs)
+	s.notifyRoutesChangedLocked(nodeKey)
 }
 
 // MasqueradePair is a pair of nodes and the IP address that the
@@ -690,36 +1504,525 @@ func (s *Server) SetMasqueradeAddresses(pairs []MasqueradePair) {
 		if m[p.Node] == nil {
 			m[p.Node] = make(map[key.NodePublic]netip.Addr)
 		}
-		m[p.Node][p.Peer] = p.NodeMasqueradesAs
+		m[p.Node][p.Peer] = p.NodeMasqueradesAs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.masquerades = m
+	s.updateLocked("SetMasqueradeAddresses", s.nodeIDsLocked(0))
+}
+
+// SetCapabilityVersion overrides the capability version that the server
+// believes nodeKey supports, making the server withhold features from or
+// deliver features to the node as it would for a client of that version.
+// A zero cv removes the override, reverting to the version the node reports
+// in its requests.
+//
+// It only affects which features the server sends, not how it interprets
+// the node's requests.
+func (s *Server) SetCapabilityVersion(nodeKey key.NodePublic, cv tailcfg.CapabilityVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cv == 0 {
+		delete(s.nodeCapVersions, nodeKey)
+	} else {
+		mak.Set(&s.nodeCapVersions, nodeKey, cv)
+	}
+	if node, ok := s.nodes[nodeKey]; ok {
+		sendUpdate(s.updates[node.ID], updateSelfChanged)
+	}
+}
+
+// SetResponseJitter makes the server wait for a random duration in [min, max]
+// before handling each Noise-protected control request (register, map, etc.),
+// to simulate the variable latency of a real control server. The delays are
+// drawn from a random source seeded with s.ResponseJitterSeed, so a given
+// seed yields the same sequence of delays. A zero max disables the jitter.
+func (s *Server) SetResponseJitter(min, max time.Duration) {
+	if max < min {
+		panic("testcontrol: SetResponseJitter max < min")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jitterMin, s.jitterMax = min, max
+	if max == 0 {
+		s.jitterRand = nil
+		return
+	}
+	s.jitterRand = rand.New(rand.NewPCG(s.ResponseJitterSeed, s.ResponseJitterSeed))
+}
+
+// nextResponseJitter returns how long to delay the next control request,
+// per SetResponseJitter.
+func (s *Server) nextResponseJitter() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jitterRand == nil {
+		return 0
+	}
+	return s.jitterMin + time.Duration(s.jitterRand.Int64N(int64(s.jitterMax-s.jitterMin)+1))
+}
+
+// FaultSpec describes the faults injected into requests to a control
+// endpoint. See SetEndpointFaults.
+type FaultSpec struct {
+	// Probability is the chance, from 0 to 1, that a request to the
+	// endpoint fails.
+	Probability float64
+
+	// StatusCode is the HTTP status code with which failed requests are
+	// answered, such as http.StatusInternalServerError.
+	StatusCode int
+}
+
+// SetEndpointFaults makes requests to the given Noise-protected control
+// endpoints fail at random, to test how clients retry and back off. The
+// faults map is keyed by the endpoint's path below /machine/, such as "map",
+// "register", "set-dns" or "update-health". Whether each request fails is
+// drawn from a random source seeded with s.EndpointFaultSeed, so a given seed
+// yields the same sequence of failures. An empty map disables the faults.
+func (s *Server) SetEndpointFaults(faults map[string]FaultSpec) {
+	for endpoint, f := range faults {
+		if f.Probability < 0 || f.Probability > 1 || f.StatusCode < 100 || f.StatusCode > 599 {
+			panic(fmt.Sprintf("testcontrol: invalid FaultSpec %+v for %q", f, endpoint))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpointFaults = maps.Clone(faults)
+	if len(faults) == 0 {
+		s.faultRand = nil
+		return
+	}
+	s.faultRand = rand.New(rand.NewPCG(s.EndpointFaultSeed, s.EndpointFaultSeed))
+}
+
+// InjectedFaults returns how many requests to the given endpoint have failed
+// because of the faults configured by SetEndpointFaults.
+func (s *Server) InjectedFaults(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faultsInjected[endpoint]
+}
+
+// nextEndpointFault returns the HTTP status code with which to fail the
+// current request to endpoint, per SetEndpointFaults, or zero if it shouldn't
+// fail.
+func (s *Server) nextEndpointFault(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.faultRand == nil {
+		return 0
+	}
+	f, ok := s.endpointFaults[endpoint]
+	if !ok || s.faultRand.Float64() >= f.Probability {
+		return 0
+	}
+	mak.Set(&s.faultsInjected, endpoint, s.faultsInjected[endpoint]+1)
+	return f.StatusCode
+}
+
+// SetDERPMap sets the DERPMap sent to nodes and sends it to all connected
+// nodes. Unlike a nil DERPMap, which means to use the prod DERP map, a
+// DERPMap with no regions leaves nodes without any DERP servers.
+func (s *Server) SetDERPMap(dm *tailcfg.DERPMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DERPMap = dm
+	s.updateLocked("SetDERPMap", s.nodeIDsLocked(0))
+}
+
+// SetDERPRegionNoHome sets the [tailcfg.DERPRegion.NoMeasureNoHome] flag of
+// the DERP region regionID in the DERPMap sent to nodes, which tells them not
+// to measure the region or use it as their home, though they may still use it
+// to reach peers whose home it is. It panics if the DERPMap has no such
+// region.
+func (s *Server) SetDERPRegionNoHome(regionID int, noHome bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dm := s.cloneDERPMapWithRegionLocked(regionID)
+	dm.Regions[regionID].NoMeasureNoHome = noHome
+	s.DERPMap = dm
+	s.updateLocked("SetDERPRegionNoHome", s.nodeIDsLocked(0))
+}
+
+// SetDERPRegionScore sets the score of the DERP region regionID in the
+// DERPMap's [tailcfg.DERPHomeParams]. Nodes multiply the region's measured
+// latency by the score when choosing their home region, so it effectively
+// sets the region's latency relative to others. A zero score removes it. It
+// panics if the DERPMap has no such region.
+func (s *Server) SetDERPRegionScore(regionID int, score float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dm := s.cloneDERPMapWithRegionLocked(regionID)
+	if dm.HomeParams == nil {
+		dm.HomeParams = new(tailcfg.DERPHomeParams)
+	}
+	if score == 0 {
+		delete(dm.HomeParams.RegionScore, regionID)
+	} else {
+		mak.Set(&dm.HomeParams.RegionScore, regionID, score)
+	}
+	s.DERPMap = dm
+	s.updateLocked("SetDERPRegionScore", s.nodeIDsLocked(0))
+}
+
+// cloneDERPMapWithRegionLocked returns a clone of s.DERPMap, which the caller
+// may modify, after checking that it has the DERP region regionID.
+//
+// s.mu must be held.
+func (s *Server) cloneDERPMapWithRegionLocked(regionID int) *tailcfg.DERPMap {
+	if s.DERPMap == nil || s.DERPMap.Regions[regionID] == nil {
+		panic(fmt.Sprintf("testcontrol: no DERP region %d in DERPMap", regionID))
+	}
+	return s.DERPMap.Clone()
+}
+
+// SetHomeDERP forces the node with the given node key to use the DERP region
+// regionID as its home region, by marking all other regions in the DERPMap
+// sent to it as [tailcfg.DERPRegion.NoMeasureNoHome]. The node can still
+// connect to the other regions to reach peers homed there. A zero regionID
+// removes the override.
+func (s *Server) SetHomeDERP(nodeKey key.NodePublic, regionID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if regionID == 0 {
+		delete(s.homeDERP, nodeKey)
+	} else {
+		mak.Set(&s.homeDERP, nodeKey, regionID)
+	}
+	if node, ok := s.nodes[nodeKey]; ok {
+		sendUpdate(s.updates[node.ID], updateSelfChanged)
+	}
+}
+
+// derpMapFor returns the DERPMap to send to the node with the given key.
+func (s *Server) derpMapFor(nodeKey key.NodePublic) *tailcfg.DERPMap {
+	s.mu.Lock()
+	dm := s.DERPMap
+	home, ok := s.homeDERP[nodeKey]
+	s.mu.Unlock()
+	if !ok || dm == nil {
+		return dm
+	}
+	dm = dm.Clone()
+	for id, r := range dm.Regions {
+		if id != home {
+			r.NoMeasureNoHome = true
+		}
+	}
+	return dm
+}
+
+// MinimumClientVersionMessageID is the ID of the display message sent to
+// nodes running a client older than the version set with
+// SetMinimumClientVersion.
+const MinimumClientVersionMessageID tailcfg.DisplayMessageID = "testcontrol-min-client-version"
+
+// SetMinimumClientVersion sets the minimum client version (e.g. "1.80.0")
+// that nodes must run. Nodes reporting an older version in their Hostinfo are
+// sent a high severity display message telling them to update, which they
+// surface as a health warning. Setting a lower version or the empty string
+// clears the warning from nodes that now satisfy it.
+//
+// It doesn't prevent outdated nodes from connecting.
+func (s *Server) SetMinimumClientVersion(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minClientVersion = v
+	s.minClientVersionSet = true
+	s.updateLocked("SetMinimumClientVersion", s.nodeIDsLocked(0))
+}
+
+// minClientVersionMessages returns the DisplayMessages to send to a node
+// running client version v, or nil if the minimum version was never set.
+func (s *Server) minClientVersionMessages(v string) map[tailcfg.DisplayMessageID]*tailcfg.DisplayMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.minClientVersionSet {
+		return nil
+	}
+	min := s.minClientVersion
+	if min == "" || cmpver.Compare(v, min) >= 0 {
+		return map[tailcfg.DisplayMessageID]*tailcfg.DisplayMessage{
+			MinimumClientVersionMessageID: nil,
+		}
+	}
+	return map[tailcfg.DisplayMessageID]*tailcfg.DisplayMessage{
+		MinimumClientVersionMessageID: {
+			Title:    "Update required",
+			Text:     fmt.Sprintf("Tailscale %s is no longer supported by this tailnet. Update to version %s or later.", v, min),
+			Severity: tailcfg.SeverityHigh,
+		},
+	}
+}
+
+// SetDisplayMessage sets the display message with the given ID that's sent to
+// all nodes, which they surface as a health warning with the message's
+// severity and primary action, if any. A nil msg clears the message.
+func (s *Server) SetDisplayMessage(id tailcfg.DisplayMessageID, msg *tailcfg.DisplayMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg != nil {
+		msg = new(*msg)
+	}
+	mak.Set(&s.displayMessages, id, msg)
+	s.updateLocked("SetDisplayMessage", s.nodeIDsLocked(0))
+}
+
+// SetControlTimeOffset makes the server send the current time plus d as the
+// ControlTime of its MapResponses, instead of a fixed date in the past. As
+// nodes only learn control's time from ControlTime, this simulates nodes whose
+// clocks are skewed by -d: a negative d for clocks running ahead, a positive
+// one for clocks running behind.
+func (s *Server) SetControlTimeOffset(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controlTimeOffset = d
+	s.controlTimeOffsetSet = true
+	s.updateLocked("SetControlTimeOffset", s.nodeIDsLocked(0))
+}
+
+// controlTimeLocked returns the time to send as MapResponse.ControlTime.
+//
+// s.mu must be held.
+func (s *Server) controlTimeLocked() time.Time {
+	if !s.controlTimeOffsetSet {
+		return time.Date(2020, 8, 3, 0, 0, 0, 1, time.UTC)
+	}
+	return time.Now().Add(s.controlTimeOffset)
+}
+
+// capVersionLocked returns the capability version that the server considers
+// nodeKey to support. s.mu must be held.
+func (s *Server) capVersionLocked(nodeKey key.NodePublic) tailcfg.CapabilityVersion {
+	if cv, ok := s.nodeCapVersions[nodeKey]; ok {
+		return cv
+	}
+	if node, ok := s.nodes[nodeKey]; ok {
+		return node.Cap
+	}
+	return 0
+}
+
+// SetNodeCapMap overrides the capability map the specified client receives.
+func (s *Server) SetNodeCapMap(nodeKey key.NodePublic, capMap tailcfg.NodeCapMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mak.Set(&s.nodeCapMaps, nodeKey, capMap)
+	s.updateLocked("SetNodeCapMap", s.nodeIDsLocked(0))
+}
+
+// SetNodeSelfCapMap sets capabilities that the specified client receives in
+// its own CapMap, in addition to those set with SetNodeCapMap, without its
+// peers seeing them, like node attributes that only concern the node itself.
+// A capability in both maps is sent with the values from capMap. A nil capMap
+// removes the self-only capabilities.
+func (s *Server) SetNodeSelfCapMap(nodeKey key.NodePublic, capMap tailcfg.NodeCapMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if capMap == nil {
+		delete(s.nodeSelfCapMaps, nodeKey)
+	} else {
+		mak.Set(&s.nodeSelfCapMaps, nodeKey, maps.Clone(capMap))
+	}
+	s.updateLocked("SetNodeSelfCapMap", s.nodeIDsLocked(0))
+}
+
+// SetDebugFlags sets the debug flags that the node with the given key is sent
+// as node attributes (tailcfg.Node.Capabilities) in its MapResponses, turning
+// on control-driven debug behaviors such as "debug-always-stun". The flags
+// replace any set by a previous call; a nil or empty flags clears them. Nodes
+// are sent the change immediately.
+func (s *Server) SetDebugFlags(nodeKey key.NodePublic, flags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(flags) == 0 {
+		delete(s.nodeDebugFlags, nodeKey)
+	} else {
+		caps := make([]tailcfg.NodeCapability, len(flags))
+		for i, f := range flags {
+			caps[i] = tailcfg.NodeCapability(f)
+		}
+		mak.Set(&s.nodeDebugFlags, nodeKey, caps)
+	}
+	s.updateLocked("SetDebugFlags", s.nodeIDsLocked(0))
+}
+
+// SetSSHHostKeys overrides the SSH host keys that the node with the given key
+// is advertised as having, in both its own and its peers' MapResponses. Peers
+// use these keys to verify the node when connecting to it with Tailscale SSH.
+//
+// A nil keys slice removes the override, so that the keys the node reports in
+// its Hostinfo are sent instead.
+func (s *Server) SetSSHHostKeys(nodeKey key.NodePublic, keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keys == nil {
+		delete(s.sshHostKeys, nodeKey)
+	} else {
+		mak.Set(&s.sshHostKeys, nodeKey, slices.Clone(keys))
+	}
+	s.updateLocked("SetSSHHostKeys", s.nodeIDsLocked(0))
+}
+
+// applySSHHostKeysLocked replaces n's advertised SSH host keys with those
+// set by SetSSHHostKeys, if any.
+//
+// s.mu must be held.
+func (s *Server) applySSHHostKeysLocked(n *tailcfg.Node) {
+	keys, ok := s.sshHostKeys[n.Key]
+	if !ok {
+		return
+	}
+	hi := n.Hostinfo.AsStruct()
+	if hi == nil {
+		hi = new(tailcfg.Hostinfo)
+	}
+	hi.SSH_HostKeys = slices.Clone(keys)
+	n.Hostinfo = hi.View()
+}
+
+// SetGlobalAppCaps configures global app capabilities. This is equivalent to
+//
+//	"grants": [
+//	   {
+//	     "src": ["*"],
+//	     "dst": ["*"],
+//	     "app": <contents of the input map>
+//	   }
+//	]
+func (s *Server) SetGlobalAppCaps(appCaps tailcfg.PeerCapMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.globalAppCaps = appCaps
+	s.updateLocked("SetGlobalAppCaps", s.nodeIDsLocked(0))
+}
+
+// SetPacketFilter sets the packet filter rules sent to all nodes in
+// MapResponses, in place of the default ones, which allow all traffic. Global
+// app capabilities (see SetGlobalAppCaps) are still appended to them. A nil
+// rules restores the default, and an empty one blocks all traffic.
+//
+// Tags (e.g. "tag:foo") may be used in place of addresses in the rules'
+// SrcIPs and DstPorts, as in a tailnet policy. They're expanded to the
+// addresses of the nodes with the tag when sent, so the filters follow tag
+// changes (see SetNodeTags).
+func (s *Server) SetPacketFilter(rules []tailcfg.FilterRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetFilter = slices.Clone(rules)
+	s.updateLocked("SetPacketFilter", s.nodeIDsLocked(0))
+}
+
+// expandFilterTagsLocked returns a copy of rules with the tags in their
+// SrcIPs and DstPorts replaced by the addresses of the nodes with those tags.
+// A tag that no node has matches nothing, and rules left matching nothing are
+// dropped.
+//
+// s.mu must be held.
+func (s *Server) expandFilterTagsLocked(rules []tailcfg.FilterRule) []tailcfg.FilterRule {
+	tagged := map[string][]string{}
+	for _, n := range s.nodes {
+		for _, tag := range n.Tags {
+			for _, a := range n.Addresses {
+				tagged[tag] = append(tagged[tag], a.Addr().String())
+			}
+		}
+	}
+	for _, addrs := range tagged {
+		slices.Sort(addrs)
+	}
+	var ret []tailcfg.FilterRule
+	for _, r := range rules {
+		var srcs []string
+		for _, src := range r.SrcIPs {
+			if strings.HasPrefix(src, "tag:") {
+				srcs = append(srcs, tagged[src]...)
+			} else {
+				srcs = append(srcs, src)
+			}
+		}
+		var dsts []tailcfg.NetPortRange
+		for _, dst := range r.DstPorts {
+			if !strings.HasPrefix(dst.IP, "tag:") {
+				dsts = append(dsts, dst)
+				continue
+			}
+			for _, a := range tagged[dst.IP] {
+				d := dst
+				d.IP = a
+				dsts = append(dsts, d)
+			}
+		}
+		if len(srcs) == 0 && len(r.SrcIPs) > 0 || len(dsts) == 0 && len(r.DstPorts) > 0 {
+			continue
+		}
+		r.SrcIPs = srcs
+		r.DstPorts = dsts
+		ret = append(ret, r)
 	}
+	return ret
+}
+
+// SetDomain sets the name of the tailnet, as sent to clients in
+// MapResponse.Domain. Users created afterwards get login names in that
+// domain. The default is "fake-control.example.net".
+func (s *Server) SetDomain(name string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.masquerades = m
-	s.updateLocked("SetMasqueradeAddresses", s.nodeIDsLocked(0))
+	s.tailnetDomain = name
+	s.updateLocked("SetDomain", s.nodeIDsLocked(0))
 }
 
-// SetNodeCapMap overrides the capability map the specified client receives.
-func (s *Server) SetNodeCapMap(nodeKey key.NodePublic, capMap tailcfg.NodeCapMap) {
+// domainLocked returns the name of the tailnet. s.mu must be held.
+func (s *Server) domainLocked() string {
+	return cmp.Or(s.tailnetDomain, domain)
+}
+
+// SetTailnetDisplayName sets the admin-editable display name of the tailnet,
+// as sent to clients in the [tailcfg.NodeAttrTailnetDisplayName] node
+// capability. An empty name removes the capability.
+func (s *Server) SetTailnetDisplayName(name string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	mak.Set(&s.nodeCapMaps, nodeKey, capMap)
-	s.updateLocked("SetNodeCapMap", s.nodeIDsLocked(0))
+	s.tailnetDisplayName = name
+	s.updateLocked("SetTailnetDisplayName", s.nodeIDsLocked(0))
 }
 
-// SetGlobalAppCaps configures global app capabilities. This is equivalent to
-//
-//	"grants": [
-//	   {
-//	     "src": ["*"],
-//	     "dst": ["*"],
-//	     "app": <contents of the input map>
-//	   }
-//	]
-func (s *Server) SetGlobalAppCaps(appCaps tailcfg.PeerCapMap) {
+// SetMagicDNSSuffix changes MagicDNSDomain to suffix, renaming all existing
+// nodes to match and replacing the old suffix with the new one in the search
+// domains of the DNS config sent to clients. A DNS config with MagicDNS
+// enabled is created if there was none.
+func (s *Server) SetMagicDNSSuffix(suffix string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.globalAppCaps = appCaps
-	s.updateLocked("SetGlobalAppCaps", s.nodeIDsLocked(0))
+	old := s.MagicDNSDomain
+	s.MagicDNSDomain = suffix
+	for _, n := range s.nodes {
+		if label := nodeNameLabel(n.Name); label != "" {
+			n.Name = label + "." + suffix + "."
+		}
+	}
+	if s.DNSConfig == nil {
+		s.DNSConfig = &tailcfg.DNSConfig{Proxied: true}
+	}
+	if old != "" {
+		s.DNSConfig.Domains = slices.DeleteFunc(s.DNSConfig.Domains, func(d string) bool { return d == old })
+	}
+	if !slices.Contains(s.DNSConfig.Domains, suffix) {
+		s.DNSConfig.Domains = append(s.DNSConfig.Domains, suffix)
+	}
+	s.updateLocked("SetMagicDNSSuffix", s.nodeIDsLocked(0))
+}
+
+// SetDNSConfig replaces the DNS config sent to clients with a copy of cfg. A
+// nil cfg means no DNS config.
+func (s *Server) SetDNSConfig(cfg *tailcfg.DNSConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DNSConfig = cfg.Clone()
+	s.updateLocked("SetDNSConfig", s.nodeIDsLocked(0))
 }
 
 // AddDNSRecords adds records to the server's DNS config.
@@ -753,6 +2056,19 @@ func (s *Server) Node(nodeKey key.NodePublic) *tailcfg.Node {
 	return s.nodeLocked(nodeKey)
 }
 
+// NodeHostinfo returns the Hostinfo most recently reported by the node with
+// the given key, or nil if there's no such node or it hasn't reported one.
+// It's always nil or cloned memory.
+func (s *Server) NodeHostinfo(nodeKey key.NodePublic) *tailcfg.Hostinfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodes[nodeKey]
+	if n == nil {
+		return nil
+	}
+	return n.Hostinfo.AsStruct()
+}
+
 // nodeLocked returns the node for nodeKey. It's always nil or cloned memory.
 //
 // s.mu must be held.
@@ -788,6 +2104,81 @@ func (s *Server) AddFakeNode() {
 	// TODO: send updates to other (non-fake?) nodes
 }
 
+// SeedNodes registers n stub nodes, without running clients, as if they had
+// registered normally. It's meant for tests of large netmaps, to avoid the
+// cost of registering that many real nodes.
+//
+// If visible is false, the nodes are registered as awaiting device approval,
+// which keeps them out of other nodes' netmaps (see SetMachineAuthorized).
+//
+// It returns the node keys of the new nodes.
+func (s *Server) SeedNodes(n int, visible bool) []key.NodePublic {
+	return s.seedNodes("SeedNodes", "seed", n, visible, false)
+}
+
+// AddSyntheticPeers is like SeedNodes, but the new nodes are always visible
+// and look like live peers: they have WireGuard endpoints (in the 198.18.0.0/15
+// benchmarking range, so nothing answers) and a recent LastSeen time. The new
+// peers are sent to all running nodes immediately. It's meant for
+// benchmarking and regression testing how clients handle netmaps from large
+// tailnets.
+//
+// It returns the node keys of the new nodes.
+func (s *Server) AddSyntheticPeers(n int) []key.NodePublic {
+	return s.seedNodes("AddSyntheticPeers", "synthetic", n, true, true)
+}
+
+// seedNodes implements SeedNodes and AddSyntheticPeers, naming the new nodes
+// with the given hostname prefix. If live, the nodes are given endpoints and a
+// LastSeen time.
+func (s *Server) seedNodes(reason, hostPrefix string, n int, visible, live bool) []key.NodePublic {
+	keys := make([]key.NodePublic, 0, n)
+	for range n {
+		nk := key.NewNode().Public()
+		user, _ := s.getUser(nk)
+
+		s.mu.Lock()
+		nodeID := len(s.nodes) + s.deletedNodes + 1
+		v4Prefix := netip.PrefixFrom(netaddr.IPv4(100, 64, uint8(nodeID>>8), uint8(nodeID)), 32)
+		v6Prefix := netip.PrefixFrom(tsaddr.Tailscale4To6(v4Prefix.Addr()), 128)
+		allowedIPs := []netip.Prefix{v4Prefix, v6Prefix}
+		hostname := fmt.Sprintf("%s-%d", hostPrefix, nodeID)
+		name := hostname
+		if s.MagicDNSDomain != "" {
+			name = name + "." + s.MagicDNSDomain + "."
+		}
+		node := &tailcfg.Node{
+			ID:                tailcfg.NodeID(nodeID),
+			StableID:          tailcfg.StableNodeID(fmt.Sprintf("TESTCTRL%08x", nodeID)),
+			Name:              name,
+			User:              user.ID,
+			Key:               nk,
+			Machine:           key.NewMachine().Public(),
+			DiscoKey:          key.NewDisco().Public(),
+			MachineAuthorized: visible,
+			Addresses:         allowedIPs,
+			AllowedIPs:        allowedIPs,
+			Hostinfo:          (&tailcfg.Hostinfo{Hostname: hostname}).View(),
+			Cap:               tailcfg.CurrentCapabilityVersion,
+		}
+		if live {
+			node.Endpoints = []netip.AddrPort{
+				netip.AddrPortFrom(netaddr.IPv4(198, 18, uint8(nodeID>>8), uint8(nodeID)), 41641),
+				netip.AddrPortFrom(netaddr.IPv4(198, 19, uint8(nodeID>>8), uint8(nodeID)), 41641),
+			}
+			node.LastSeen = new(time.Now().Round(time.Second))
+		}
+		mak.Set(&s.nodes, nk, node)
+		s.mu.Unlock()
+		keys = append(keys, nk)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateLocked(reason, s.nodeIDsLocked(0))
+	return keys
+}
+
 func (s *Server) allUserProfiles() (res []tailcfg.UserProfile) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -837,7 +2228,7 @@ func (s *Server) getUser(nodeKey key.NodePublic) (*tailcfg.User, *tailcfg.Login)
 		id = 123
 	}
 	s.logf("Created user %v for node %s", id, nodeKey)
-	loginName := fmt.Sprintf("user-%d@%s", id, domain)
+	loginName := fmt.Sprintf("user-%d@%s", id, s.domainLocked())
 	displayName := fmt.Sprintf("User %d", id)
 	login := &tailcfg.Login{
 		ID:            tailcfg.LoginID(id),
@@ -855,6 +2246,25 @@ func (s *Server) getUser(nodeKey key.NodePublic) (*tailcfg.User, *tailcfg.Login)
 	return user, login
 }
 
+// SetNodeProfile sets the display name, login name and profile picture URL of
+// the user that the node with the given key is logged in as, and sends the new
+// profile to all nodes. The profile's ID is ignored; the user keeps its ID.
+func (s *Server) SetNodeProfile(nodeKey key.NodePublic, up tailcfg.UserProfile) {
+	s.getUser(nodeKey) // create the user if need be
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.users[nodeKey].Clone()
+	user.DisplayName = up.DisplayName
+	login := *s.logins[nodeKey]
+	login.LoginName = up.LoginName
+	login.DisplayName = up.DisplayName
+	login.ProfilePicURL = up.ProfilePicURL
+	s.users[nodeKey] = user
+	s.logins[nodeKey] = &login
+	s.updateLocked("SetNodeProfile", s.nodeIDsLocked(0))
+}
+
 // authPathDone returns a close-only struct that's closed when the
 // authPath ("/auth/XXXXXX") has authenticated.
 func (s *Server) authPathDone(authPath string) <-chan struct{} {
@@ -926,6 +2336,94 @@ func (s *Server) CompleteDeviceApproval(controlUrl string, urlStr string, nodeKe
 	return true
 }
 
+// SetMachineAuthorized sets whether the node with the given node key is
+// authorized to join the tailnet, as an admin would by approving or
+// revoking approval of a device when the tailnet requires device approval
+// (see RequireMachineAuth). Unauthorized nodes get no peers and aren't
+// included in other nodes' netmaps. The change is pushed to the node and its
+// peers on their next map poll.
+func (s *Server) SetMachineAuthorized(nodeKey key.NodePublic, authorized bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.nodes[nodeKey]
+	if !ok {
+		panic("SetMachineAuthorized: unknown node key")
+	}
+	node.MachineAuthorized = authorized
+	sendUpdate(s.updates[node.ID], updateSelfChanged)
+	s.updateLocked("SetMachineAuthorized", s.nodeIDsLocked(node.ID))
+}
+
+// supersedeSameMachineLocked handles the registration of a new node key nk
+// by a machine whose key mkey is already registered to a node that hasn't
+// logged out, as happens when a VM is cloned or a backup of a node's state
+// is restored onto another machine, and the copy registers anew. The later
+// registration supersedes the earlier one: the existing node, with its ID,
+// addresses and user, now belongs to nk, and the earlier node key is no
+// longer known, so map requests using it fail. This way at most one live node
+// exists per machine key, and peers never see two nodes claiming the same
+// identity.
+//
+// Registrations that rotate a node key (oldNodeKey is set) and registrations
+// after a logout aren't affected; the latter create new nodes.
+//
+// s.mu must be held.
+func (s *Server) supersedeSameMachineLocked(mkey key.MachinePublic, nk, oldNodeKey key.NodePublic) {
+	if _, ok := s.nodes[nk]; ok || !oldNodeKey.IsZero() {
+		return
+	}
+	for prevKey, n := range s.nodes {
+		if n.Machine != mkey || s.loggedOut[prevKey] {
+			continue
+		}
+		s.logf("node %v supersedes %v, which has the same machine key", nk.ShortString(), prevKey.ShortString())
+		n.Key = nk
+		s.nodes[nk] = n
+		delete(s.nodes, prevKey)
+		if u, ok := s.users[prevKey]; ok {
+			s.users[nk] = u
+			s.logins[nk] = s.logins[prevKey]
+			delete(s.users, prevKey)
+			delete(s.logins, prevKey)
+		}
+		s.updateLocked("supersedeSameMachine", s.nodeIDsLocked(0))
+		return
+	}
+}
+
+// uniqueNodeNameLocked returns the name, without the MagicDNS suffix, to give
+// a new node with the given hostname registering from machine mkey.
+//
+// Like the real control plane, it deduplicates names within the tailnet: if
+// another machine's node already has the name (ignoring case), it appends
+// "-1", "-2", and so on, using the first suffix that's not taken. Nodes from
+// mkey itself don't count, so a machine that registers again keeps its name.
+//
+// s.mu must be held.
+func (s *Server) uniqueNodeNameLocked(hostname string, mkey key.MachinePublic) string {
+	if hostname == "" {
+		return ""
+	}
+	taken := make(set.Set[string])
+	for _, n := range s.nodes {
+		if n.Machine != mkey {
+			taken.Add(strings.ToLower(nodeNameLabel(n.Name)))
+		}
+	}
+	name := hostname
+	for i := 1; taken.Contains(strings.ToLower(name)); i++ {
+		name = fmt.Sprintf("%s-%d", hostname, i)
+	}
+	return name
+}
+
+// nodeNameLabel returns the first label of a node's name, which is the node's
+// name without the MagicDNS suffix.
+func nodeNameLabel(name string) string {
+	label, _, _ := strings.Cut(name, ".")
+	return label
+}
+
 func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.MachinePublic) {
 	if fn := s.MaybeRateLimitRegister; fn != nil {
 		if reject, retryAfter, msg := fn(); reject {
@@ -958,7 +2456,12 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		j, _ := json.MarshalIndent(req, "", "\t")
 		log.Printf("Got %T: %s", req, j)
 	}
-	if s.RequireAuthKey != "" && (req.Auth == nil || req.Auth.AuthKey != s.RequireAuthKey) {
+	s.mu.Lock()
+	mak.Set(&s.registerCounts, req.NodeKey, s.registerCounts[req.NodeKey]+1)
+	s.mu.Unlock()
+	authKeyOpts, validKey := s.validAuthKey(&req)
+	missingKey := req.Auth == nil || req.Auth.AuthKey == ""
+	if !validKey && !(missingKey && s.AllowMissingAuthKey) {
 		res := must.Get(s.encode(false, tailcfg.RegisterResponse{
 			Error: "invalid authkey",
 		}))
@@ -985,6 +2488,24 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		// some follow-ups? For now all are successes.
 	}
 
+	// With AllowMissingAuthKey, a request without a required auth key is
+	// fine from a node that's already registered, such as one restarting
+	// with its persisted node key or rotating it, or one that has logged
+	// in interactively. Like real control, any other node is asked to log
+	// in, rather than refused, so that it can still register with an auth
+	// key later, as a restarted ephemeral node whose node was deleted
+	// while it was offline does.
+	if !validKey && !isFollowup && s.Node(req.NodeKey) == nil && s.Node(req.OldNodeKey) == nil {
+		authPath := fmt.Sprintf("/auth/%s", rands.HexString(20))
+		s.addAuthPath(authPath, req.NodeKey)
+		res := must.Get(s.encode(false, tailcfg.RegisterResponse{
+			AuthURL: s.BaseURL() + authPath,
+		}))
+		w.WriteHeader(200)
+		w.Write(res)
+		return
+	}
+
 	// On a key rotation (OldNodeKey set and known to s.nodes), stage
 	// the new key as a candidate entry but keep the old key's entry
 	// alive so an in-flight map poll can still receive updates while
@@ -1006,9 +2527,15 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 			delete(s.logins, req.OldNodeKey)
 		}
 	}
-	s.mu.Unlock()
-
 	nk := req.NodeKey
+	if !req.Expiry.IsZero() && req.Expiry.Before(time.Now()) {
+		// The node is logging out.
+		mak.Set(&s.loggedOut, nk, true)
+	} else {
+		delete(s.loggedOut, nk)
+		s.supersedeSameMachineLocked(mkey, nk, req.OldNodeKey)
+	}
+	s.mu.Unlock()
 
 	user, login := s.getUser(nk)
 	s.mu.Lock()
@@ -1017,9 +2544,11 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 	}
 	_, ok := s.nodes[nk]
 	machineAuthorized := !s.RequireMachineAuth
-	if !ok {
+	if ok {
+		machineAuthorized = s.nodes[nk].MachineAuthorized
+	} else {
 
-		nodeID := len(s.nodes) + 1
+		nodeID := len(s.nodes) + s.deletedNodes + 1
 		v4Prefix := netip.PrefixFrom(netaddr.IPv4(100, 64, uint8(nodeID>>8), uint8(nodeID)), 32)
 		v6Prefix := netip.PrefixFrom(tsaddr.Tailscale4To6(v4Prefix.Addr()), 128)
 
@@ -1050,7 +2579,7 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 			Addresses:         allowedIPs,
 			AllowedIPs:        allowedIPs,
 			Hostinfo:          req.Hostinfo.View(),
-			Name:              req.Hostinfo.Hostname,
+			Name:              s.uniqueNodeNameLocked(req.Hostinfo.Hostname, mkey),
 			Cap:               req.Version,
 			CapMap:            capMap,
 			Capabilities:      slices.Collect(maps.Keys(capMap)),
@@ -1060,24 +2589,55 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 			// against the registering user are not modeled.
 			node.Tags = slices.Clone(req.Hostinfo.RequestTags)
 		}
+		if len(authKeyOpts.Tags) > 0 {
+			node.Tags = slices.Clone(authKeyOpts.Tags)
+		}
+		if req.Hostinfo != nil {
+			if routes := preauthorizedRoutes(req.Hostinfo.RoutableIPs, authKeyOpts.PreauthorizedRoutes); len(routes) > 0 {
+				s.logf("Approving preauthorized subnet routes for %s: %v", nk.ShortString(), routes)
+				mak.Set(&s.nodeSubnetRoutes, nk, routes)
+			}
+		}
 		if s.MagicDNSDomain != "" {
 			node.Name = node.Name + "." + s.MagicDNSDomain + "."
 		}
 		s.nodes[nk] = node
+		if req.Ephemeral || authKeyOpts.Ephemeral {
+			mak.Set(&s.ephemeralNodes, node.ID, &ephemeralNode{idleSince: time.Now()})
+		}
 	}
 	// Consider a node key expired if allExpired is set or if the nodeKey has
 	// an expiry time in the past. This allows tests to set per-node KeyExpiry
 	// via UpdateNode to simulate an admin-triggered or time-based expiry.
-	nodeKeyExpired := s.allExpired
+	nodeID := s.nodes[nk].ID
+	if isFollowup {
+		// The user just (re)authenticated interactively.
+		s.startSessionLocked(nodeID)
+		s.verifiedMachines.Make()
+		s.verifiedMachines.Add(mkey)
+	}
+	// A node whose session has expired has to reauthenticate, which it
+	// does with a new node key, so its current one is expired.
+	sessionExpired := s.sessionExpiredLocked(nodeID)
+	nodeKeyExpired := s.allExpired || (sessionExpired && req.OldNodeKey.IsZero())
 	if !nodeKeyExpired && req.OldNodeKey.IsZero() {
 		if n, ok := s.nodes[nk]; ok && !n.KeyExpiry.IsZero() && n.KeyExpiry.Before(time.Now()) {
 			nodeKeyExpired = true
 		}
 	}
-	requireAuth := s.RequireAuth
-	if requireAuth && s.nodeKeyAuthed.Contains(nk) && !nodeKeyExpired {
+	requireAuth := s.RequireAuth || sessionExpired
+	if requireAuth && s.nodeKeyAuthed.Contains(nk) && !nodeKeyExpired && !sessionExpired {
 		requireAuth = false
 	}
+	if s.RequireNewDeviceVerification && !s.verifiedMachines.Contains(mkey) {
+		s.logf("Requiring verification of new device %s", mkey.ShortString())
+		requireAuth = true
+	}
+	if !requireAuth {
+		if _, ok := s.sessionStart[nodeID]; !ok {
+			s.startSessionLocked(nodeID)
+		}
+	}
 	s.mu.Unlock()
 
 	authURL := ""
@@ -1291,6 +2851,34 @@ func (s *Server) incrInServeMap(delta int) {
 	s.inServeMap += delta
 }
 
+// SetNodeTags sets the tags of the node with the given node key, as an admin
+// would by editing its tags. Tags referenced in the rules passed to
+// SetPacketFilter follow the change, and it's pushed to the node and its
+// peers.
+//
+// Removing all tags from a tagged node leaves it with no owner, so, as with a
+// node requesting that itself (see TagOwners), its node key is expired
+// instead: the client goes to NeedsLogin and its user has to reauthenticate
+// it. Removing only some tags doesn't affect the node's login, only its
+// identity as seen by peers and the packet filter rules that apply to it.
+func (s *Server) SetNodeTags(nodeKey key.NodePublic, tags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.nodes[nodeKey]
+	if !ok {
+		panic("SetNodeTags: unknown node key")
+	}
+	if len(tags) == 0 && len(node.Tags) > 0 {
+		s.logf("testcontrol: all tags removed from node %v; expiring its node key", node.ID)
+		node.KeyExpiry = time.Now().Add(-time.Minute)
+	} else {
+		s.logf("testcontrol: retagging node %v: %v -> %v", node.ID, node.Tags, tags)
+		node.Tags = slices.Clone(tags)
+	}
+	sendUpdate(s.updates[node.ID], updateSelfChanged)
+	s.updateLocked("SetNodeTags", s.nodeIDsLocked(node.ID))
+}
+
 // handleTagTransitionLocked models the production control server's handling
 // of tag changes requested via Hostinfo.RequestTags in non-streaming map
 // requests (see updateTags in the control server). A request whose
@@ -1356,6 +2944,63 @@ func tagsEqualAnyOrder(a, b []string) bool {
 	return slices.Equal(as, bs)
 }
 
+// RegisterCount returns the number of register requests received from the
+// node with the given key.
+func (s *Server) RegisterCount(nodeKey key.NodePublic) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registerCounts[nodeKey]
+}
+
+// MapPollCount returns the number of streaming map requests, that is, map
+// polls, received from the node with the given key.
+func (s *Server) MapPollCount(nodeKey key.NodePublic) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mapPollCounts[nodeKey]
+}
+
+// PauseNode holds the map requests of the node with the given key until
+// ResumeNode is called with it, simulating a control server that stalls for
+// that node only. Its map poll in flight stays open but gets no more
+// messages, not even keep-alives, and its subsequent map requests aren't
+// processed. Other nodes are unaffected.
+func (s *Server) PauseNode(nodeKey key.NodePublic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pausedNodes[nodeKey]; !ok {
+		mak.Set(&s.pausedNodes, nodeKey, make(chan struct{}))
+	}
+}
+
+// ResumeNode resumes the map requests of the node with the given key paused by
+// PauseNode. The node's map poll then gets the updates that it missed.
+func (s *Server) ResumeNode(nodeKey key.NodePublic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, ok := s.pausedNodes[nodeKey]; ok {
+		close(ch)
+		delete(s.pausedNodes, nodeKey)
+	}
+}
+
+// awaitNodeResumed waits until the node with the given key isn't paused by
+// PauseNode. It reports false if ctx is done first.
+func (s *Server) awaitNodeResumed(ctx context.Context, nodeKey key.NodePublic) bool {
+	s.mu.Lock()
+	ch := s.pausedNodes[nodeKey]
+	s.mu.Unlock()
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // InServeMap returns the number of clients currently in a MapRequest HTTP handler.
 func (s *Server) InServeMap() int {
 	s.mu.Lock()
@@ -1382,6 +3027,9 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	}
 
 	s.mu.Lock()
+	if req.Stream {
+		mak.Set(&s.mapPollCounts, req.NodeKey, s.mapPollCounts[req.NodeKey]+1)
+	}
 	if s.onMapRequest != nil {
 		s.onMapRequest(req.NodeKey)
 	}
@@ -1392,6 +3040,9 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 			defer done()
 		}
 	}
+	if !s.awaitNodeResumed(ctx, req.NodeKey) {
+		return
+	}
 
 	if s.AltMapStream != nil {
 		// The caller takes over the stream entirely; it must handle
@@ -1467,6 +3118,9 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	}
 
 	nodeID := node.ID
+	if s.startEphemeralMapRequest(nodeID) {
+		defer s.endEphemeralMapRequest(nodeID)
+	}
 
 	s.mu.Lock()
 	updatesCh := make(chan updateType, 1)
@@ -1491,23 +3145,75 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	streaming := req.Stream && !req.ReadOnly
 	compress := req.Compress != ""
 	first := true
+	var lastPeers []tailcfg.NodeID // peers sent in the previous MapResponse
 
 	w.WriteHeader(200)
 	for {
+		if !s.awaitNodeResumed(ctx, req.NodeKey) {
+			return
+		}
+		forceFull := false
+		sentDelta := false
 		// Only send raw map responses to the streaming poll, to avoid a
 		// non-streaming map request beating the streaming poll in a race and
 		// potentially dropping the map response.
 		if streaming {
-			if resBytes, ok := s.takeRawMapMessage(req.NodeKey); ok {
+			if s.takeOmitPeersMapResponse(req.NodeKey) {
+				res, err := s.MapResponse(req)
+				if err != nil || res == nil {
+					return
+				}
+				res.Peers = nil
+				s.mu.Lock()
+				expired := s.allExpired || s.sessionExpiredLocked(nodeID)
+				s.mu.Unlock()
+				if expired {
+					res.Node.KeyExpiry = time.Now().Add(-1 * time.Minute)
+				}
+				resBytes, err := json.Marshal(res)
+				if err != nil {
+					s.logf("json.Marshal: %v", err)
+					return
+				}
 				if err := s.sendMapMsg(w, compress, resBytes); err != nil {
-					s.logf("sendMapMsg of raw message: %v", err)
+					s.logf("sendMapMsg of omit-peers response: %v", err)
 					return
 				}
 				continue
 			}
+			if peer, ok := s.takePeerEndpointsMapResponse(req.NodeKey); ok {
+				res, err := s.MapResponse(req)
+				if err != nil || res == nil {
+					return
+				}
+				if delta := peerEndpointsDelta(res, peer); delta != nil {
+					resBytes, err := json.Marshal(delta)
+					if err != nil {
+						s.logf("json.Marshal: %v", err)
+						return
+					}
+					if err := s.sendMapMsg(w, compress, resBytes); err != nil {
+						s.logf("sendMapMsg of peer endpoints: %v", err)
+						return
+					}
+				}
+				// Don't follow the incremental update with a full
+				// MapResponse, which would make it moot.
+				sentDelta = true
+			}
+			forceFull = s.takeFullMapResponse(req.NodeKey)
+			if !forceFull && !sentDelta {
+				if resBytes, ok := s.takeRawMapMessage(req.NodeKey); ok {
+					if err := s.sendMapMsg(w, compress, resBytes); err != nil {
+						s.logf("sendMapMsg of raw message: %v", err)
+						return
+					}
+					continue
+				}
+			}
 		}
 
-		if s.canGenerateAutomaticMapResponseFor(req.NodeKey) {
+		if forceFull || !sentDelta && s.canGenerateAutomaticMapResponseFor(req.NodeKey) {
 			res, err := s.MapResponse(req)
 			if err != nil {
 				// TODO: log
@@ -1516,11 +3222,21 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 			if res == nil {
 				return // done
 			}
+			// An empty Peers list is omitted from the JSON, which clients
+			// interpret as no change, so removal of the last remaining
+			// peers must be sent explicitly.
+			if len(res.Peers) == 0 {
+				res.PeersRemoved = lastPeers
+			}
+			lastPeers = nil
+			for _, p := range res.Peers {
+				lastPeers = append(lastPeers, p.ID)
+			}
 
 			s.mu.Lock()
-			allExpired := s.allExpired
+			expired := s.allExpired || s.sessionExpiredLocked(nodeID)
 			s.mu.Unlock()
-			if allExpired {
+			if expired {
 				res.Node.KeyExpiry = time.Now().Add(-1 * time.Minute)
 			}
 			if f := s.ModifyFirstMapResponse; first && f != nil {
@@ -1564,6 +3280,9 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 				}
 				break keepAliveLoop
 			case <-keepAliveTimerCh:
+				if !s.awaitNodeResumed(ctx, req.NodeKey) {
+					return
+				}
 				if err := s.sendMapMsg(w, compress, keepAliveMsg); err != nil {
 					return
 				}
@@ -1612,48 +3331,90 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 
 	s.mu.Lock()
 	nodeCapMap := maps.Clone(s.nodeCapMaps[nk])
+	for c, v := range s.nodeSelfCapMaps[nk] {
+		mak.Set(&nodeCapMap, c, v)
+	}
 	var dns *tailcfg.DNSConfig
 	if s.DNSConfig != nil {
 		dns = s.DNSConfig.Clone()
 	}
 	magicDNSDomain := s.MagicDNSDomain
 	sshPolicy := s.SSHPolicy.Clone()
+	tailnetDomain := s.domainLocked()
+	tailnetDisplayName := s.tailnetDisplayName
+	debugFlags := s.nodeDebugFlags[nk]
+	disabledFeatures := maps.Clone(s.disabledFeatures)
+	for feature := range s.nodeDisabledFeatures[nk] {
+		mak.Set(&disabledFeatures, feature, struct{}{})
+	}
+	s.applySSHHostKeysLocked(node)
+	t := s.controlTimeLocked()
 	s.mu.Unlock()
 
 	node.CapMap = nodeCapMap
+	if tailnetDisplayName != "" {
+		mak.Set(&node.CapMap, tailcfg.NodeAttrTailnetDisplayName, []tailcfg.RawMessage{
+			tailcfg.RawMessage(must.Get(json.Marshal(tailnetDisplayName))),
+		})
+	}
 	node.Capabilities = append(node.Capabilities, tailcfg.NodeAttrDisableUPnP)
+	node.Capabilities = append(node.Capabilities, debugFlags...)
 	if sshPolicy != nil {
 		mak.Set(&node.CapMap, tailcfg.CapabilitySSH, nil)
 	}
+	for feature := range disabledFeatures {
+		c := featureCaps[feature]
+		delete(node.CapMap, c)
+		node.Capabilities = slices.DeleteFunc(node.Capabilities, func(nc tailcfg.NodeCapability) bool { return nc == c })
+	}
 
-	t := time.Date(2020, 8, 3, 0, 0, 0, 1, time.UTC)
 	if dns != nil && magicDNSDomain != "" {
-		dns.CertDomains = append(dns.CertDomains, node.Hostinfo.Hostname()+"."+magicDNSDomain)
+		dns.CertDomains = append(dns.CertDomains, nodeNameLabel(node.Name)+"."+magicDNSDomain)
 	}
 
 	res = &tailcfg.MapResponse{
 		Node:            node,
-		DERPMap:         s.DERPMap,
-		Domain:          domain,
+		DERPMap:         s.derpMapFor(nk),
+		Domain:          tailnetDomain,
 		CollectServices: cmp.Or(s.CollectServices, opt.True),
 		PacketFilter:    packetFilterWithIngress(s.PeerRelayGrants),
 		DNSConfig:       dns,
 		SSHPolicy:       sshPolicy,
 		ControlTime:     &t,
 	}
+	res.DisplayMessages = s.minClientVersionMessages(node.Hostinfo.IPNVersion())
+	s.mu.Lock()
+	for id, msg := range s.displayMessages {
+		mak.Set(&res.DisplayMessages, id, msg)
+	}
+	s.mu.Unlock()
 
 	s.mu.Lock()
 	nodeMasqs := s.masquerades[node.Key]
 	jailed := maps.Clone(s.peerIsJailed[node.Key])
 	globalAppCaps := s.globalAppCaps
+	customFilter := s.packetFilter != nil
+	if customFilter {
+		res.PacketFilter = s.expandFilterTagsLocked(s.packetFilter)
+	}
+	capVer := s.capVersionLocked(node.Key)
 	s.mu.Unlock()
 	for _, p := range s.AllNodes() {
 		if p.StableID == node.StableID {
 			continue
 		}
+		if !node.MachineAuthorized || !p.MachineAuthorized {
+			// Nodes awaiting device approval neither see nor are seen by
+			// other nodes.
+			continue
+		}
 		if masqIP := nodeMasqs[p.Key]; masqIP.IsValid() {
 			if masqIP.Is6() {
-				p.SelfNodeV6MasqAddrForThisPeer = new(masqIP)
+				// Clients before capability version 104 don't handle IPv6
+				// masquerade addresses correctly, so don't send them.
+				if capVer >= 104 {
+					p.SelfNodeV6MasqAddrForThisPeer = new(masqIP)
+				}
 			} else {
 				p.SelfNodeV4MasqAddrForThisPeer = new(masqIP)
 			}
@@ -1662,8 +3423,13 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 
 		s.mu.Lock()
 		peerAddress := s.masquerades[p.Key][node.Key]
-		routes := s.nodeSubnetRoutes[p.Key]
+		routes := s.primaryRoutesLocked(p.Key)
+		allowedRoutes := s.allowedRoutesLocked(p.Key)
 		peerCapMap := maps.Clone(s.nodeCapMaps[p.Key])
+		s.applySSHHostKeysLocked(p)
+		if s.derpOnly.Contains(p.Key) {
+			p.Endpoints = nil
+		}
 		s.mu.Unlock()
 		if peerCapMap != nil {
 			p.CapMap = peerCapMap
@@ -1679,8 +3445,8 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		}
 		if len(routes) > 0 {
 			p.PrimaryRoutes = routes
-			p.AllowedIPs = append(p.AllowedIPs, routes...)
 		}
+		p.AllowedIPs = append(p.AllowedIPs, allowedRoutes...)
 		if s.AllOnline {
 			p.Online = new(true)
 		}
@@ -1692,12 +3458,15 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 	})
 	res.UserProfiles = s.allUserProfiles()
 
-	v4Prefix := netip.PrefixFrom(netaddr.IPv4(100, 64, uint8(node.ID>>8), uint8(node.ID)), 32)
-	v6Prefix := netip.PrefixFrom(tsaddr.Tailscale4To6(v4Prefix.Addr()), 128)
-
-	res.Node.Addresses = []netip.Prefix{
-		v4Prefix,
-		v6Prefix,
+	// Nodes get addresses derived from their IDs when they register,
+	// unless they've since been reassigned with SetNodeAddresses.
+	if len(node.Addresses) == 0 {
+		v4Prefix := netip.PrefixFrom(netaddr.IPv4(100, 64, uint8(node.ID>>8), uint8(node.ID)), 32)
+		v6Prefix := netip.PrefixFrom(tsaddr.Tailscale4To6(v4Prefix.Addr()), 128)
+		res.Node.Addresses = []netip.Prefix{
+			v4Prefix,
+			v6Prefix,
+		}
 	}
 
 	if globalAppCaps != nil {
@@ -1711,6 +3480,13 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 			},
 		})
 	}
+	if customFilter && len(res.PacketFilter) == 0 {
+		// An empty PacketFilter isn't marshaled, so it would mean the
+		// filter is unchanged. Clear all filters instead, blocking
+		// everything.
+		res.PacketFilter = nil
+		res.PacketFilters = map[string][]tailcfg.FilterRule{"*": nil}
+	}
 
 	// If the server is tracking TKA state, and there's a single TKA head,
 	// add it to the MapResponse.
@@ -1729,8 +3505,8 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	res.Node.PrimaryRoutes = s.nodeSubnetRoutes[nk]
-	res.Node.AllowedIPs = append(res.Node.Addresses, s.nodeSubnetRoutes[nk]...)
+	res.Node.PrimaryRoutes = s.primaryRoutesLocked(nk)
+	res.Node.AllowedIPs = append(res.Node.Addresses, res.Node.PrimaryRoutes...)
 
 	// Consume a PingRequest at the head of the queue, if any.
 	if q := s.msgToSend[nk]; len(q) > 0 {
@@ -1767,6 +3543,75 @@ func (s *Server) hasPendingRawMapMessage(nk key.NodePublic) bool {
 	return len(s.msgToSend[nk]) > 0
 }
 
+// takeOmitPeersMapResponse reports whether the head of nk's message queue is
+// an omitPeersMapResponse, popping it if so.
+func (s *Server) takeOmitPeersMapResponse(nk key.NodePublic) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.msgToSend[nk]
+	if len(q) == 0 {
+		return false
+	}
+	if _, ok := q[0].(omitPeersMapResponse); !ok {
+		return false
+	}
+	s.popMsgToSendLocked(nk)
+	return true
+}
+
+// takeFullMapResponse reports whether the head of nk's message queue is a
+// fullMapResponse, popping it if so.
+func (s *Server) takeFullMapResponse(nk key.NodePublic) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.msgToSend[nk]
+	if len(q) == 0 {
+		return false
+	}
+	if _, ok := q[0].(fullMapResponse); !ok {
+		return false
+	}
+	s.popMsgToSendLocked(nk)
+	return true
+}
+
+// takePeerEndpointsMapResponse reports whether the head of nk's message queue
+// is a peerEndpointsMapResponse, popping it and returning its peer if so.
+func (s *Server) takePeerEndpointsMapResponse(nk key.NodePublic) (peer key.NodePublic, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.msgToSend[nk]
+	if len(q) == 0 {
+		return peer, false
+	}
+	m, ok := q[0].(peerEndpointsMapResponse)
+	if !ok {
+		return peer, false
+	}
+	s.popMsgToSendLocked(nk)
+	return m.peer, true
+}
+
+// peerEndpointsDelta returns an incremental MapResponse that updates the
+// endpoints of peer to those in the full MapResponse res, or nil if res
+// doesn't include peer.
+func peerEndpointsDelta(res *tailcfg.MapResponse, peer key.NodePublic) *tailcfg.MapResponse {
+	i := slices.IndexFunc(res.Peers, func(p *tailcfg.Node) bool { return p.Key == peer })
+	if i < 0 {
+		return nil
+	}
+	p := res.Peers[i]
+	if len(p.Endpoints) == 0 {
+		return &tailcfg.MapResponse{PeersChanged: []*tailcfg.Node{p}}
+	}
+	return &tailcfg.MapResponse{
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:    p.ID,
+			Endpoints: p.Endpoints,
+		}},
+	}
+}
+
 func (s *Server) takeRawMapMessage(nk key.NodePublic) (mapResJSON []byte, ok bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
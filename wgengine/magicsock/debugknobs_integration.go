@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_integration_test
+
+package magicsock
+
+import (
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+
+	"tailscale.com/envknob"
+)
+
+func init() {
+	testHookBindAddr = debugBindAddr
+}
+
+// debugBindAddrFile is the path of a file that, if it exists, holds an IP
+// address to bind magicsock's UDP sockets of the same family to, instead of
+// the unspecified address. It's read on every (re)bind, so integration tests
+// can simulate a node moving networks by changing it and forcing a rebind.
+var debugBindAddrFile = envknob.RegisterString("TS_DEBUG_MAGICSOCK_BIND_ADDR_FILE")
+
+// debugBindAddr returns the address from TS_DEBUG_MAGICSOCK_BIND_ADDR_FILE to
+// bind sockets of the given network ("udp4" or "udp6") to, or the empty string
+// to bind to the unspecified address.
+func debugBindAddr(network string) string {
+	f := debugBindAddrFile()
+	if f == "" {
+		return ""
+	}
+	bs, err := os.ReadFile(f)
+	if err != nil {
+		return ""
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(string(bs)))
+	if err != nil {
+		log.Printf("ignoring invalid address in %s: %v", f, err)
+		return ""
+	}
+	if ip.Is4() != (network == "udp4") {
+		return ""
+	}
+	return ip.String()
+}
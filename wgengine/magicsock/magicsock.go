@@ -3696,6 +3696,11 @@ func (c *Conn) ReSTUN(why string) {
 	}
 }
 
+// testHookBindAddr, if non-nil, returns the address to bind sockets of the
+// given network to, or the empty string to bind to the unspecified address.
+// It's only set in binaries built for integration tests.
+var testHookBindAddr func(network string) string
+
 // listenPacket opens a packet listener.
 // The network must be "udp4" or "udp6".
 func (c *Conn) listenPacket(network string, port uint16) (nettype.PacketConn, error) {
@@ -3705,7 +3710,11 @@ func (c *Conn) listenPacket(network string, port uint16) (nettype.PacketConn, er
 	} else {
 		ctx = sockstats.WithSockStats(ctx, sockstats.LabelMagicsockConnUDP6, c.logf)
 	}
-	addr := net.JoinHostPort("", fmt.Sprint(port))
+	var host string
+	if testHookBindAddr != nil {
+		host = testHookBindAddr(network)
+	}
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
 	if c.testOnlyPacketListener != nil {
 		return nettype.MakePacketListenerWithNetIP(c.testOnlyPacketListener).ListenPacket(ctx, network, addr)
 	}